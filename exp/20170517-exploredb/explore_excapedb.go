@@ -4,9 +4,10 @@ package main
 
 import (
 	"fmt"
+	"io"
+
+	"github.com/pharmbio/ptp-project/lib/excapedb"
 	sp "github.com/scipipe/scipipe"
-	spc "github.com/scipipe/scipipe/components"
-	"strings"
 )
 
 var (
@@ -74,49 +75,50 @@ func main() {
 	dlExcapeDB := wf.NewProc("dlDB", fmt.Sprintf("wget https://zenodo.org/record/173258/files/%s -O {o:excapexz}", dbFileName))
 	dlExcapeDB.SetPathStatic("excapexz", "../../raw/"+dbFileName)
 
-	unPackDB := wf.NewProc("unPackDB", "xzcat {i:xzfile} > {o:unxzed}")
-	unPackDB.SetPathReplace("xzfile", "unxzed", ".xz", "")
-	// SLURM string
-	//unPackDB.Prepend = "salloc -A snic2017-7-89 -n 2 -t 8:00:00 -J unpack_excapedb"
-
-	// --------------------------------
-	// Connect workflow dependency network
-	// --------------------------------
-	unPackDB.In("xzfile").Connect(dlExcapeDB.Out("excapexz"))
-
-	unPackDBFanOut := spc.NewFanOut("unpackdb_fanout")
-	unPackDBFanOut.InFile.Connect(unPackDB.Out("unxzed"))
-	wf.AddProc(unPackDBFanOut) // Oh, this is so easy to forget!!!
-
-	tableFile := "dat/compound_counts.tsv"
-	createTableFile := wf.NewProc("create_table_file", "echo 'Gene_symbol,Compound_count' > {o:table}")
-	createTableFile.SetPathStatic("table", tableFile)
-
-	createTableFanOut := spc.NewFanOut("create_table_fanout")
-	createTableFanOut.InFile.Connect(createTableFile.Out("table"))
-	wf.AddProc(createTableFanOut)
-
 	// --------------------------------
-	// Count ligands in targets
+	// Compute statistics for the targets, in a single pass over the database
 	// --------------------------------
-	for _, gene := range bowesRiskGenes {
-		geneLC := strings.ToLower(gene)
-		procName := "cnt_comp_" + geneLC
-
-		countCompoundsPerTarget := wf.NewProc(procName, fmt.Sprintf(`awk -F"\t" '$9 == "%s" { SUM += 1 } END { print SUM }' {i:tsvfile} > {o:compound_count}`, gene))
-		countCompoundsPerTarget.SetPathStatic("compound_count", "dat/compound_count_"+geneLC+".txt")
-		countCompoundsPerTarget.In("tsvfile").Connect(unPackDBFanOut.Out("to_" + procName))
-
-		// SLURM string
-		countCompoundsPerTarget.Prepend = "salloc -A snic2017-7-89 -n 4 -t 1:00:00 -J scipipe_cnt_comp_" + geneLC + " srun "
+	// The pass runs in-process, in the workflow binary, so to run it on a
+	// cluster node, run the whole workflow in a SLURM allocation
+	targetStats := wf.NewProc("target_statistics", "# Custom Go process. Ports: {i:excapedb} {o:stats_tsv} {o:stats_json}")
+	targetStats.SetPathStatic("stats_tsv", "dat/target_statistics.tsv")
+	targetStats.SetPathStatic("stats_json", "dat/target_statistics.json")
+	targetStats.In("excapedb").Connect(dlExcapeDB.Out("excapexz"))
+	targetStats.CustomExecute = func(t *sp.Task) {
+		excapeFile, err := excapedb.Open(t.InPath("excapedb"))
+		sp.CheckWithMsg(err, "Could not open ExCAPE-DB file")
+		defer excapeFile.Close()
 
-		writeToTable := wf.NewProc("write_to_table_"+geneLC, "echo \""+gene+"\t$(head -n 1 {i:cnt})\" >> {i:create_table}; touch {o:write_done}")
-		writeToTable.SetPathStatic("write_done", tableFile+".write_done_"+geneLC)
-		writeToTable.In("create_table").Connect(createTableFanOut.Out("table_" + gene))
-		writeToTable.In("cnt").Connect(countCompoundsPerTarget.Out("compound_count"))
+		// The database is not sorted on gene, so we use one collector per
+		// gene, which is fine for a limited set of genes
+		collectors := map[string]*excapedb.StatsCollector{}
+		for _, gene := range bowesRiskGenes {
+			collectors[gene] = excapedb.NewStatsCollector()
+		}
+		for {
+			rec, err := excapeFile.Read()
+			if err == io.EOF {
+				break
+			}
+			sp.CheckWithMsg(err, "Could not read ExCAPE-DB record")
+			if collector, ok := collectors[rec.GeneSymbol]; ok {
+				sp.Check(collector.Add(rec.Measurement()))
+			}
+		}
 
-		wf.ConnectLast(writeToTable.Out("write_done"))
+		allStats := []*excapedb.TargetStats{}
+		for _, gene := range bowesRiskGenes {
+			allStats = append(allStats, collectors[gene].Stats()...)
+		}
+		tsvFh := t.OutIP("stats_tsv").OpenWriteTemp()
+		sp.CheckWithMsg(excapedb.WriteStatsTSV(allStats, tsvFh), "Could not write statistics TSV file")
+		tsvFh.Close()
+		jsonFh := t.OutIP("stats_json").OpenWriteTemp()
+		sp.CheckWithMsg(excapedb.WriteStatsJSON(allStats, jsonFh), "Could not write statistics JSON file")
+		jsonFh.Close()
 	}
+	wf.ConnectLast(targetStats.Out("stats_tsv"))
+	wf.ConnectLast(targetStats.Out("stats_json"))
 
 	// --------------------------------
 	// Run the pipeline!
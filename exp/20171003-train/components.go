@@ -2,13 +2,16 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/csv"
 	"fmt"
+	"io"
 	"strconv"
 
 	str "strings"
 
+	"github.com/pharmbio/ptp-project/lib/excapedb"
 	sp "github.com/scipipe/scipipe"
 )
 
@@ -456,3 +459,70 @@ func (p *FinalModelSummarizer) Run() {
 	oip.Atomize()
 	p.OutSummary.Send(oip)
 }
+
+// ================================================================================
+
+// ExtractExcapeDBColumns reads an ExCAPE-DB file (plain TSV or .xz
+// compressed), validates its header, and writes the given columns (selected
+// by name, not position) into a TSV file without header
+type ExtractExcapeDBColumns struct {
+	procName   string
+	FileName   string
+	Columns    []string
+	InExcapeDB *sp.FilePort
+	OutTSV     *sp.FilePort
+}
+
+func NewExtractExcapeDBColumns(wf *sp.Workflow, name string, fileName string, columns []string) *ExtractExcapeDBColumns {
+	p := &ExtractExcapeDBColumns{
+		procName:   name,
+		FileName:   fileName,
+		Columns:    columns,
+		InExcapeDB: sp.NewFilePort(),
+		OutTSV:     sp.NewFilePort(),
+	}
+	wf.AddProc(p)
+	return p
+}
+
+func (p *ExtractExcapeDBColumns) Name() string {
+	return p.procName
+}
+
+func (p *ExtractExcapeDBColumns) IsConnected() bool {
+	return p.InExcapeDB.IsConnected() && p.OutTSV.IsConnected()
+}
+
+func (p *ExtractExcapeDBColumns) Run() {
+	defer p.OutTSV.Close()
+	go p.InExcapeDB.RunMergeInputs()
+
+	oip := sp.NewInformationPacket(p.FileName)
+	for iip := range p.InExcapeDB.InChan {
+		if oip.Exists() {
+			sp.Info.Printf("Process %s: Out-target %s already exists, so skipping\n", p.Name(), oip.GetPath())
+			continue
+		}
+		excapeFile, err := excapedb.Open(iip.GetPath())
+		sp.CheckErr(err)
+		fh := oip.OpenWriteTemp()
+		bufWriter := bufio.NewWriter(fh)
+		vals := make([]string, len(p.Columns))
+		for {
+			rec, err := excapeFile.Read()
+			if err == io.EOF {
+				break
+			}
+			sp.CheckErr(err)
+			for i, col := range p.Columns {
+				vals[i] = rec.Value(col)
+			}
+			bufWriter.WriteString(str.Join(vals, "\t") + "\n")
+		}
+		sp.CheckErr(bufWriter.Flush())
+		fh.Close()
+		excapeFile.Close()
+		oip.Atomize()
+	}
+	p.OutTSV.Send(oip)
+}
@@ -8,6 +8,8 @@ import (
 	"strconv"
 	str "strings"
 
+	"github.com/pharmbio/ptp-project/lib/cpsign"
+	"github.com/pharmbio/ptp-project/lib/excapedb"
 	sp "github.com/scipipe/scipipe"
 	spc "github.com/scipipe/scipipe/components"
 )
@@ -19,8 +21,9 @@ var (
 	runSlurm = flag.Bool("slurm", false, "Start computationally heavy jobs via SLURM")
 	debug    = flag.Bool("debug", false, "Increase logging level to include DEBUG messages")
 
-	cpSignPath = "../../bin/cpsign-0.6.3.jar"
-	geneSets   = map[string][]string{
+	cpSignPath        = "../../bin/cpsign-0.6.3.jar"
+	cpSignLicensePath = "../../bin/cpsign.lic"
+	geneSets          = map[string][]string{
 		"bowes44": []string{
 			// Not available in dataset: "CHRNA1".
 			// Not available in dataset: "KCNE1"
@@ -92,15 +95,15 @@ func main() {
 	// Initialize processes and add to runner
 	// --------------------------------
 	wf := sp.NewWorkflow("train_models", *maxTasks)
+	cpSign := cpsign.NewTool(cpSignPath, cpSignLicensePath)
 
 	dbFileName := "pubchem.chembl.dataset4publication_inchi_smiles.tsv.xz"
 	dlExcapeDB := wf.NewProc("dlDB", fmt.Sprintf("wget https://zenodo.org/record/173258/files/%s -O {o:excapexz}", dbFileName))
 	dlExcapeDB.SetPathStatic("excapexz", "../../raw/"+dbFileName)
 
-	unPackDB := wf.NewProc("unPackDB", "xzcat {i:xzfile} > {o:unxzed}")
-	unPackDB.SetPathReplace("xzfile", "unxzed", ".xz", "")
-	unPackDB.In("xzfile").Connect(dlExcapeDB.Out("excapexz"))
-	//unPackDB.Prepend = "salloc -A snic2017-7-89 -n 2 -t 8:00:00 -J unpack_excapedb"
+	extractGSA := NewExtractExcapeDBColumns(wf, "extract_gene_smiles_activity", "../../raw/"+str.TrimSuffix(dbFileName, ".tsv.xz")+".ext_gene_smiles_activity.tsv",
+		[]string{excapedb.ColGeneSymbol, excapedb.ColSMILES, excapedb.ColActivityFlag})
+	extractGSA.InExcapeDB.Connect(dlExcapeDB.Out("excapexz"))
 
 	finalModelsSummary := NewFinalModelSummarizer(wf, "finalmodels_summary_creator", "res/final_models_summary.tsv", '\t')
 	// --------------------------------
@@ -113,10 +116,10 @@ func main() {
 		// --------------------------------------------------------------------------------
 		// Extract target data step
 		// --------------------------------------------------------------------------------
-		extractTargetData := wf.NewProc("extract_target_data_"+uniq_gene, `awk -F"\t" '$9 == "{p:gene}" { print $12"\t"$4 }' {i:raw_data} > {o:target_data}`)
+		extractTargetData := wf.NewProc("extract_target_data_"+uniq_gene, `awk -F"\t" '$1 == "{p:gene}" { print $2"\t"$3 }' {i:gene_smiles_activity} > {o:target_data}`)
 		extractTargetData.ParamPort("gene").ConnectStr(gene)
 		extractTargetData.SetPathStatic("target_data", fmt.Sprintf("dat/%s/%s.tsv", geneLC, geneLC))
-		extractTargetData.In("raw_data").Connect(unPackDB.Out("unxzed"))
+		extractTargetData.In("gene_smiles_activity").Connect(extractGSA.OutTSV)
 		if *runSlurm {
 			extractTargetData.Prepend = "salloc -A snic2017-7-89 -n 4 -c 4 -t 1:00:00 -J scipipe_cnt_comp_" + geneLC // SLURM string
 		}
@@ -129,14 +132,14 @@ func main() {
 		// --------------------------------------------------------------------------------
 		// Pre-compute step
 		// --------------------------------------------------------------------------------
-		cpSignPrecomp := wf.NewProc("cpsign_precomp_"+uniq_gene,
-			`java -jar `+cpSignPath+` precompute \
-									--license ../../bin/cpsign.lic \
-									--cptype 1 \
-									--trainfile {i:traindata} \
-									--labels A, N \
-									--model-out {o:precomp} \
-									--model-name "`+gene+` target profile"`)
+		cpSignPrecompCmd, err := cpSign.CommandLine(&cpsign.Precompute{
+			TrainFile: "{i:traindata}",
+			Labels:    []string{"A", "N"},
+			ModelOut:  "{o:precomp}",
+			ModelName: gene + " target profile",
+		})
+		sp.CheckErr(err)
+		cpSignPrecomp := wf.NewProc("cpsign_precomp_"+uniq_gene, cpSignPrecompCmd)
 		cpSignPrecomp.In("traindata").Connect(extractTargetData.Out("target_data"))
 		cpSignPrecomp.SetPathExtend("traindata", "precomp", ".precomp")
 		if *runSlurm {
@@ -158,17 +161,18 @@ func main() {
 			for _, cost := range costVals {
 				uniq_cost := uniq_repl + "_" + cost
 				// If Liblinear
-				evalCost := wf.NewProc("crossval_"+uniq_cost, `java -jar `+cpSignPath+` crossvalidate \
-									--license ../../bin/cpsign.lic \
-									--cptype 1 \
-									--trainfile {i:traindata} \
-									--impl liblinear \
-									--labels A, N \
-									--nr-models {p:nrmdl} \
-									--cost {p:cost} \
-									--cv-folds {p:cvfolds} \
-									--output-format json \
-									--confidence {p:confidence} | grep -P "^{" > {o:stats} # {p:gene} {p:replicate}`)
+				evalCostCmd, err := cpSign.CommandLine(&cpsign.CrossValidate{
+					TrainFile:    "{i:traindata}",
+					Impl:         "liblinear",
+					Labels:       []string{"A", "N"},
+					NrModels:     "{p:nrmdl}",
+					Cost:         "{p:cost}",
+					CVFolds:      "{p:cvfolds}",
+					OutputFormat: "json",
+					Confidence:   "{p:confidence}",
+				})
+				sp.CheckErr(err)
+				evalCost := wf.NewProc("crossval_"+uniq_cost, evalCostCmd+" "+cpsign.JSONTo("{o:stats}")+" # {p:gene} {p:replicate}")
 				evalCost.SetPathCustom("stats", func(t *sp.SciTask) string {
 					c, err := strconv.ParseInt(t.Param("cost"), 10, 0)
 					geneLC := str.ToLower(t.Param("gene"))
@@ -216,17 +220,18 @@ func main() {
 			// --------------------------------------------------------------------------------
 			// Train step
 			// --------------------------------------------------------------------------------
+			cpSignTrainCmd, err := cpSign.CommandLine(&cpsign.Train{
+				ModelFile: "{i:model}",
+				Labels:    []string{"A", "N"},
+				Impl:      "liblinear",
+				NrModels:  "{p:nrmdl}",
+				Cost:      "{p:cost}",
+				ModelOut:  "{o:model}",
+				ModelName: "{p:gene} target profile",
+			})
+			sp.CheckErr(err)
 			cpSignTrain := wf.NewProc("cpsign_train_"+uniq_repl,
-				`java -jar `+cpSignPath+` train \
-									--license ../../bin/cpsign.lic \
-									--cptype 1 \
-									--modelfile {i:model} \
-									--labels A, N \
-									--impl liblinear \
-									--nr-models {p:nrmdl} \
-									--cost {p:cost} \
-									--model-out {o:model} \
-									--model-name "{p:gene} target profile" # {p:replicate} Validity: {p:validity} Efficiency: {p:efficiency} Class-Equalized Observed Fuzziness: {p:obsfuzz_classavg} Observed Fuzziness (Overall): {p:obsfuzz_overall} Observed Fuzziness (Active class): {p:obsfuzz_active} Observed Fuzziness (Non-active class): {p:obsfuzz_nonactive} Class Confidence: {p:class_confidence} Class Credibility: {p:class_credibility}`)
+				cpSignTrainCmd+" # {p:replicate} Validity: {p:validity} Efficiency: {p:efficiency} Class-Equalized Observed Fuzziness: {p:obsfuzz_classavg} Observed Fuzziness (Overall): {p:obsfuzz_overall} Observed Fuzziness (Active class): {p:obsfuzz_active} Observed Fuzziness (Non-active class): {p:obsfuzz_nonactive} Class Confidence: {p:class_confidence} Class Credibility: {p:class_credibility}")
 			cpSignTrain.In("model").Connect(cpSignPrecomp.Out("precomp"))
 			cpSignTrain.ParamPort("nrmdl").ConnectStr("10")
 			cpSignTrain.ParamPort("gene").ConnectStr(gene)
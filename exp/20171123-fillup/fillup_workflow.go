@@ -10,19 +10,23 @@ import (
 	"strconv"
 	str "strings"
 
+	"github.com/pharmbio/ptp-project/lib/cpsign"
+	"github.com/pharmbio/ptp-project/lib/excapedb"
 	sp "github.com/scipipe/scipipe"
 	spc "github.com/scipipe/scipipe/components"
 )
 
 var (
-	maxTasks = flag.Int("maxtasks", 4, "Max number of local cores to use")
-	threads  = flag.Int("threads", 1, "Number of threads that Go is allowed to start")
-	geneSet  = flag.String("geneset", "smallest1", "Gene set to use (one of smallest1, smallest3, smallest4, bowes44)")
-	runSlurm = flag.Bool("slurm", false, "Start computationally heavy jobs via SLURM")
-	debug    = flag.Bool("debug", false, "Increase logging level to include DEBUG messages")
-
-	cpSignPath = "../../bin/cpsign-0.6.3.jar"
-	geneSets   = map[string][]string{
+	maxTasks     = flag.Int("maxtasks", 4, "Max number of local cores to use")
+	threads      = flag.Int("threads", 1, "Number of threads that Go is allowed to start")
+	geneSet      = flag.String("geneset", "smallest1", "Gene set to use (one of smallest1, smallest3, smallest4, bowes44)")
+	runSlurm     = flag.Bool("slurm", false, "Start computationally heavy jobs via SLURM")
+	debug        = flag.Bool("debug", false, "Increase logging level to include DEBUG messages")
+	samplingSeed = flag.Int64("seed", 1, "Seed for the random sampling of the assumed negatives, for which replicate number i (r1, r2, ...) uses seed+i, so that a recorded seed fully reproduces a selection")
+
+	cpSignPath        = "../../bin/cpsign-0.6.3.jar"
+	cpSignLicensePath = "../../bin/cpsign.lic"
+	geneSets          = map[string][]string{
 		"bowes44": []string{
 			// Not available in dataset: "CHRNA1".
 			// Not available in dataset: "KCNE1"
@@ -102,21 +106,21 @@ func main() {
 	// Initialize processes and add to runner
 	// --------------------------------
 	wf := sp.NewWorkflow("train_models", *maxTasks)
+	cpSign := cpsign.NewTool(cpSignPath, cpSignLicensePath)
 
 	dbFileName := "pubchem.chembl.dataset4publication_inchi_smiles.tsv.xz"
 	dlExcapeDB := wf.NewProc("dlDB", fmt.Sprintf("wget https://zenodo.org/record/173258/files/%s -O {o:excapexz}", dbFileName))
 	dlExcapeDB.SetPathStatic("excapexz", "../../raw/"+dbFileName)
 
-	unPackDB := wf.NewProc("unPackDB", "xzcat {i:xzfile} > {o:unxzed}")
-	unPackDB.SetPathReplace("xzfile", "unxzed", ".xz", "")
-	unPackDB.In("xzfile").Connect(dlExcapeDB.Out("excapexz"))
-	//unPackDB.Prepend = "salloc -A snic2017-7-89 -n 2 -t 8:00:00 -J unpack_excapedb"
-
 	// extractGSA extracts a file with only Gene symbol, SMILES and the
-	// Activity flag, into a .tsv file, for easier subsequent parsing
-	extractGSA := wf.NewProc("extract_gene_smiles_activity", `awk -F "\t" '{ print $9 "\t" $12 "\t" $4 }' {i:excapedb} | sort -uV > {os:gene_smiles_activity}`) // os = output (streaming) ... stream output via a fifo file
-	extractGSA.SetPathReplace("excapedb", "gene_smiles_activity", ".tsv", ".ext_gene_smiles_activity.tsv")
-	extractGSA.In("excapedb").Connect(unPackDB.Out("unxzed"))
+	// Activity flag, into a .tsv file, for easier subsequent parsing. The
+	// ExCAPE-DB file is read directly in its .xz compressed form, and its
+	// columns are selected by name, after validating its header.
+	extractGSA := NewExtractExcapeDBColumns(wf, "extract_gene_smiles_activity",
+		[]string{excapedb.ColGeneSymbol, excapedb.ColSMILES, excapedb.ColActivityFlag},
+		"-uV")
+	extractGSA.SetPathReplace("excapedb", "tsv", ".tsv.xz", ".ext_gene_smiles_activity.tsv")
+	extractGSA.InExcapeDB().Connect(dlExcapeDB.Out("excapexz"))
 
 	// removeConflicting removes (or, SHOULD remove) rows which have the same values on both row 1 and 2 (I think ...)
 	removeConflicting := wf.NewProc("remove_conflicting", `awk -F "\t" '(( $1 != p1 ) || ( $2 != p2)) && ( c[p1,p2] <= 1 ) && ( p1 != "" ) && ( p2 != "" ) { print p1 "\t" p2 "\t" p3 }
@@ -124,12 +128,10 @@ func main() {
 																	  END { print $1 "\t" $2 "\t" $3 }' \
 																	  {i:gene_smiles_activity} > {o:gene_smiles_activity}`)
 	removeConflicting.SetPathReplace("gene_smiles_activity", "gene_smiles_activity", ".tsv", ".dedup.tsv")
-	removeConflicting.In("gene_smiles_activity").Connect(extractGSA.Out("gene_smiles_activity"))
+	removeConflicting.In("gene_smiles_activity").Connect(extractGSA.OutTSV())
 
 	finalModelsSummary := NewFinalModelSummarizer(wf, "finalmodels_summary_creator", "res/final_models_summary.tsv", '\t')
 
-	genRandomProcs := map[string]*sp.Process{}
-
 	// --------------------------------
 	// Set up gene-specific workflow branches
 	// --------------------------------
@@ -149,29 +151,33 @@ func main() {
 		}
 
 		countProcs := map[string]*sp.Process{}
-		for _, replicate := range replicates {
+		for i, replicate := range replicates {
+			seed := i + 1
 			uniqStrGeneRepl := uniqStrGene + "_" + replicate
 
 			var targetDataPort *sp.OutPort
 
 			if doFillUp {
-				genRandomID := "create_random_bytes_" + replicate
-				if _, ok := genRandomProcs[genRandomID]; !ok {
-					genRandomProcs[genRandomID] = wf.NewProc(genRandomID, "dd if=/dev/urandom of={o:rand} bs=1048576 count=1024")
-				}
-				genRandomProcs[genRandomID].SetPathStatic("rand", "dat/"+replicate+"_random_bytes.bin")
-
-				fillAssumedNonbinding := wf.NewProc("fillup_"+uniqStrGeneRepl, `
-				cat {i:targetdata} > {o:filledup} \
-				&& let "fillup_lines_cnt = "$(wc -l {i:targetdata} | awk '{ printf $1 }')" * 2" \
-				&& awk -F"\t" 'FNR==NR{target_smiles[$1]; next} ($1 != "{p:gene}") && !($2 in target_smiles) { print $2 "\tN" }' {i:targetdata} {i:rawdata} \
-				| sort -uV \
-				| shuf --random-source={i:randsrc} -n $fillup_lines_cnt >> {o:filledup}`)
-				fillAssumedNonbinding.SetPathReplace("targetdata", "filledup", ".tsv", ".incl_assumed_neg.tsv")
+				// Here we add assumed negatives to the double amount of the
+				// number of compounds in the target data
+				sampleAssumedNonBinding := NewSampleAssumedNegatives(wf, "sample_assumed_n_"+uniqStrGeneRepl, geneUppercase, *samplingSeed+int64(seed), func(activeCnt int, nonactiveCnt int) int {
+					return 2 * (activeCnt + nonactiveCnt)
+				})
+				sampleAssumedNonBinding.SetPathCustom("assumed_n", func(t *sp.Task) string {
+					geneLC := str.ToLower(t.Param("gene"))
+					return "dat/" + geneLC + "/" + t.Param("replicate") + "/" + geneLC + "." + t.Param("replicate") + ".assumed_n.tsv"
+				})
+				sampleAssumedNonBinding.InRawData().Connect(removeConflicting.Out("gene_smiles_activity"))
+				sampleAssumedNonBinding.InTargetData().Connect(extractTargetData.Out("target_data"))
+				sampleAssumedNonBinding.ParamInPort("replicate").ConnectStr(replicate)
+
+				fillAssumedNonbinding := wf.NewProc("fillup_"+uniqStrGeneRepl, `cat {i:targetdata} {i:assumed_n} > {o:filledup} # {p:replicate}`)
+				fillAssumedNonbinding.SetPathCustom("filledup", func(t *sp.Task) string {
+					return str.TrimSuffix(t.InPath("targetdata"), ".tsv") + "." + t.Param("replicate") + ".incl_assumed_neg.tsv"
+				})
 				fillAssumedNonbinding.In("targetdata").Connect(extractTargetData.Out("target_data"))
-				fillAssumedNonbinding.In("rawdata").Connect(removeConflicting.Out("gene_smiles_activity"))
-				fillAssumedNonbinding.ParamInPort("gene").ConnectStr(geneUppercase)
-				fillAssumedNonbinding.In("randsrc").Connect(genRandomProcs[genRandomID].Out("rand"))
+				fillAssumedNonbinding.In("assumed_n").Connect(sampleAssumedNonBinding.OutAssumedNeg())
+				fillAssumedNonbinding.ParamInPort("replicate").ConnectStr(replicate)
 				targetDataPort = fillAssumedNonbinding.Out("filledup")
 			} else {
 				targetDataPort = extractTargetData.Out("target_data")
@@ -187,14 +193,16 @@ func main() {
 			// --------------------------------------------------------------------------------
 			// Pre-compute step
 			// --------------------------------------------------------------------------------
-			cpSignPrecomp := wf.NewProc("cpsign_precomp_"+uniqStrGeneRepl,
-				`java -jar `+cpSignPath+` precompute \
-									--license ../../bin/cpsign.lic \
-									--cptype 1 \
-									--trainfile {i:traindata} \
-									--labels A, N \
-									--model-out {o:precomp} \
-									--model-name "`+geneUppercase+` target profile"`)
+			// This version of CPSign writes no log files, so the commands are
+			// run in plain processes
+			cpSignPrecompCmd, err := cpSign.CommandLine(&cpsign.Precompute{
+				TrainFile: "{i:traindata}",
+				Labels:    []string{"A", "N"},
+				ModelOut:  "{o:precomp}",
+				ModelName: geneUppercase + " target profile",
+			})
+			sp.Check(err)
+			cpSignPrecomp := wf.NewProc("cpsign_precomp_"+uniqStrGeneRepl, cpSignPrecompCmd)
 			cpSignPrecomp.In("traindata").Connect(targetDataPort)
 			cpSignPrecomp.SetPathExtend("traindata", "precomp", ".precomp")
 			if *runSlurm {
@@ -213,17 +221,18 @@ func main() {
 			for _, cost := range costVals {
 				uniqStrCost := uniqStrGeneRepl + "_" + cost
 				// If Liblinear
-				evalCost := wf.NewProc("crossval_"+uniqStrCost, `java -jar `+cpSignPath+` crossvalidate \
-									--license ../../bin/cpsign.lic \
-									--cptype 1 \
-									--trainfile {i:traindata} \
-									--impl liblinear \
-									--labels A, N \
-									--nr-models {p:nrmdl} \
-									--cost {p:cost} \
-									--cv-folds {p:cvfolds} \
-									--output-format json \
-									--confidence {p:confidence} | grep -P "^{" > {o:stats} # {p:gene} {p:replicate}`)
+				evalCostCmd, err := cpSign.CommandLine(&cpsign.CrossValidate{
+					TrainFile:    "{i:traindata}",
+					Impl:         "liblinear",
+					Labels:       []string{"A", "N"},
+					NrModels:     "{p:nrmdl}",
+					Cost:         "{p:cost}",
+					CVFolds:      "{p:cvfolds}",
+					OutputFormat: "json",
+					Confidence:   "{p:confidence}",
+				})
+				sp.Check(err)
+				evalCost := wf.NewProc("crossval_"+uniqStrCost, evalCostCmd+" "+cpsign.JSONTo("{o:stats}")+" # {p:gene} {p:replicate}")
 				evalCost.SetPathCustom("stats", func(t *sp.Task) string {
 					c, err := strconv.ParseInt(t.Param("cost"), 10, 0)
 					sp.Check(err)
@@ -272,17 +281,18 @@ func main() {
 			// --------------------------------------------------------------------------------
 			// Train step
 			// --------------------------------------------------------------------------------
+			cpSignTrainCmd, err := cpSign.CommandLine(&cpsign.Train{
+				ModelFile: "{i:model}",
+				Labels:    []string{"A", "N"},
+				Impl:      "liblinear",
+				NrModels:  "{p:nrmdl}",
+				Cost:      "{p:cost}",
+				ModelOut:  "{o:model}",
+				ModelName: "{p:gene} target profile",
+			})
+			sp.Check(err)
 			cpSignTrain := wf.NewProc("cpsign_train_"+uniqStrGeneRepl,
-				`java -jar `+cpSignPath+` train \
-									--license ../../bin/cpsign.lic \
-									--cptype 1 \
-									--modelfile {i:model} \
-									--labels A, N \
-									--impl liblinear \
-									--nr-models {p:nrmdl} \
-									--cost {p:cost} \
-									--model-out {o:model} \
-									--model-name "{p:gene} target profile" # {p:replicate} Validity: {p:validity} Efficiency: {p:efficiency} Class-Equalized Observed Fuzziness: {p:obsfuzz_classavg} Observed Fuzziness (Overall): {p:obsfuzz_overall} Observed Fuzziness (Active class): {p:obsfuzz_active} Observed Fuzziness (Non-active class): {p:obsfuzz_nonactive} Class Confidence: {p:class_confidence} Class Credibility: {p:class_credibility}`)
+				cpSignTrainCmd+" # {p:replicate} Validity: {p:validity} Efficiency: {p:efficiency} Class-Equalized Observed Fuzziness: {p:obsfuzz_classavg} Observed Fuzziness (Overall): {p:obsfuzz_overall} Observed Fuzziness (Active class): {p:obsfuzz_active} Observed Fuzziness (Non-active class): {p:obsfuzz_nonactive} Class Confidence: {p:class_confidence} Class Credibility: {p:class_credibility}")
 			cpSignTrain.In("model").Connect(cpSignPrecomp.Out("precomp"))
 			cpSignTrain.ParamInPort("nrmdl").ConnectStr("10")
 			cpSignTrain.ParamInPort("gene").ConnectStr(geneUppercase)
@@ -3,10 +3,10 @@ package main
 import (
 	"encoding/csv"
 	"encoding/json"
-	"encoding/xml"
 	"io"
 	"os"
 
+	"github.com/pharmbio/ptp-project/lib/drugbank"
 	sp "github.com/scipipe/scipipe"
 )
 
@@ -73,14 +73,14 @@ func main() {
 	excapeDBOrigIDsUnique.SetPathExtend("excapedb", "entries", ".origids.uniq.tsv")
 	excapeDBOrigIDsUnique.In("excapedb").Connect(excapeDB.Out())
 
-	//xmlToTSV := wf.NewProc("xml_to_tsv", "# Custom Go code with input: {i:xml} and output: {o:tsv}")
-	//xmlToTSV.SetPathExtend("xml", "tsv", ".extr.tsv")
-	//xmlToTSV.In("xml").Connect(unzipDrugBank.Out("xml"))
-	//xmlToTSV.CustomExecute = NewXMLToTSVFunc()
+	xmlToTSV := wf.NewProc("xml_to_tsv", "# Custom Go code with input: {i:xml} and output: {o:tsv}")
+	xmlToTSV.SetPathExtend("xml", "tsv", ".extr.tsv")
+	xmlToTSV.In("xml").Connect(unzipDrugBank.Out("xml"))
+	xmlToTSV.CustomExecute = NewXMLToTSVFunc()
 
-	//sortTsv := wf.NewProc("sort_tsv", "head -n 1 {i:unsorted} > {o:sorted}; tail -n +2 {i:unsorted} | sort >> {o:sorted}")
-	//sortTsv.SetPathExtend("unsorted", "sorted", ".sorted.tsv")
-	//sortTsv.In("unsorted").Connect(xmlToTSV.Out("tsv"))
+	sortTsv := wf.NewProc("sort_tsv", "head -n 1 {i:unsorted} > {o:sorted}; tail -n +2 {i:unsorted} | sort >> {o:sorted}")
+	sortTsv.SetPathExtend("unsorted", "sorted", ".sorted.tsv")
+	sortTsv.In("unsorted").Connect(xmlToTSV.Out("tsv"))
 
 	excapeDBVsDrugBank := wf.NewProc("exc_vs_drb", "# Custom Go function with inputs: {i:excapedb_ids_uniq}, {i:excapedb_ids_all} {i:approv_ids}, {i:withdr_ids} and output: {o:stats}")
 	excapeDBVsDrugBank.SetPathStatic("stats", "dat/excapedb_vs_drugbank_stats.json")
@@ -225,96 +225,12 @@ func NewXMLToTSVFunc() func(t *sp.Task) {
 		if err != nil {
 			sp.Fail("Could not open file", t.InPath("xml"))
 		}
+		defer fh.Close()
 
-		tsvWrt := csv.NewWriter(t.OutIP("tsv").OpenWriteTemp())
-		tsvWrt.Comma = '\t'
-		tsvHeader := []string{"inchikey", "status", "chembl_id", "pubchem_sid", "pubchem_cid"}
-		tsvWrt.Write(tsvHeader)
-
-		// Implement a streaming XML parser according to guide in
-		// http://blog.davidsingleton.org/parsing-huge-xml-files-with-go
-		xmlDec := xml.NewDecoder(fh)
-		for {
-			t, tokenErr := xmlDec.Token()
-			if tokenErr != nil {
-				if tokenErr.Error() == "EOF" {
-					break
-				} else {
-					sp.Fail("Failed to read token:", tokenErr)
-				}
-			}
-			switch startElem := t.(type) {
-			case xml.StartElement:
-				if startElem.Name.Local == "drug" {
-					var status string
-					var inchiKey string
-					var chemblID string
-					var pubchemSID string
-					var pubchemCID string
-
-					drug := &Drug{}
-					decErr := xmlDec.DecodeElement(drug, &startElem)
-					if err != nil {
-						sp.Fail("Could not decode element", decErr)
-					}
-					for _, g := range drug.Groups {
-						if g == "approved" {
-							status = "A"
-						}
-						// Withdrawn till "shadow" (what's the correct term?) approved status
-						if g == "withdrawn" {
-							status = "W"
-						}
-					}
-					for _, p := range drug.CalculatedProperties {
-						if p.Kind == "InChIKey" {
-							inchiKey = p.Value
-						}
-					}
-
-					for _, eid := range drug.ExternalIdentifiers {
-						if eid.Resource == "ChEMBL" {
-							chemblID = eid.Identifier
-						} else if eid.Resource == "PubChem Substance" {
-							pubchemSID = eid.Identifier
-						} else if eid.Resource == "PubChem Compound" {
-							pubchemCID = eid.Identifier
-						}
-					}
-
-					tsvWrt.Write([]string{inchiKey, status, chemblID, pubchemSID, pubchemCID})
-				}
-			case xml.EndElement:
-				continue
-			}
+		tsvFh := t.OutIP("tsv").OpenWriteTemp()
+		defer tsvFh.Close()
+		if err := drugbank.WriteTSV(fh, tsvFh); err != nil {
+			sp.Fail("Could not convert DrugBank XML to TSV:", err)
 		}
-		tsvWrt.Flush()
-		fh.Close()
 	}
 }
-
-type Drugbank struct {
-	XMLName xml.Name `xml:"drugbank"`
-	Drugs   []Drug   `xml:"drug"`
-}
-
-type Drug struct {
-	XMLName              xml.Name             `xml:"drug"`
-	Name                 string               `xml:"name"`
-	Groups               []string             `xml:"groups>group"`
-	CalculatedProperties []Property           `xml:"calculated-properties>property"`
-	ExternalIdentifiers  []ExternalIdentifier `xml:"external-identifiers>external-identifier"`
-}
-
-type Property struct {
-	XMLName xml.Name `xml:"property"`
-	Kind    string   `xml:"kind"`
-	Value   string   `xml:"value"`
-	Source  string   `xml:"source"`
-}
-
-type ExternalIdentifier struct {
-	XMLName    xml.Name `xml:"external-identifier"`
-	Resource   string   `xml:"resource"`
-	Identifier string   `xml:"identifier"`
-}
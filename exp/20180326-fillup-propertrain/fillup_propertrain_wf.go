@@ -11,20 +11,25 @@ import (
 	"strconv"
 	str "strings"
 
+	"github.com/pharmbio/ptp-project/lib/cpsign"
+	"github.com/pharmbio/ptp-project/lib/excapedb"
+	"github.com/pharmbio/ptp-project/lib/sampling"
 	sp "github.com/scipipe/scipipe"
 	spc "github.com/scipipe/scipipe/components"
 )
 
 var (
-	graph    = flag.Bool("graph", false, "If this flag is specified, the workflow will just print out the workflow as a graph in dot and pdf format, and nothing else")
-	maxTasks = flag.Int("maxtasks", 4, "Max number of local cores to use")
-	threads  = flag.Int("threads", 1, "Number of threads that Go is allowed to start")
-	geneSet  = flag.String("geneset", "smallest1", "Gene set to use (one of smallest1, smallest3, smallest4, bowes44)")
-	runSlurm = flag.Bool("slurm", false, "Start computationally heavy jobs via SLURM")
-	debug    = flag.Bool("debug", false, "Increase logging level to include DEBUG messages")
-
-	cpSignPath = "../../bin/cpsign-0.6.12.jar"
-	geneSets   = map[string][]string{
+	graph        = flag.Bool("graph", false, "If this flag is specified, the workflow will just print out the workflow as a graph in dot and pdf format, and nothing else")
+	maxTasks     = flag.Int("maxtasks", 4, "Max number of local cores to use")
+	threads      = flag.Int("threads", 1, "Number of threads that Go is allowed to start")
+	geneSet      = flag.String("geneset", "smallest1", "Gene set to use (one of smallest1, smallest3, smallest4, bowes44)")
+	runSlurm     = flag.Bool("slurm", false, "Start computationally heavy jobs via SLURM")
+	debug        = flag.Bool("debug", false, "Increase logging level to include DEBUG messages")
+	samplingSeed = flag.Int64("seed", 1, "Seed for the random sampling of the assumed negatives, for which replicate number i (r1, r2, ...) uses seed+i, so that a recorded seed fully reproduces a selection")
+
+	cpSignPath        = "../../bin/cpsign-0.6.12.jar"
+	cpSignLicensePath = "../../bin/cpsign.lic"
+	geneSets          = map[string][]string{
 		"bowes44": []string{
 			// Not available in dataset: "CHRNA1".
 			// Not available in dataset: "KCNE1"
@@ -104,21 +109,21 @@ func main() {
 	// Initialize processes and add to runner
 	// --------------------------------
 	wf := sp.NewWorkflow("train_models", *maxTasks)
+	cpSign := cpsign.NewTool(cpSignPath, cpSignLicensePath)
 
 	dbFileName := "pubchem.chembl.dataset4publication_inchi_smiles.tsv.xz"
 	dlExcapeDB := wf.NewProc("dlDB", fmt.Sprintf("wget https://zenodo.org/record/173258/files/%s -O {o:excapexz}", dbFileName))
 	dlExcapeDB.SetPathStatic("excapexz", "../../raw/"+dbFileName)
 
-	unPackDB := wf.NewProc("unPackDB", "xzcat {i:xzfile} > {o:unxzed}")
-	unPackDB.SetPathReplace("xzfile", "unxzed", ".xz", "")
-	unPackDB.In("xzfile").Connect(dlExcapeDB.Out("excapexz"))
-	//unPackDB.Prepend = "salloc -A snic2017-7-89 -n 2 -t 8:00:00 -J unpack_excapedb"
-
 	// extractGSA extracts a file with only Gene symbol, SMILES and the
-	// Activity flag, into a .tsv file, for easier subsequent parsing
-	extractGSA := wf.NewProc("extract_gene_smiles_activity", `awk -F "\t" '{ print $9 "\t" $12 "\t" $4 }' {i:excapedb} | sort -uV > {os:gene_smiles_activity}`) // os = output (streaming) ... stream output via a fifo file
-	extractGSA.SetPathReplace("excapedb", "gene_smiles_activity", ".tsv", ".ext_gene_smiles_activity.tsv")
-	extractGSA.In("excapedb").Connect(unPackDB.Out("unxzed"))
+	// Activity flag, into a .tsv file, for easier subsequent parsing. The
+	// ExCAPE-DB file is read directly in its .xz compressed form, and its
+	// columns are selected by name, after validating its header.
+	extractGSA := NewExtractExcapeDBColumns(wf, "extract_gene_smiles_activity",
+		[]string{excapedb.ColGeneSymbol, excapedb.ColSMILES, excapedb.ColActivityFlag},
+		"-uV")
+	extractGSA.SetPathReplace("excapedb", "tsv", ".tsv.xz", ".ext_gene_smiles_activity.tsv")
+	extractGSA.InExcapeDB().Connect(dlExcapeDB.Out("excapexz"))
 
 	// removeConflicting removes (or, SHOULD remove) rows which have the same values on both row 1 and 2 (I think ...)
 	removeConflicting := wf.NewProc("remove_conflicting", `awk -F "\t" '(( $1 != p1 ) || ( $2 != p2)) && ( c[p1,p2] <= 1 ) && ( p1 != "" ) && ( p2 != "" ) { print p1 "\t" p2 "\t" p3 }
@@ -126,12 +131,10 @@ func main() {
 																	  END { print $1 "\t" $2 "\t" $3 }' \
 																	  {i:gene_smiles_activity} > {o:gene_smiles_activity}`)
 	removeConflicting.SetPathReplace("gene_smiles_activity", "gene_smiles_activity", ".tsv", ".dedup.tsv")
-	removeConflicting.In("gene_smiles_activity").Connect(extractGSA.Out("gene_smiles_activity"))
+	removeConflicting.In("gene_smiles_activity").Connect(extractGSA.OutTSV())
 
 	finalModelsSummary := NewFinalModelSummarizer(wf, "finalmodels_summary_creator", "res/final_models_summary.tsv", '\t')
 
-	genRandomProcs := map[string]*sp.Process{}
-
 	// --------------------------------
 	// Set up gene-specific workflow branches
 	// --------------------------------
@@ -151,38 +154,26 @@ func main() {
 		}
 
 		countProcs := map[string]*sp.Process{}
-		for _, replicate := range replicates {
+		for i, replicate := range replicates {
+			seed := i + 1
 			uniqStrGeneRepl := uniqStrGene + "_" + replicate
 
 			var assumedN *sp.OutPort
 
 			if doFillUp {
 				sp.Audit.Printf("Filling up dataset with assumed negatives, for gene %s ...\n", geneUppercase)
-				genRandomID := "create_random_bytes_" + replicate
-				if _, ok := genRandomProcs[genRandomID]; !ok {
-					genRandomProcs[genRandomID] = wf.NewProc(genRandomID, "dd if=/dev/urandom of={o:rand} bs=1048576 count=1024")
-				}
-				genRandomProcs[genRandomID].SetPathStatic("rand", "dat/"+replicate+"_random_bytes.bin")
-
 				// Here we fill up TO the double amount of non-actives compared
-				// to number of actives, by multiplying the number of actives
-				// times two, and subtracting the number of existing
-				// non-actices (See "A*2-N" in the AWK-script below).
-				extractAssumedNonBinding := wf.NewProc("extract_assumed_n_"+uniqStrGeneRepl, `
-					let "fillup_lines_cnt = "$(awk -F"\t" '$2 == "A" { A += 1 } $2 == "N" { N += 1 } END { print A*2-N }' {i:targetdata}) \
-					&& awk -F"\t" 'FNR==NR{target_smiles[$1]; next} ($1 != "{p:gene}") && !($2 in target_smiles) { print $2 "\tN" }' {i:targetdata} {i:rawdata} \
-					| sort -uV \
-					| shuf --random-source={i:randsrc} -n $fillup_lines_cnt > {o:assumed_n} # replicate:{p:replicate}`)
+				// to number of actives (see sampling.FillUpRule)
+				fillUpRule := &sampling.FillUpRule{Ratio: 2}
+				extractAssumedNonBinding := NewSampleAssumedNegatives(wf, "extract_assumed_n_"+uniqStrGeneRepl, geneUppercase, *samplingSeed+int64(seed), fillUpRule.Count)
 				extractAssumedNonBinding.SetPathCustom("assumed_n", func(t *sp.Task) string {
 					geneLC := str.ToLower(t.Param("gene"))
 					return "dat/" + geneLC + "/" + t.Param("replicate") + "/" + geneLC + "." + t.Param("replicate") + ".assumed_n.tsv"
 				})
-				extractAssumedNonBinding.In("rawdata").Connect(removeConflicting.Out("gene_smiles_activity"))
-				extractAssumedNonBinding.In("targetdata").Connect(extractTargetData.Out("target_data"))
-				extractAssumedNonBinding.ParamInPort("gene").ConnectStr(geneUppercase)
+				extractAssumedNonBinding.InRawData().Connect(removeConflicting.Out("gene_smiles_activity"))
+				extractAssumedNonBinding.InTargetData().Connect(extractTargetData.Out("target_data"))
 				extractAssumedNonBinding.ParamInPort("replicate").ConnectStr(replicate)
-				extractAssumedNonBinding.In("randsrc").Connect(genRandomProcs[genRandomID].Out("rand"))
-				assumedN = extractAssumedNonBinding.Out("assumed_n")
+				assumedN = extractAssumedNonBinding.OutAssumedNeg()
 
 				// --------------------
 				//fillAssumedNonbinding := wf.NewProc("fillup_"+uniqStrGeneRepl, `cat {i:targetdata} {i:assumed_n} > {o:filledup} # gene:{p:gene} replicate:{p:replicate}`)
@@ -208,19 +199,19 @@ func main() {
 			// --------------------------------------------------------------------------------
 			// Pre-compute step
 			// --------------------------------------------------------------------------------
-			cpSignPrecompCmd := `java -jar ` + cpSignPath + ` precompute \
-									--license ../../bin/cpsign.lic \
-									--cptype 1 \
-									--trainfile {i:traindata} \
-									--labels A, N \
-									--model-out {o:precomp} \
-									--model-name "` + geneUppercase + `" \
-									--logfile {o:logfile}`
+			precompute := &cpsign.Precompute{
+				// The log keeps its own extension (see below)
+				Common:    cpsign.Common{LogFile: "{o:logfile}"},
+				TrainFile: "{i:traindata}",
+				Labels:    []string{"A", "N"},
+				ModelOut:  "{o:precomp}",
+				ModelName: geneUppercase,
+			}
 			if doFillUp {
-				cpSignPrecompCmd += ` \
-									--proper-trainfile {i:propertraindata}`
+				precompute.ProperTrainFile = "{i:propertraindata}"
 			}
-			cpSignPrecomp := wf.NewProc("cpsign_precomp_"+uniqStrGeneRepl, cpSignPrecompCmd)
+			cpSignPrecomp, err := cpSign.NewProc(wf, "cpsign_precomp_"+uniqStrGeneRepl, precompute, "")
+			sp.Check(err)
 			cpSignPrecomp.In("traindata").Connect(extractTargetData.Out("target_data"))
 			if doFillUp {
 				cpSignPrecomp.In("propertraindata").Connect(assumedN)
@@ -243,24 +234,23 @@ func main() {
 			for _, cost := range costVals {
 				uniqStrCost := uniqStrGeneRepl + "_" + cost
 				// If Liblinear
-				evalCostCmd := `java -jar ` + cpSignPath + ` crossvalidate \
-									--license ../../bin/cpsign.lic \
-									--cptype 1 \
-									--trainfile {i:traindata} \
-									--impl liblinear \
-									--labels A, N \
-									--nr-models {p:nrmdl} \
-									--cost {p:cost} \
-									--cv-folds {p:cvfolds} \
-									--output-format json \
-									--logfile {o:logfile}`
+				crossValidate := &cpsign.CrossValidate{
+					// The log keeps its own extension (see below)
+					Common:       cpsign.Common{LogFile: "{o:logfile}"},
+					TrainFile:    "{i:traindata}",
+					Impl:         "liblinear",
+					Labels:       []string{"A", "N"},
+					NrModels:     "{p:nrmdl}",
+					Cost:         "{p:cost}",
+					CVFolds:      "{p:cvfolds}",
+					OutputFormat: "json",
+					Confidences:  "{p:confidences}",
+				}
 				if doFillUp {
-					evalCostCmd += ` \
-									--proper-trainfile {i:propertraindata}`
+					crossValidate.ProperTrainFile = "{i:propertraindata}"
 				}
-				evalCostCmd += ` \
-									--confidences "{p:confidences}" | grep -P "^\[" > {o:stats} # {p:gene} {p:replicate}`
-				evalCost := wf.NewProc("crossval_"+uniqStrCost, evalCostCmd)
+				evalCost, err := cpSign.NewProc(wf, "crossval_"+uniqStrCost, crossValidate, cpsign.JSONTo("{o:stats}")+" # {p:gene} {p:replicate}")
+				sp.Check(err)
 				evalCostStatsPathFunc := func(t *sp.Task) string {
 					c, err := strconv.ParseInt(t.Param("cost"), 10, 0)
 					sp.Check(err)
@@ -322,18 +312,20 @@ func main() {
 			// --------------------------------------------------------------------------------
 			// Train step
 			// --------------------------------------------------------------------------------
-			cpSignTrain := wf.NewProc("cpsign_train_"+uniqStrGeneRepl,
-				`java -jar `+cpSignPath+` train \
-									--license ../../bin/cpsign.lic \
-									--cptype 1 \
-									--modelfile {i:model} \
-									--labels A, N \
-									--impl liblinear \
-									--nr-models {p:nrmdl} \
-									--cost {p:cost} \
-									--model-out {o:model} \
-									--logfile {o:logfile} \
-									--model-name "{p:gene} target profile" # {p:replicate} Accuracy: {p:accuracy} Efficiency: {p:efficiency} Class-Equalized Observed Fuzziness: {p:obsfuzz_classavg} Observed Fuzziness (Overall): {p:obsfuzz_overall} Observed Fuzziness (Active class): {p:obsfuzz_active} Observed Fuzziness (Non-active class): {p:obsfuzz_nonactive} Class Confidence: {p:class_confidence} Class Credibility: {p:class_credibility}`)
+			cpSignTrain, err := cpSign.NewProc(wf, "cpsign_train_"+uniqStrGeneRepl,
+				&cpsign.Train{
+					// The log keeps its own extension (see below)
+					Common:    cpsign.Common{LogFile: "{o:logfile}"},
+					ModelFile: "{i:model}",
+					Labels:    []string{"A", "N"},
+					Impl:      "liblinear",
+					NrModels:  "{p:nrmdl}",
+					Cost:      "{p:cost}",
+					ModelOut:  "{o:model}",
+					ModelName: "{p:gene} target profile",
+				},
+				"# {p:replicate} Accuracy: {p:accuracy} Efficiency: {p:efficiency} Class-Equalized Observed Fuzziness: {p:obsfuzz_classavg} Observed Fuzziness (Overall): {p:obsfuzz_overall} Observed Fuzziness (Active class): {p:obsfuzz_active} Observed Fuzziness (Non-active class): {p:obsfuzz_nonactive} Class Confidence: {p:class_confidence} Class Credibility: {p:class_credibility}")
+			sp.Check(err)
 			cpSignTrain.In("model").Connect(cpSignPrecomp.Out("precomp"))
 			cpSignTrain.ParamInPort("nrmdl").ConnectStr("10")
 			cpSignTrain.ParamInPort("gene").ConnectStr(geneUppercase)
@@ -2,13 +2,19 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/csv"
 	"fmt"
+	"io"
+	"os"
+	"sort"
 	"strconv"
 
 	str "strings"
 
+	"github.com/pharmbio/ptp-project/lib/excapedb"
+	"github.com/pharmbio/ptp-project/lib/sampling"
 	sp "github.com/scipipe/scipipe"
 )
 
@@ -437,3 +443,135 @@ func (p *FinalModelSummarizer) Run() {
 	oip.Atomize()
 	p.OutSummary().Send(oip)
 }
+
+// ================================================================================
+
+// ExtractExcapeDBColumns is a SciPipe process that streams through an
+// ExCAPE-DB file (plain TSV or .xz compressed), validates its header, and
+// writes the given columns (selected by name, not position) into a TSV file
+// without header, sorted with the given flags to the unix sort command.
+type ExtractExcapeDBColumns struct {
+	*sp.Process
+	Columns   []string
+	SortFlags string
+}
+
+func (p *ExtractExcapeDBColumns) InExcapeDB() *sp.InPort { return p.In("excapedb") }
+func (p *ExtractExcapeDBColumns) OutTSV() *sp.OutPort    { return p.Out("tsv") }
+
+func NewExtractExcapeDBColumns(wf *sp.Workflow, procName string, columns []string, sortFlags string) *ExtractExcapeDBColumns {
+	p := &ExtractExcapeDBColumns{
+		Process:   wf.NewProc(procName, "# ExtractExcapeDBColumns custom process. Ports: {i:excapedb} {o:tsv} Columns: "+str.Join(columns, ",")+" Sorting: "+sortFlags),
+		Columns:   columns,
+		SortFlags: sortFlags,
+	}
+	p.CustomExecute = func(t *sp.Task) {
+		excapeFile, err := excapedb.Open(t.InPath("excapedb"))
+		sp.CheckWithMsg(err, "Could not open ExCAPE-DB file")
+		defer excapeFile.Close()
+
+		unsortedPath := t.OutIP("tsv").TempPath() + ".unsorted"
+		unsortedFh, err := os.Create(unsortedPath)
+		sp.CheckWithMsg(err, "Could not create file "+unsortedPath)
+		bufWriter := bufio.NewWriter(unsortedFh)
+		vals := make([]string, len(p.Columns))
+		for {
+			rec, err := excapeFile.Read()
+			if err == io.EOF {
+				break
+			}
+			sp.CheckWithMsg(err, "Could not read ExCAPE-DB record")
+			for i, col := range p.Columns {
+				vals[i] = rec.Value(col)
+			}
+			bufWriter.WriteString(str.Join(vals, "\t") + "\n")
+		}
+		sp.Check(bufWriter.Flush())
+		unsortedFh.Close()
+
+		sp.ExecCmd(fmt.Sprintf("sort %s %s > %s && rm %s", p.SortFlags, unsortedPath, t.OutIP("tsv").TempPath(), unsortedPath))
+	}
+	return p
+}
+
+// ================================================================================
+
+// SampleAssumedNegatives is a SciPipe process that samples assumed negatives
+// for a target: distinct SMILES from the gene, smiles, activity data of all
+// targets, that are not measured on the target, labelled N. The number of
+// assumed negatives is given by the Count function, from the number of
+// actives and non-actives in the target data. The sampling is fully
+// reproducible from the seed parameter (see sampling.NewRand).
+type SampleAssumedNegatives struct {
+	*sp.Process
+	Count func(activeCnt int, nonactiveCnt int) int
+}
+
+func (p *SampleAssumedNegatives) InRawData() *sp.InPort      { return p.In("rawdata") }
+func (p *SampleAssumedNegatives) InTargetData() *sp.InPort   { return p.In("targetdata") }
+func (p *SampleAssumedNegatives) OutAssumedNeg() *sp.OutPort { return p.Out("assumed_n") }
+
+func NewSampleAssumedNegatives(wf *sp.Workflow, procName string, gene string, seed int64, count func(activeCnt int, nonactiveCnt int) int) *SampleAssumedNegatives {
+	p := &SampleAssumedNegatives{
+		Process: wf.NewProc(procName, "# SampleAssumedNegatives custom process. Ports: {i:rawdata} {i:targetdata} {o:assumed_n} Gene: {p:gene} Seed: {p:seed} # {p:replicate}"),
+		Count:   count,
+	}
+	p.ParamInPort("gene").ConnectStr(gene)
+	p.ParamInPort("seed").ConnectStr(strconv.FormatInt(seed, 10))
+	p.CustomExecute = func(t *sp.Task) {
+		targetSMILES := map[string]bool{}
+		activeCnt, nonactiveCnt := 0, 0
+		tdFh := t.InIP("targetdata").Open()
+		tdScanner := bufio.NewScanner(tdFh)
+		tdScanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+		for tdScanner.Scan() {
+			fields := str.Split(tdScanner.Text(), "\t")
+			if len(fields) < 2 {
+				continue
+			}
+			targetSMILES[fields[0]] = true
+			switch fields[1] {
+			case "A":
+				activeCnt++
+			case "N":
+				nonactiveCnt++
+			}
+		}
+		sp.CheckWithMsg(tdScanner.Err(), "Could not read target data "+t.InPath("targetdata"))
+		tdFh.Close()
+
+		poolSet := map[string]bool{}
+		rawFh := t.InIP("rawdata").Open()
+		rawScanner := bufio.NewScanner(rawFh)
+		rawScanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+		for rawScanner.Scan() {
+			fields := str.Split(rawScanner.Text(), "\t")
+			if len(fields) < 2 || fields[0] == t.Param("gene") || targetSMILES[fields[1]] {
+				continue
+			}
+			poolSet[fields[1]] = true
+		}
+		sp.CheckWithMsg(rawScanner.Err(), "Could not read raw data "+t.InPath("rawdata"))
+		rawFh.Close()
+		// The pool is sorted, so that the sample only depends on the seed
+		pool := make([]string, 0, len(poolSet))
+		for smiles := range poolSet {
+			pool = append(pool, smiles)
+		}
+		sort.Strings(pool)
+
+		seed, err := strconv.ParseInt(t.Param("seed"), 10, 64)
+		sp.CheckWithMsg(err, "Could not parse seed")
+		sampled := sampling.Sample(pool, p.Count(activeCnt, nonactiveCnt), sampling.NewRand(seed))
+		sp.Audit.Printf("Process %s: Sampled %d assumed negatives for %s from a pool of %d compounds, with seed %d\n", p.Name(), len(sampled), t.Param("gene"), len(pool), seed)
+
+		outFh := t.OutIP("assumed_n").OpenWriteTemp()
+		defer outFh.Close()
+		outWriter := bufio.NewWriter(outFh)
+		for _, smiles := range sampled {
+			outWriter.WriteString(smiles + "\tN\n")
+		}
+		sp.Check(outWriter.Flush())
+	}
+	return p
+}
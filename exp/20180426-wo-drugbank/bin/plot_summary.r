@@ -7,6 +7,7 @@ library(getopt)
 optspec = matrix(c(
   'infile', 'i', 1, 'character',
   'outfile', 'o', 1, 'character',
+  'aggregated', 'a', 2, 'character',
   'format', 'f', 1, 'character'
 ), byrow=TRUE, ncol=4);
 opt = getopt(optspec);
@@ -14,7 +15,7 @@ opt = getopt(optspec);
 # if help was asked for print a friendly message
 # and exit with a non-zero error code
 if ( is.null(opt$format) || is.null(opt$infile) || is.null(opt$outfile) ) {
-  cat('Usage: Rscript plot_heatmap.r -i infile -o outfile -f (png|pdf)\n');
+  cat('Usage: Rscript plot_summary.r -i infile [-a aggregated_infile] -o outfile -f (png|pdf)\n');
   q(status=1);
 }
 
@@ -39,6 +40,29 @@ d <- read.csv(opt$infile, sep = '\t', header = TRUE);
 
 drepl <- split(d, d$Replicate)
 
+# The summary aggregated over replicates (mean, SD, min and max of every metric
+# per gene and runset), if given, is used for drawing error bars
+agg <- NULL
+if ( !is.null(opt$aggregated) ) {
+  agg <- read.csv(opt$aggregated, sep = '\t', header = TRUE);
+  agg <- agg[match(paste(drepl$r1$Gene, drepl$r1$Runset), paste(agg$Gene, agg$Runset)),]
+}
+
+# Draw error bars of +/- one standard deviation around the mean of a metric,
+# inverted (1-x) like the plotted values
+plot_error_bars <- function(metric, col) {
+  if ( is.null(agg) ) {
+    return(invisible(NULL))
+  }
+  mean <- agg[[paste(metric, "Mean", sep="")]]
+  sd <- agg[[paste(metric, "SD", sep="")]]
+  has_sd <- !is.na(sd) & sd > 0
+  if ( any(has_sd) ) {
+    arrows(bplt[has_sd], 1-(mean[has_sd]-sd[has_sd]), bplt[has_sd], 1-(mean[has_sd]+sd[has_sd]),
+           angle=90, code=3, length=0.02, col=col);
+  }
+}
+
 invert <- function(x) (
   return(1-x)
 )
@@ -101,6 +125,7 @@ col_caof <- "#673BA8"
 #plot(bplt, 1-drepl$r3$Efficiency, type="p", axes=FALSE, col=col_eff, col.axis=col_eff, las=2, ylab=NA, xlab=NA, ylim=c(0,1));
 par(new=TRUE);
 plot(bplt, 1-drepl$r1$Efficiency, type="p", axes=FALSE, col=col_eff, col.axis=col_eff, las=2, ylab=NA, xlab=NA, ylim=c(0,1));
+plot_error_bars("Efficiency", col_eff);
 eff_median <- aggregate(d$Efficiency, by=list(Gene = d$Gene), FUN=median)
 eff_median <- eff_median[order(sort_vector_totcounts$x),]
 par(new=TRUE);
@@ -121,6 +146,7 @@ mtext("M Criterion (MC)", side=4, line=3.6, col=col_eff)
 #plot(bplt, 1-drepl$r3$ObsFuzzOverall, type="p", axes=FALSE, col=col_of, col.axis=col_of, las=2, ylab=NA, xlab=NA, ylim=c(0,1));
 par(new=TRUE);
 plot(bplt, 1-drepl$r1$ObsFuzzOverall, type="p", axes=FALSE, col=col_of, col.axis=col_of, las=2, ylab=NA, xlab=NA, ylim=c(0,1));
+plot_error_bars("ObsFuzzOverall", col_of);
 ofca_median <- aggregate(d$ObsFuzzOverall, by=list(Gene = d$Gene), FUN=median)
 ofca_median <- ofca_median[order(sort_vector_totcounts$x),]
 par(new=TRUE);
@@ -141,6 +167,7 @@ mtext("Observed Fuzziness (OF)", side=4, line=4.8, col=col_of)
 #plot(bplt, 1-drepl$r3$ObsFuzzClassAvg, type="p", axes=FALSE, col=col_caof, col.axis=col_caof, las=2, ylab=NA, xlab=NA, ylim=c(0,1));
 par(new=TRUE);
 plot(bplt, 1-drepl$r1$ObsFuzzClassAvg, type="p", axes=FALSE, col=col_caof, col.axis=col_caof, las=2, ylab=NA, xlab=NA, ylim=c(0,1));
+plot_error_bars("ObsFuzzClassAvg", col_caof);
 ofca_median <- aggregate(d$ObsFuzzClassAvg, by=list(Gene = d$Gene), FUN=median)
 ofca_median <- ofca_median[order(sort_vector_totcounts$x),]
 par(new=TRUE);
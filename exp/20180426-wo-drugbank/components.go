@@ -2,14 +2,26 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"encoding/csv"
 	"fmt"
+	"io"
+	"math"
+	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"time"
 
 	str "strings"
 
+	"github.com/pharmbio/ptp-project/lib/datasrc"
+	"github.com/pharmbio/ptp-project/lib/drugbank"
+	"github.com/pharmbio/ptp-project/lib/excapedb"
+	"github.com/pharmbio/ptp-project/lib/excapestore"
+	"github.com/pharmbio/ptp-project/lib/gridsearch"
+	"github.com/pharmbio/ptp-project/lib/sampling"
+	"github.com/pharmbio/ptp-project/lib/scaffold"
 	sp "github.com/scipipe/scipipe"
 )
 
@@ -25,312 +37,523 @@ func indexOfStr(s string, strs []string) int {
 	return -1
 }
 
-// gene, efficiency, accuracy, obsFuzzActive, obsFuzzNonactive, obsFuzzOverall, cost)
-
-// SummarizeCostGammaPerf is specialized a SciPipe Process that reads output
-// from cpSign status output to extract information about the efficiency and
-// accuracy of generated models for given cost and gamma values
-type SummarizeCostGammaPerf struct {
+// GridSearchCollect is a SciPipe process that collects the cross-validation
+// statistics (as output by CPSign crossvalidate in JSON format) of all the
+// grid points of a grid search into one long-format table (see
+// gridsearch.WriteResults), with one row per grid point, confidence level and
+// metric. The in-coming IPs need the params gene, replicate, runset and
+// grid_point.
+type GridSearchCollect struct {
 	sp.BaseProcess
-	procName     string
-	FileName     string
-	IncludeGamma bool
+	FileName string
 }
 
-func NewSummarizeCostGammaPerf(wf *sp.Workflow, name string, filename string, includeGamma bool) *SummarizeCostGammaPerf {
-	p := &SummarizeCostGammaPerf{
-		BaseProcess:  sp.NewBaseProcess(wf, name),
-		FileName:     filename,
-		IncludeGamma: includeGamma,
+func NewGridSearchCollect(wf *sp.Workflow, name string, fileName string) *GridSearchCollect {
+	p := &GridSearchCollect{
+		BaseProcess: sp.NewBaseProcess(wf, name),
+		FileName:    fileName,
 	}
-	p.InitInPort(p, "in")
-	p.InitOutPort(p, "out_stats")
+	p.InitInPort(p, "stats")
+	p.InitOutPort(p, "results")
 	wf.AddProc(p)
 	return p
 }
 
-func (p *SummarizeCostGammaPerf) In() *sp.InPort        { return p.InPort("in") }
-func (p *SummarizeCostGammaPerf) OutStats() *sp.OutPort { return p.OutPort("out_stats") }
+func (p *GridSearchCollect) InStats() *sp.InPort     { return p.InPort("stats") }
+func (p *GridSearchCollect) OutResults() *sp.OutPort { return p.OutPort("results") }
 
-func (p *SummarizeCostGammaPerf) Run() {
-	defer p.OutStats().Close()
+func (p *GridSearchCollect) Run() {
+	defer p.OutResults().Close()
 
 	outIp := sp.NewFileIP(p.FileName)
 	if outIp.Exists() {
 		sp.Info.Printf("Process %s: Out-target %s already exists, so skipping\n", p.Name(), outIp.Path())
-	} else {
-		header := []string{"Gene", "Efficiency", "Accuracy", "ObsFuzzActive", "ObsFuzzNonactive", "ObsFuzzOverall", "ClassConfidence", "ClassCredibility", "Cost"}
-		if p.IncludeGamma {
-			header = append(header, "Gamma")
+		for range p.InStats().Chan {
 		}
-		rows := [][]string{header}
-		for iip := range p.In().Chan {
-			gene := iip.Param("gene")
-			efficiency := iip.Key("efficiency")
-			accuracy := iip.Key("accuracy")
-			cost := iip.Param("cost")
-
-			obsFuzzActive := iip.Key("obsfuzz_active")
-			obsFuzzNonactive := iip.Key("obsfuzz_nonactive")
-			obsFuzzOverall := iip.Key("obsfuzz_overall")
-			classConfidence := iip.Key("class_confidence")
-			classCredibility := iip.Key("class_credibility")
-
-			row := []string{gene, efficiency, accuracy, obsFuzzActive, obsFuzzNonactive, obsFuzzOverall, classConfidence, classCredibility, cost}
-			if p.IncludeGamma {
-				row = append(row, iip.Param("gamma"))
-			}
-			rows = append(rows, row)
+	} else {
+		results := []*gridsearch.Result{}
+		for iip := range p.InStats().Chan {
+			crossValOuts := &[]cpSignCrossValOutput{}
+			iip.UnMarshalJSON(crossValOuts)
+			results = append(results, crossValResults(*crossValOuts, iip.Param("gene"), iip.Param("replicate"), iip.Param("runset"), iip.Param("grid_point"))...)
 		}
 		ofh := outIp.OpenWriteTemp()
-		tsvWriter := csv.NewWriter(ofh)
-		tsvWriter.Comma = '\t'
-		for _, row := range rows {
-			tsvWriter.Write(row)
-		}
-		tsvWriter.Flush()
+		err := gridsearch.WriteResults(ofh, results)
 		ofh.Close()
+		sp.CheckWithMsg(err, "Could not write grid search results to "+outIp.Path())
 		outIp.Atomize()
 	}
-	p.OutStats().Send(outIp)
+	p.OutResults().Send(outIp)
+}
+
+// crossValResults converts the output of CPSign crossvalidate for a grid point
+// to grid search results
+func crossValResults(crossValOuts []cpSignCrossValOutput, gene string, replicate string, runSet string, point string) []*gridsearch.Result {
+	results := []*gridsearch.Result{}
+	for _, crossValOut := range crossValOuts {
+		metrics := map[string]float64{
+			gridsearch.MetricAccuracy:         crossValOut.Accuracy,
+			gridsearch.MetricEfficiency:       crossValOut.Efficiency,
+			gridsearch.MetricObsFuzzOverall:   crossValOut.ObservedFuzziness.Overall,
+			gridsearch.MetricObsFuzzActive:    crossValOut.ObservedFuzziness.Active,
+			gridsearch.MetricObsFuzzNonactive: crossValOut.ObservedFuzziness.Nonactive,
+			// We take the average for the two classes, to get more equal
+			// influence of each class
+			gridsearch.MetricObsFuzzClassAvg:  (crossValOut.ObservedFuzziness.Active + crossValOut.ObservedFuzziness.Nonactive) / 2,
+			gridsearch.MetricClassConfidence:  crossValOut.ClassConfidence,
+			gridsearch.MetricClassCredibility: crossValOut.ClassCredibility,
+		}
+		for _, metric := range gridSearchMetrics {
+			results = append(results, &gridsearch.Result{
+				Gene:       gene,
+				Replicate:  replicate,
+				Runset:     runSet,
+				Point:      point,
+				Confidence: crossValOut.Confidence,
+				Metric:     metric,
+				Value:      metrics[metric],
+			})
+		}
+	}
+	return results
+}
+
+// gridSearchMetrics are the metrics in the grid search results, in order
+var gridSearchMetrics = []string{
+	gridsearch.MetricAccuracy,
+	gridsearch.MetricEfficiency,
+	gridsearch.MetricObsFuzzOverall,
+	gridsearch.MetricObsFuzzActive,
+	gridsearch.MetricObsFuzzNonactive,
+	gridsearch.MetricObsFuzzClassAvg,
+	gridsearch.MetricClassConfidence,
+	gridsearch.MetricClassCredibility,
 }
 
 // ================================================================================
 
-type BestCostGamma struct {
+// AdaptiveGridSearch is a SciPipe process that grid searches the parameter
+// space of a target with successive halving (see gridsearch.Halving), or in
+// one full round if the space has no halving section, as an alternative to
+// one crossvalidate process per grid point and GridSearchCollect. The
+// crossvalidate tasks of each round are generated, and run as the results of
+// the earlier rounds come in, within the limit of concurrent tasks of the
+// workflow (-maxtasks), which they share with the tasks of all other
+// processes. Each crossvalidate output gets an audit log, like the outputs of
+// ordinary tasks. The results of the final, full round are written as a
+// long-format table (see gridsearch.WriteResults), and those of the cheap
+// rounds to tables with a .round<number>.tsv extension.
+type AdaptiveGridSearch struct {
 	sp.BaseProcess
-	procName            string
-	Separator           rune
-	Header              bool
-	EfficiencyValColIdx int // Which column to check for the efficiency value
-	AccuracyValColIdx   int // Which column to check for the accuracy value
-	IncludeGamma        bool
-}
-
-func NewBestCostGamma(wf *sp.Workflow, procName string, separator rune, header bool, includeGamma bool) *BestCostGamma {
-	sbcr := &BestCostGamma{
-		BaseProcess:  sp.NewBaseProcess(wf, procName),
-		Separator:    separator,
-		Header:       header,
-		IncludeGamma: includeGamma,
-	}
-	sbcr.InitInPort(sbcr, "csv_file")
-	sbcr.InitParamOutPort(sbcr, "best_accuracy")
-	sbcr.InitParamOutPort(sbcr, "best_eff")
-	sbcr.InitParamOutPort(sbcr, "best_obsfuzz_classavg")
-	sbcr.InitParamOutPort(sbcr, "best_obsfuzz_overall")
-	sbcr.InitParamOutPort(sbcr, "best_obsfuzz_active")
-	sbcr.InitParamOutPort(sbcr, "best_obsfuzz_nonactive")
-	sbcr.InitParamOutPort(sbcr, "best_class_confidence")
-	sbcr.InitParamOutPort(sbcr, "best_class_credibility")
-	sbcr.InitParamOutPort(sbcr, "best_cost")
-	sbcr.InitParamOutPort(sbcr, "best_gamma")
-	wf.AddProc(sbcr)
-	return sbcr
-}
-
-func (p BestCostGamma) InCSVFile() *sp.InPort {
-	return p.InPort("csv_file")
-}
-func (p *BestCostGamma) OutBestAccuracy() *sp.ParamOutPort {
-	return p.ParamOutPort("best_accuracy")
-}
-func (p *BestCostGamma) OutBestEfficiency() *sp.ParamOutPort {
-	return p.ParamOutPort("best_eff")
-}
-func (p *BestCostGamma) OutBestObsFuzzClassAvg() *sp.ParamOutPort {
-	return p.ParamOutPort("best_obsfuzz_classavg")
-}
-func (p *BestCostGamma) OutBestObsFuzzOverall() *sp.ParamOutPort {
-	return p.ParamOutPort("best_obsfuzz_overall")
-}
-func (p *BestCostGamma) OutBestObsFuzzActive() *sp.ParamOutPort {
-	return p.ParamOutPort("best_obsfuzz_active")
-}
-func (p *BestCostGamma) OutBestObsFuzzNonactive() *sp.ParamOutPort {
-	return p.ParamOutPort("best_obsfuzz_nonactive")
-}
-func (p *BestCostGamma) OutBestClassConfidence() *sp.ParamOutPort {
-	return p.ParamOutPort("best_class_confidence")
-}
-func (p *BestCostGamma) OutBestClassCredibility() *sp.ParamOutPort {
-	return p.ParamOutPort("best_class_credibility")
-}
-func (p *BestCostGamma) OutBestCost() *sp.ParamOutPort {
-	return p.ParamOutPort("best_cost")
-}
-func (p *BestCostGamma) OutBestGamma() *sp.ParamOutPort {
-	return p.ParamOutPort("best_gamma")
-}
-
-func (p *BestCostGamma) Run() {
-	defer p.OutBestCost().Close()
-	if p.IncludeGamma {
-		defer p.OutBestGamma().Close()
-	}
-	defer p.OutBestAccuracy().Close()
-	defer p.OutBestEfficiency().Close()
-	defer p.OutBestObsFuzzClassAvg().Close()
-	defer p.OutBestObsFuzzOverall().Close()
-	defer p.OutBestObsFuzzActive().Close()
-	defer p.OutBestObsFuzzNonactive().Close()
-	defer p.OutBestClassConfidence().Close()
-	defer p.OutBestClassCredibility().Close()
-
-	for iip := range p.InCSVFile().Chan {
-		csvData := iip.Read()
-
-		bytesReader := bytes.NewReader(csvData)
-		csvReader := csv.NewReader(bytesReader)
-		csvReader.Comma = p.Separator
-
-		bestObsFuzzOverall := 1000000.000 // N.B: The best efficiency in Conformal Prediction is the *minimal* one. Initializing here with an unreasonably large number in order to spot when something is wrong.
-
-		var header []string
-
-		var bestCost int64 = -1
-		var bestGamma float64 = -1.0
-		var bestAccuracy float64 = -1.0
-		var bestEfficiency float64 = -1.0
-		var bestObsFuzzActive float64 = -1.0
-		var bestObsFuzzNonactive float64 = -1.0
-		var bestClassConfidence float64 = -1.0
-		var bestClassCredibility float64 = -1.0
-		var bestClassAvgObsFuzz float64 = -1.0
-
-		i := 0
-		for {
-			rec, err := csvReader.Read()
-			if err != nil {
-				break
-			}
-			i++
-			if i == 1 {
-				header = rec
-				if !p.Header {
-					continue
-				}
-			}
+	Space     *gridsearch.Space
+	Selection *gridsearch.Selection
+	Gene      string
+	Replicate string
+	Runset    string
+	// Group is the selection group (see gridsearch.Best), if any
+	Group string
+	// PathPrefix is prepended to the paths of the crossvalidate output,
+	// which end with .<grid point tag>[.round<number>].cvstats.json
+	PathPrefix string
+	CVFolds    int
+	FileName   string
+	// CrossValCmd returns the crossvalidate command for a grid point, with
+	// an empty properTrainPath if there is no proper training data
+	CrossValCmd func(trainPath string, properTrainPath string, gridArgs string, cvFolds int, statsPath string) string
+	// Store, WarmStart and SearchHash: With WarmStart, if Store has a best
+	// grid point selected on the same data (see gridsearch.DatasetHash), in
+	// a search with the same SearchHash (see gridsearch.SearchHash), its
+	// results are used, instead of a new grid search
+	Store           *gridsearch.Store
+	WarmStart       bool
+	SearchHash      string
+	withProperTrain bool
+}
+
+func NewAdaptiveGridSearch(wf *sp.Workflow, name string, space *gridsearch.Space, selection *gridsearch.Selection, withProperTrain bool) *AdaptiveGridSearch {
+	p := &AdaptiveGridSearch{
+		BaseProcess:     sp.NewBaseProcess(wf, name),
+		Space:           space,
+		Selection:       selection,
+		CVFolds:         10,
+		withProperTrain: withProperTrain,
+	}
+	p.InitInPort(p, "traindata")
+	if withProperTrain {
+		p.InitInPort(p, "propertraindata")
+	}
+	p.InitOutPort(p, "results")
+	wf.AddProc(p)
+	return p
+}
+
+func (p *AdaptiveGridSearch) InTrainData() *sp.InPort       { return p.InPort("traindata") }
+func (p *AdaptiveGridSearch) InProperTrainData() *sp.InPort { return p.InPort("propertraindata") }
+func (p *AdaptiveGridSearch) OutResults() *sp.OutPort       { return p.OutPort("results") }
+
+func (p *AdaptiveGridSearch) Run() {
+	defer p.OutResults().Close()
+
+	trainIP := <-p.InTrainData().Chan
+	var properTrainIP *sp.FileIP
+	properTrainPath := ""
+	if p.withProperTrain {
+		properTrainIP = <-p.InProperTrainData().Chan
+		properTrainPath = properTrainIP.Path()
+	}
 
-			obsFuzzOverall, err := strconv.ParseFloat(rec[indexOfStr("ObsFuzzOverall", header)], 64)
+	outIp := sp.NewFileIP(p.FileName)
+	if outIp.Exists() {
+		sp.Info.Printf("Process %s: Out-target %s already exists, so skipping\n", p.Name(), outIp.Path())
+		p.OutResults().Send(outIp)
+		return
+	}
+
+	if p.WarmStart {
+		dataPaths := []string{trainIP.Path()}
+		if properTrainPath != "" {
+			dataPaths = append(dataPaths, properTrainPath)
+		}
+		datasetHash, err := gridsearch.DatasetHash(dataPaths...)
+		sp.Check(err)
+		stored, err := p.Store.Get(p.Gene, p.Replicate, p.Runset, p.Group)
+		sp.Check(err)
+		switch {
+		case stored == nil:
+		case stored.DatasetHash != datasetHash:
+			sp.Info.Printf("Process %s: Stored best grid point %s was selected on other data, so doing a new grid search\n", p.Name(), stored.Point)
+		case stored.SearchHash != p.SearchHash:
+			sp.Info.Printf("Process %s: Stored best grid point %s was selected with another parameter space or selection settings, so doing a new grid search\n", p.Name(), stored.Point)
+		case len(stored.Results) > 0:
+			sp.Info.Printf("Process %s: Stored best grid point %s was selected on the same data, in the same search, so using it instead of a new grid search\n", p.Name(), stored.Point)
+			p.writeResults(p.FileName, stored.Results)
+			p.OutResults().Send(outIp)
+			return
+		}
+	}
+
+	halving := p.Space.Halving
+	if halving == nil {
+		halving = &gridsearch.Halving{}
+	}
+	candidates := p.Space.Points()
+	for i, round := range halving.Rounds {
+		roundTag := fmt.Sprintf(".round%d", i+1)
+		results := p.evaluate(candidates, round.Values, round.CVFolds, roundTag, trainIP, properTrainIP)
+		p.writeResults(str.TrimSuffix(p.FileName, ".tsv")+roundTag+".tsv", results)
+
+		keys := []string{}
+		for _, point := range candidates {
+			keys = append(keys, point.Key())
+		}
+		survivors, err := halving.Survivors(results, keys, p.Selection)
+		sp.Check(err)
+		sp.Info.Printf("Process %s: Kept %d of %d grid points after round %d: %s\n", p.Name(), len(survivors), len(keys), i+1, str.Join(survivors, "; "))
+		candidates = []gridsearch.Point{}
+		for _, key := range survivors {
+			point, err := p.Space.ParsePoint(key)
 			sp.Check(err)
+			candidates = append(candidates, point)
+		}
+	}
+	if halving.Refine {
+		refined := p.Space.Refine(candidates[0])
+		for _, point := range refined {
+			sp.Info.Printf("Process %s: Refining around %s with %s\n", p.Name(), candidates[0].Key(), point.Key())
+		}
+		candidates = append(candidates, refined...)
+	}
+	results := p.evaluate(candidates, nil, p.CVFolds, "", trainIP, properTrainIP)
+	p.writeResults(p.FileName, results)
+	p.OutResults().Send(outIp)
+}
 
-			if obsFuzzOverall < bestObsFuzzOverall { // Smaller is better
-				bestObsFuzzOverall = obsFuzzOverall
+// evaluate runs crossvalidate for the points, with the values in values
+// overriding those of the points, and returns the results. The proper
+// training data is nil if there is none.
+func (p *AdaptiveGridSearch) evaluate(points []gridsearch.Point, values map[string]string, cvFolds int, roundTag string, trainIP *sp.FileIP, properTrainIP *sp.FileIP) []*gridsearch.Result {
+	statsPaths := make([]string, len(points))
+	done := make(chan bool)
+	for i, point := range points {
+		statsPaths[i] = p.PathPrefix + "." + point.Tag() + roundTag + ".cvstats.json"
+		go func(point gridsearch.Point, statsPath string) {
+			p.crossValidate(point.With(values), cvFolds, statsPath, trainIP, properTrainIP)
+			done <- true
+		}(point, statsPaths[i])
+	}
+	for range points {
+		<-done
+	}
 
-				sp.Debug.Printf("Proc:%s Raw cost value: %s\n", p.Name(), rec[indexOfStr("Cost", header)])
-				bestCost, err = strconv.ParseInt(rec[indexOfStr("Cost", header)], 10, 0)
-				sp.Debug.Printf("Proc:%s Parsed cost value: %d\n", p.Name(), bestCost)
-				sp.CheckWithMsg(err, "Could not parse best cost value")
+	results := []*gridsearch.Result{}
+	for i, point := range points {
+		crossValOuts := &[]cpSignCrossValOutput{}
+		sp.NewFileIP(statsPaths[i]).UnMarshalJSON(crossValOuts)
+		results = append(results, crossValResults(*crossValOuts, p.Gene, p.Replicate, p.Runset, point.Key())...)
+	}
+	return results
+}
 
-				if p.IncludeGamma {
-					bestGamma, err = strconv.ParseFloat(rec[indexOfStr("Gamma", header)], 64)
-					sp.Check(err)
-				}
+// crossValidate runs crossvalidate for a grid point, unless its output
+// already exists. While running, it takes one of the slots for concurrent
+// tasks of the workflow, just like a task of an ordinary process, and then
+// writes the audit log of the output.
+func (p *AdaptiveGridSearch) crossValidate(point gridsearch.Point, cvFolds int, statsPath string, trainIP *sp.FileIP, properTrainIP *sp.FileIP) {
+	statsIP := sp.NewFileIP(statsPath)
+	if statsIP.Exists() {
+		sp.Info.Printf("Process %s: Crossvalidation output %s already exists, so not running it again\n", p.Name(), statsPath)
+		return
+	}
+	properTrainPath := ""
+	upstream := map[string]*sp.AuditInfo{trainIP.Path(): trainIP.AuditInfo()}
+	if properTrainIP != nil {
+		properTrainPath = properTrainIP.Path()
+		upstream[properTrainPath] = properTrainIP.AuditInfo()
+	}
+	cmd := p.CrossValCmd(trainIP.Path(), properTrainPath, point.Args(gridsearch.StageCrossValidate), cvFolds, statsIP.TempPath())
 
-				bestAccuracy, err = strconv.ParseFloat(rec[indexOfStr("Accuracy", header)], 64)
-				sp.Check(err)
+	p.Workflow().IncConcurrentTasks(1)
+	sp.Audit.Printf("Process %s: Executing: %s\n", p.Name(), cmd)
+	startTime := time.Now()
+	sp.ExecCmd(cmd)
+	execTime := time.Since(startTime)
+	p.Workflow().DecConcurrentTasks(1)
 
-				bestEfficiency, err = strconv.ParseFloat(rec[indexOfStr("Efficiency", header)], 64)
-				sp.Check(err)
+	auditInfo := sp.NewAuditInfo()
+	auditInfo.ProcessName = p.Name()
+	auditInfo.Command = cmd
+	auditInfo.Params = map[string]string{
+		"gene":      p.Gene,
+		"replicate": p.Replicate,
+		"runset":    p.Runset,
+		"gridpoint": point.Key(),
+		"cvfolds":   strconv.Itoa(cvFolds),
+	}
+	auditInfo.ExecTimeMS = execTime / time.Millisecond
+	auditInfo.Upstream = upstream
+	statsIP.SetAuditInfo(auditInfo)
+	statsIP.Atomize()
+	statsIP.WriteAuditLogToFile()
+}
 
-				bestObsFuzzActive, err := strconv.ParseFloat(rec[indexOfStr("ObsFuzzActive", header)], 64)
-				sp.Check(err)
+func (p *AdaptiveGridSearch) writeResults(path string, results []*gridsearch.Result) {
+	outIp := sp.NewFileIP(path)
+	ofh := outIp.OpenWriteTemp()
+	err := gridsearch.WriteResults(ofh, results)
+	ofh.Close()
+	sp.CheckWithMsg(err, "Could not write grid search results to "+path)
+	outIp.Atomize()
+}
 
-				bestObsFuzzNonactive, err := strconv.ParseFloat(rec[indexOfStr("ObsFuzzNonactive", header)], 64)
-				sp.Check(err)
+// ================================================================================
 
-				bestClassAvgObsFuzz = (bestObsFuzzActive + bestObsFuzzNonactive) / 2 // We take the average for the two classes, to get more equal influence of each class
+// GridSearchSelectBest is a SciPipe process that selects the best grid point
+// from the results of a grid search (see GridSearchCollect), as the valid one
+// with the minimal value of the objective of the selection (see
+// gridsearch.Selection). If no grid point is valid, the validity check is
+// dropped, with a warning. The selected grid point, with its parameters,
+// command line flags per stage, metrics, and the hash of the training data,
+// is put in the best parameter store (see gridsearch.Store), replacing any
+// earlier one, and the stored file is sent on the out-port. See
+// BestGridPointParams for passing it on to the downstream CPSign commands.
+type GridSearchSelectBest struct {
+	sp.BaseProcess
+	Space     *gridsearch.Space
+	Selection *gridsearch.Selection
+	Store     *gridsearch.Store
+	// Group is the selection group (see gridsearch.Best), if any
+	Group string
+	// SearchHash is stored with the best grid point, for warm starts (see
+	// AdaptiveGridSearch)
+	SearchHash      string
+	withProperTrain bool
+}
 
-				bestClassConfidence, err = strconv.ParseFloat(rec[indexOfStr("ClassConfidence", header)], 64)
-				sp.Check(err)
+func NewGridSearchSelectBest(wf *sp.Workflow, name string, space *gridsearch.Space, selection *gridsearch.Selection, store *gridsearch.Store, withProperTrain bool) *GridSearchSelectBest {
+	p := &GridSearchSelectBest{
+		BaseProcess:     sp.NewBaseProcess(wf, name),
+		Space:           space,
+		Selection:       selection,
+		Store:           store,
+		withProperTrain: withProperTrain,
+	}
+	p.InitInPort(p, "results")
+	p.InitInPort(p, "traindata")
+	if withProperTrain {
+		p.InitInPort(p, "propertraindata")
+	}
+	p.InitOutPort(p, "best")
+	wf.AddProc(p)
+	return p
+}
 
-				bestClassCredibility, err = strconv.ParseFloat(rec[indexOfStr("ClassCredibility", header)], 64)
-				sp.Check(err)
-			}
+func (p *GridSearchSelectBest) InResults() *sp.InPort         { return p.InPort("results") }
+func (p *GridSearchSelectBest) InTrainData() *sp.InPort       { return p.InPort("traindata") }
+func (p *GridSearchSelectBest) InProperTrainData() *sp.InPort { return p.InPort("propertraindata") }
+func (p *GridSearchSelectBest) OutBest() *sp.OutPort          { return p.OutPort("best") }
+
+func (p *GridSearchSelectBest) Run() {
+	defer p.OutBest().Close()
+
+	for iip := range p.InResults().Chan {
+		resultsFh := iip.Open()
+		results, err := gridsearch.ReadResults(resultsFh)
+		resultsFh.Close()
+		sp.CheckWithMsg(err, "Could not read grid search results from "+iip.Path())
+		if len(results) == 0 {
+			sp.Error.Fatalf("Process %s: No grid search results in %s\n", p.Name(), iip.Path())
 		}
-		sp.Debug.Printf("Final optimal (minimal) observed fuzziness (overall): %f (For: Cost:%03d)\n", bestObsFuzzOverall, bestCost)
-		if p.IncludeGamma {
-			sp.Debug.Printf("Final optimal (minimal) observed fuzziness (overall): %f (For: Cost:%03d, Gamma:%.3f)\n", bestObsFuzzOverall, bestCost, bestGamma)
+		dataPaths := []string{(<-p.InTrainData().Chan).Path()}
+		if p.withProperTrain {
+			dataPaths = append(dataPaths, (<-p.InProperTrainData().Chan).Path())
 		}
-		p.OutBestCost().Send(fmt.Sprintf("%d", bestCost))
-		if p.IncludeGamma {
-			p.OutBestGamma().Send(fmt.Sprintf("%.3f", bestGamma))
+		datasetHash, err := gridsearch.DatasetHash(dataPaths...)
+		sp.Check(err)
+
+		gene, replicate, runSet := results[0].Gene, results[0].Replicate, results[0].Runset
+		selection := p.Selection
+		bestKey, score, rejected, err := selection.Select(results)
+		if err != nil && len(rejected) > 0 {
+			sp.Warning.Printf("Process %s: No valid grid point for %s (%s, %s), so selecting among all of them: %v\n", p.Name(), gene, runSet, replicate, err)
+			unchecked := *selection
+			unchecked.ValidityTolerance = -1
+			selection = &unchecked
+			bestKey, score, _, err = selection.Select(results)
 		}
-		p.OutBestAccuracy().Send(fmt.Sprintf("%.3f", bestAccuracy))
-		p.OutBestEfficiency().Send(fmt.Sprintf("%.3f", bestEfficiency))
-		p.OutBestObsFuzzClassAvg().Send(fmt.Sprintf("%.3f", bestClassAvgObsFuzz))
-		p.OutBestObsFuzzOverall().Send(fmt.Sprintf("%.3f", bestObsFuzzOverall))
-		p.OutBestObsFuzzActive().Send(fmt.Sprintf("%.3f", bestObsFuzzActive))
-		p.OutBestObsFuzzNonactive().Send(fmt.Sprintf("%.3f", bestObsFuzzNonactive))
-		p.OutBestClassConfidence().Send(fmt.Sprintf("%.3f", bestClassConfidence))
-		p.OutBestClassCredibility().Send(fmt.Sprintf("%.3f", bestClassCredibility))
+		sp.Check(err)
+		bestPoint, err := p.Space.ForTarget(gene).ParsePoint(bestKey)
+		sp.Check(err)
+		_, metricsPerPoint := gridsearch.MetricsAt(results, selection.Confidence)
+		metrics := metricsPerPoint[bestKey]
+		sp.Debug.Printf("Proc:%s Final optimal (minimal) %s: %f (For: %s)\n", p.Name(), selection.Objective, score, bestKey)
+		curveMetrics, err := gridsearch.CurveMetrics(results, bestKey)
+		sp.Check(err)
+
+		best := gridsearch.NewBest(gene, replicate, runSet, bestPoint, selection, score, rejected, metrics, curveMetrics)
+		best.Group = p.Group
+		best.DatasetHash = datasetHash
+		best.SearchHash = p.SearchHash
+		best.Results = gridsearch.PointResults(results, bestKey)
+		sp.Check(p.Store.Put(best))
+		p.OutBest().Send(sp.NewFileIP(p.Store.Path(gene, replicate, runSet, p.Group)))
 	}
 }
 
 // ================================================================================
 
-type ParamPrinter struct {
+// BestGridPointParams is a SciPipe process that reads a best grid point, as
+// stored by GridSearchSelectBest, and sends the grid point key, the flags for
+// the precompute and train stages, the metrics, and the curve-level metrics
+// over all confidence levels (see OutCurveMetric) on param out-ports, for use
+// in the downstream CPSign commands, so that any set of hyperparameters
+// passes through the same ports.
+type BestGridPointParams struct {
 	sp.BaseProcess
-	procName           string
-	BestParamsFileName string
 }
 
-func NewParamPrinter(wf *sp.Workflow, procName string, fileName string) *ParamPrinter {
-	p := &ParamPrinter{
-		BaseProcess:        sp.NewBaseProcess(wf, procName),
-		procName:           procName,
-		BestParamsFileName: fileName,
+func NewBestGridPointParams(wf *sp.Workflow, name string) *BestGridPointParams {
+	p := &BestGridPointParams{
+		BaseProcess: sp.NewBaseProcess(wf, name),
+	}
+	p.InitInPort(p, "best")
+	for _, pname := range bestGridPointParamOuts {
+		p.InitParamOutPort(p, pname)
+	}
+	for _, name := range gridsearch.CurveMetricNames() {
+		p.InitParamOutPort(p, "curve_"+name)
 	}
-	p.InitOutPort(p, "best_param")
 	wf.AddProc(p)
 	return p
 }
 
-func (p *ParamPrinter) OutBestParamsFile() *sp.OutPort {
-	return p.OutPort("best_param")
+// bestGridPointParamOuts are the names of the param out-ports of
+// BestGridPointParams, except for the curve-level metrics
+var bestGridPointParamOuts = []string{
+	"grid_point",
+	"args_precompute",
+	"args_train",
+	"accuracy",
+	"efficiency",
+	"obsfuzz_classavg",
+	"obsfuzz_overall",
+	"obsfuzz_active",
+	"obsfuzz_nonactive",
+	"class_confidence",
+	"class_credibility",
 }
 
-func (p *ParamPrinter) GetNewParamInPort(portName string) *sp.ParamInPort {
-	if _, ok := p.ParamInPorts()[portName]; !ok {
-		p.InitParamInPort(p, portName)
-	}
-	return p.ParamInPort(portName)
+func (p *BestGridPointParams) InBest() *sp.InPort { return p.InPort("best") }
+func (p *BestGridPointParams) OutGridPoint() *sp.ParamOutPort {
+	return p.ParamOutPort("grid_point")
+}
+func (p *BestGridPointParams) OutArgsPrecompute() *sp.ParamOutPort {
+	return p.ParamOutPort("args_precompute")
+}
+func (p *BestGridPointParams) OutArgsTrain() *sp.ParamOutPort {
+	return p.ParamOutPort("args_train")
+}
+func (p *BestGridPointParams) OutAccuracy() *sp.ParamOutPort {
+	return p.ParamOutPort("accuracy")
+}
+func (p *BestGridPointParams) OutEfficiency() *sp.ParamOutPort {
+	return p.ParamOutPort("efficiency")
+}
+func (p *BestGridPointParams) OutObsFuzzClassAvg() *sp.ParamOutPort {
+	return p.ParamOutPort("obsfuzz_classavg")
+}
+func (p *BestGridPointParams) OutObsFuzzOverall() *sp.ParamOutPort {
+	return p.ParamOutPort("obsfuzz_overall")
+}
+func (p *BestGridPointParams) OutObsFuzzActive() *sp.ParamOutPort {
+	return p.ParamOutPort("obsfuzz_active")
+}
+func (p *BestGridPointParams) OutObsFuzzNonactive() *sp.ParamOutPort {
+	return p.ParamOutPort("obsfuzz_nonactive")
+}
+func (p *BestGridPointParams) OutClassConfidence() *sp.ParamOutPort {
+	return p.ParamOutPort("class_confidence")
+}
+func (p *BestGridPointParams) OutClassCredibility() *sp.ParamOutPort {
+	return p.ParamOutPort("class_credibility")
 }
 
-func (p *ParamPrinter) Run() {
-	defer p.OutBestParamsFile().Close()
-
-	oip := sp.NewFileIP(p.BestParamsFileName)
-	if !oip.Exists() && !oip.TempFileExists() {
-		rows := []map[string]string{}
-		for len(p.ParamInPorts()) > 0 {
-			row := map[string]string{}
-			for pname, pport := range p.ParamInPorts() {
-				param, ok := <-pport.Chan
-				if !ok {
-					p.DeleteParamInPort(pname) // This we should implement in the BaseProcess instead!
-					continue
-				}
-				row[pname] = param
-			}
-			rows = append(rows, row)
-		}
+// OutCurveMetric returns the param out-port for a curve-level metric (see
+// gridsearch.CurveMetricNames), which is NA if it could not be computed
+func (p *BestGridPointParams) OutCurveMetric(name string) *sp.ParamOutPort {
+	return p.ParamOutPort("curve_" + name)
+}
 
-		var outContent string
+func (p *BestGridPointParams) Run() {
+	for _, pname := range bestGridPointParamOuts {
+		defer p.ParamOutPort(pname).Close()
+	}
+	for _, name := range gridsearch.CurveMetricNames() {
+		defer p.OutCurveMetric(name).Close()
+	}
 
-		for _, row := range rows {
-			for name, val := range row {
-				outContent += fmt.Sprintf("%s=%s\n", name, val)
+	for iip := range p.InBest().Chan {
+		best, err := gridsearch.ReadBest(iip.Path())
+		sp.Check(err)
+		metrics := best.Metrics
+		p.OutGridPoint().Send(best.Point)
+		p.OutArgsPrecompute().Send(best.Args[gridsearch.StagePrecompute])
+		p.OutArgsTrain().Send(best.Args[gridsearch.StageTrain])
+		p.OutAccuracy().Send(fmt.Sprintf("%.3f", metrics[gridsearch.MetricAccuracy]))
+		p.OutEfficiency().Send(fmt.Sprintf("%.3f", metrics[gridsearch.MetricEfficiency]))
+		p.OutObsFuzzClassAvg().Send(fmt.Sprintf("%.3f", metrics[gridsearch.MetricObsFuzzClassAvg]))
+		p.OutObsFuzzOverall().Send(fmt.Sprintf("%.3f", metrics[gridsearch.MetricObsFuzzOverall]))
+		p.OutObsFuzzActive().Send(fmt.Sprintf("%.3f", metrics[gridsearch.MetricObsFuzzActive]))
+		p.OutObsFuzzNonactive().Send(fmt.Sprintf("%.3f", metrics[gridsearch.MetricObsFuzzNonactive]))
+		p.OutClassConfidence().Send(fmt.Sprintf("%.3f", metrics[gridsearch.MetricClassConfidence]))
+		p.OutClassCredibility().Send(fmt.Sprintf("%.3f", metrics[gridsearch.MetricClassCredibility]))
+		for _, name := range gridsearch.CurveMetricNames() {
+			if val, ok := best.CurveMetrics[name]; ok {
+				p.OutCurveMetric(name).Send(fmt.Sprintf("%.3f", val))
+			} else {
+				p.OutCurveMetric(name).Send("NA")
 			}
 		}
-		oip.Write([]byte(outContent))
-		oip.Atomize()
-	} else {
-		sp.Info.Printf("Target file (or temp file) exists for: %s, so skipping\n", oip.Path())
 	}
-
-	p.OutBestParamsFile().Send(oip)
 }
 
 // ================================================================================
@@ -339,16 +562,26 @@ type FinalModelSummarizer struct {
 	sp.BaseProcess
 	SummaryFileName string
 	Separator       rune
+	// SelectPer is the parameter that grid points are selected per (see
+	// gridsearch.Best), for matching the models with their nested
+	// crossvalidation (see NestedCVCollect)
+	SelectPer    string
+	withNestedCV bool
 }
 
-func NewFinalModelSummarizer(wf *sp.Workflow, procName string, fileName string, separator rune) *FinalModelSummarizer {
+func NewFinalModelSummarizer(wf *sp.Workflow, procName string, fileName string, separator rune, withNestedCV bool) *FinalModelSummarizer {
 	p := &FinalModelSummarizer{
 		BaseProcess:     sp.NewBaseProcess(wf, procName),
 		SummaryFileName: fileName,
 		Separator:       separator,
+		withNestedCV:    withNestedCV,
 	}
 	p.InitInPort(p, "model")
 	p.InitInPort(p, "target_data_count")
+	p.InitInPort(p, "species")
+	if withNestedCV {
+		p.InitInPort(p, "nested_cv")
+	}
 	p.InitOutPort(p, "summary")
 	// InModel:           sp.NewInPort(),
 	// InTargetDataCount: sp.NewInPort(),
@@ -359,18 +592,37 @@ func NewFinalModelSummarizer(wf *sp.Workflow, procName string, fileName string,
 
 func (p *FinalModelSummarizer) InModel() *sp.InPort           { return p.InPort("model") }
 func (p *FinalModelSummarizer) InTargetDataCount() *sp.InPort { return p.InPort("target_data_count") }
+func (p *FinalModelSummarizer) InSpecies() *sp.InPort         { return p.InPort("species") }
+func (p *FinalModelSummarizer) InNestedCV() *sp.InPort        { return p.InPort("nested_cv") }
 func (p *FinalModelSummarizer) OutSummary() *sp.OutPort       { return p.OutPort("summary") }
 
 func (p *FinalModelSummarizer) Run() {
 	defer p.OutSummary().Close()
 
+	// Species composition per gene, from the Species column of the TSV file
+	// written by TargetStatistics
+	speciesPerGene := map[string]string{}
+	for statsIP := range p.InSpecies().Chan {
+		statsFh := statsIP.Open()
+		statsReader := csv.NewReader(statsFh)
+		statsReader.Comma = '\t'
+		statsRows, err := statsReader.ReadAll()
+		statsFh.Close()
+		sp.CheckWithMsg(err, "Could not read target statistics file "+statsIP.Path())
+		speciesIdx := indexOfStr("Species", statsRows[0])
+		for _, row := range statsRows[1:] {
+			speciesPerGene[row[0]] = row[speciesIdx]
+		}
+	}
+
 	activeCounts := map[string]int64{}
 	nonActiveCounts := map[string]int64{}
+	assumedNegCounts := map[string]int64{}
 	totalCompounds := map[string]int64{}
 	for tdip := range p.InTargetDataCount().Chan {
 		gene := tdip.Param("gene")
 		runSet := tdip.Param("runset")
-		uniq := gene + "_" + runSet
+		uniq := gene + "_" + runSet + "_" + tdip.Param("replicate")
 
 		strs := str.Split(string(tdip.Read()), "\t")
 		activeStr := str.TrimSuffix(strs[0], "\n")
@@ -379,11 +631,31 @@ func (p *FinalModelSummarizer) Run() {
 		nonActiveStr := str.TrimSuffix(strs[1], "\n")
 		nonActiveCnt, err := strconv.ParseInt(nonActiveStr, 10, 64)
 		sp.CheckWithMsg(err, "Could not parse non-active count value")
+		// The number of assumed negatives added (included in the non-active
+		// count) is in the third column
+		assumedNegCnt := int64(0)
+		if len(strs) > 2 {
+			assumedNegStr := str.TrimSuffix(strs[2], "\n")
+			assumedNegCnt, err = strconv.ParseInt(assumedNegStr, 10, 64)
+			sp.CheckWithMsg(err, "Could not parse assumed negatives count value")
+		}
 		activeCounts[uniq] = activeCnt
 		nonActiveCounts[uniq] = nonActiveCnt
+		assumedNegCounts[uniq] = assumedNegCnt
 		totalCompounds[uniq] = activeCnt + nonActiveCnt
 	}
 
+	// The outer loop of the nested crossvalidation, per gene, runset,
+	// replicate and selection group
+	nestedCVs := map[string]*gridsearch.Nested{}
+	if p.withNestedCV {
+		for nip := range p.InNestedCV().Chan {
+			nested, err := gridsearch.ReadNested(nip.Path())
+			sp.Check(err)
+			nestedCVs[str.ToLower(nested.Gene)+"_"+nested.Runset+"_"+nested.Replicate+"_"+nested.Group] = nested
+		}
+	}
+
 	rows := [][]string{[]string{
 		"Gene",
 		"Replicate",
@@ -396,14 +668,28 @@ func (p *FinalModelSummarizer) Run() {
 		"ObsFuzzNonactive",
 		"ClassConfidence",
 		"ClassCredibility",
-		"Cost",
+		"GridPoint",
 		"ExecTimeMS",
 		"SizeBytes",
 		"ActiveCnt",
 		"NonactiveCnt",
-		"TotalCnt"}}
+		"AssumedNegCnt",
+		"TotalCnt",
+		"Species"}}
+	// The curve-level metrics over all confidence levels go after the other
+	// columns, to keep the column numbers of those
+	rows[0] = append(rows[0], gridsearch.CurveMetricNames()...)
+	rows[0] = append(rows[0], "Impl")
+	// The metrics of the outer loop of the nested crossvalidation, if any, go
+	// last, as Outer<metric>
+	if p.withNestedCV {
+		for _, name := range append(append([]string{}, gridSearchMetrics...), gridsearch.CurveMetricNames()...) {
+			rows[0] = append(rows[0], "Outer"+name)
+		}
+		rows[0] = append(rows[0], "OuterGridPoints")
+	}
 	for iip := range p.InModel().Chan {
-		uniq := iip.Param("gene") + "_" + iip.Param("runset")
+		uniq := iip.Param("gene") + "_" + iip.Param("runset") + "_" + iip.Param("replicate")
 		row := []string{
 			iip.Param("gene"),
 			iip.Param("replicate"),
@@ -416,12 +702,45 @@ func (p *FinalModelSummarizer) Run() {
 			iip.Param("obsfuzz_nonactive"),
 			iip.Param("class_confidence"),
 			iip.Param("class_credibility"),
-			iip.Param("cost"),
+			iip.Param("grid_point"),
 			fmt.Sprintf("%d", iip.AuditInfo().ExecTimeMS),
 			fmt.Sprintf("%d", iip.Size()),
 			fmt.Sprintf("%d", activeCounts[uniq]),
 			fmt.Sprintf("%d", nonActiveCounts[uniq]),
+			fmt.Sprintf("%d", assumedNegCounts[uniq]),
 			fmt.Sprintf("%d", totalCompounds[uniq]),
+			speciesPerGene[iip.Param("gene")],
+		}
+		for _, name := range gridsearch.CurveMetricNames() {
+			row = append(row, iip.Param("curve_"+name))
+		}
+		row = append(row, gridsearch.KeyParams(iip.Param("grid_point"))["impl"])
+		if p.withNestedCV {
+			group := gridsearch.KeyParams(iip.Param("grid_point"))[p.SelectPer]
+			nested, ok := nestedCVs[str.ToLower(iip.Param("gene"))+"_"+iip.Param("runset")+"_"+iip.Param("replicate")+"_"+group]
+			if !ok {
+				sp.Warning.Printf("Process %s: No nested crossvalidation for %s (%s, %s)\n", p.Name(), iip.Param("gene"), iip.Param("runset"), iip.Param("replicate"))
+				nested = &gridsearch.Nested{}
+			}
+			for _, name := range gridSearchMetrics {
+				if val, found := nested.Metrics[name]; found {
+					row = append(row, fmt.Sprintf("%.3f", val))
+				} else {
+					row = append(row, "NA")
+				}
+			}
+			for _, name := range gridsearch.CurveMetricNames() {
+				if val, found := nested.CurveMetrics[name]; found {
+					row = append(row, fmt.Sprintf("%.3f", val))
+				} else {
+					row = append(row, "NA")
+				}
+			}
+			if ok {
+				row = append(row, str.Join(nested.Points, ";"))
+			} else {
+				row = append(row, "NA")
+			}
 		}
 		rows = append(rows, row)
 	}
@@ -465,3 +784,1354 @@ func NewEmbedAuditLogInJar(wf *sp.Workflow, procName string) *EmbedAuditLogInJar
 	}
 	return p
 }
+
+// ================================================================================
+
+// ExtractExcapeDBColumns is a SciPipe process that streams through an
+// ExCAPE-DB file (plain TSV or .xz compressed), validates its header, and
+// writes the given columns (selected by name, not position) into a TSV file
+// without header, sorted with the given flags to the unix sort command.
+type ExtractExcapeDBColumns struct {
+	*sp.Process
+	Columns   []string
+	SortFlags string
+	// SpeciesFilter, if set, restricts the extracted records to a set of
+	// species, and/or replaces the gene symbol of each record with the one of
+	// its ortholog group
+	SpeciesFilter *excapedb.SpeciesFilter
+}
+
+func (p *ExtractExcapeDBColumns) InExcapeDB() *sp.InPort { return p.In("excapedb") }
+func (p *ExtractExcapeDBColumns) OutTSV() *sp.OutPort    { return p.Out("tsv") }
+
+func NewExtractExcapeDBColumns(wf *sp.Workflow, procName string, columns []string, sortFlags string, speciesFilter *excapedb.SpeciesFilter) *ExtractExcapeDBColumns {
+	cmd := "# ExtractExcapeDBColumns custom process. Ports: {i:excapedb} {o:tsv} Columns: " + str.Join(columns, ",") + " Sorting: " + sortFlags
+	if speciesFilter != nil {
+		cmd += " Species: " + speciesFilter.String()
+	}
+	p := &ExtractExcapeDBColumns{
+		Process:       wf.NewProc(procName, cmd),
+		Columns:       columns,
+		SortFlags:     sortFlags,
+		SpeciesFilter: speciesFilter,
+	}
+	p.CustomExecute = func(t *sp.Task) {
+		var orthologMap *excapedb.OrthologMap
+		if p.SpeciesFilter != nil && p.SpeciesFilter.ByOrthologGroup {
+			orthologMap = p.readOrthologMap(t.InPath("excapedb"))
+		}
+
+		excapeFile, err := excapedb.Open(t.InPath("excapedb"))
+		sp.CheckWithMsg(err, "Could not open ExCAPE-DB file")
+		defer excapeFile.Close()
+
+		unsortedPath := t.OutIP("tsv").TempPath() + ".unsorted"
+		unsortedFh, err := os.Create(unsortedPath)
+		sp.CheckWithMsg(err, "Could not create file "+unsortedPath)
+		bufWriter := bufio.NewWriter(unsortedFh)
+		vals := make([]string, len(p.Columns))
+		for {
+			rec, err := excapeFile.Read()
+			if err == io.EOF {
+				break
+			}
+			sp.CheckWithMsg(err, "Could not read ExCAPE-DB record")
+			if p.SpeciesFilter != nil && !p.SpeciesFilter.Accept(rec) {
+				continue
+			}
+			for i, col := range p.Columns {
+				if col == excapedb.ColGeneSymbol && orthologMap != nil {
+					vals[i] = orthologMap.Gene(rec)
+					continue
+				}
+				vals[i] = rec.Value(col)
+			}
+			bufWriter.WriteString(str.Join(vals, "\t") + "\n")
+		}
+		sp.Check(bufWriter.Flush())
+		unsortedFh.Close()
+
+		sp.ExecCmd(fmt.Sprintf("sort %s %s > %s && rm %s", p.SortFlags, unsortedPath, t.OutIP("tsv").TempPath(), unsortedPath))
+	}
+	return p
+}
+
+// readOrthologMap reads the ortholog groups of all records of the accepted
+// species in the ExCAPE-DB file at path, in a separate pass before the
+// extraction, since the gene symbol of a group is only known after all its
+// members are seen
+func (p *ExtractExcapeDBColumns) readOrthologMap(path string) *excapedb.OrthologMap {
+	excapeFile, err := excapedb.Open(path)
+	sp.CheckWithMsg(err, "Could not open ExCAPE-DB file")
+	defer excapeFile.Close()
+	orthologMap := excapedb.NewOrthologMap()
+	for {
+		rec, err := excapeFile.Read()
+		if err == io.EOF {
+			break
+		}
+		sp.CheckWithMsg(err, "Could not read ExCAPE-DB record")
+		if p.SpeciesFilter.Accept(rec) {
+			orthologMap.Add(rec)
+		}
+	}
+	return orthologMap
+}
+
+// ================================================================================
+
+// RemoveConflicting is a SciPipe process that resolves compounds with
+// disagreeing activity flags for the same target, according to a selectable
+// excapedb.ConflictPolicy. The input is a TSV file with the columns gene, id,
+// smiles, activity, pxc50, assay id, inchikey, tax id and source db, sorted on
+// gene and smiles. It outputs a gene, id, smiles, activity (GISA) file with one row per
+// gene and smiles, and a report with every removed or relabelled pair, and
+// the reason for it.
+type RemoveConflicting struct {
+	*sp.Process
+}
+
+func (p *RemoveConflicting) InMeasurements() *sp.InPort { return p.In("measurements") }
+func (p *RemoveConflicting) OutGISA() *sp.OutPort       { return p.Out("gisa") }
+func (p *RemoveConflicting) OutReport() *sp.OutPort     { return p.Out("report") }
+
+func NewRemoveConflicting(wf *sp.Workflow, procName string, policy excapedb.ConflictPolicy) *RemoveConflicting {
+	p := &RemoveConflicting{wf.NewProc(procName, "# RemoveConflicting custom process. Ports: {i:measurements} {o:gisa} {o:report} Policy: {p:policy}")}
+	p.ParamInPort("policy").ConnectStr(string(policy))
+	p.CustomExecute = func(t *sp.Task) {
+		policy, err := excapedb.ParseConflictPolicy(t.Param("policy"))
+		sp.Check(err)
+		resolver := excapedb.NewConflictResolver(policy)
+
+		inFh := t.InIP("measurements").Open()
+		defer inFh.Close()
+		gisaFh := t.OutIP("gisa").OpenWriteTemp()
+		defer gisaFh.Close()
+		reportFh := t.OutIP("report").OpenWriteTemp()
+		defer reportFh.Close()
+
+		gisaWriter := bufio.NewWriter(gisaFh)
+		reportWriter := csv.NewWriter(reportFh)
+		reportWriter.Comma = '\t'
+		reportWriter.Write([]string{"Gene", "SMILES", "Action", "KeptLabel", "KeptID", "ActiveCnt", "NonactiveCnt", "ActiveAssayCnt", "NonactiveAssayCnt", "MedianPXC50", "Reason"})
+
+		removedCnt := 0
+		relabelledCnt := 0
+		writeGroup := func(group []*excapedb.Measurement) {
+			res := resolver.Resolve(group)
+			if res.Kept != nil {
+				gisaWriter.WriteString(res.Kept.Gene + "\t" + res.Kept.ID + "\t" + res.Kept.SMILES + "\t" + res.Kept.Label + "\n")
+			}
+			if res.Action == "" {
+				return
+			}
+			keptLabel, keptID := "", ""
+			if res.Kept != nil {
+				keptLabel, keptID = res.Kept.Label, res.Kept.ID
+				relabelledCnt++
+			} else {
+				removedCnt++
+			}
+			medianPXC50 := ""
+			if !math.IsNaN(res.MedianPXC50) {
+				medianPXC50 = fmt.Sprintf("%.2f", res.MedianPXC50)
+			}
+			reportWriter.Write([]string{
+				group[0].Gene,
+				group[0].SMILES,
+				res.Action,
+				keptLabel,
+				keptID,
+				fmt.Sprintf("%d", res.ActiveCnt),
+				fmt.Sprintf("%d", res.NonactiveCnt),
+				fmt.Sprintf("%d", res.ActiveAssayCnt),
+				fmt.Sprintf("%d", res.NonactiveAssayCnt),
+				medianPXC50,
+				res.Reason,
+			})
+		}
+
+		group := []*excapedb.Measurement{}
+		lineScanner := bufio.NewScanner(inFh)
+		lineScanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+		for lineScanner.Scan() {
+			m := parseMeasurement(lineScanner.Text())
+			if len(group) > 0 && (m.Gene != group[0].Gene || m.SMILES != group[0].SMILES) {
+				writeGroup(group)
+				group = []*excapedb.Measurement{}
+			}
+			group = append(group, m)
+		}
+		sp.CheckWithMsg(lineScanner.Err(), "Could not read measurements file "+t.InPath("measurements"))
+		if len(group) > 0 {
+			writeGroup(group)
+		}
+		sp.Check(gisaWriter.Flush())
+		reportWriter.Flush()
+		sp.Audit.Printf("Process %s: Removed %d and relabelled %d conflicting compound/target pairs (policy: %s)\n", p.Name(), removedCnt, relabelledCnt, policy)
+	}
+	return p
+}
+
+// parseMeasurement parses a line with the tab-separated columns gene, id,
+// smiles, activity, pxc50, assay id, inchikey, tax id and source db
+func parseMeasurement(line string) *excapedb.Measurement {
+	fields := str.Split(line, "\t")
+	if len(fields) != 9 {
+		sp.Error.Fatalf("Expected 9 fields (gene, id, smiles, activity, pxc50, assay id, inchikey, tax id, db), but got %d in line: %s\n", len(fields), line)
+	}
+	pxc50 := math.NaN()
+	if fields[4] != "" {
+		var err error
+		pxc50, err = strconv.ParseFloat(fields[4], 64)
+		sp.CheckWithMsg(err, "Could not parse pXC50 value: "+fields[4])
+	}
+	return &excapedb.Measurement{
+		Gene:     fields[0],
+		ID:       fields[1],
+		SMILES:   fields[2],
+		Label:    fields[3],
+		PXC50:    pxc50,
+		AssayID:  fields[5],
+		InchiKey: fields[6],
+		TaxID:    fields[7],
+		DB:       fields[8],
+	}
+}
+
+// ================================================================================
+
+// LabelOnPXC50 is a SciPipe process that derives the activity labels of
+// measurements (gene, id, smiles, activity, pxc50, assay id, inchikey, tax
+// id, db) from their pXC50 values, according to global or per-target thresholds
+// (see excapedb.ParseLabeller), dropping the measurements in the grey zone
+// between the thresholds. It also outputs a per-target report of the label
+// counts, including how many measurements fell into the grey zone.
+type LabelOnPXC50 struct {
+	*sp.Process
+}
+
+func (p *LabelOnPXC50) InMeasurements() *sp.InPort   { return p.In("measurements") }
+func (p *LabelOnPXC50) OutMeasurements() *sp.OutPort { return p.Out("labelled") }
+func (p *LabelOnPXC50) OutReport() *sp.OutPort       { return p.Out("report") }
+
+func NewLabelOnPXC50(wf *sp.Workflow, procName string, labeller *excapedb.Labeller) *LabelOnPXC50 {
+	p := &LabelOnPXC50{wf.NewProc(procName, "# LabelOnPXC50 custom process. Ports: {i:measurements} {o:labelled} {o:report} Thresholds: {p:thresholds}")}
+	p.ParamInPort("thresholds").ConnectStr(labeller.String())
+	p.CustomExecute = func(t *sp.Task) {
+		labeller, err := excapedb.ParseLabeller(t.Param("thresholds"))
+		sp.Check(err)
+
+		inFh := t.InIP("measurements").Open()
+		defer inFh.Close()
+		outFh := t.OutIP("labelled").OpenWriteTemp()
+		defer outFh.Close()
+		outWriter := bufio.NewWriter(outFh)
+
+		genes := []string{}
+		counts := map[string]map[string]int{}
+		lineScanner := bufio.NewScanner(inFh)
+		lineScanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+		for lineScanner.Scan() {
+			m := parseMeasurement(lineScanner.Text())
+			if _, ok := counts[m.Gene]; !ok {
+				genes = append(genes, m.Gene)
+				counts[m.Gene] = map[string]int{}
+			}
+			label := labeller.Label(m.Gene, m.PXC50, m.Label)
+			if math.IsNaN(m.PXC50) {
+				counts[m.Gene]["no_pxc50"]++
+			}
+			if label == "" {
+				counts[m.Gene]["greyzone"]++
+				continue
+			}
+			if label != m.Label {
+				counts[m.Gene]["relabelled"]++
+			}
+			counts[m.Gene][label]++
+			m.Label = label
+			outWriter.WriteString(formatMeasurement(m) + "\n")
+		}
+		sp.CheckWithMsg(lineScanner.Err(), "Could not read measurements file "+t.InPath("measurements"))
+		sp.Check(outWriter.Flush())
+
+		reportFh := t.OutIP("report").OpenWriteTemp()
+		defer reportFh.Close()
+		reportWriter := csv.NewWriter(reportFh)
+		reportWriter.Comma = '\t'
+		reportWriter.Write([]string{"Gene", "Thresholds", "ActiveCnt", "NonactiveCnt", "GreyZoneCnt", "NoPXC50Cnt", "RelabelledCnt"})
+		greyZoneTotal := 0
+		for _, gene := range genes {
+			thresholds := "excapedb_flag"
+			if lt, ok := labeller.Thresholds(gene); ok {
+				thresholds = lt.String()
+			}
+			reportWriter.Write([]string{
+				gene,
+				thresholds,
+				fmt.Sprintf("%d", counts[gene][excapedb.Active]),
+				fmt.Sprintf("%d", counts[gene][excapedb.Nonactive]),
+				fmt.Sprintf("%d", counts[gene]["greyzone"]),
+				fmt.Sprintf("%d", counts[gene]["no_pxc50"]),
+				fmt.Sprintf("%d", counts[gene]["relabelled"]),
+			})
+			greyZoneTotal += counts[gene]["greyzone"]
+		}
+		reportWriter.Flush()
+		sp.Audit.Printf("Process %s: Dropped %d measurements in the pXC50 grey zone (thresholds: %s)\n", p.Name(), greyZoneTotal, labeller)
+	}
+	return p
+}
+
+// formatMeasurement formats a measurement as a line with the tab-separated
+// columns gene, id, smiles, activity, pxc50, assay id, inchikey, tax id and
+// source db (without newline)
+func formatMeasurement(m *excapedb.Measurement) string {
+	pxc50 := ""
+	if !math.IsNaN(m.PXC50) {
+		pxc50 = strconv.FormatFloat(m.PXC50, 'f', -1, 64)
+	}
+	return str.Join([]string{m.Gene, m.ID, m.SMILES, m.Label, pxc50, m.AssayID, m.InchiKey, m.TaxID, m.DB}, "\t")
+}
+
+// ================================================================================
+
+// AggregateConsensus is a SciPipe process that aggregates repeated
+// measurements (gene, id, smiles, activity, pxc50, assay id, inchikey, tax
+// id, db, sorted on gene) of the same compound (InChIKey) on the same target into
+// one consensus record, with a label derived from the median pXC50 (see
+// excapedb.ConsensusAggregator). The output is a GISA file with the extra
+// columns measurement count, pXC50 spread, consensus pXC50, assay count and a
+// high variance flag (1 or 0), which is also set for compounds with activity
+// flags that disagree with their pXC50 values.
+type AggregateConsensus struct {
+	*sp.Process
+}
+
+func (p *AggregateConsensus) InMeasurements() *sp.InPort { return p.In("measurements") }
+func (p *AggregateConsensus) OutGISA() *sp.OutPort       { return p.Out("gisa") }
+
+func NewAggregateConsensus(wf *sp.Workflow, procName string, labeller *excapedb.Labeller, maxSpread float64) *AggregateConsensus {
+	p := &AggregateConsensus{wf.NewProc(procName, "# AggregateConsensus custom process. Ports: {i:measurements} {o:gisa} Thresholds: {p:thresholds} Max pXC50 spread: {p:maxspread}")}
+	p.ParamInPort("thresholds").ConnectStr(labeller.String())
+	p.ParamInPort("maxspread").ConnectStr(strconv.FormatFloat(maxSpread, 'f', -1, 64))
+	p.CustomExecute = func(t *sp.Task) {
+		labeller, err := excapedb.ParseLabeller(t.Param("thresholds"))
+		sp.Check(err)
+		aggregator := excapedb.NewConsensusAggregator(labeller)
+		aggregator.MaxSpread, err = strconv.ParseFloat(t.Param("maxspread"), 64)
+		sp.Check(err)
+
+		inFh := t.InIP("measurements").Open()
+		defer inFh.Close()
+		outFh := t.OutIP("gisa").OpenWriteTemp()
+		defer outFh.Close()
+		outWriter := bufio.NewWriter(outFh)
+
+		formatNaN := func(f float64) string {
+			if math.IsNaN(f) {
+				return ""
+			}
+			return fmt.Sprintf("%.2f", f)
+		}
+		droppedCnt := 0
+		highVarCnt := 0
+		conflictingCnt := 0
+		// Measurements are sorted on gene, so we collect one gene at a time
+		flushGene := func(groups map[string][]*excapedb.Measurement) {
+			consensi := []*excapedb.Consensus{}
+			for _, group := range groups {
+				cons := aggregator.Aggregate(group)
+				if cons.Label == "" {
+					sp.Debug.Printf("Process %s: Dropping %s for %s: %s\n", p.Name(), cons.Representative.InchiKey, cons.Representative.Gene, cons.Reason)
+					droppedCnt++
+					continue
+				}
+				consensi = append(consensi, cons)
+			}
+			sort.Slice(consensi, func(i, j int) bool {
+				return consensi[i].Representative.SMILES < consensi[j].Representative.SMILES
+			})
+			for _, cons := range consensi {
+				highVar := "0"
+				if cons.HighVariance || cons.Conflicting {
+					highVar = "1"
+				}
+				if cons.HighVariance {
+					highVarCnt++
+				}
+				if cons.Conflicting {
+					conflictingCnt++
+				}
+				rep := cons.Representative
+				outWriter.WriteString(str.Join([]string{
+					rep.Gene,
+					rep.ID,
+					rep.SMILES,
+					cons.Label,
+					fmt.Sprintf("%d", cons.MeasurementCnt),
+					formatNaN(cons.Spread),
+					formatNaN(cons.PXC50),
+					fmt.Sprintf("%d", cons.AssayCnt),
+					highVar,
+				}, "\t") + "\n")
+			}
+		}
+
+		currentGene := ""
+		groups := map[string][]*excapedb.Measurement{}
+		lineScanner := bufio.NewScanner(inFh)
+		lineScanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+		for lineScanner.Scan() {
+			m := parseMeasurement(lineScanner.Text())
+			if m.Gene != currentGene {
+				flushGene(groups)
+				groups = map[string][]*excapedb.Measurement{}
+				currentGene = m.Gene
+			}
+			groups[m.InchiKey] = append(groups[m.InchiKey], m)
+		}
+		sp.CheckWithMsg(lineScanner.Err(), "Could not read measurements file "+t.InPath("measurements"))
+		flushGene(groups)
+		sp.Check(outWriter.Flush())
+		sp.Audit.Printf("Process %s: Dropped %d compound/target pairs without consensus label, and flagged %d as having high pXC50 variance (spread > %s) and %d as having activity flags conflicting with their pXC50 values\n", p.Name(), droppedCnt, highVarCnt, t.Param("maxspread"), conflictingCnt)
+	}
+	return p
+}
+
+// ================================================================================
+
+// DrugBankXMLToTSV is a SciPipe process that converts the full DrugBank XML
+// database into a TSV table with one row per drug, with the columns in
+// drugbank.TSVHeader
+type DrugBankXMLToTSV struct {
+	*sp.Process
+}
+
+func (p *DrugBankXMLToTSV) InXML() *sp.InPort   { return p.In("xml") }
+func (p *DrugBankXMLToTSV) OutTSV() *sp.OutPort { return p.Out("tsv") }
+
+func NewDrugBankXMLToTSV(wf *sp.Workflow, procName string) *DrugBankXMLToTSV {
+	p := &DrugBankXMLToTSV{wf.NewProc(procName, "# DrugBankXMLToTSV custom process. Ports: {i:xml} {o:tsv}")}
+	p.CustomExecute = func(t *sp.Task) {
+		xmlFh := t.InIP("xml").Open()
+		defer xmlFh.Close()
+		tsvFh := t.OutIP("tsv").OpenWriteTemp()
+		defer tsvFh.Close()
+		sp.CheckWithMsg(drugbank.WriteTSV(xmlFh, tsvFh), "Could not convert DrugBank XML file "+t.InPath("xml"))
+	}
+	return p
+}
+
+// ================================================================================
+
+// SelectDrugBankCompIDs is a SciPipe process that selects the small molecule
+// drugs that belong to all of the include groups, and none of the exclude
+// groups, from a DrugBank TSV table (see DrugBankXMLToTSV), and writes their
+// PubChem compound and ChEMBL IDs as comma-separated lines
+type SelectDrugBankCompIDs struct {
+	*sp.Process
+}
+
+func (p *SelectDrugBankCompIDs) InDrugBankTSV() *sp.InPort { return p.In("drugbank_tsv") }
+func (p *SelectDrugBankCompIDs) OutCompIDs() *sp.OutPort   { return p.Out("compids") }
+
+func NewSelectDrugBankCompIDs(wf *sp.Workflow, procName string, includeGroups []string, excludeGroups []string) *SelectDrugBankCompIDs {
+	p := &SelectDrugBankCompIDs{wf.NewProc(procName, "# SelectDrugBankCompIDs custom process. Ports: {i:drugbank_tsv} {o:compids} Include groups: {p:include} Exclude groups: {p:exclude}")}
+	p.ParamInPort("include").ConnectStr(str.Join(includeGroups, ","))
+	p.ParamInPort("exclude").ConnectStr(str.Join(excludeGroups, ","))
+	p.CustomExecute = func(t *sp.Task) {
+		tsvFh := t.InIP("drugbank_tsv").Open()
+		entries, err := drugbank.ReadTSV(tsvFh)
+		tsvFh.Close()
+		sp.CheckWithMsg(err, "Could not read DrugBank TSV file "+t.InPath("drugbank_tsv"))
+
+		lines := []string{}
+	EntryLoop:
+		for _, e := range entries {
+			if e.Type != drugbank.TypeSmallMolecule || (e.PubChemCID == "" && e.ChEMBLID == "") {
+				continue
+			}
+			for _, g := range str.Split(t.Param("include"), ",") {
+				if g != "" && !e.HasGroup(g) {
+					continue EntryLoop
+				}
+			}
+			for _, g := range str.Split(t.Param("exclude"), ",") {
+				if g != "" && e.HasGroup(g) {
+					continue EntryLoop
+				}
+			}
+			lines = append(lines, e.PubChemCID+","+e.ChEMBLID+"\n")
+		}
+		sort.Strings(lines)
+		t.OutIP("compids").Write([]byte(str.Join(lines, "")))
+	}
+	return p
+}
+
+// ================================================================================
+
+// ResolveDataSource is a SciPipe process that provides the file of a data
+// source from a datasrc.Registry, either by downloading it from its URL, or by
+// linking to its local mirror (in offline mode). The file is always verified
+// against the pinned SHA-256 checksum (also when it already exists), and the
+// workflow fails on mismatch, or if the source is not pinned, unless the
+// registry allows unpinned sources. The version and checksum are added as
+// keys to the audit info of the file, so that they are part of the audit
+// trail of all downstream files.
+type ResolveDataSource struct {
+	sp.BaseProcess
+	Registry *datasrc.Registry
+	Source   *datasrc.Source
+	Path     string
+}
+
+func NewResolveDataSource(wf *sp.Workflow, procName string, registry *datasrc.Registry, sourceName string, path string) *ResolveDataSource {
+	src, err := registry.Source(sourceName)
+	sp.Check(err)
+	p := &ResolveDataSource{
+		BaseProcess: sp.NewBaseProcess(wf, procName),
+		Registry:    registry,
+		Source:      src,
+		Path:        path,
+	}
+	p.InitOutPort(p, "file")
+	wf.AddProc(p)
+	return p
+}
+
+func (p *ResolveDataSource) OutFile() *sp.OutPort { return p.OutPort("file") }
+
+func (p *ResolveDataSource) Run() {
+	defer p.OutFile().Close()
+
+	oip := sp.NewFileIP(p.Path)
+	verifyPath := oip.Path()
+	if oip.Exists() {
+		sp.Info.Printf("Process %s: Target %s already exists, so only verifying it\n", p.Name(), oip.Path())
+	} else {
+		sp.ExecCmd("mkdir -p " + filepath.Dir(oip.TempPath()))
+		if p.Registry.Fetchable(p.Source) {
+			authPart := ""
+			if p.Source.AuthFile != "" {
+				authPart = "-u $(cat " + p.Source.AuthFile + ") "
+			}
+			sp.Audit.Printf("Process %s: Downloading %s (version %s) from %s\n", p.Name(), p.Source.Name, p.Source.Version, p.Source.URL)
+			sp.ExecCmd("curl -Lfv -o " + oip.TempPath() + " " + authPart + p.Source.URL)
+		} else {
+			mirrorPath, err := filepath.Abs(p.Source.MirrorPath)
+			sp.Check(err)
+			if _, err := os.Stat(mirrorPath); err != nil {
+				sp.Error.Fatalf("Process %s: Local mirror of %s (version %s) not found at %s: %v\n", p.Name(), p.Source.Name, p.Source.Version, mirrorPath, err)
+			}
+			sp.Audit.Printf("Process %s: Using local mirror of %s (version %s) at %s\n", p.Name(), p.Source.Name, p.Source.Version, mirrorPath)
+			sp.ExecCmd("ln -s " + mirrorPath + " " + oip.TempPath())
+		}
+		verifyPath = oip.TempPath()
+	}
+
+	sum, err := p.Registry.Verify(p.Source, verifyPath)
+	if err != nil {
+		sp.Error.Fatalf("Process %s: %v (or run with -allowunpinned to use it unverified)\n", p.Name(), err)
+	}
+	if !p.Source.Pinned() {
+		sp.Warning.Printf("Process %s: Using source %s unverified, as it is not pinned to a checksum. Add \"sha256\": \"%s\" to the registry to pin it.\n", p.Name(), p.Source.Name, sum)
+	}
+	if verifyPath != oip.Path() {
+		oip.Atomize()
+	}
+
+	oip.AddKey("datasrc_"+p.Source.Name+"_version", p.Source.Version)
+	oip.AddKey("datasrc_"+p.Source.Name+"_sha256", sum)
+	oip.WriteAuditLogToFile()
+	p.OutFile().Send(oip)
+}
+
+// ================================================================================
+
+// ImportToStore is a SciPipe process that imports the deduplicated gene, id,
+// smiles, activity (GISA) data, and the list of DrugBank compound IDs to
+// exclude, into an SQLite database (see the excapestore package), so that the
+// per-target data can be queried from it. The rows of the DrugBank compounds
+// are moved to a table of their own (see
+// excapestore.Store.RemoveDrugBankExcluded), and the distinct SMILES of the
+// rest are collected once, for the assumed-negative pools.
+type ImportToStore struct {
+	*sp.Process
+}
+
+func (p *ImportToStore) InGISA() *sp.InPort               { return p.In("gisa") }
+func (p *ImportToStore) InDrugBankExclusions() *sp.InPort { return p.In("drugbank_exclusions") }
+func (p *ImportToStore) OutDB() *sp.OutPort               { return p.Out("db") }
+
+func NewImportToStore(wf *sp.Workflow, procName string) *ImportToStore {
+	p := &ImportToStore{wf.NewProc(procName, "# ImportToStore custom process. Ports: {i:gisa} {i:drugbank_exclusions} {o:db}")}
+	p.CustomExecute = func(t *sp.Task) {
+		dbPath := t.OutIP("db").TempPath()
+		sp.ExecCmd("mkdir -p " + filepath.Dir(dbPath))
+		store, err := excapestore.Create(dbPath)
+		sp.CheckWithMsg(err, "Could not create database "+dbPath)
+		defer store.Close()
+
+		gisaFh := t.InIP("gisa").Open()
+		cnt, err := store.ImportGISA(gisaFh)
+		gisaFh.Close()
+		sp.CheckWithMsg(err, "Could not import "+t.InPath("gisa"))
+		sp.Audit.Printf("Process %s: Imported %d rows into table gisa\n", p.Name(), cnt)
+
+		exclFh := t.InIP("drugbank_exclusions").Open()
+		cnt, err = store.ImportDrugBankExclusions(exclFh)
+		exclFh.Close()
+		sp.CheckWithMsg(err, "Could not import "+t.InPath("drugbank_exclusions"))
+		sp.Audit.Printf("Process %s: Imported %d DrugBank exclusions\n", p.Name(), cnt)
+
+		cnt, err = store.RemoveDrugBankExcluded()
+		sp.CheckWithMsg(err, "Could not remove DrugBank compounds in "+dbPath)
+		sp.Audit.Printf("Process %s: Moved %d rows of DrugBank compounds into table drugbank_removed\n", p.Name(), cnt)
+
+		cnt, err = store.FillSMILES()
+		sp.CheckWithMsg(err, "Could not fill the smiles table in "+dbPath)
+		sp.Audit.Printf("Process %s: Filled table smiles with %d distinct SMILES\n", p.Name(), cnt)
+
+		sp.CheckWithMsg(store.CreateIndices(), "Could not create indices in "+dbPath)
+	}
+	return p
+}
+
+// ================================================================================
+
+// ExportStoreTable is a SciPipe process that writes a table of GISA rows
+// (gisa or drugbank_removed) in a database created by ImportToStore, to a
+// file (see excapestore.Store.WriteGISA)
+type ExportStoreTable struct {
+	*sp.Process
+}
+
+func (p *ExportStoreTable) InDB() *sp.InPort    { return p.In("db") }
+func (p *ExportStoreTable) OutTSV() *sp.OutPort { return p.Out("tsv") }
+
+func NewExportStoreTable(wf *sp.Workflow, procName string, table string) *ExportStoreTable {
+	p := &ExportStoreTable{wf.NewProc(procName, "# ExportStoreTable custom process. Ports: {i:db} {o:tsv} Table: {p:table}")}
+	p.ParamInPort("table").ConnectStr(table)
+	p.CustomExecute = func(t *sp.Task) {
+		store, err := excapestore.Open(t.InPath("db"))
+		sp.CheckWithMsg(err, "Could not open database "+t.InPath("db"))
+		defer store.Close()
+		tsvFh := t.OutIP("tsv").OpenWriteTemp()
+		defer tsvFh.Close()
+		sp.CheckWithMsg(store.WriteGISA(t.Param("table"), tsvFh), "Could not write table "+t.Param("table")+" of database "+t.InPath("db"))
+	}
+	return p
+}
+
+// ================================================================================
+
+// StoreQueryFunc writes the result of a query for one gene to w, such as
+// (*excapestore.Store).WriteTargetData
+type StoreQueryFunc func(store *excapestore.Store, gene string, w io.Writer) error
+
+// QueryStore is a SciPipe process that writes the result of a per-target
+// query on a database created by ImportToStore, to a file
+type QueryStore struct {
+	*sp.Process
+}
+
+func (p *QueryStore) InDB() *sp.InPort    { return p.In("db") }
+func (p *QueryStore) OutTSV() *sp.OutPort { return p.Out("tsv") }
+
+func NewQueryStore(wf *sp.Workflow, procName string, gene string, query StoreQueryFunc) *QueryStore {
+	p := &QueryStore{wf.NewProc(procName, "# QueryStore custom process. Ports: {i:db} {o:tsv} Gene: {p:gene}")}
+	p.ParamInPort("gene").ConnectStr(gene)
+	p.CustomExecute = func(t *sp.Task) {
+		store, err := excapestore.Open(t.InPath("db"))
+		sp.CheckWithMsg(err, "Could not open database "+t.InPath("db"))
+		defer store.Close()
+		tsvFh := t.OutIP("tsv").OpenWriteTemp()
+		defer tsvFh.Close()
+		sp.CheckWithMsg(query(store, t.Param("gene"), tsvFh), "Could not query database "+t.InPath("db")+" for gene "+t.Param("gene"))
+	}
+	return p
+}
+
+// ================================================================================
+
+// TargetStatistics is a SciPipe process that computes statistics per target
+// (see excapedb.TargetStats) in a single pass over the measurements (gene, id,
+// smiles, activity, pxc50, assay id, inchikey, tax id, db, sorted on gene),
+// and counts of the compounds removed when aggregating into the deduplicated
+// GISA data, and when removing the DrugBank compounds from it. The statistics
+// are written both as TSV and JSON.
+type TargetStatistics struct {
+	*sp.Process
+}
+
+func (p *TargetStatistics) InMeasurements() *sp.InPort    { return p.In("measurements") }
+func (p *TargetStatistics) InDedupGISA() *sp.InPort       { return p.In("dedup_gisa") }
+func (p *TargetStatistics) InFinalGISA() *sp.InPort       { return p.In("final_gisa") }
+func (p *TargetStatistics) InDrugBankRemoved() *sp.InPort { return p.In("drugbank_removed") }
+func (p *TargetStatistics) OutStatsTSV() *sp.OutPort      { return p.Out("stats_tsv") }
+func (p *TargetStatistics) OutStatsJSON() *sp.OutPort     { return p.Out("stats_json") }
+
+// NewTargetStatistics returns a new TargetStatistics process. Aggregation is
+// the aggregation used for the dedup GISA data (conflicts or consensus), which
+// decides whether compounds are counted per SMILES or per InChIKey.
+func NewTargetStatistics(wf *sp.Workflow, procName string, aggregation string) *TargetStatistics {
+	p := &TargetStatistics{wf.NewProc(procName, "# TargetStatistics custom process. Ports: {i:measurements} {i:dedup_gisa} {i:final_gisa} {i:drugbank_removed} {o:stats_tsv} {o:stats_json} Aggregation: {p:aggregation}")}
+	p.ParamInPort("aggregation").ConnectStr(aggregation)
+	p.CustomExecute = func(t *sp.Task) {
+		collector := excapedb.NewStatsCollector()
+		inFh := t.InIP("measurements").Open()
+		lineScanner := bufio.NewScanner(inFh)
+		lineScanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+		for lineScanner.Scan() {
+			sp.Check(collector.Add(parseMeasurement(lineScanner.Text())))
+		}
+		sp.CheckWithMsg(lineScanner.Err(), "Could not read measurements file "+t.InPath("measurements"))
+		inFh.Close()
+
+		dedupCounts := countGISAPerGene(t.InIP("dedup_gisa"))
+		finalCounts := countGISAPerGene(t.InIP("final_gisa"))
+		drugBankCounts := countGISAPerGene(t.InIP("drugbank_removed"))
+
+		allStats := collector.Stats()
+		for _, ts := range allStats {
+			groupCnt := ts.UniqueSMILESCnt
+			if t.Param("aggregation") == "consensus" {
+				groupCnt = ts.UniqueStructureCnt
+			}
+			dedupCnt := dedupCounts[ts.Gene][0] + dedupCounts[ts.Gene][1]
+			ts.ConflictingRemovedCnt = groupCnt - dedupCnt
+			ts.DrugBankRemovedCnt = drugBankCounts[ts.Gene][0] + drugBankCounts[ts.Gene][1]
+			ts.FinalActiveCnt = finalCounts[ts.Gene][0]
+			ts.FinalNonactiveCnt = finalCounts[ts.Gene][1]
+		}
+
+		tsvFh := t.OutIP("stats_tsv").OpenWriteTemp()
+		sp.CheckWithMsg(excapedb.WriteStatsTSV(allStats, tsvFh), "Could not write statistics TSV file")
+		tsvFh.Close()
+		jsonFh := t.OutIP("stats_json").OpenWriteTemp()
+		sp.CheckWithMsg(excapedb.WriteStatsJSON(allStats, jsonFh), "Could not write statistics JSON file")
+		jsonFh.Close()
+	}
+	return p
+}
+
+// countGISAPerGene counts the actives and non-actives per gene in a gene, id,
+// smiles, activity (GISA) file
+func countGISAPerGene(ip *sp.FileIP) map[string][2]int {
+	counts := map[string][2]int{}
+	fh := ip.Open()
+	defer fh.Close()
+	lineScanner := bufio.NewScanner(fh)
+	lineScanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for lineScanner.Scan() {
+		fields := str.SplitN(lineScanner.Text(), "\t", 5)
+		if len(fields) < 4 {
+			sp.Error.Fatalf("Expected at least 4 fields (gene, id, smiles, activity) in %s, but got: %s\n", ip.Path(), lineScanner.Text())
+		}
+		cnt := counts[fields[0]]
+		switch fields[3] {
+		case excapedb.Active:
+			cnt[0]++
+		case excapedb.Nonactive:
+			cnt[1]++
+		}
+		counts[fields[0]] = cnt
+	}
+	sp.CheckWithMsg(lineScanner.Err(), "Could not read GISA file "+ip.Path())
+	return counts
+}
+
+// ================================================================================
+
+// SampleAssumedNegatives is a SciPipe process that samples assumed negatives
+// for a target from a pool of compounds not measured on it (see
+// excapestore.Store.WriteAssumedNegativePool), according to a
+// sampling.Strategy, to fill up the target data as given by a
+// sampling.FillUpRule (such as to the double amount of non-actives compared
+// to actives). For the exclude_family and
+// exclude_panel_actives strategies, the compounds measured on (or active on)
+// the exclude genes are first removed from the pool, using the database.
+type SampleAssumedNegatives struct {
+	*sp.Process
+}
+
+func (p *SampleAssumedNegatives) InDB() *sp.InPort           { return p.In("db") }
+func (p *SampleAssumedNegatives) InPool() *sp.InPort         { return p.In("pool") }
+func (p *SampleAssumedNegatives) InTargetData() *sp.InPort   { return p.In("targetdata") }
+func (p *SampleAssumedNegatives) OutAssumedNeg() *sp.OutPort { return p.Out("assumed_n") }
+
+// sizeBinWidth is the width, in heavy atoms, of the bins used for matching the
+// size distribution of the actives, with the property_matched strategy
+const sizeBinWidth = 5
+
+func NewSampleAssumedNegatives(wf *sp.Workflow, procName string, gene string, strategy sampling.Strategy, excludeGenes []string, fillUp *sampling.FillUpRule, seed int64) *SampleAssumedNegatives {
+	p := &SampleAssumedNegatives{wf.NewProc(procName, "# SampleAssumedNegatives custom process. Ports: {i:db} {i:pool} {i:targetdata} {o:assumed_n} Gene: {p:gene} Strategy: {p:strategy} Exclude genes: {p:exclude_genes} Ratio: {p:ratio} Min added: {p:min_added} Max added: {p:max_added} Seed: {p:seed} # {p:replicate} {p:runset}")}
+	p.ParamInPort("gene").ConnectStr(gene)
+	p.ParamInPort("seed").ConnectStr(strconv.FormatInt(seed, 10))
+	p.ParamInPort("ratio").ConnectStr(strconv.FormatFloat(fillUp.Ratio, 'f', -1, 64))
+	p.ParamInPort("min_added").ConnectStr(strconv.Itoa(fillUp.MinAdded))
+	p.ParamInPort("max_added").ConnectStr(strconv.Itoa(fillUp.MaxAdded))
+	p.ParamInPort("strategy").ConnectStr(string(strategy))
+	p.ParamInPort("exclude_genes").ConnectStr(str.Join(excludeGenes, ","))
+	p.CustomExecute = func(t *sp.Task) {
+		strategy, err := sampling.ParseStrategy(t.Param("strategy"))
+		sp.Check(err)
+		fillUp := &sampling.FillUpRule{}
+		fillUp.Ratio, err = strconv.ParseFloat(t.Param("ratio"), 64)
+		sp.CheckWithMsg(err, "Could not parse fill-up ratio")
+		fillUp.MinAdded, err = strconv.Atoi(t.Param("min_added"))
+		sp.CheckWithMsg(err, "Could not parse min number of assumed negatives to add")
+		fillUp.MaxAdded, err = strconv.Atoi(t.Param("max_added"))
+		sp.CheckWithMsg(err, "Could not parse max number of assumed negatives to add")
+
+		// Count actives and non-actives, and collect the SMILES of the actives
+		tdFh := t.InIP("targetdata").Open()
+		tdReader := csv.NewReader(tdFh)
+		tdReader.Comma = '\t'
+		tdReader.FieldsPerRecord = -1
+		tdReader.LazyQuotes = true
+		tdRows, err := tdReader.ReadAll()
+		tdFh.Close()
+		sp.CheckWithMsg(err, "Could not read target data "+t.InPath("targetdata"))
+		activeSMILES := []string{}
+		activeCnt, nonActiveCnt := 0, 0
+		for _, row := range tdRows[1:] {
+			switch row[1] {
+			case excapedb.Active:
+				activeCnt++
+				activeSMILES = append(activeSMILES, row[0])
+			case excapedb.Nonactive:
+				nonActiveCnt++
+			}
+		}
+		fillUpCnt := fillUp.Count(activeCnt, nonActiveCnt)
+
+		// Compounds to exclude from the pool, depending on the strategy
+		var excluded map[string]bool
+		excludeGenes := []string{}
+		if t.Param("exclude_genes") != "" {
+			excludeGenes = str.Split(t.Param("exclude_genes"), ",")
+		}
+		if strategy == sampling.ExcludeFamily || strategy == sampling.ExcludePanelActives {
+			store, err := excapestore.Open(t.InPath("db"))
+			sp.CheckWithMsg(err, "Could not open database "+t.InPath("db"))
+			excluded, err = store.SMILESForGenes(excludeGenes, strategy == sampling.ExcludePanelActives)
+			store.Close()
+			sp.CheckWithMsg(err, "Could not query compounds to exclude")
+		}
+
+		pool := []string{}
+		poolFh := t.InIP("pool").Open()
+		lineScanner := bufio.NewScanner(poolFh)
+		lineScanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+		for lineScanner.Scan() {
+			smiles := str.Split(lineScanner.Text(), "\t")[0]
+			if !excluded[smiles] {
+				pool = append(pool, smiles)
+			}
+		}
+		sp.CheckWithMsg(lineScanner.Err(), "Could not read pool file "+t.InPath("pool"))
+		poolFh.Close()
+
+		seed, err := strconv.ParseInt(t.Param("seed"), 10, 64)
+		sp.CheckWithMsg(err, "Could not parse seed")
+		rnd := sampling.NewRand(seed)
+		sampled := []string{}
+		if fillUpCnt > 0 {
+			if strategy == sampling.PropertyMatched {
+				sampled = sampling.SamplePropertyMatched(pool, fillUpCnt, activeSMILES, sizeBinWidth, rnd)
+			} else {
+				sampled = sampling.Sample(pool, fillUpCnt, rnd)
+			}
+		}
+		if len(sampled) < fillUpCnt {
+			sp.Warning.Printf("Process %s: Only %d compounds left in the pool for %s (strategy %s), so could only add %d of %d assumed negatives\n", p.Name(), len(pool), t.Param("gene"), strategy, len(sampled), fillUpCnt)
+		}
+		sp.Audit.Printf("Process %s: Sampled %d assumed negatives for %s from a pool of %d compounds (strategy: %s, %d excluded)\n", p.Name(), len(sampled), t.Param("gene"), len(pool), strategy, len(excluded))
+
+		outFh := t.OutIP("assumed_n").OpenWriteTemp()
+		defer outFh.Close()
+		outWriter := bufio.NewWriter(outFh)
+		for _, smiles := range sampled {
+			outWriter.WriteString(smiles + "\t" + excapedb.Nonactive + "\n")
+		}
+		sp.Check(outWriter.Flush())
+	}
+	return p
+}
+
+// ================================================================================
+
+// SampleToTotal is a SciPipe process that samples lines from the in-file
+// without replacement, so that together with the lines in the other-file,
+// there are (at most) total lines. The sampling is fully reproducible from the
+// seed parameter (see sampling.NewRand).
+type SampleToTotal struct {
+	*sp.Process
+}
+
+func (p *SampleToTotal) InFile() *sp.InPort          { return p.In("in") }
+func (p *SampleToTotal) InOther() *sp.InPort         { return p.In("other") }
+func (p *SampleToTotal) OutSampled() *sp.OutPort     { return p.Out("sampled") }
+func (p *SampleToTotal) ParamTotal() *sp.ParamInPort { return p.ParamInPort("total") }
+func (p *SampleToTotal) ParamSeed() *sp.ParamInPort  { return p.ParamInPort("seed") }
+
+func NewSampleToTotal(wf *sp.Workflow, procName string, seed int64) *SampleToTotal {
+	p := &SampleToTotal{wf.NewProc(procName, "# SampleToTotal custom process. Ports: {i:in} {i:other} {o:sampled} Total: {p:total} Seed: {p:seed}")}
+	p.ParamSeed().ConnectStr(strconv.FormatInt(seed, 10))
+	p.CustomExecute = func(t *sp.Task) {
+		total, err := strconv.Atoi(t.Param("total"))
+		sp.CheckWithMsg(err, "Could not parse total number of lines")
+		seed, err := strconv.ParseInt(t.Param("seed"), 10, 64)
+		sp.CheckWithMsg(err, "Could not parse seed")
+
+		otherLines := readLines(t.InPath("other"))
+		lines := readLines(t.InPath("in"))
+		sampled := sampling.Sample(lines, total-len(otherLines), sampling.NewRand(seed))
+
+		outFh := t.OutIP("sampled").OpenWriteTemp()
+		defer outFh.Close()
+		outWriter := bufio.NewWriter(outFh)
+		for _, line := range sampled {
+			outWriter.WriteString(line + "\n")
+		}
+		sp.Check(outWriter.Flush())
+	}
+	return p
+}
+
+// readLines reads the (non-empty) lines of a file
+func readLines(path string) []string {
+	fh, err := os.Open(path)
+	sp.CheckWithMsg(err, "Could not open file "+path)
+	defer fh.Close()
+	lines := []string{}
+	lineScanner := bufio.NewScanner(fh)
+	for lineScanner.Scan() {
+		if line := lineScanner.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	sp.CheckWithMsg(lineScanner.Err(), "Could not read file "+path)
+	return lines
+}
+
+// ================================================================================
+
+// SummaryAggregator is a SciPipe process that aggregates the rows of the final
+// models summary (see FinalModelSummarizer) over replicates, into one row per
+// gene, runset and implementation (if there is an Impl column), with the mean,
+// standard deviation, min and max of every numeric column (as <Column>Mean,
+// <Column>SD, <Column>Min and <Column>Max). Non-numeric columns are kept as
+// they are, or as a comma-separated list of their unique values if they
+// differ between replicates. The standard deviation is the sample standard
+// deviation, which is NA for one replicate.
+type SummaryAggregator struct {
+	*sp.Process
+}
+
+func (p *SummaryAggregator) InSummary() *sp.InPort      { return p.In("summary") }
+func (p *SummaryAggregator) OutAggregated() *sp.OutPort { return p.Out("aggregated") }
+
+func NewSummaryAggregator(wf *sp.Workflow, procName string) *SummaryAggregator {
+	p := &SummaryAggregator{wf.NewProc(procName, "# SummaryAggregator custom process. Ports: {i:summary} {o:aggregated}")}
+	p.CustomExecute = func(t *sp.Task) {
+		summaryFh := t.InIP("summary").Open()
+		summaryReader := csv.NewReader(summaryFh)
+		summaryReader.Comma = '\t'
+		rows, err := summaryReader.ReadAll()
+		summaryFh.Close()
+		sp.CheckWithMsg(err, "Could not read summary file "+t.InPath("summary"))
+		header := rows[0]
+		rows = rows[1:]
+		geneIdx := indexOfStr("Gene", header)
+		replIdx := indexOfStr("Replicate", header)
+		runSetIdx := indexOfStr("Runset", header)
+		implIdx := -1
+		if strInSlice("Impl", header) {
+			implIdx = indexOfStr("Impl", header)
+		}
+
+		// A column is numeric if all its values parse as numbers
+		numeric := make([]bool, len(header))
+		for i := range header {
+			numeric[i] = i != geneIdx && i != replIdx && i != runSetIdx
+			for _, row := range rows {
+				if _, err := strconv.ParseFloat(row[i], 64); err != nil {
+					numeric[i] = false
+					break
+				}
+			}
+		}
+
+		// Group rows on gene, runset and implementation, in order of first
+		// appearance
+		groupKeys := []string{}
+		groups := map[string][][]string{}
+		for _, row := range rows {
+			key := row[geneIdx] + "\t" + row[runSetIdx]
+			if implIdx >= 0 {
+				key += "\t" + row[implIdx]
+			}
+			if _, ok := groups[key]; !ok {
+				groupKeys = append(groupKeys, key)
+			}
+			groups[key] = append(groups[key], row)
+		}
+
+		outHeader := []string{"Gene", "Runset", "ReplicateCnt"}
+		for i, col := range header {
+			if i == geneIdx || i == replIdx || i == runSetIdx {
+				continue
+			}
+			if numeric[i] {
+				outHeader = append(outHeader, col+"Mean", col+"SD", col+"Min", col+"Max")
+			} else {
+				outHeader = append(outHeader, col)
+			}
+		}
+		outRows := [][]string{outHeader}
+		for _, key := range groupKeys {
+			group := groups[key]
+			outRow := []string{group[0][geneIdx], group[0][runSetIdx], strconv.Itoa(len(group))}
+			for i := range header {
+				if i == geneIdx || i == replIdx || i == runSetIdx {
+					continue
+				}
+				if !numeric[i] {
+					uniqVals := []string{}
+					for _, row := range group {
+						if !strInSlice(row[i], uniqVals) {
+							uniqVals = append(uniqVals, row[i])
+						}
+					}
+					outRow = append(outRow, str.Join(uniqVals, ","))
+					continue
+				}
+				vals := []float64{}
+				for _, row := range group {
+					val, err := strconv.ParseFloat(row[i], 64)
+					sp.Check(err)
+					vals = append(vals, val)
+				}
+				mean, sd, min, max := meanSDMinMax(vals)
+				sdStr := "NA"
+				if len(vals) > 1 {
+					sdStr = strconv.FormatFloat(sd, 'f', -1, 64)
+				}
+				outRow = append(outRow,
+					strconv.FormatFloat(mean, 'f', -1, 64),
+					sdStr,
+					strconv.FormatFloat(min, 'f', -1, 64),
+					strconv.FormatFloat(max, 'f', -1, 64))
+			}
+			outRows = append(outRows, outRow)
+		}
+
+		outFh := t.OutIP("aggregated").OpenWriteTemp()
+		defer outFh.Close()
+		csvWriter := csv.NewWriter(outFh)
+		csvWriter.Comma = '\t'
+		sp.Check(csvWriter.WriteAll(outRows))
+	}
+	return p
+}
+
+// meanSDMinMax returns the mean, sample standard deviation, min and max of a
+// (non-empty) list of values
+func meanSDMinMax(vals []float64) (mean float64, sd float64, min float64, max float64) {
+	min, max = vals[0], vals[0]
+	for _, val := range vals {
+		mean += val
+		min = math.Min(min, val)
+		max = math.Max(max, val)
+	}
+	mean /= float64(len(vals))
+	if len(vals) > 1 {
+		for _, val := range vals {
+			sd += (val - mean) * (val - mean)
+		}
+		sd = math.Sqrt(sd / float64(len(vals)-1))
+	}
+	return mean, sd, min, max
+}
+
+// ================================================================================
+
+// ScaffoldSplit is a SciPipe process that splits the target data (a TSV file
+// with SMILES in the first column, and a header line) into a training and a
+// test set without any Bemis-Murcko scaffold in common (see scaffold.Split),
+// for validating models on novel chemistry. Both output files get the header
+// of the input file.
+type ScaffoldSplit struct {
+	*sp.Process
+}
+
+func (p *ScaffoldSplit) InTargetData() *sp.InPort { return p.In("targetdata") }
+func (p *ScaffoldSplit) OutTrain() *sp.OutPort    { return p.Out("train") }
+func (p *ScaffoldSplit) OutTest() *sp.OutPort     { return p.Out("test") }
+
+func NewScaffoldSplit(wf *sp.Workflow, procName string, testFraction float64, seed int64) *ScaffoldSplit {
+	p := &ScaffoldSplit{wf.NewProc(procName, "# ScaffoldSplit custom process. Ports: {i:targetdata} {o:train} {o:test} Test fraction: {p:test_fraction} Seed: {p:seed} # {p:gene} {p:replicate}")}
+	p.ParamInPort("test_fraction").ConnectStr(strconv.FormatFloat(testFraction, 'f', -1, 64))
+	p.ParamInPort("seed").ConnectStr(strconv.FormatInt(seed, 10))
+	p.CustomExecute = func(t *sp.Task) {
+		testFraction, err := strconv.ParseFloat(t.Param("test_fraction"), 64)
+		sp.CheckWithMsg(err, "Could not parse test fraction")
+		seed, err := strconv.ParseInt(t.Param("seed"), 10, 64)
+		sp.CheckWithMsg(err, "Could not parse seed")
+
+		lines := readLines(t.InPath("targetdata"))
+		header, lines := lines[0], lines[1:]
+		smiles := []string{}
+		for _, line := range lines {
+			smiles = append(smiles, str.Split(line, "\t")[0])
+		}
+		train, test, scaffolds := scaffold.Split(smiles, testFraction, sampling.NewRand(seed))
+		uniqScaffolds := map[string]bool{}
+		for _, s := range scaffolds {
+			uniqScaffolds[s] = true
+		}
+		sp.Audit.Printf("Process %s: Split %d compounds with %d scaffolds into %d for training and %d for testing\n", p.Name(), len(lines), len(uniqScaffolds), len(train), len(test))
+
+		for _, part := range []struct {
+			port    string
+			indices []int
+		}{{"train", train}, {"test", test}} {
+			outFh := t.OutIP(part.port).OpenWriteTemp()
+			outWriter := bufio.NewWriter(outFh)
+			outWriter.WriteString(header + "\n")
+			for _, i := range part.indices {
+				outWriter.WriteString(lines[i] + "\n")
+			}
+			sp.Check(outWriter.Flush())
+			outFh.Close()
+		}
+	}
+	return p
+}
+
+// ================================================================================
+
+// OuterFoldSplit is a SciPipe process that splits the target data (a TSV file
+// with SMILES and activity in the first two columns, and a header line) into
+// the outer fold with the given (1-based) number, out of folds stratified on
+// the activity (see sampling.StratifiedFolds), and the other folds, for the
+// outer loop of a nested crossvalidation. The folds are fully reproducible
+// from the seed parameter, so that the processes for the different folds of
+// the same data split it in the same way. Both output files get the header of
+// the input file.
+type OuterFoldSplit struct {
+	*sp.Process
+}
+
+func (p *OuterFoldSplit) InTargetData() *sp.InPort { return p.In("targetdata") }
+func (p *OuterFoldSplit) OutInner() *sp.OutPort    { return p.Out("inner") }
+func (p *OuterFoldSplit) OutOuter() *sp.OutPort    { return p.Out("outer") }
+
+func NewOuterFoldSplit(wf *sp.Workflow, procName string, folds int, fold int, seed int64) *OuterFoldSplit {
+	p := &OuterFoldSplit{wf.NewProc(procName, "# OuterFoldSplit custom process. Ports: {i:targetdata} {o:inner} {o:outer} Fold: {p:fold} of {p:folds} Seed: {p:seed} # {p:gene} {p:replicate} {p:runset}")}
+	p.ParamInPort("folds").ConnectStr(strconv.Itoa(folds))
+	p.ParamInPort("fold").ConnectStr(strconv.Itoa(fold))
+	p.ParamInPort("seed").ConnectStr(strconv.FormatInt(seed, 10))
+	p.CustomExecute = func(t *sp.Task) {
+		folds, err := strconv.Atoi(t.Param("folds"))
+		sp.CheckWithMsg(err, "Could not parse number of folds")
+		fold, err := strconv.Atoi(t.Param("fold"))
+		sp.CheckWithMsg(err, "Could not parse fold")
+		seed, err := strconv.ParseInt(t.Param("seed"), 10, 64)
+		sp.CheckWithMsg(err, "Could not parse seed")
+
+		lines := readLines(t.InPath("targetdata"))
+		header, lines := lines[0], lines[1:]
+		labels := []string{}
+		for _, line := range lines {
+			fields := str.Split(line, "\t")
+			if len(fields) < 2 {
+				sp.Error.Fatalf("Process %s: Expected SMILES and activity in line: %s\n", p.Name(), line)
+			}
+			labels = append(labels, fields[1])
+		}
+		lineFolds, err := sampling.StratifiedFolds(labels, folds, sampling.NewRand(seed))
+		sp.CheckWithMsg(err, "Could not split the target data "+t.InPath("targetdata")+" into folds")
+
+		innerFh := t.OutIP("inner").OpenWriteTemp()
+		defer innerFh.Close()
+		outerFh := t.OutIP("outer").OpenWriteTemp()
+		defer outerFh.Close()
+		innerWriter := bufio.NewWriter(innerFh)
+		outerWriter := bufio.NewWriter(outerFh)
+		innerWriter.WriteString(header + "\n")
+		outerWriter.WriteString(header + "\n")
+		outerCnt := 0
+		for i, line := range lines {
+			if lineFolds[i] == fold-1 {
+				outerWriter.WriteString(line + "\n")
+				outerCnt++
+			} else {
+				innerWriter.WriteString(line + "\n")
+			}
+		}
+		sp.Check(innerWriter.Flush())
+		sp.Check(outerWriter.Flush())
+		sp.Audit.Printf("Process %s: Held out %d of %d compounds in outer fold %d of %d\n", p.Name(), outerCnt, len(lines), fold, folds)
+	}
+	return p
+}
+
+// ================================================================================
+
+// NestedCVCollect is a SciPipe process that collects the validation output of
+// CPSign validate (in JSON format) for the outer folds of a nested
+// crossvalidation, where each fold was predicted by a model trained with the
+// grid point selected on the other folds, and computes the metrics of the
+// outer loop from the pooled predictions (see gridsearch.PredictionResults),
+// at the Confidences they were predicted at. The metrics are written, with the
+// grid point of each fold, as JSON (see gridsearch.Nested). The in-coming IPs
+// need the params gene, replicate, runset, grid_point and outer_fold.
+type NestedCVCollect struct {
+	sp.BaseProcess
+	FileName    string
+	Confidences []float64
+	// Confidence is the confidence level of the metrics, other than the
+	// curve-level ones
+	Confidence float64
+	// Group is the selection group (see gridsearch.Best), if any
+	Group string
+}
+
+func NewNestedCVCollect(wf *sp.Workflow, name string, fileName string, confidences []float64, confidence float64) *NestedCVCollect {
+	p := &NestedCVCollect{
+		BaseProcess: sp.NewBaseProcess(wf, name),
+		FileName:    fileName,
+		Confidences: confidences,
+		Confidence:  confidence,
+	}
+	p.InitInPort(p, "validation")
+	p.InitOutPort(p, "nested")
+	wf.AddProc(p)
+	return p
+}
+
+func (p *NestedCVCollect) InValidation() *sp.InPort { return p.InPort("validation") }
+func (p *NestedCVCollect) OutNested() *sp.OutPort   { return p.OutPort("nested") }
+
+func (p *NestedCVCollect) Run() {
+	defer p.OutNested().Close()
+
+	outIp := sp.NewFileIP(p.FileName)
+	if outIp.Exists() {
+		sp.Info.Printf("Process %s: Out-target %s already exists, so skipping\n", p.Name(), outIp.Path())
+		for range p.InValidation().Chan {
+		}
+		p.OutNested().Send(outIp)
+		return
+	}
+
+	var gene, replicate, runSet string
+	pointPerFold := map[int]string{}
+	preds := []*gridsearch.Prediction{}
+	for iip := range p.InValidation().Chan {
+		gene, replicate, runSet = iip.Param("gene"), iip.Param("replicate"), iip.Param("runset")
+		fold, err := strconv.Atoi(iip.Param("outer_fold"))
+		sp.CheckWithMsg(err, "Could not parse outer fold")
+		pointPerFold[fold] = iip.Param("grid_point")
+		valFh := iip.Open()
+		foldPreds, err := gridsearch.ReadPredictions(valFh)
+		valFh.Close()
+		sp.CheckWithMsg(err, "Could not read validation output "+iip.Path())
+		preds = append(preds, foldPreds...)
+	}
+	folds := []int{}
+	for fold := range pointPerFold {
+		folds = append(folds, fold)
+	}
+	sort.Ints(folds)
+	points := []string{}
+	for _, fold := range folds {
+		points = append(points, pointPerFold[fold])
+	}
+
+	results, err := gridsearch.PredictionResults(preds, p.Confidences, excapedb.Active, excapedb.Nonactive, gene, replicate, runSet, gridsearch.NestedPoint)
+	sp.Check(err)
+	nested, err := gridsearch.NewNested(gene, replicate, runSet, points, p.Confidence, results)
+	sp.Check(err)
+	nested.Group = p.Group
+	sp.Check(os.MkdirAll(filepath.Dir(outIp.Path()), 0755))
+	sp.Check(gridsearch.WriteNested(outIp.TempPath(), nested))
+	outIp.Atomize()
+	p.OutNested().Send(outIp)
+}
+
+// ================================================================================
+
+// UndersampleMajority is a SciPipe process that undersamples the majority
+// class (active or non-active) of the target data, to at most ratio times the
+// number of compounds in the minority class, for targets with at least
+// min_cnt compounds. Smaller targets are passed through as they are. The
+// sampling is fully reproducible from the seed parameter (see
+// sampling.NewRand), and the kept rows stay in their original order.
+type UndersampleMajority struct {
+	*sp.Process
+}
+
+func (p *UndersampleMajority) InTargetData() *sp.InPort { return p.In("targetdata") }
+func (p *UndersampleMajority) OutBalanced() *sp.OutPort { return p.Out("balanced") }
+
+func NewUndersampleMajority(wf *sp.Workflow, procName string, ratio float64, minCnt int, seed int64) *UndersampleMajority {
+	p := &UndersampleMajority{wf.NewProc(procName, "# UndersampleMajority custom process. Ports: {i:targetdata} {o:balanced} Ratio: {p:ratio} Min count: {p:min_cnt} Seed: {p:seed} # {p:gene} {p:replicate}")}
+	p.ParamInPort("ratio").ConnectStr(strconv.FormatFloat(ratio, 'f', -1, 64))
+	p.ParamInPort("min_cnt").ConnectStr(strconv.Itoa(minCnt))
+	p.ParamInPort("seed").ConnectStr(strconv.FormatInt(seed, 10))
+	p.CustomExecute = func(t *sp.Task) {
+		ratio, err := strconv.ParseFloat(t.Param("ratio"), 64)
+		sp.CheckWithMsg(err, "Could not parse ratio")
+		minCnt, err := strconv.Atoi(t.Param("min_cnt"))
+		sp.CheckWithMsg(err, "Could not parse min count")
+		seed, err := strconv.ParseInt(t.Param("seed"), 10, 64)
+		sp.CheckWithMsg(err, "Could not parse seed")
+
+		lines := readLines(t.InPath("targetdata"))
+		header, lines := lines[0], lines[1:]
+		linesPerClass := map[string][]string{}
+		for _, line := range lines {
+			fields := str.Split(line, "\t")
+			if len(fields) < 2 {
+				sp.Error.Fatalf("Process %s: Expected SMILES and activity in line: %s\n", p.Name(), line)
+			}
+			linesPerClass[fields[1]] = append(linesPerClass[fields[1]], line)
+		}
+		majority, minority := excapedb.Nonactive, excapedb.Active
+		if len(linesPerClass[excapedb.Active]) > len(linesPerClass[excapedb.Nonactive]) {
+			majority, minority = excapedb.Active, excapedb.Nonactive
+		}
+
+		kept := map[string]bool{}
+		maxMajorityCnt := int(ratio * float64(len(linesPerClass[minority])))
+		if len(lines) >= minCnt && len(linesPerClass[majority]) > maxMajorityCnt {
+			for _, line := range sampling.Sample(linesPerClass[majority], maxMajorityCnt, sampling.NewRand(seed)) {
+				kept[line] = true
+			}
+			sp.Audit.Printf("Process %s: Undersampled %d %s compounds to %d, for %d %s compounds\n", p.Name(), len(linesPerClass[majority]), majority, maxMajorityCnt, len(linesPerClass[minority]), minority)
+		} else {
+			for _, line := range linesPerClass[majority] {
+				kept[line] = true
+			}
+		}
+
+		outFh := t.OutIP("balanced").OpenWriteTemp()
+		defer outFh.Close()
+		outWriter := bufio.NewWriter(outFh)
+		outWriter.WriteString(header + "\n")
+		for _, line := range lines {
+			if kept[line] || str.Split(line, "\t")[1] != majority {
+				outWriter.WriteString(line + "\n")
+			}
+		}
+		sp.Check(outWriter.Flush())
+	}
+	return p
+}
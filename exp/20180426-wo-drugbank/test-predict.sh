@@ -10,7 +10,7 @@ else
             -c 1 \
             -im \
             -if $id"-"$tgt \
-            -m dat/final_models/$tgt/r1/fill/$tgt.r1.fill.liblin_c*_nrmdl10.mdl.jar \
+            -m dat/final_models/$tgt/r1/fill/$tgt.r1.fill.*.mdl.jar \
             -sm "$smiles";
     done;
 fi;
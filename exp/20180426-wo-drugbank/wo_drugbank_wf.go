@@ -4,108 +4,77 @@ package main
 
 import (
 	"encoding/csv"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"math"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"runtime"
 	"strconv"
 	str "strings"
 
+	"github.com/pharmbio/ptp-project/lib/cpsign"
+	"github.com/pharmbio/ptp-project/lib/datasrc"
+	"github.com/pharmbio/ptp-project/lib/drugbank"
+	"github.com/pharmbio/ptp-project/lib/excapedb"
+	"github.com/pharmbio/ptp-project/lib/excapestore"
+	"github.com/pharmbio/ptp-project/lib/genesets"
+	"github.com/pharmbio/ptp-project/lib/gridsearch"
+	"github.com/pharmbio/ptp-project/lib/sampling"
 	sp "github.com/scipipe/scipipe"
 	spc "github.com/scipipe/scipipe/components"
 )
 
 var (
-	graph      = flag.Bool("graph", false, "If this flag is specified, the workflow will just print out the workflow as a graph in dot and pdf format, and nothing else")
-	maxTasks   = flag.Int("maxtasks", 4, "Max number of local cores to use")
-	threads    = flag.Int("threads", 1, "Number of threads that Go is allowed to start")
-	geneSet    = flag.String("geneset", "smallest1", "Gene set to use (one of smallest1, smallest3, smallest4, bowes44)")
-	runSlurm   = flag.Bool("slurm", false, "Start computationally heavy jobs via SLURM")
-	debug      = flag.Bool("debug", false, "Increase logging level to include DEBUG messages")
-	procsRegex = flag.String("procs", "plot_summary.*", "A regex specifying which processes (by name) to run up to")
-
-	cpSignPath = "../../bin/cpsign-0.6.14.jar"
-	geneSets   = map[string][]string{
-		"bowes44": []string{
-			// Not available in dataset: "CHRNA1".
-			// Not available in dataset: "KCNE1"
-			// Instead we use MinK1 as they both share the same alias
-			// "MinK", and also confirmed by Wes to be the same.
-			"ADORA2A", "ADRA1A", "ADRA2A", "ADRB1", "ADRB2", "CNR1", "CNR2", "CCKAR", "DRD1", "DRD2",
-			"EDNRA", "HRH1", "HRH2", "OPRD1", "OPRK1", "OPRM1", "CHRM1", "CHRM2", "CHRM3", "HTR1A",
-			"HTR1B", "HTR2A", "HTR2B", "AVPR1A", "CHRNA4", "CACNA1C", "GABRA1", "KCNH2", "KCNQ1", "MINK1",
-			"GRIN1", "HTR3A", "SCN5A", "ACHE", "PTGS1", "PTGS2", "MAOA", "PDE3A", "PDE4D", "LCK",
-			"SLC6A3", "SLC6A2", "SLC6A4", "AR", "NR3C1",
-		},
-		"bowes44min100percls": []string{
-			"PDE3A", "SCN5A", "CCKAR", "ADRB1", "PTGS1", "CHRM3", "CHRM2", "EDNRA", "MAOA", "LCK",
-			"PTGS2", "SLC6A2", "ACHE", "CNR2", "CNR1", "ADORA2A", "OPRD1", "NR3C1", "AR", "SLC6A4",
-			"OPRM1", "HTR1A", "SLC6A3", "OPRK1", "AVPR1A", "ADRB2", "DRD2", "KCNH2", "DRD1", "HTR2A",
-			"CHRM1",
-		},
-		"bowes44min100percls_small": []string{ // These are the ones for which we want to fill up with assumed negative
-			"PDE3A", "SCN5A", "CCKAR", "ADRB1", "PTGS1", "CHRM3", "CHRM2", "EDNRA", "MAOA", "LCK",
-			"PTGS2", "SLC6A2", "ACHE", "CNR2", "CNR1", "ADORA2A", "OPRD1", "NR3C1", "AR", "SLC6A4",
-			"OPRM1",
-		},
-		"bowes44min100percls_large": []string{
-			"HTR1A", "SLC6A3", "OPRK1", "AVPR1A", "ADRB2", "DRD2", "KCNH2", "DRD1", "HTR2A", "CHRM1",
-		},
-		"smallest1": []string{
-			"PDE3A",
-		},
-		"smallest3": []string{
-			"PDE3A", "SCN5A", "CCKAR",
-		},
-		"smallest4": []string{
-			"PDE3A", "SCN5A", "CCKAR", "ADRB1",
-		},
-	}
-	//costVals = []string{
-	//	"1",
-	//	"10",
-	//	"100",
-	//}
-	costsPerTarget = map[string][]string{
-		"PDE3A":   []string{"1"},
-		"SCN5A":   []string{"10"},
-		"PTGS1":   []string{"1"},
-		"CCKAR":   []string{"1"},
-		"MAOA":    []string{"1"},
-		"ADRB1":   []string{"1"},
-		"CHRM3":   []string{"10"},
-		"CHRM2":   []string{"1"},
-		"EDNRA":   []string{"1"},
-		"NR3C1":   []string{"1"},
-		"AR":      []string{"1"},
-		"PTGS2":   []string{"1"},
-		"LCK":     []string{"10"},
-		"ACHE":    []string{"1"},
-		"SLC6A2":  []string{"1"},
-		"CNR2":    []string{"1"},
-		"OPRD1":   []string{"1"},
-		"ADORA2A": []string{"1"},
-		"CNR1":    []string{"1"},
-		"OPRM1":   []string{"1"},
-		"SLC6A4":  []string{"1"},
-		"HTR1A":   []string{"1"},
-		"SLC6A3":  []string{"1"},
-		"OPRK1":   []string{"1"},
-		"AVPR1A":  []string{"100"},
-		"ADRB2":   []string{"10"},
-		"DRD2":    []string{"1"},
-		"KCNH2":   []string{"1"},
-		"DRD1":    []string{"1"},
-		"HTR2A":   []string{"1"},
-		"CHRM1":   []string{"1"},
-	}
-	replicates = []string{
-		"r1",
-	}
-	//replicates = []string{
-	//	"r1", "r2", "r3",
-	//}
+	graph           = flag.Bool("graph", false, "If this flag is specified, the workflow will just print out the workflow as a graph in dot and pdf format, and nothing else")
+	maxTasks        = flag.Int("maxtasks", 4, "Max number of local cores to use")
+	threads         = flag.Int("threads", 1, "Number of threads that Go is allowed to start")
+	geneSet         = flag.String("geneset", "smallest1", "Gene set to use, as defined in the -genesets file (such as smallest1, smallest3, smallest4, bowes44, bowes44min100percls)")
+	geneSetsFile    = flag.String("genesets", "genesets.json", "JSON file with the gene set rules (explicit members, or members of another set fulfilling criteria on the number of compounds)")
+	aliasesFile     = flag.String("aliases", "aliases.tsv", "Tab-separated alias table (symbol, entrez_id, uniprot, aliases) for resolving the gene set members to the gene symbols in ExCAPE-DB")
+	missingTargets  = flag.String("missingtargets", "warn", "What to do when gene set members are not available in ExCAPE-DB (one of warn, fail)")
+	fillUpFile      = flag.String("fillup", "fillup.json", "JSON file configuring the fill-up with assumed negatives: the gene set (as defined in the -genesets file) of the targets eligible for fill-up, the ratio of non-actives to actives to fill up to, and the min and max number of assumed negatives to add, with optional overrides per target")
+	runSlurm        = flag.Bool("slurm", false, "Start computationally heavy jobs via SLURM")
+	debug           = flag.Bool("debug", false, "Increase logging level to include DEBUG messages")
+	procsRegex      = flag.String("procs", "plot_summary.*", "A regex specifying which processes (by name) to run up to")
+	dataSources     = flag.String("datasources", "datasources.json", "JSON file with the registry of data sources (versions, checksums, URLs and local mirrors)")
+	offline         = flag.Bool("offline", false, "Take all data sources from their local mirrors, instead of downloading them")
+	allowUnpinned   = flag.Bool("allowunpinned", false, "Use data sources without a pinned checksum in the -datasources registry unverified, with a warning, instead of failing")
+	labelThresholds = flag.String("labelthresholds", "", "Derive activity labels from pXC50 instead of using the ExCAPE-DB activity flags, with thresholds given as active:inactive (globally) or GENE=active:inactive (per target), separated by commas, e.g. 6.5:5.0,PDE3A=7.0:5.5. Compounds in between the thresholds are dropped")
+	aggregation     = flag.String("aggregation", "conflicts", "How to aggregate multiple measurements of the same compound and target (one of: conflicts, for removing or resolving conflicting activity flags according to -conflictpolicy, or consensus, for one label per InChIKey from the median pXC50)")
+	maxPXC50Spread  = flag.Float64("maxspread", excapedb.DefaultMaxPXC50Spread, "Largest spread (max - min) of pXC50 values for a compound and target, above which it is flagged as high-variance (only used with -aggregation consensus)")
+	conflictPolicy  = flag.String("conflictpolicy", "drop", "Policy for compounds with conflicting activity flags for the same target (one of drop, majority, most_assays, pxc50_tiebreak)")
+	species         = flag.String("species", "", "Only use measurements on these species, as a comma-separated list of taxonomy IDs or names (human, rat, mouse), e.g. human or 9606,10116. Default is all species")
+	orthologs       = flag.Bool("orthologs", false, "Include the measurements on all members of the ortholog group of each target, under the gene symbol of the (human) target")
+	samplingSeed    = flag.Int64("seed", 1, "Seed for the random sampling of the DrugBank compounds to remove, and of the assumed negatives, for which replicate number i (r1, r2, ...) uses seed+i, so that a recorded seed fully reproduces a selection")
+	scaffoldTest    = flag.Float64("scaffoldtest", 0.0, "Fraction of the compounds of each target to hold out from training, as an external test set without any Bemis-Murcko scaffold in common with the training data, on which the models are validated (0 means no hold-out)")
+	replicatesCnt   = flag.Int("replicates", 1, "Number of replicates (r1, r2, ...) to train, each with its own seed and draw of assumed negatives. The final summary is aggregated over the replicates")
+	runSetsFlag     = flag.String("runsets", "fill", "Comma-separated list of run sets: orig (no fill-up), fill (fill up with uniformly sampled assumed negatives), fill_<strategy>, with a strategy for sampling the assumed negatives (one of uniform, exclude_family, exclude_panel_actives, property_matched), or balanced (undersample the majority class of large targets, see -balanceratio)")
+	balanceRatio    = flag.Float64("balanceratio", 1.0, "Largest ratio of majority to minority class compounds in the balanced run set, to which the majority class is undersampled")
+	balanceMinCnt   = flag.Int("balancemincnt", 100000, "Least number of compounds of a target for undersampling it in the balanced run set. Smaller targets are used as they are")
+	familiesFile    = flag.String("families", "families.tsv", "Tab-separated table (gene, family) of target families, used by the exclude_family sampling strategy")
+	objective       = flag.String("objective", "mean_obsfuzz_overall,calibration", "Objective to minimize in the selection of the best grid point: one of obsfuzz_overall, obsfuzz_classavg, efficiency, accuracy_deviation (|accuracy - confidence|), calibration (the area between the calibration curve and the diagonal, over all confidence levels), mean_obsfuzz_overall, mean_obsfuzz_classavg, mean_efficiency (means over all confidence levels; the efficiency terms enter as 1 - efficiency, since larger efficiency is better), or a weighted combination, as term:weight separated by commas, e.g. obsfuzz_classavg:0.7,calibration:0.3")
+	selConfidence   = flag.Float64("selconfidence", 0.9, "Confidence level at which the objective is evaluated in the selection of the best grid point")
+	validityTol     = flag.Float64("validitytol", 0.05, "Largest amount by which the error rate of a grid point may exceed 1 - confidence, at any confidence level, before it is rejected in the selection of the best grid point (negative means no check)")
+	gridSearchMode  = flag.String("gridsearch", "full", "How to search the -gridspace parameter space (one of full, for crossvalidating every grid point, or halving, for an adaptive search with successive halving, as configured in the halving section of the -gridspace file, with cheap rounds of fewer folds and models, after each of which only the best grid points are kept, a refinement around the best one, and a final full round. The search starts from the declared values of the parameters, for all targets. No calibration plots are made with halving)")
+	paramStoreDir   = flag.String("paramstore", "res/best_params", "Directory of the best parameter store, where the selected grid point of each target, runset and replicate is kept between runs, as JSON, together with a hash of the training data")
+	warmStart       = flag.Bool("warmstart", false, "Skip the grid search for targets, runsets and replicates with an entry in the -paramstore store that was selected on the same training data, with the same parameter space and selection settings (by hash), and use the stored grid point. The grid search is then run as one process per target, runset and replicate, as with -gridsearch halving, without calibration plots")
+	selectPer       = flag.String("selectper", "impl", "Parameter of the -gridspace parameter space to select the best grid point per value of, training one model for each, such as impl for comparing liblinear and libsvm models of the same target. Parameters with one value for a target give one model")
+	nestedCVFolds   = flag.Int("nestedcv", 0, "Number of outer folds for a nested crossvalidation, in which each outer fold of the training data is held out in turn, the best grid point is selected on the other folds, as in the normal grid search, and a model trained with it on them is validated on the held-out fold, for an unbiased estimate of the performance of the tuned models. The outer-loop metrics go in the final models summary as Outer<metric> columns (0 means no nested crossvalidation)")
+	gridSpaceFile   = flag.String("gridspace", "gridspace.json", "JSON file with the hyperparameter space to grid search with crossvalidation (such as cost, gamma, number of models, implementation and signature heights): the values and CPSign flag of each parameter, with optional overrides of the values per target")
+
+	cpSignPath        = "../../bin/cpsign-0.6.14.jar"
+	cpSignLicensePath = "../../bin/cpsign.lic"
+	// crossValConfidences are the confidence levels at which crossvalidate
+	// reports the metrics of a grid point
+	crossValConfidences = "0.05, 0.1, 0.15, 0.2, 0.25, 0.3, 0.35, 0.4, 0.45, 0.5, 0.55, 0.6, 0.65, 0.7, 0.75, 0.8, 0.85, 0.9, 0.95"
+	// crossValFolds is the number of folds in (the final round of) the grid
+	// search
+	crossValFolds = 10
+	// targetStatsJSONPath is the file with the target statistics, against
+	// which the gene set rules are resolved
+	targetStatsJSONPath = "res/target_statistics.json"
 )
 
 func main() {
@@ -118,12 +87,85 @@ func main() {
 	} else {
 		sp.InitLogAudit()
 	}
-	if len(geneSets[*geneSet]) == 0 {
-		names := []string{}
-		for n := range geneSets {
-			names = append(names, n)
+	geneSetRules, err := genesets.LoadRules(*geneSetsFile)
+	sp.Check(err)
+	aliasTable, err := genesets.LoadAliasTable(*aliasesFile)
+	sp.Check(err)
+	if *missingTargets != "warn" && *missingTargets != "fail" {
+		sp.Error.Fatalf("Incorrect value %s for -missingtargets specified! Only allowed values are: warn, fail\n", *missingTargets)
+	}
+	fillUpConfig, err := sampling.LoadFillUpConfig(*fillUpFile)
+	sp.Check(err)
+	for _, name := range []string{*geneSet, fillUpConfig.GeneSet} {
+		if _, err := geneSetRules.Rule(name); err != nil {
+			sp.Error.Fatalf("Incorrect gene set %s specified! Only allowed values are: %s\n", name, str.Join(geneSetRules.Names(), ", "))
 		}
-		sp.Error.Fatalf("Incorrect gene set %s specified! Only allowed values are: %s\n", *geneSet, str.Join(names, ", "))
+	}
+	conflPolicy, err := excapedb.ParseConflictPolicy(*conflictPolicy)
+	sp.Check(err)
+	labeller, err := excapedb.ParseLabeller(*labelThresholds)
+	sp.Check(err)
+	speciesFilter, err := excapedb.ParseSpeciesFilter(*species, *orthologs)
+	sp.Check(err)
+	registry, err := datasrc.LoadRegistry(*dataSources)
+	sp.Check(err)
+	gridSpace, err := gridsearch.LoadSpace(*gridSpaceFile)
+	sp.Check(err)
+	if *gridSearchMode != "full" && *gridSearchMode != "halving" {
+		sp.Error.Fatalf("Incorrect grid search mode %s specified! Only allowed values are: full, halving\n", *gridSearchMode)
+	}
+	if *gridSearchMode == "halving" && gridSpace.Halving == nil {
+		sp.Error.Fatalf("Grid search mode halving specified, but there is no halving section in %s\n", *gridSpaceFile)
+	}
+	selObjective, err := gridsearch.ParseObjective(*objective)
+	sp.Check(err)
+	paramStore := gridsearch.NewStore(*paramStoreDir)
+	selection := &gridsearch.Selection{Objective: selObjective, Confidence: *selConfidence, ValidityTolerance: *validityTol}
+	registry.Offline = *offline
+	registry.AllowUnpinned = *allowUnpinned
+	cpSign := cpsign.NewTool(cpSignPath, cpSignLicensePath)
+	if *aggregation != "conflicts" && *aggregation != "consensus" {
+		sp.Error.Fatalf("Incorrect aggregation %s specified! Only allowed values are: conflicts, consensus\n", *aggregation)
+	}
+	runSets := str.Split(*runSetsFlag, ",")
+	runSetStrategies := map[string]sampling.Strategy{}
+	for _, runSet := range runSets {
+		strategy, doFill, err := parseRunSet(runSet)
+		if err != nil {
+			sp.Error.Fatalf("Incorrect run set %s specified! Only allowed values are: orig, fill, fill_<strategy>, balanced (%v)\n", runSet, err)
+		}
+		if doFill {
+			runSetStrategies[runSet] = strategy
+		}
+	}
+	var families *sampling.FamilyTable
+	for _, strategy := range runSetStrategies {
+		if strategy == sampling.ExcludeFamily && families == nil {
+			families, err = sampling.LoadFamilyTable(*familiesFile)
+			sp.Check(err)
+		}
+	}
+	if *scaffoldTest < 0 || *scaffoldTest >= 1 {
+		sp.Error.Fatalf("Incorrect scaffold test fraction %f specified! Must be at least 0 and less than 1\n", *scaffoldTest)
+	}
+	if *balanceRatio < 1 {
+		sp.Error.Fatalf("Incorrect balance ratio %f specified! Must be at least 1\n", *balanceRatio)
+	}
+	if *nestedCVFolds != 0 && *nestedCVFolds < 2 {
+		sp.Error.Fatalf("Incorrect number of nested crossvalidation folds %d specified! Must be 0 (no nested crossvalidation), or at least 2\n", *nestedCVFolds)
+	}
+	nestedConfidences := []float64{}
+	for _, confStr := range str.Split(crossValConfidences, ",") {
+		conf, err := strconv.ParseFloat(str.TrimSpace(confStr), 64)
+		sp.Check(err)
+		nestedConfidences = append(nestedConfidences, conf)
+	}
+	if *replicatesCnt < 1 {
+		sp.Error.Fatalf("Incorrect number of replicates %d specified! Must be at least 1\n", *replicatesCnt)
+	}
+	replicates := []string{}
+	for i := 1; i <= *replicatesCnt; i++ {
+		replicates = append(replicates, fmt.Sprintf("r%d", i))
 	}
 	runtime.GOMAXPROCS(*threads)
 
@@ -138,89 +180,76 @@ func main() {
 	// --------------------------------
 	wf := sp.NewWorkflow("train_models", *maxTasks)
 
+	// Data sources are resolved through the registry in datasources.json, which
+	// verifies their checksums, and records their versions and checksums in
+	// the audit info of all downstream files
 	dbFileName := "pubchem.chembl.dataset4publication_inchi_smiles.tsv.xz"
-	dlExcapeDB := wf.NewProc("dlDB", fmt.Sprintf("wget https://zenodo.org/record/173258/files/%s -O {o:excapexz}", dbFileName))
-	dlExcapeDB.SetPathStatic("excapexz", "../../raw/"+dbFileName)
-
-	unPackDB := wf.NewProc("unPackDB", "xzcat {i:xzfile} > {o:unxzed}")
-	unPackDB.SetPathReplace("xzfile", "unxzed", ".xz", "")
-	unPackDB.In("xzfile").Connect(dlExcapeDB.Out("excapexz"))
-
-	dataExcapeDB := unPackDB.Out("unxzed")
-	//unPackDB.Prepend = "salloc -A snic2017-7-89 -n 2 -t 8:00:00 -J unpack_excapedb"
-
-	// Download chemical structures and "links" (references) for *approved* (small molecule) drugs
-	dlApproved := wf.NewProc("dl_approv", "curl -Lfv -o {o:zip} -u $(cat drugbank_userinfo.txt) https://www.drugbank.ca/releases/5-0-11/downloads/approved-structure-links")
-	dlApproved.SetPathStatic("zip", "dat/drugbank_approved_csv.zip")
-	// Unzip the above file
-	unzipApproved := wf.NewProc("unzip_approved", `unzip -d dat/approved/ {i:zip}; mv "dat/approved/structure links.csv" {o:csv}`)
-	unzipApproved.SetPathStatic("csv", "dat/drugbank_approved.csv")
-	unzipApproved.In("zip").Connect(dlApproved.Out("zip"))
-
-	// Download chemical structures and "links" (references) for *withdrawn* (small molecule) drugs
-	dlWithdrawn := wf.NewProc("dl_withdrawn", "curl -Lfv -o {o:zip} -u $(cat drugbank_userinfo.txt) https://www.drugbank.ca/releases/5-0-11/downloads/withdrawn-structure-links")
-	dlWithdrawn.SetPathStatic("zip", "dat/drugbank_withdrawn_csv.zip")
-	// Unzip the above file
-	unzipWithdrawn := wf.NewProc("unzip_withdrawn", `unzip -d dat/withdrawn/ {i:zip}; mv "dat/withdrawn/structure links.csv" {o:csv}`)
-	unzipWithdrawn.SetPathStatic("csv", "dat/drugbank_withdrawn.csv")
-	unzipWithdrawn.In("zip").Connect(dlWithdrawn.Out("zip"))
-
-	// Extract only CHEMBL and PubChem IDs from DrugBank TSV files and merge into one file
-	drugBankCompIDCmd := `csvcut -K 1 -c 11,14 {i:drugbankcsv} | sed '/^,$/d' | sed '/^$/d' | sort -V > {o:compids}`
-	drugBankCompIDsApprov := wf.NewProc("drugbank_compids_appr", drugBankCompIDCmd)
-	drugBankCompIDsApprov.SetPathExtend("drugbankcsv", "compids", ".compids.csv")
-	drugBankCompIDsApprov.In("drugbankcsv").Connect(unzipApproved.Out("csv"))
-	drugBankCompIDsWithdr := wf.NewProc("drugbank_compids_withdr", drugBankCompIDCmd)
-	drugBankCompIDsWithdr.SetPathExtend("drugbankcsv", "compids", ".compids.csv")
-	drugBankCompIDsWithdr.In("drugbankcsv").Connect(unzipWithdrawn.Out("csv"))
-
-	excapeDBCompIDs := wf.NewProc("ext_excape_compids", `awk '{ print $2 }' {i:excapedb} | tail -n +2 | sort -V | uniq > {o:excape_compids}`)
-	excapeDBCompIDs.SetPathStatic("excape_compids", "dat/excapedb_compids.csv")
-	excapeDBCompIDs.In("excapedb").Connect(dataExcapeDB)
-
-	genRandSrcForDrugBankSelection := wf.NewProc("gen_randsrc_for_drugbank_selection", "dd if=/dev/urandom of={o:rand} bs=1024 count=1024") // HERE
-	genRandSrcForDrugBankSelection.SetPathStatic("rand", "dat/randsrc_for_drugbank_selection.bin")
-
-	// Approved/Withdrawn status in DrugBank is not mutually exclusive, so we need
-	// to filter out the approved ones that are only approved, but NOT also
-	// withdrawn
-	extractUniquelyApproved := wf.NewProc("extract_uniquely_approved", `awk 'FNR==NR { withdr[$0]; next } !($1 in withdr)' {i:withdr} {i:approv} > {o:uniqapprov}`)
-	extractUniquelyApproved.SetPathExtend("approv", "uniqapprov", ".uniq_appr.csv")
-	extractUniquelyApproved.In("withdr").Connect(drugBankCompIDsWithdr.Out("compids"))
-	extractUniquelyApproved.In("approv").Connect(drugBankCompIDsApprov.Out("compids"))
+	dlExcapeDB := NewResolveDataSource(wf, "dlDB", registry, "excapedb", "../../raw/"+dbFileName)
+
+	// The ExCAPE-DB file is read directly in its .xz compressed form, by the
+	// ExtractExcapeDBColumns processes below
+	dataExcapeDB := dlExcapeDB.OutFile()
+
+	// Download the full DrugBank database
+	dlDrugBank := NewResolveDataSource(wf, "dl_drugbank", registry, "drugbank", "dat/drugbank.zip")
+
+	// Unzip the full DrugBank database
+	unzipDrugBank := wf.NewProc("unzip_drugbank", `unzip -d dat/ {i:zip}; mv "dat/full database.xml" {o:xml}`)
+	unzipDrugBank.SetPathStatic("xml", "dat/drugbank.xml")
+	unzipDrugBank.In("zip").Connect(dlDrugBank.OutFile())
+
+	// Convert the DrugBank XML into a table with InChIKey, groups, ChEMBL and
+	// PubChem IDs and target genes for each drug, which is our source of
+	// record for DrugBank data
+	drugBankXMLToTSV := NewDrugBankXMLToTSV(wf, "drugbank_xml_to_tsv")
+	drugBankXMLToTSV.SetPathReplace("xml", "tsv", ".xml", ".tsv")
+	drugBankXMLToTSV.InXML().Connect(unzipDrugBank.Out("xml"))
+
+	// Extract only CHEMBL and PubChem IDs for approved and withdrawn (small
+	// molecule) drugs. Approved/Withdrawn status in DrugBank is not mutually
+	// exclusive, so we only take the approved ones that are NOT also withdrawn
+	drugBankCompIDsApprov := NewSelectDrugBankCompIDs(wf, "drugbank_compids_appr", []string{drugbank.GroupApproved}, []string{drugbank.GroupWithdrawn})
+	drugBankCompIDsApprov.SetPathStatic("compids", "dat/drugbank_approved.compids.uniq_appr.csv")
+	drugBankCompIDsApprov.InDrugBankTSV().Connect(drugBankXMLToTSV.OutTSV())
+	drugBankCompIDsWithdr := NewSelectDrugBankCompIDs(wf, "drugbank_compids_withdr", []string{drugbank.GroupWithdrawn}, []string{})
+	drugBankCompIDsWithdr.SetPathStatic("compids", "dat/drugbank_withdrawn.compids.csv")
+	drugBankCompIDsWithdr.InDrugBankTSV().Connect(drugBankXMLToTSV.OutTSV())
+
+	excapeDBCompIDs := NewExtractExcapeDBColumns(wf, "ext_excape_compids", []string{excapedb.ColOriginalEntryID}, "-uV", nil)
+	excapeDBCompIDs.SetPathStatic("tsv", "dat/excapedb_compids.csv")
+	excapeDBCompIDs.InExcapeDB().Connect(dataExcapeDB)
 
 	// Filter out only the DrugBank compound IDs available in DrugBank
 	drugBankCompIDsInExcapeDBCmd := `awk -F"," 'FNR==NR { edb[$1]; next } ($1 in edb) || ($2 in edb)' {i:excape_compids} {i:drugbank} > {o:out}`
 	drugBankCompIDsInExcapeDBApprov := wf.NewProc("drugbank_compids_in_excapedb_approv", drugBankCompIDsInExcapeDBCmd)
 	drugBankCompIDsInExcapeDBApprov.SetPathExtend("drugbank", "out", ".inexcapedb.csv")
-	drugBankCompIDsInExcapeDBApprov.In("excape_compids").Connect(excapeDBCompIDs.Out("excape_compids"))
-	drugBankCompIDsInExcapeDBApprov.In("drugbank").Connect(extractUniquelyApproved.Out("uniqapprov"))
+	drugBankCompIDsInExcapeDBApprov.In("excape_compids").Connect(excapeDBCompIDs.OutTSV())
+	drugBankCompIDsInExcapeDBApprov.In("drugbank").Connect(drugBankCompIDsApprov.OutCompIDs())
 	drugBankCompIDsInExcapeDBWithdr := wf.NewProc("drugbank_compids_in_excapedb_withdr", drugBankCompIDsInExcapeDBCmd)
 	drugBankCompIDsInExcapeDBWithdr.SetPathExtend("drugbank", "out", ".inexcapedb.csv")
-	drugBankCompIDsInExcapeDBWithdr.In("excape_compids").Connect(excapeDBCompIDs.Out("excape_compids"))
-	drugBankCompIDsInExcapeDBWithdr.In("drugbank").Connect(drugBankCompIDsWithdr.Out("compids"))
+	drugBankCompIDsInExcapeDBWithdr.In("excape_compids").Connect(excapeDBCompIDs.OutTSV())
+	drugBankCompIDsInExcapeDBWithdr.In("drugbank").Connect(drugBankCompIDsWithdr.OutCompIDs())
 
 	// Extract the approved compounds in DrugBank that we want to add to our set of
 	// DrugBank compounds to remove from the dataset before training
-	extractApprovedToAdd := wf.NewProc("extract_approved_to_add", `shuf --random-source={i:randsrc} -n $(awk 'END { print {p:nrcomp}-NR }' {i:withdr}) {i:approv} > {o:approved_to_add}`)
-	extractApprovedToAdd.SetPathCustom("approved_to_add", func(t *sp.Task) string {
-		return "dat/drugbank_compids_appr_to_add_for_tot_n" + t.Param("nrcomp") + ".csv"
+	extractApprovedToAdd := NewSampleToTotal(wf, "extract_approved_to_add", *samplingSeed)
+	extractApprovedToAdd.SetPathCustom("sampled", func(t *sp.Task) string {
+		return "dat/drugbank_compids_appr_to_add_for_tot_n" + t.Param("total") + ".seed" + t.Param("seed") + ".csv"
 	})
-	extractApprovedToAdd.In("approv").Connect(drugBankCompIDsInExcapeDBApprov.Out("out"))
-	extractApprovedToAdd.In("withdr").Connect(drugBankCompIDsInExcapeDBWithdr.Out("out"))
-	extractApprovedToAdd.In("randsrc").Connect(genRandSrcForDrugBankSelection.Out("rand"))
-	extractApprovedToAdd.ParamInPort("nrcomp").ConnectStr("1000")
+	extractApprovedToAdd.InFile().Connect(drugBankCompIDsInExcapeDBApprov.Out("out"))
+	extractApprovedToAdd.InOther().Connect(drugBankCompIDsInExcapeDBWithdr.Out("out"))
+	extractApprovedToAdd.ParamTotal().ConnectStr("1000")
 
 	// Simply merge the withdrawn compounds from DrugBank, with the selected
 	// approved ones, into one file
 	mergeApprWithdr := wf.NewProc("merge_appr_withdr", "cat {i:approv} {i:withdr} | sort -V | uniq > {o:out}")
 	mergeApprWithdr.SetPathStatic("out", "dat/drugbank_compids_to_remove.csv")
-	mergeApprWithdr.In("approv").Connect(extractApprovedToAdd.Out("approved_to_add"))
+	mergeApprWithdr.In("approv").Connect(extractApprovedToAdd.OutSampled())
 	mergeApprWithdr.In("withdr").Connect(drugBankCompIDsInExcapeDBWithdr.Out("out"))
 
 	// Merge the (sometimes) two comma-separated columns of compound IDs into one
 	// column, so it can be used as a skip-list for filtering out the selected
-	// DrugBank compounds in AWK later
+	// DrugBank compounds in the database later
 	makeOneColumn := wf.NewProc("make_one_column", `cat {i:infile} | tr "," "\n" | sed '/^,$/d' | sed '/^$/d' | sort -V > {o:onecol}`)
 	makeOneColumn.SetPathExtend("infile", "onecol", ".onecol.csv")
 	makeOneColumn.In("infile").Connect(mergeApprWithdr.Out("out"))
@@ -229,398 +258,777 @@ func main() {
 	drugBankIdsCsvToTsv.SetPathReplace("csv", "tsv", ".csv", ".tsv")
 	drugBankIdsCsvToTsv.In("csv").Connect(mergeApprWithdr.Out("out"))
 
-	// extractGISA extracts a file with only Gene symbol, id (orig entry), SMILES,
-	// and the Activity flag into a .tsv file, for easier subsequent parsing.
+	// extractMeasurements extracts a file with only Gene symbol, id (orig
+	// entry), SMILES, the Activity flag, pXC50, the assay id, InChIKey, Tax_ID
+	// and source DB, into a .tsv file, for easier subsequent parsing. Only the
+	// measurements on the species selected with -species are kept, and with
+	// -orthologs, the gene symbols are replaced with the one of the ortholog
+	// group.
 	// ATTENTION: The sorting order (Gene, SMILES, Activity) is super important,
 	// for the following component, `removeConflicting` to function properly!
-	extractGISA := wf.NewProc("extract_gene_id_smiles_activity", `awk -F "\t" '{ print $9 "\t" $2 "\t" $12 "\t" $4 }' {i:excapedb} | sort -uV -k 1,1 -k 3,3 -k 4,4 > {o:gene_id_smiles_activity}`)
-	extractGISA.SetPathReplace("excapedb", "gene_id_smiles_activity", ".tsv", ".gisa.tsv")
-	extractGISA.In("excapedb").Connect(dataExcapeDB)
-
-	// removeConflicting prints the previous line, unless it has the same values on
-	removeConflicting := wf.NewProc("remove_conflicting", `awk -F "\t" '((( prev1 != $1 ) && ( prev1 != "")) || (( prev3 != $3 ) && ( prev3 != "" ))) && !isconflicting[prev1,prev3] { print prev1 "\t" prev2 "\t" prev3 "\t" prev4 }
-																( seen[$1,$3] > 0 ) && ( activity[$1,$3] != $4 ) { isconflicting[$1,$3] = true }
-																{ seen[$1,$3]++; activity[$1,$3] = $4; prev1 = $1; prev2 = $2; prev3 = $3; prev4 = $4 }
-																END { print }' \
-															{i:gene_id_smiles_activity} > {o:gene_id_smiles_activity}`)
-	removeConflicting.SetPathReplace("gene_id_smiles_activity", "gene_id_smiles_activity", ".tsv", ".dedup.tsv")
-	removeConflicting.In("gene_id_smiles_activity").Connect(extractGISA.Out("gene_id_smiles_activity"))
-
-	// Create process for subtracting the DrugBank compounds HERE
-	remDrugBankComps := wf.NewProc("remove_drugbank_compounds", `awk 'FNR==NR { db[$1]; next } !($2 in db)' {i:compids_to_remove} {i:gisa} | sort -uV > {o:gisa_wo_drugbank}`)
-	remDrugBankComps.SetPathStatic("gisa_wo_drugbank", "dat/excapedb.gisa_wo_drugbank.tsv")
-	remDrugBankComps.In("compids_to_remove").Connect(makeOneColumn.Out("onecol"))
-	remDrugBankComps.In("gisa").Connect(removeConflicting.Out("gene_id_smiles_activity"))
-
-	// extractValidationRawdata prepares a data file for use in validation at the end of the workflow
-	extractValidationRawdata := wf.NewProc("extract_validation_rawdata", `awk -F"\t" 'FNR==NR { cid[$1]; cbl[$2]; next } (( $2 in cid ) || ($2 in cbl )) { print }' {i:removed_compids} {i:gisa} | sort -uV > {o:drugbank_removed}`)
-	extractValidationRawdata.In("removed_compids").Connect(drugBankIdsCsvToTsv.Out("tsv"))
-	extractValidationRawdata.In("gisa").Connect(removeConflicting.Out("gene_id_smiles_activity"))
-	extractValidationRawdata.SetPathExtend("gisa", "drugbank_removed", ".drugbank_removed.tsv")
-
-	finalModelsSummary := NewFinalModelSummarizer(wf, "finalmodels_summary_creator", "res/final_models_summary.tsv", '\t')
-
-	genRandomProcs := map[string]*sp.Process{}
-
-	// We only do the fill run-set here (filling up for "small" datasets)
-	runSets := []string{"fill"} // []string{"orig", "fill"}
+	extractMeasurements := NewExtractExcapeDBColumns(wf, "extract_gene_id_smiles_activity",
+		[]string{excapedb.ColGeneSymbol, excapedb.ColOriginalEntryID, excapedb.ColSMILES, excapedb.ColActivityFlag, excapedb.ColPXC50, excapedb.ColOriginalAssayID, excapedb.ColAmbitInchiKey, excapedb.ColTaxID, excapedb.ColDB},
+		"-s -V -k 1,1 -k 3,3 -k 4,4", speciesFilter)
+	measurementsExt := ".gisapa.tsv"
+	if speciesFilter.Tag() != "" {
+		measurementsExt = ".gisapa." + speciesFilter.Tag() + ".tsv"
+	}
+	extractMeasurements.SetPathReplace("excapedb", "tsv", ".tsv.xz", measurementsExt)
+	extractMeasurements.InExcapeDB().Connect(dataExcapeDB)
+
+	measurements := extractMeasurements.OutTSV()
+
+	// labelOnPXC50 optionally replaces the ExCAPE-DB activity flags with labels
+	// derived from pXC50 thresholds, dropping compounds in the grey zone. When
+	// aggregating on consensus, the thresholds are instead applied to the
+	// consensus pXC50 value of each compound.
+	if *labelThresholds != "" && *aggregation != "consensus" {
+		labellingTag := str.NewReplacer(":", "-", ",", "_", "=", "-").Replace(labeller.String())
+		labelOnPXC50 := NewLabelOnPXC50(wf, "label_on_pxc50", labeller)
+		labelOnPXC50.SetPathReplace("measurements", "labelled", ".tsv", ".labelled_"+labellingTag+".tsv")
+		labelOnPXC50.SetPathStatic("report", "res/labelling."+labellingTag+".tsv")
+		labelOnPXC50.InMeasurements().Connect(measurements)
+		measurements = labelOnPXC50.OutMeasurements()
+	}
+
+	// dedupGISA gets one row per compound and target. When aggregating on
+	// consensus, it has the extra columns measurement count and pXC50 spread,
+	// which are then added to the target data files.
+	var dedupGISA *sp.OutPort
+	if *aggregation == "consensus" {
+		// aggregateConsensus aggregates all measurements of the same compound
+		// (InChIKey) and target into one record, with a label derived from the
+		// consensus (median) pXC50 value
+		aggregateConsensus := NewAggregateConsensus(wf, "aggregate_consensus", labeller, *maxPXC50Spread)
+		aggregateConsensus.SetPathReplace("measurements", "gisa", ".tsv", ".consensus.tsv")
+		aggregateConsensus.InMeasurements().Connect(measurements)
+		dedupGISA = aggregateConsensus.OutGISA()
+	} else {
+		// removeConflicting resolves compounds with conflicting activity flags
+		// for the same target, according to the selected policy, and writes a
+		// report of all removed or relabelled compound/target pairs
+		removeConflicting := NewRemoveConflicting(wf, "remove_conflicting", conflPolicy)
+		removeConflicting.SetPathReplace("measurements", "gisa", ".tsv", ".dedup_"+string(conflPolicy)+".tsv")
+		removeConflicting.SetPathStatic("report", "res/conflicts."+string(conflPolicy)+".tsv")
+		removeConflicting.InMeasurements().Connect(measurements)
+		dedupGISA = removeConflicting.OutGISA()
+	}
+
+	// importToStore imports the data prepared above into an SQLite database
+	// indexed on gene symbol, from which the gene-specific branches below
+	// query their data, instead of each doing another pass over the full data
+	// files. The DrugBank compounds are removed from the data in the database.
+	importToStore := NewImportToStore(wf, "import_to_store")
+	importToStore.SetPathStatic("db", "dat/excapedb.sqlite")
+	importToStore.InGISA().Connect(dedupGISA)
+	importToStore.InDrugBankExclusions().Connect(makeOneColumn.Out("onecol"))
+
+	// remDrugBankComps writes the deduplicated data without the DrugBank
+	// compounds, from the database
+	remDrugBankComps := NewExportStoreTable(wf, "remove_drugbank_compounds", "gisa")
+	remDrugBankComps.SetPathStatic("tsv", "dat/excapedb.gisa_wo_drugbank.tsv")
+	remDrugBankComps.InDB().Connect(importToStore.OutDB())
+
+	// extractValidationRawdata writes the removed DrugBank compounds, from the
+	// database, for use in validation at the end of the workflow
+	extractValidationRawdata := NewExportStoreTable(wf, "extract_validation_rawdata", "drugbank_removed")
+	extractValidationRawdata.SetPathReplace("db", "tsv", ".sqlite", ".drugbank_removed.tsv")
+	extractValidationRawdata.InDB().Connect(importToStore.OutDB())
+
+	// targetStats computes statistics per target, such as the number of
+	// measurements, unique structures, assays, source DBs and species, and the
+	// number of compounds removed as conflicting, or as DrugBank compounds
+	targetStats := NewTargetStatistics(wf, "target_statistics", *aggregation)
+	targetStats.SetPathStatic("stats_tsv", "res/target_statistics.tsv")
+	targetStats.SetPathStatic("stats_json", targetStatsJSONPath)
+	targetStats.InMeasurements().Connect(measurements)
+	targetStats.InDedupGISA().Connect(dedupGISA)
+	targetStats.InFinalGISA().Connect(remDrugBankComps.OutTSV())
+	targetStats.InDrugBankRemoved().Connect(extractValidationRawdata.OutTSV())
+
+	// --------------------------------
+	// Resolve gene sets
+	// --------------------------------
+	// Gene sets with criteria on the number of compounds are resolved against
+	// the target statistics from an earlier run. If there are none yet, we
+	// only run the workflow up to computing them.
+	needsStats := false
+	for _, name := range []string{*geneSet, fillUpConfig.GeneSet} {
+		needs, err := geneSetRules.NeedsStats(name)
+		sp.Check(err)
+		needsStats = needsStats || needs
+	}
+	var statsByGene map[string]*excapedb.TargetStats
+	if _, err := os.Stat(targetStatsJSONPath); err == nil {
+		statsFh, err := os.Open(targetStatsJSONPath)
+		sp.Check(err)
+		allStats, err := excapedb.ReadStatsJSON(statsFh)
+		statsFh.Close()
+		sp.CheckWithMsg(err, "Could not read target statistics in "+targetStatsJSONPath)
+		statsByGene = genesets.StatsByGene(allStats)
+	} else if needsStats {
+		sp.Audit.Printf("Gene sets %s and %s are resolved from target statistics, which are not computed yet, so only running the workflow up to target_statistics. Run it again to train the models.\n", *geneSet, fillUpConfig.GeneSet)
+		wf.RunToRegex("target_statistics")
+		return
+	}
+	// Gene set members are resolved to the gene symbols in ExCAPE-DB through
+	// the alias table, and checked for availability if statistics exist
+	var availableGenes map[string]bool
+	if statsByGene != nil {
+		availableGenes = map[string]bool{}
+		for gene := range statsByGene {
+			availableGenes[gene] = true
+		}
+	} else {
+		sp.Warning.Printf("No target statistics in %s yet, so not checking that the gene set members are available in ExCAPE-DB\n", targetStatsJSONPath)
+	}
+	geneResolver := genesets.NewResolver(aliasTable, availableGenes)
+	geneSetRules.Resolver = geneResolver
+	resolvedGeneSets := map[string][]string{}
+	for _, name := range geneSetRules.Names() {
+		if needs, _ := geneSetRules.NeedsStats(name); needs && statsByGene == nil {
+			continue
+		}
+		resolvedGeneSets[name], err = geneSetRules.Resolve(name, statsByGene)
+		sp.Check(err)
+	}
+	if missing := geneResolver.Missing(); len(missing) > 0 {
+		if *missingTargets == "fail" {
+			sp.Error.Fatalf("Gene set members not available in ExCAPE-DB: %s\n", str.Join(missing, ", "))
+		}
+		sp.Warning.Printf("Gene set members not available in ExCAPE-DB, so left out: %s\n", str.Join(missing, ", "))
+	}
+	genes := resolvedGeneSets[*geneSet]
+	if len(genes) == 0 {
+		sp.Error.Fatalf("Gene set %s is empty, when resolved against the target statistics in %s\n", *geneSet, targetStatsJSONPath)
+	}
+	fillUpGenes := resolvedGeneSets[fillUpConfig.GeneSet]
+	sp.Audit.Printf("Resolved gene set %s to: %s\n", *geneSet, str.Join(genes, ", "))
+	sp.Audit.Printf("Resolved fill-up gene set %s to: %s\n", fillUpConfig.GeneSet, str.Join(fillUpGenes, ", "))
+	writeResolvedGeneSets("res/genesets.resolved.json", resolvedGeneSets, *geneSetsFile, geneResolver, registry)
+
+	finalModelsSummary := NewFinalModelSummarizer(wf, "finalmodels_summary_creator", "res/final_models_summary.tsv", '\t', *nestedCVFolds > 0)
+	finalModelsSummary.SelectPer = *selectPer
+	finalModelsSummary.InSpecies().Connect(targetStats.OutStatsTSV())
 
 	calibPlotPorts := []*sp.OutPort{}
 
 	// --------------------------------
 	// Set up gene-specific workflow branches
 	// --------------------------------
-	for _, geneUppercase := range geneSets[*geneSet] {
+	for _, geneUppercase := range genes {
 		geneLowerCase := str.ToLower(geneUppercase)
 		uniqStrGene := geneLowerCase
 
 		// extractTargetData extract all data for the specific target, into a separate file
-		extractTargetData := wf.NewProc("extract_target_data_"+uniqStrGene, `awk 'END { print "smiles\tactivity" }' /dev/null > {o:target_data} && awk -F"\t" '$1 == "{p:gene}" { print $3"\t"$4 }' {i:raw_data} >> {o:target_data}`)
-		extractTargetData.ParamInPort("gene").ConnectStr(geneUppercase)
-		extractTargetData.SetPathStatic("target_data", fmt.Sprintf("dat/%s/%s.tsv", geneLowerCase, geneLowerCase))
-		extractTargetData.In("raw_data").Connect(remDrugBankComps.Out("gisa_wo_drugbank"))
-		if *runSlurm {
-			extractTargetData.Prepend = "salloc -A snic2017-7-89 -n 4 -c 4 -t 1:00:00 -J scipipe_extract_" + geneLowerCase // SLURM string
-		}
+		extractTargetData := NewQueryStore(wf, "extract_target_data_"+uniqStrGene, geneUppercase, (*excapestore.Store).WriteTargetData)
+		extractTargetData.SetPathStatic("tsv", fmt.Sprintf("dat/%s/%s.tsv", geneLowerCase, geneLowerCase))
+		extractTargetData.InDB().Connect(importToStore.OutDB())
+		targetData := extractTargetData.OutTSV()
+
+		// extractTargetValidationData extracts the DrugBank compounds removed
+		// from the target data, for validation at the end of the workflow
+		extractTargetValidationData := NewQueryStore(wf, "extract_target_validation_data_"+uniqStrGene, geneUppercase, (*excapestore.Store).WriteDrugBankRemoved)
+		extractTargetValidationData.SetPathStatic("tsv", fmt.Sprintf("dat/validate/%s/%s.validation_data.tsv", geneLowerCase, geneLowerCase))
+		extractTargetValidationData.InDB().Connect(importToStore.OutDB())
+
+		// dedupTargetValData --------------------------------------------
+		dedupTargetValData := wf.NewProc("dedup_target_validation_data_"+uniqStrGene, `awk '
+			FNR == NR { ids[$1] = $2 "\t" $3; next }
+			( $1 in ids ) { print ids[$1] }
+			(!( $1 in ids ) && ( $2 in ids )) { print ids[$2] }' \
+		{i:target_val_data} {i:drugbank_compids} > {o:dedup}`)
+		dedupTargetValData.SetPathExtend("target_val_data", "dedup", ".dedup.tsv")
+		dedupTargetValData.In("target_val_data").Connect(extractTargetValidationData.OutTSV())
+		dedupTargetValData.In("drugbank_compids").Connect(drugBankIdsCsvToTsv.Out("tsv"))
+
+		// extractAssumedNPool (created only for genes that are filled up)
+		// extracts all compounds not measured on the target, to sample
+		// assumed negatives from
+		var assumedNPool *sp.OutPort
+
+		// scaffoldSplits (created only when a scaffold hold-out is asked for)
+		// split the target data per replicate into training data, and a test
+		// set without any scaffold in common with it
+		scaffoldSplits := map[string]*ScaffoldSplit{}
 
 		for _, runSet := range runSets {
 			uniqStrRunSet := uniqStrGene + "_" + runSet
 
+			strategy, isFillRunSet := runSetStrategies[runSet]
 			doFillUp := false
-			if runSet == "fill" && strInSlice(geneUppercase, geneSets["bowes44min100percls_small"]) {
+			if isFillRunSet && fillUpConfig.IsEligible(geneUppercase, strInSlice(geneUppercase, fillUpGenes)) {
 				doFillUp = true
 			}
 
-			countProcs := map[string]*sp.Process{}
 			for i, replicate := range replicates {
 				seed := i + 1 // Not sure if safe to use 0 as seed in CPSign, so ...(?)
 				uniqStrRepl := uniqStrRunSet + "_" + replicate
 
-				var assumedNonActive *sp.OutPort
-
-				if doFillUp {
-					sp.Audit.Printf("Filling up dataset with assumed negatives, for gene %s ...\n", geneUppercase)
-					genRandomID := "create_random_bytes_" + replicate
-					if _, ok := genRandomProcs[genRandomID]; !ok {
-						genRandomProcs[genRandomID] = wf.NewProc(genRandomID, "dd if=/dev/urandom of={o:rand} bs=1048576 count=1024")
+				trainData := targetData
+				var scaffoldTestData *sp.OutPort
+				if *scaffoldTest > 0 {
+					if _, ok := scaffoldSplits[replicate]; !ok {
+						scaffoldSplit := NewScaffoldSplit(wf, "scaffold_split_"+uniqStrGene+"_"+replicate, *scaffoldTest, *samplingSeed+int64(seed))
+						scaffoldSplit.SetPathCustom("train", func(t *sp.Task) string {
+							return fmt.Sprintf("dat/%s/%s/%s.%s.scaffold_train.tsv", geneLowerCase, t.Param("replicate"), geneLowerCase, t.Param("replicate"))
+						})
+						scaffoldSplit.SetPathCustom("test", func(t *sp.Task) string {
+							return fmt.Sprintf("dat/%s/%s/%s.%s.scaffold_test.tsv", geneLowerCase, t.Param("replicate"), geneLowerCase, t.Param("replicate"))
+						})
+						scaffoldSplit.InTargetData().Connect(targetData)
+						scaffoldSplit.ParamInPort("gene").ConnectStr(geneUppercase)
+						scaffoldSplit.ParamInPort("replicate").ConnectStr(replicate)
+						scaffoldSplits[replicate] = scaffoldSplit
 					}
-					genRandomProcs[genRandomID].SetPathStatic("rand", "dat/"+replicate+"_random_bytes.bin")
-
-					// Here we fill up TO the double amount of non-actives compared
-					// to number of actives, by multiplying the number of actives
-					// times two, and subtracting the number of existing
-					// non-actices (See "A*2-N" in the AWK-script below).
-					extractAssumedNonBinding := wf.NewProc("extract_assumed_n_"+uniqStrRepl, `
-					let "fillup_lines_cnt = "$(awk -F"\t" '$2 == "A" { A += 1 } $2 == "N" { N += 1 } END { print A*2-N }' {i:targetdata}) \
-					&& awk -F"\t" 'FNR==NR{target_smiles[$1]; next} ($1 != "{p:gene}") && !($3 in target_smiles) { print $3 "\tN" }' {i:targetdata} {i:rawdata} \
-					| sort -uV \
-					| shuf --random-source={i:randsrc} -n $fillup_lines_cnt > {o:assumed_n} # replicate:{p:replicate}`)
-					extractAssumedNonBinding.SetPathCustom("assumed_n", func(t *sp.Task) string {
+					trainData = scaffoldSplits[replicate].OutTrain()
+					scaffoldTestData = scaffoldSplits[replicate].OutTest()
+				}
+
+				// For the balanced run set, the majority class is undersampled
+				// (for large targets)
+				if runSet == "balanced" {
+					undersample := NewUndersampleMajority(wf, "undersample_majority_"+uniqStrRepl, *balanceRatio, *balanceMinCnt, *samplingSeed+int64(seed))
+					undersample.SetPathCustom("balanced", func(t *sp.Task) string {
 						gene := str.ToLower(t.Param("gene"))
 						repl := t.Param("replicate")
-						return "dat/" + gene + "/" + repl + "/" + gene + "." + repl + ".assumed_n.tsv"
+						return "dat/" + gene + "/" + repl + "/balanced/" + gene + "." + repl + ".balanced.tsv"
 					})
-					extractAssumedNonBinding.In("rawdata").Connect(remDrugBankComps.Out("gisa_wo_drugbank"))
-					extractAssumedNonBinding.In("targetdata").Connect(extractTargetData.Out("target_data"))
-					extractAssumedNonBinding.ParamInPort("gene").ConnectStr(geneUppercase)
-					extractAssumedNonBinding.ParamInPort("replicate").ConnectStr(replicate)
-					extractAssumedNonBinding.In("randsrc").Connect(genRandomProcs[genRandomID].Out("rand"))
-					assumedNonActive = extractAssumedNonBinding.Out("assumed_n")
+					undersample.InTargetData().Connect(trainData)
+					undersample.ParamInPort("gene").ConnectStr(geneUppercase)
+					undersample.ParamInPort("replicate").ConnectStr(replicate)
+					trainData = undersample.OutBalanced()
 				}
 
-				if replicate == "r1" {
-					catPart := `cat {i:targetdata}`
-					if doFillUp {
-						catPart = `cat {i:targetdata} {i:assumed_n}`
+				var assumedNonActive *sp.OutPort
+
+				if doFillUp {
+					sp.Audit.Printf("Filling up dataset with assumed negatives, for gene %s ...\n", geneUppercase)
+
+					if assumedNPool == nil {
+						extractAssumedNPool := NewQueryStore(wf, "extract_assumed_n_pool_"+uniqStrGene, geneUppercase, (*excapestore.Store).WriteAssumedNegativePool)
+						extractAssumedNPool.SetPathStatic("tsv", fmt.Sprintf("dat/%s/%s.assumed_n_pool.tsv", geneLowerCase, geneLowerCase))
+						extractAssumedNPool.InDB().Connect(importToStore.OutDB())
+						assumedNPool = extractAssumedNPool.OutTSV()
+					}
+
+					// Compounds measured on the other members of the target
+					// family, or active on any target in the gene set, are
+					// excluded from the pool, for the respective strategies
+					excludeGenes := []string{}
+					switch strategy {
+					case sampling.ExcludeFamily:
+						excludeGenes = families.Relatives(geneUppercase)
+					case sampling.ExcludePanelActives:
+						excludeGenes = genes
 					}
-					countProcs[uniqStrRunSet] = wf.NewProc("cnt_targetdata_rows_"+uniqStrRepl, catPart+` | awk '$2 == "A" { a += 1 } $2 == "N" { n += 1 } END { print a "\t" n }' > {o:count} # {p:runset} {p:gene} {p:replicate}`)
-					countProcs[uniqStrRunSet].SetPathCustom("count", func(t *sp.Task) string {
+					sampleAssumedNonBinding := NewSampleAssumedNegatives(wf, "extract_assumed_n_"+uniqStrRepl, geneUppercase, strategy, excludeGenes, fillUpConfig.Rule(geneUppercase), *samplingSeed+int64(seed))
+					sampleAssumedNonBinding.SetPathCustom("assumed_n", func(t *sp.Task) string {
 						gene := str.ToLower(t.Param("gene"))
 						repl := t.Param("replicate")
 						rset := t.Param("runset")
-						return "dat/" + gene + "/" + repl + "/" + rset + "/" + gene + "." + repl + "." + rset + ".cnt"
+						return "dat/" + gene + "/" + repl + "/" + rset + "/" + gene + "." + repl + "." + rset + ".assumed_n.tsv"
 					})
-					countProcs[uniqStrRunSet].In("targetdata").Connect(extractTargetData.Out("target_data"))
-					if doFillUp {
-						countProcs[uniqStrRunSet].In("assumed_n").Connect(assumedNonActive)
-					}
-					countProcs[uniqStrRunSet].ParamInPort("runset").ConnectStr(runSet)
-					countProcs[uniqStrRunSet].ParamInPort("gene").ConnectStr(geneUppercase)
-					countProcs[uniqStrRunSet].ParamInPort("replicate").ConnectStr(replicate)
+					sampleAssumedNonBinding.InDB().Connect(importToStore.OutDB())
+					sampleAssumedNonBinding.InPool().Connect(assumedNPool)
+					sampleAssumedNonBinding.InTargetData().Connect(trainData)
+					sampleAssumedNonBinding.ParamInPort("replicate").ConnectStr(replicate)
+					sampleAssumedNonBinding.ParamInPort("runset").ConnectStr(runSet)
+					assumedNonActive = sampleAssumedNonBinding.OutAssumedNeg()
 				}
 
-				// --------------------------------------------------------------------------------
-				// Pre-compute step
-				// --------------------------------------------------------------------------------
-				cpSignPrecompCmd := `java -jar ` + cpSignPath + ` precompute \
-									--license ../../bin/cpsign.lic \
-									--cptype 1 \
-									--trainfile {i:traindata} \
-									--response-name activity \
-									--labels A, N \
-									--model-out {o:precomp} \
-									--model-name "` + geneUppercase + `" \
-									--logfile {o:logfile}`
-				if doFillUp {
-					cpSignPrecompCmd += ` \
-									--proper-trainfile {i:propertraindata}`
-				}
-				cpSignPrecompCmd += ` # {p:gene} {p:runset} {p:replicate}`
-				cpSignPrecomp := wf.NewProc("cpsign_precomp_"+uniqStrRepl, cpSignPrecompCmd)
-				cpSignPrecomp.In("traindata").Connect(extractTargetData.Out("target_data"))
+				// Counts actives, non-actives, and the assumed negatives
+				// among the non-actives (the lines after the target data)
+				filesPart := `{i:targetdata}`
 				if doFillUp {
-					cpSignPrecomp.In("propertraindata").Connect(assumedNonActive)
+					filesPart = `{i:targetdata} {i:assumed_n}`
 				}
-				cpSignPrecomp.ParamInPort("gene").ConnectStr(geneLowerCase)
-				cpSignPrecomp.ParamInPort("replicate").ConnectStr(replicate)
-				cpSignPrecomp.ParamInPort("runset").ConnectStr(runSet)
-				precompPathFunc := func(t *sp.Task) string {
-					gene := t.Param("gene")
+				countTargetData := wf.NewProc("cnt_targetdata_rows_"+uniqStrRepl, `awk '$2 == "A" { a += 1 } $2 == "N" { n += 1 } FNR < NR && $2 == "N" { added += 1 } END { print a "\t" n "\t" added+0 }' `+filesPart+` > {o:count} # {p:runset} {p:gene} {p:replicate}`)
+				countTargetData.SetPathCustom("count", func(t *sp.Task) string {
+					gene := str.ToLower(t.Param("gene"))
 					repl := t.Param("replicate")
 					rset := t.Param("runset")
-					return "dat/" + gene + "/" + repl + "/" + rset + "/" + gene + "." + repl + "." + rset + ".precomp"
-				}
-				cpSignPrecomp.SetPathCustom("precomp", precompPathFunc)
-				cpSignPrecomp.SetPathCustom("logfile", func(t *sp.Task) string {
-					return precompPathFunc(t) + ".cpsign.log"
+					return "dat/" + gene + "/" + repl + "/" + rset + "/" + gene + "." + repl + "." + rset + ".cnt"
 				})
-				if *runSlurm {
-					cpSignPrecomp.Prepend = "salloc -A snic2017-7-89 -n 4 -c 4 -t 1-00:00:00 -J precmp_" + geneLowerCase // SLURM string
+				countTargetData.In("targetdata").Connect(trainData)
+				if doFillUp {
+					countTargetData.In("assumed_n").Connect(assumedNonActive)
+				}
+				countTargetData.ParamInPort("runset").ConnectStr(runSet)
+				countTargetData.ParamInPort("gene").ConnectStr(geneUppercase)
+				countTargetData.ParamInPort("replicate").ConnectStr(replicate)
+				finalModelsSummary.InTargetDataCount().Connect(countTargetData.Out("count"))
+
+				// outerSplits (created only for nested crossvalidation) split
+				// the training data into the outer folds, which are the same
+				// for all selection groups
+				outerSplits := []*OuterFoldSplit{}
+				for fold := 1; fold <= *nestedCVFolds; fold++ {
+					outerSplit := NewOuterFoldSplit(wf, fmt.Sprintf("outer_fold_split_%s_outer%d", uniqStrRepl, fold), *nestedCVFolds, fold, *samplingSeed+int64(seed))
+					outerSplitPathFunc := func(part string) func(t *sp.Task) string {
+						return func(t *sp.Task) string {
+							gene := str.ToLower(t.Param("gene"))
+							repl := t.Param("replicate")
+							rset := t.Param("runset")
+							return "dat/" + gene + "/" + repl + "/" + rset + "/nested/" + gene + "." + repl + "." + rset + ".outer" + t.Param("fold") + "." + part + ".tsv"
+						}
+					}
+					outerSplit.SetPathCustom("inner", outerSplitPathFunc("inner"))
+					outerSplit.SetPathCustom("outer", outerSplitPathFunc("outer"))
+					outerSplit.InTargetData().Connect(trainData)
+					outerSplit.ParamInPort("gene").ConnectStr(geneUppercase)
+					outerSplit.ParamInPort("replicate").ConnectStr(replicate)
+					outerSplit.ParamInPort("runset").ConnectStr(runSet)
+					outerSplits = append(outerSplits, outerSplit)
 				}
 
-				// --------------------------------------------------------------------------------
-				// Optimize cost/gamma-step
-				// --------------------------------------------------------------------------------
-				includeGamma := false // For liblinear
-				summarize := NewSummarizeCostGammaPerf(wf,
-					"summarize_cost_gamma_perf_"+uniqStrRepl,
-					"dat/"+runSet+"/"+geneLowerCase+"/"+replicate+"/"+geneLowerCase+"_cost_gamma_perf_stats.tsv",
-					includeGamma)
-
-				for _, cost := range costsPerTarget[geneUppercase] {
-					uniqStrCost := uniqStrRepl + "_" + cost
-					// If Liblinear
-					evalCostCmd := `java -jar ` + cpSignPath + ` crossvalidate \
-									--license ../../bin/cpsign.lic \
-									--seed {p:seed} \
-									--cptype 1 \
-									--trainfile {i:traindata} \
-									--response-name activity \
-									--impl liblinear \
-									--labels A, N \
-									--nr-models {p:nrmdl} \
-									--cost {p:cost} \
-									--cv-folds {p:cvfolds} \
-									--output-format json \
-									--logfile {o:logfile}`
-					if doFillUp {
-						evalCostCmd += ` \
-									--proper-trainfile {i:propertraindata}`
+				// Grid points are selected per value of the -selectper
+				// parameter (such as one model per implementation), if it has
+				// more than one value. With halving, all targets start from
+				// the declared values, rather than the values per target.
+				baseSpace := gridSpace.ForTarget(geneUppercase)
+				if *gridSearchMode == "halving" {
+					baseSpace = gridSpace
+				}
+				selGroups := []string{""}
+				if vals := baseSpace.Values(*selectPer); len(vals) > 1 {
+					selGroups = vals
+				}
+				for _, selGroup := range selGroups {
+					uniqStrSel := uniqStrRepl
+					groupTag := ""
+					searchSpace := baseSpace
+					if selGroup != "" {
+						uniqStrSel += "_" + selGroup
+						groupTag = "." + selGroup
+						searchSpace = baseSpace.Restrict(*selectPer, selGroup)
+					}
+
+					// --------------------------------------------------------------------------------
+					// Grid search step
+					// --------------------------------------------------------------------------------
+					// crossValCmd is the crossvalidate command of the searches
+					// that generate their own tasks (see AdaptiveGridSearch)
+					evalPointPrepend := ""
+					if *runSlurm {
+						evalPointPrepend = "salloc -A snic2017-7-89 -n 4 -c 4 -t 1-00:00:00 -J evalgp_" + uniqStrSel + " " // SLURM string
 					}
-					evalCostCmd += ` \
-									--confidences "{p:confidences}" | grep -P "^\[" > {o:stats} # {p:gene} {p:runset} {p:replicate}`
-					evalCost := wf.NewProc("crossval_"+uniqStrCost, evalCostCmd)
-					evalCostStatsPathFunc := func(t *sp.Task) string {
-						cost, err := strconv.ParseInt(t.Param("cost"), 10, 0)
+					crossValCmd := func(trainPath string, properTrainPath string, gridArgs string, cvFolds int, statsPath string) string {
+						cmd, err := cpSign.CommandLine(&cpsign.CrossValidate{
+							Common:          cpsign.Common{LogFile: statsPath + ".cpsign.log"},
+							Seed:            fmt.Sprintf("%d", seed),
+							TrainFile:       trainPath,
+							ProperTrainFile: properTrainPath,
+							ResponseName:    "activity",
+							Labels:          []string{"A", "N"},
+							ExtraArgs:       gridArgs,
+							CVFolds:         fmt.Sprintf("%d", cvFolds),
+							OutputFormat:    "json",
+							Confidences:     crossValConfidences,
+						})
 						sp.Check(err)
-						gene := str.ToLower(t.Param("gene"))
+						return evalPointPrepend + cmd + " " + cpsign.JSONTo(statsPath)
+					}
+					gridSearchDir := "dat/" + geneLowerCase + "/" + replicate + "/" + runSet + "/"
+					gridSearchPrefix := gridSearchDir + geneLowerCase + "." + replicate + "." + runSet + groupTag
+					// The space as searched, and the selection settings, are
+					// stored with the selected grid point, so that a warm start
+					// only reuses it for the same search
+					searchedSpace := *searchSpace
+					if *gridSearchMode == "full" {
+						searchedSpace.Halving = nil
+					}
+					searchHash, err := gridsearch.SearchHash(&searchedSpace, selection)
+					sp.Check(err)
+					var gridSearchResults *sp.OutPort
+					if *gridSearchMode == "halving" || *warmStart {
+						// Crossvalidate tasks are generated round by round, as
+						// the results come in
+						adaptiveGridSearch := NewAdaptiveGridSearch(wf,
+							"adaptive_gridsearch_"+uniqStrSel,
+							&searchedSpace,
+							selection,
+							doFillUp)
+						adaptiveGridSearch.Group = selGroup
+						adaptiveGridSearch.Store = paramStore
+						adaptiveGridSearch.WarmStart = *warmStart
+						adaptiveGridSearch.SearchHash = searchHash
+						adaptiveGridSearch.Gene = geneUppercase
+						adaptiveGridSearch.Replicate = replicate
+						adaptiveGridSearch.Runset = runSet
+						adaptiveGridSearch.PathPrefix = gridSearchPrefix
+						adaptiveGridSearch.CVFolds = crossValFolds
+						adaptiveGridSearch.FileName = gridSearchPrefix + ".gridsearch.tsv"
+						adaptiveGridSearch.CrossValCmd = crossValCmd
+						adaptiveGridSearch.InTrainData().Connect(trainData)
+						if doFillUp {
+							adaptiveGridSearch.InProperTrainData().Connect(assumedNonActive)
+						}
+						gridSearchResults = adaptiveGridSearch.OutResults()
+					} else {
+						collectGridSearch := NewGridSearchCollect(wf,
+							"collect_gridsearch_"+uniqStrSel,
+							gridSearchPrefix+".gridsearch.tsv")
+
+						for _, gridPoint := range searchSpace.Points() {
+							uniqStrPoint := uniqStrSel + "_" + gridPoint.Tag()
+							crossValidate := &cpsign.CrossValidate{
+								Seed:         "{p:seed}",
+								TrainFile:    "{i:traindata}",
+								ResponseName: "activity",
+								Labels:       []string{"A", "N"},
+								ExtraArgs:    "{p:grid_args}",
+								CVFolds:      "{p:cvfolds}",
+								OutputFormat: "json",
+								Confidences:  "{p:confidences}",
+							}
+							if doFillUp {
+								crossValidate.ProperTrainFile = "{i:propertraindata}"
+							}
+							evalPoint, err := cpSign.NewProc(wf, "crossval_"+uniqStrPoint, crossValidate, cpsign.JSONTo("{o:stats}")+" # {p:gene} {p:runset} {p:replicate} {p:grid_point}")
+							sp.Check(err)
+							evalPointStatsPath := gridSearchPrefix + "." + gridPoint.Tag() + ".cvstats.json"
+							evalPoint.SetPathStatic("stats", evalPointStatsPath)
+							if doFillUp {
+								evalPoint.In("propertraindata").Connect(assumedNonActive)
+							}
+							evalPoint.In("traindata").Connect(trainData)
+							evalPoint.ParamInPort("seed").ConnectStr(fmt.Sprintf("%d", seed))
+							evalPoint.ParamInPort("grid_args").ConnectStr(gridPoint.Args(gridsearch.StageCrossValidate))
+							evalPoint.ParamInPort("cvfolds").ConnectStr(fmt.Sprintf("%d", crossValFolds))
+							evalPoint.ParamInPort("confidences").ConnectStr(crossValConfidences)
+							evalPoint.ParamInPort("gene").ConnectStr(geneUppercase)
+							evalPoint.ParamInPort("runset").ConnectStr(runSet)
+							evalPoint.ParamInPort("replicate").ConnectStr(replicate)
+							evalPoint.ParamInPort("grid_point").ConnectStr(gridPoint.Key())
+							if *runSlurm {
+								evalPoint.Prepend = "salloc -A snic2017-7-89 -n 4 -c 4 -t 1-00:00:00 -J evalgp_" + uniqStrPoint // SLURM string
+							}
+
+							extractCalibrationData := wf.NewProc("extract_calibration_data_"+uniqStrPoint, "# {i:cvstats} {o:tsv}")
+							extractCalibrationData.SetPathExtend("cvstats", "tsv", ".calibration.tsv")
+							extractCalibrationData.In("cvstats").Connect(evalPoint.Out("stats"))
+							extractCalibrationData.CustomExecute = func(t *sp.Task) {
+								tsvFh := t.OutIP("tsv").OpenWriteTemp()
+								defer tsvFh.Close()
+
+								tsvWrt := csv.NewWriter(tsvFh)
+								tsvWrt.Comma = '\t'
+
+								cvStatsRecords := &[]cpSignCrossValOutput{}
+								t.InIP("cvstats").UnMarshalJSON(cvStatsRecords)
+
+								tsvWrt.Write([]string{"confidence", "accuracty"})
+								for _, crossValOut := range *cvStatsRecords {
+									confidence := fmt.Sprintf("%.3f", crossValOut.Confidence)
+									accuracy := fmt.Sprintf("%.3f", crossValOut.Accuracy)
+									tsvWrt.Write([]string{confidence, accuracy})
+								}
+								tsvWrt.Flush()
+							}
+
+							plotCalibrationData := wf.NewProc("plot_calibration_data_"+uniqStrPoint, "Rscript bin/plot_calibration.r -i {i:tsv} -o {o:pdf} -f pdf -g {p:gene}")
+							plotCalibrationData.SetPathExtend("tsv", "pdf", ".pdf")
+							plotCalibrationData.ParamInPort("gene").ConnectStr(geneUppercase)
+							plotCalibrationData.In("tsv").Connect(extractCalibrationData.Out("tsv"))
+							calibPlotPorts = append(calibPlotPorts, plotCalibrationData.Out("pdf"))
+
+							collectGridSearch.InStats().Connect(evalPoint.Out("stats"))
+						} // end for grid point
+						gridSearchResults = collectGridSearch.OutResults()
+					}
+
+					selectBest := NewGridSearchSelectBest(wf,
+						"select_best_gridpoint_"+uniqStrSel,
+						gridSpace,
+						selection,
+						paramStore,
+						doFillUp)
+					selectBest.Group = selGroup
+					selectBest.SearchHash = searchHash
+					selectBest.InResults().Connect(gridSearchResults)
+					selectBest.InTrainData().Connect(trainData)
+					if doFillUp {
+						selectBest.InProperTrainData().Connect(assumedNonActive)
+					}
+
+					// The downstream steps read the selected grid point from the
+					// best parameter store
+					bestParams := NewBestGridPointParams(wf, "best_gridpoint_params_"+uniqStrSel)
+					bestParams.InBest().Connect(selectBest.OutBest())
+
+					// --------------------------------------------------------------------------------
+					// Pre-compute step
+					// --------------------------------------------------------------------------------
+					precompute := &cpsign.Precompute{
+						TrainFile:    "{i:traindata}",
+						ResponseName: "activity",
+						Labels:       []string{"A", "N"},
+						ExtraArgs:    "{p:grid_args}",
+						ModelOut:     "{o:precomp}",
+						ModelName:    geneUppercase,
+					}
+					if doFillUp {
+						precompute.ProperTrainFile = "{i:propertraindata}"
+					}
+					cpSignPrecomp, err := cpSign.NewProc(wf, "cpsign_precomp_"+uniqStrSel, precompute, "# {p:gene} {p:runset} {p:replicate}")
+					sp.Check(err)
+					cpSignPrecomp.In("traindata").Connect(trainData)
+					if doFillUp {
+						cpSignPrecomp.In("propertraindata").Connect(assumedNonActive)
+					}
+					cpSignPrecomp.ParamInPort("gene").ConnectStr(geneLowerCase)
+					cpSignPrecomp.ParamInPort("replicate").ConnectStr(replicate)
+					cpSignPrecomp.ParamInPort("runset").ConnectStr(runSet)
+					cpSignPrecomp.ParamInPort("grid_args").Connect(bestParams.OutArgsPrecompute())
+					precompPathFunc := func(t *sp.Task) string {
+						gene := t.Param("gene")
 						repl := t.Param("replicate")
 						rset := t.Param("runset")
-						return filepath.Dir(t.InPath("traindata")) + "/" + repl + "/" + rset + "/" + fmt.Sprintf("%s.%s.%s.liblin_c%03d", gene, repl, rset, cost) + ".cvstats.json"
+						return "dat/" + gene + "/" + repl + "/" + rset + "/" + gene + "." + repl + "." + rset + groupTag + ".precomp"
 					}
-					evalCost.SetPathCustom("stats", evalCostStatsPathFunc)
-					evalCost.SetPathCustom("logfile", func(t *sp.Task) string {
-						return evalCostStatsPathFunc(t) + ".cpsign.log"
-					})
-					if doFillUp {
-						evalCost.In("propertraindata").Connect(assumedNonActive)
+					cpSignPrecomp.SetPathCustom("precomp", precompPathFunc)
+					if *runSlurm {
+						cpSignPrecomp.Prepend = "salloc -A snic2017-7-89 -n 4 -c 4 -t 1-00:00:00 -J precmp_" + geneLowerCase // SLURM string
+					}
+
+					// --------------------------------------------------------------------------------
+					// Train step
+					// --------------------------------------------------------------------------------
+					// The curve-level metrics of the selected grid point, over all
+					// confidence levels, go in the train command comment as well
+					curveMetricsPart := ""
+					for _, name := range gridsearch.CurveMetricNames() {
+						curveMetricsPart += " " + name + ": {p:curve_" + name + "}"
+					}
+					cpSignTrain, err := cpSign.NewProc(wf, "cpsign_train_"+uniqStrSel,
+						&cpsign.Train{
+							Seed:            "{p:seed}",
+							ModelFile:       "{i:model}",
+							Labels:          []string{"A", "N"},
+							ExtraArgs:       "{p:grid_args}",
+							PercentilesFile: "{i:percentilesfile}",
+							Percentiles:     "{p:nrpercentiles}",
+							ModelOut:        "{o:model}",
+							ModelName:       "{p:gene}",
+						},
+						`# {p:runset} {p:replicate} Panel entry: {p:panel_entry} Labelling: {p:labelling} Grid point: {p:grid_point} Accuracy: {p:accuracy} Efficiency: {p:efficiency} Class-Equalized Observed Fuzziness: {p:obsfuzz_classavg} Observed Fuzziness (Overall): {p:obsfuzz_overall} Observed Fuzziness (Active class): {p:obsfuzz_active} Observed Fuzziness (Non-active class): {p:obsfuzz_nonactive} Class Confidence: {p:class_confidence} Class Credibility: {p:class_credibility}`+curveMetricsPart)
+					sp.Check(err)
+					cpSignTrain.In("model").Connect(cpSignPrecomp.Out("precomp"))
+					cpSignTrain.In("percentilesfile").Connect(trainData)
+					cpSignTrain.ParamInPort("seed").ConnectStr(fmt.Sprintf("%d", seed))
+					cpSignTrain.ParamInPort("gene").ConnectStr(geneUppercase)
+					cpSignTrain.ParamInPort("replicate").ConnectStr(replicate)
+					cpSignTrain.ParamInPort("runset").ConnectStr(runSet)
+					cpSignTrain.ParamInPort("grid_point").Connect(bestParams.OutGridPoint())
+					cpSignTrain.ParamInPort("grid_args").Connect(bestParams.OutArgsTrain())
+					cpSignTrain.ParamInPort("accuracy").Connect(bestParams.OutAccuracy())
+					cpSignTrain.ParamInPort("efficiency").Connect(bestParams.OutEfficiency())
+					cpSignTrain.ParamInPort("obsfuzz_classavg").Connect(bestParams.OutObsFuzzClassAvg())
+					cpSignTrain.ParamInPort("obsfuzz_overall").Connect(bestParams.OutObsFuzzOverall())
+					cpSignTrain.ParamInPort("obsfuzz_active").Connect(bestParams.OutObsFuzzActive())
+					cpSignTrain.ParamInPort("obsfuzz_nonactive").Connect(bestParams.OutObsFuzzNonactive())
+					cpSignTrain.ParamInPort("class_confidence").Connect(bestParams.OutClassConfidence())
+					cpSignTrain.ParamInPort("class_credibility").Connect(bestParams.OutClassCredibility())
+					for _, name := range gridsearch.CurveMetricNames() {
+						cpSignTrain.ParamInPort("curve_" + name).Connect(bestParams.OutCurveMetric(name))
 					}
-					evalCost.In("traindata").Connect(extractTargetData.Out("target_data"))
-					evalCost.ParamInPort("seed").ConnectStr(fmt.Sprintf("%d", seed))
-					evalCost.ParamInPort("nrmdl").ConnectStr("10")
-					evalCost.ParamInPort("cvfolds").ConnectStr("10")
-					evalCost.ParamInPort("confidences").ConnectStr("0.05, 0.1, 0.15, 0.2, 0.25, 0.3, 0.35, 0.4, 0.45, 0.5, 0.55, 0.6, 0.65, 0.7, 0.75, 0.8, 0.85, 0.9, 0.95")
-					evalCost.ParamInPort("gene").ConnectStr(geneUppercase)
-					evalCost.ParamInPort("runset").ConnectStr(runSet)
-					evalCost.ParamInPort("replicate").ConnectStr(replicate)
-					evalCost.ParamInPort("cost").ConnectStr(cost)
+					cpSignTrain.ParamInPort("nrpercentiles").ConnectStr("200") // Reasonable number according to staffan
+					cpSignTrain.ParamInPort("labelling").ConnectStr(labeller.Tag(geneUppercase))
+					panelEntry, _ := geneResolver.Substitution(geneUppercase)
+					cpSignTrain.ParamInPort("panel_entry").ConnectStr(panelEntry)
+					cpSignTrainModelPathFunc := func(t *sp.Task) string {
+						labelling := ""
+						if t.Param("labelling") != "" {
+							labelling = "." + t.Param("labelling")
+						}
+						gridPoint, err := gridSpace.ParsePoint(t.Param("grid_point"))
+						sp.Check(err)
+						return fmt.Sprintf("dat/final_models/%s/%s/%s/%s.%s.%s%s.%s.mdl.jar",
+							str.ToLower(t.Param("gene")),
+							t.Param("replicate"),
+							t.Param("runset"),
+							str.ToLower(t.Param("gene")),
+							t.Param("replicate"),
+							t.Param("runset"),
+							labelling,
+							gridPoint.Tag())
+					}
+					cpSignTrain.SetPathCustom("model", cpSignTrainModelPathFunc)
 					if *runSlurm {
-						evalCost.Prepend = "salloc -A snic2017-7-89 -n 4 -c 4 -t 1-00:00:00 -J evalcg_" + uniqStrCost // SLURM string
+						cpSignTrain.Prepend = "salloc -A snic2017-7-89 -n 4 -c 4 -t 1-00:00:00 -J train_" + uniqStrSel // SLURM string
 					}
 
-					extractCalibrationData := wf.NewProc("extract_calibration_data_"+uniqStrCost, "# {i:cvstats} {o:tsv}")
-					extractCalibrationData.SetPathExtend("cvstats", "tsv", ".calibration.tsv")
-					extractCalibrationData.In("cvstats").Connect(evalCost.Out("stats"))
-					extractCalibrationData.CustomExecute = func(t *sp.Task) {
-						tsvFh := t.OutIP("tsv").OpenWriteTemp()
-						defer tsvFh.Close()
+					embedAuditLog := NewEmbedAuditLogInJar(wf, "embed_auditlog_"+uniqStrSel)
+					embedAuditLog.InJarFile().Connect(cpSignTrain.Out("model"))
 
-						tsvWrt := csv.NewWriter(tsvFh)
-						tsvWrt.Comma = '\t'
+					finalModelsSummary.InModel().Connect(cpSignTrain.Out("model"))
 
-						cvStatsRecords := &[]cpSignCrossValOutput{}
-						t.InIP("cvstats").UnMarshalJSON(cvStatsRecords)
+					// ------------------------------------------
+					// Validate excluded DrugBank compounds (compare predicted and actual values)
+					// ------------------------------------------
+					// gisa: gene, id, smiles, activity. sa: smiles, activity
 
-						tsvWrt.Write([]string{"confidence", "accuracty"})
-						for _, crossValOut := range *cvStatsRecords {
-							confidence := fmt.Sprintf("%.3f", crossValOut.Confidence)
-							accuracy := fmt.Sprintf("%.3f", crossValOut.Accuracy)
-							tsvWrt.Write([]string{confidence, accuracy})
+					// validateDrugBank ----------------------------------------------
+					validate := &cpsign.Validate{
+						ModelFile:          "{i:model}",
+						PredictFile:        "{i:smiles}",
+						ValidationProperty: "activity",
+						Confidences:        "{p:confidences}",
+						OutputFormat:       "json",
+						Output:             "{o:json}",
+					}
+					validateDrugBank, err := cpSign.NewProc(wf, "validate_drugbank_"+uniqStrSel, validate, "# {p:gene} {p:replicate} {p:runset}")
+					sp.Check(err)
+					validateDrugBankJSONPathFunc := func(t *sp.Task) string {
+						uniqStrReplRunset := t.Param("gene") + "." + t.Param("replicate") + "." + t.Param("runset")
+						return "dat/validate/" + uniqStrReplRunset + "/" + uniqStrReplRunset + groupTag + ".validate_drugbank_1000.json"
+					}
+					validateDrugBank.SetPathCustom("json", validateDrugBankJSONPathFunc)
+					validateDrugBank.In("model").Connect(cpSignTrain.Out("model"))
+					validateDrugBank.In("smiles").Connect(dedupTargetValData.Out("dedup")) // Create target specific data file
+					validateDrugBank.ParamInPort("gene").ConnectStr(geneLowerCase)
+					validateDrugBank.ParamInPort("replicate").ConnectStr(replicate)
+					validateDrugBank.ParamInPort("runset").ConnectStr(runSet)
+					validateDrugBank.ParamInPort("confidences").ConnectStr("0.8, 0.9")
+
+					// validateScaffoldHoldout -----------------------------------------
+					// Validate on the compounds held out from training, which have
+					// no scaffold in common with the training data
+					if scaffoldTestData != nil {
+						validateScaffoldHoldout, err := cpSign.NewProc(wf, "validate_scaffold_holdout_"+uniqStrSel, validate, "# {p:gene} {p:replicate} {p:runset}")
+						sp.Check(err)
+						validateScaffoldHoldoutJSONPathFunc := func(t *sp.Task) string {
+							uniqStrReplRunset := t.Param("gene") + "." + t.Param("replicate") + "." + t.Param("runset")
+							return "dat/validate/" + uniqStrReplRunset + "/" + uniqStrReplRunset + groupTag + ".validate_scaffold_holdout.json"
 						}
-						tsvWrt.Flush()
+						validateScaffoldHoldout.SetPathCustom("json", validateScaffoldHoldoutJSONPathFunc)
+						validateScaffoldHoldout.In("model").Connect(cpSignTrain.Out("model"))
+						validateScaffoldHoldout.In("smiles").Connect(scaffoldTestData)
+						validateScaffoldHoldout.ParamInPort("gene").ConnectStr(geneLowerCase)
+						validateScaffoldHoldout.ParamInPort("replicate").ConnectStr(replicate)
+						validateScaffoldHoldout.ParamInPort("runset").ConnectStr(runSet)
+						validateScaffoldHoldout.ParamInPort("confidences").ConnectStr("0.8, 0.9")
 					}
 
-					plotCalibrationData := wf.NewProc("plot_calibration_data_"+uniqStrCost, "Rscript bin/plot_calibration.r -i {i:tsv} -o {o:pdf} -f pdf -g {p:gene}")
-					plotCalibrationData.SetPathExtend("tsv", "pdf", ".pdf")
-					plotCalibrationData.ParamInPort("gene").ConnectStr(geneUppercase)
-					plotCalibrationData.In("tsv").Connect(extractCalibrationData.Out("tsv"))
-					calibPlotPorts = append(calibPlotPorts, plotCalibrationData.Out("pdf"))
-
-					extractCostGammaStats := spc.NewMapToKeys(wf, "extract_cgstats_"+uniqStrCost, func(ip *sp.FileIP) map[string]string {
-						newKeys := map[string]string{}
-						crossValOuts := &[]cpSignCrossValOutput{}
-						ip.UnMarshalJSON(crossValOuts)
-						for _, crossValOut := range *crossValOuts {
-							if diff := math.Abs(crossValOut.Confidence - 0.9); diff < 0.001 {
-								newKeys["confidence"] = fmt.Sprintf("%.3f", crossValOut.Confidence)
-								newKeys["accuracy"] = fmt.Sprintf("%.3f", crossValOut.Accuracy)
-								newKeys["efficiency"] = fmt.Sprintf("%.3f", crossValOut.Efficiency)
-								newKeys["class_confidence"] = fmt.Sprintf("%.3f", crossValOut.ClassConfidence)
-								newKeys["class_credibility"] = fmt.Sprintf("%.3f", crossValOut.ClassCredibility)
-								newKeys["obsfuzz_active"] = fmt.Sprintf("%.3f", crossValOut.ObservedFuzziness.Active)
-								newKeys["obsfuzz_nonactive"] = fmt.Sprintf("%.3f", crossValOut.ObservedFuzziness.Nonactive)
-								newKeys["obsfuzz_overall"] = fmt.Sprintf("%.3f", crossValOut.ObservedFuzziness.Overall)
-							}
+					// --------------------------------------------------------------------------------
+					// Nested crossvalidation
+					// --------------------------------------------------------------------------------
+					// In each outer fold, the best grid point is selected with the
+					// same grid search and selection on the other folds, and a
+					// model trained with it on them is validated on the outer fold
+					if len(outerSplits) > 0 {
+						nestedGroup := selGroup
+						if vals := searchSpace.Values(*selectPer); len(vals) == 1 {
+							nestedGroup = vals[0]
 						}
-						return newKeys
-					})
-					extractCostGammaStats.In().Connect(evalCost.Out("stats"))
-
-					summarize.In().Connect(extractCostGammaStats.Out())
-				} // end for cost
-
-				selectBest := NewBestCostGamma(wf,
-					"select_best_cost_gamma_"+uniqStrRepl,
-					'\t',
-					false, includeGamma)
-				selectBest.InCSVFile().Connect(summarize.OutStats())
-
-				// --------------------------------------------------------------------------------
-				// Train step
-				// --------------------------------------------------------------------------------
-				cpSignTrain := wf.NewProc("cpsign_train_"+uniqStrRepl,
-					`java -jar `+cpSignPath+` train \
-									--license ../../bin/cpsign.lic \
-									--seed {p:seed} \
-									--cptype 1 \
-									--modelfile {i:model} \
-									--labels A, N \
-									--impl liblinear \
-									--nr-models {p:nrmdl} \
-									--cost {p:cost} \
-									--percentilesfile {i:percentilesfile} \
-									--percentiles {p:nrpercentiles} \
-									--model-out {o:model} \
-									--logfile {o:logfile} \
-									--model-name "{p:gene}" # {p:runset} {p:replicate} Accuracy: {p:accuracy} Efficiency: {p:efficiency} Class-Equalized Observed Fuzziness: {p:obsfuzz_classavg} Observed Fuzziness (Overall): {p:obsfuzz_overall} Observed Fuzziness (Active class): {p:obsfuzz_active} Observed Fuzziness (Non-active class): {p:obsfuzz_nonactive} Class Confidence: {p:class_confidence} Class Credibility: {p:class_credibility}`)
-				cpSignTrain.In("model").Connect(cpSignPrecomp.Out("precomp"))
-				cpSignTrain.In("percentilesfile").Connect(extractTargetData.Out("target_data"))
-				cpSignTrain.ParamInPort("seed").ConnectStr(fmt.Sprintf("%d", seed))
-				cpSignTrain.ParamInPort("nrmdl").ConnectStr("10")
-				cpSignTrain.ParamInPort("gene").ConnectStr(geneUppercase)
-				cpSignTrain.ParamInPort("replicate").ConnectStr(replicate)
-				cpSignTrain.ParamInPort("runset").ConnectStr(runSet)
-				cpSignTrain.ParamInPort("accuracy").Connect(selectBest.OutBestAccuracy())
-				cpSignTrain.ParamInPort("efficiency").Connect(selectBest.OutBestEfficiency())
-				cpSignTrain.ParamInPort("obsfuzz_classavg").Connect(selectBest.OutBestObsFuzzClassAvg())
-				cpSignTrain.ParamInPort("obsfuzz_overall").Connect(selectBest.OutBestObsFuzzOverall())
-				cpSignTrain.ParamInPort("obsfuzz_active").Connect(selectBest.OutBestObsFuzzActive())
-				cpSignTrain.ParamInPort("obsfuzz_nonactive").Connect(selectBest.OutBestObsFuzzNonactive())
-				cpSignTrain.ParamInPort("class_confidence").Connect(selectBest.OutBestClassConfidence())
-				cpSignTrain.ParamInPort("class_credibility").Connect(selectBest.OutBestClassCredibility())
-				cpSignTrain.ParamInPort("cost").Connect(selectBest.OutBestCost())
-				cpSignTrain.ParamInPort("nrpercentiles").ConnectStr("200") // Reasonable number according to staffan
-				cpSignTrainModelPathFunc := func(t *sp.Task) string {
-					return fmt.Sprintf("dat/final_models/%s/%s/%s/%s.%s.%s.%s_c%s_nrmdl%s.mdl.jar",
-						str.ToLower(t.Param("gene")),
-						t.Param("replicate"),
-						t.Param("runset"),
-						str.ToLower(t.Param("gene")),
-						t.Param("replicate"),
-						t.Param("runset"),
-						"liblin",
-						t.Param("cost"),
-						t.Param("nrmdl"))
-				}
-				cpSignTrain.SetPathCustom("model", cpSignTrainModelPathFunc)
-				cpSignTrain.SetPathCustom("logfile", func(t *sp.Task) string {
-					return cpSignTrainModelPathFunc(t) + ".cpsign.log"
-				})
-				if *runSlurm {
-					cpSignTrain.Prepend = "salloc -A snic2017-7-89 -n 4 -c 4 -t 1-00:00:00 -J train_" + uniqStrRepl // SLURM string
-				}
-
-				embedAuditLog := NewEmbedAuditLogInJar(wf, "embed_auditlog_"+uniqStrRepl)
-				embedAuditLog.InJarFile().Connect(cpSignTrain.Out("model"))
+						collectNestedCV := NewNestedCVCollect(wf, "collect_nested_cv_"+uniqStrSel, gridSearchPrefix+".nestedcv.json", nestedConfidences, *selConfidence)
+						collectNestedCV.Group = nestedGroup
+						for i, outerSplit := range outerSplits {
+							fold := i + 1
+							uniqStrFold := fmt.Sprintf("%s_outer%d", uniqStrSel, fold)
+							foldPrefix := fmt.Sprintf("%snested/%s.%s.%s%s.outer%d", gridSearchDir, geneLowerCase, replicate, runSet, groupTag, fold)
+							// The grid points selected in the outer folds are
+							// kept apart from the ones of the final models
+							foldStore := gridsearch.NewStore(filepath.Join(*paramStoreDir, "nested", fmt.Sprintf("outer%d", fold)))
+
+							innerGridSearch := NewAdaptiveGridSearch(wf,
+								"inner_gridsearch_"+uniqStrFold,
+								&searchedSpace,
+								selection,
+								doFillUp)
+							innerGridSearch.Group = selGroup
+							innerGridSearch.Store = foldStore
+							innerGridSearch.WarmStart = *warmStart
+							innerGridSearch.SearchHash = searchHash
+							innerGridSearch.Gene = geneUppercase
+							innerGridSearch.Replicate = replicate
+							innerGridSearch.Runset = runSet
+							innerGridSearch.PathPrefix = foldPrefix
+							innerGridSearch.CVFolds = crossValFolds
+							innerGridSearch.FileName = foldPrefix + ".gridsearch.tsv"
+							innerGridSearch.CrossValCmd = crossValCmd
+							innerGridSearch.InTrainData().Connect(outerSplit.OutInner())
+							if doFillUp {
+								innerGridSearch.InProperTrainData().Connect(assumedNonActive)
+							}
 
-				finalModelsSummary.InModel().Connect(cpSignTrain.Out("model"))
+							innerSelectBest := NewGridSearchSelectBest(wf,
+								"inner_select_best_gridpoint_"+uniqStrFold,
+								gridSpace,
+								selection,
+								foldStore,
+								doFillUp)
+							innerSelectBest.Group = selGroup
+							innerSelectBest.SearchHash = searchHash
+							innerSelectBest.InResults().Connect(innerGridSearch.OutResults())
+							innerSelectBest.InTrainData().Connect(outerSplit.OutInner())
+							if doFillUp {
+								innerSelectBest.InProperTrainData().Connect(assumedNonActive)
+							}
+							innerParams := NewBestGridPointParams(wf, "inner_best_gridpoint_params_"+uniqStrFold)
+							innerParams.InBest().Connect(innerSelectBest.OutBest())
+
+							innerPrecomp, err := cpSign.NewProc(wf, "nested_precomp_"+uniqStrFold, precompute, "# {p:gene} {p:runset} {p:replicate}")
+							sp.Check(err)
+							innerPrecomp.SetPathStatic("precomp", foldPrefix+".precomp")
+							innerPrecomp.In("traindata").Connect(outerSplit.OutInner())
+							if doFillUp {
+								innerPrecomp.In("propertraindata").Connect(assumedNonActive)
+							}
+							innerPrecomp.ParamInPort("gene").ConnectStr(geneLowerCase)
+							innerPrecomp.ParamInPort("replicate").ConnectStr(replicate)
+							innerPrecomp.ParamInPort("runset").ConnectStr(runSet)
+							innerPrecomp.ParamInPort("grid_args").Connect(innerParams.OutArgsPrecompute())
+							if *runSlurm {
+								innerPrecomp.Prepend = "salloc -A snic2017-7-89 -n 4 -c 4 -t 1-00:00:00 -J precmp_" + uniqStrFold // SLURM string
+							}
 
-				// ------------------------------------------
-				// Validate excluded DrugBank compounds (compare predicted and actual values)
-				// ------------------------------------------
-				// gisa: gene, id, smiles, activity. sa: smiles, activity
+							innerTrain, err := cpSign.NewProc(wf, "nested_train_"+uniqStrFold,
+								&cpsign.Train{
+									Seed:      "{p:seed}",
+									ModelFile: "{i:model}",
+									Labels:    []string{"A", "N"},
+									ExtraArgs: "{p:grid_args}",
+									ModelOut:  "{o:model}",
+									ModelName: "{p:gene}",
+								},
+								"# {p:runset} {p:replicate} Outer fold: {p:outer_fold} Grid point: {p:grid_point}")
+							sp.Check(err)
+							innerTrain.SetPathStatic("model", foldPrefix+".mdl.jar")
+							innerTrain.In("model").Connect(innerPrecomp.Out("precomp"))
+							innerTrain.ParamInPort("seed").ConnectStr(fmt.Sprintf("%d", seed))
+							innerTrain.ParamInPort("gene").ConnectStr(geneUppercase)
+							innerTrain.ParamInPort("replicate").ConnectStr(replicate)
+							innerTrain.ParamInPort("runset").ConnectStr(runSet)
+							innerTrain.ParamInPort("outer_fold").ConnectStr(fmt.Sprintf("%d", fold))
+							innerTrain.ParamInPort("grid_point").Connect(innerParams.OutGridPoint())
+							innerTrain.ParamInPort("grid_args").Connect(innerParams.OutArgsTrain())
+							if *runSlurm {
+								innerTrain.Prepend = "salloc -A snic2017-7-89 -n 4 -c 4 -t 1-00:00:00 -J train_" + uniqStrFold // SLURM string
+							}
 
-				// extractTargetValidationData -----------------------------------
-				extractTargetValidationData := wf.NewProc("extract_target_validation_data_"+uniqStrRepl, `awk '
-					( $1 == "`+geneUppercase+`" ) { print $2 "\t" $3 "\t" $4 }' \
-				{i:raw} > {o:tgt} # {p:gene} {p:replicate} {p:runset}`)
-				extractTargetValidationData.SetPathCustom("tgt", func(t *sp.Task) string {
-					uniqStrReplRunset := t.Param("gene") + "." + t.Param("replicate") + "." + t.Param("runset")
-					return "dat/validate/" + uniqStrReplRunset + "/" + uniqStrReplRunset + ".validation_data.tsv"
-				})
-				extractTargetValidationData.In("raw").Connect(extractValidationRawdata.Out("drugbank_removed")) // HERE
-				extractTargetValidationData.ParamInPort("gene").ConnectStr(geneLowerCase)
-				extractTargetValidationData.ParamInPort("replicate").ConnectStr(replicate)
-				extractTargetValidationData.ParamInPort("runset").ConnectStr(runSet)
-
-				// dedupTargetValData --------------------------------------------
-				dedupTargetValData := wf.NewProc("dedup_target_validation_data_"+uniqStrRepl, `awk '
-					FNR == NR { ids[$1] = $2 "\t" $3; next }
-					( $1 in ids ) { print ids[$1] }
-					(!( $1 in ids ) && ( $2 in ids )) { print ids[$2] }' \
-				{i:target_val_data} {i:drugbank_compids} > {o:dedup}`)
-				dedupTargetValData.SetPathExtend("target_val_data", "dedup", ".dedup.tsv")
-				dedupTargetValData.In("target_val_data").Connect(extractTargetValidationData.Out("tgt"))
-				dedupTargetValData.In("drugbank_compids").Connect(drugBankIdsCsvToTsv.Out("tsv"))
-
-				// validateDrugBank ----------------------------------------------
-				validateDrugBank := wf.NewProc("validate_drugbank_"+uniqStrRepl, `java -jar `+cpSignPath+` validate \
-									--license ../../bin/cpsign.lic \
-									--cptype 1 \
-									--modelfile {i:model} \
-									--predictfile {i:smiles} \
-									--validation-property activity \
-									--confidences {p:confidences} \
-									--output-format json \
-									--logfile {o:log} \
-									--output {o:json} # {p:gene} {p:replicate} {p:runset}`)
-				validateDrugBankJSONPathFunc := func(t *sp.Task) string {
-					uniqStrReplRunset := t.Param("gene") + "." + t.Param("replicate") + "." + t.Param("runset")
-					return "dat/validate/" + uniqStrReplRunset + "/" + uniqStrReplRunset + ".validate_drugbank_1000.json"
-				}
-				validateDrugBank.SetPathCustom("json", validateDrugBankJSONPathFunc)
-				validateDrugBank.SetPathCustom("log", func(t *sp.Task) string {
-					return validateDrugBankJSONPathFunc(t) + ".cpsign.log"
-				})
-				validateDrugBank.In("model").Connect(cpSignTrain.Out("model"))
-				validateDrugBank.In("smiles").Connect(dedupTargetValData.Out("dedup")) // Create target specific data file
-				validateDrugBank.ParamInPort("gene").ConnectStr(geneLowerCase)
-				validateDrugBank.ParamInPort("replicate").ConnectStr(replicate)
-				validateDrugBank.ParamInPort("runset").ConnectStr(runSet)
-				validateDrugBank.ParamInPort("confidences").ConnectStr("0.8, 0.9")
+							// The outer fold is predicted at all the confidence
+							// levels of the grid search, for the curve-level
+							// metrics
+							validateOuterFold, err := cpSign.NewProc(wf, "validate_outer_fold_"+uniqStrFold, validate, "# {p:gene} {p:replicate} {p:runset} {p:grid_point} Outer fold: {p:outer_fold}")
+							sp.Check(err)
+							validateOuterFold.SetPathStatic("json", foldPrefix+".validate.json")
+							validateOuterFold.In("model").Connect(innerTrain.Out("model"))
+							validateOuterFold.In("smiles").Connect(outerSplit.OutOuter())
+							validateOuterFold.ParamInPort("gene").ConnectStr(geneLowerCase)
+							validateOuterFold.ParamInPort("replicate").ConnectStr(replicate)
+							validateOuterFold.ParamInPort("runset").ConnectStr(runSet)
+							validateOuterFold.ParamInPort("confidences").ConnectStr(crossValConfidences)
+							validateOuterFold.ParamInPort("outer_fold").ConnectStr(fmt.Sprintf("%d", fold))
+							validateOuterFold.ParamInPort("grid_point").Connect(innerParams.OutGridPoint())
+							collectNestedCV.InValidation().Connect(validateOuterFold.Out("json"))
+						}
+						finalModelsSummary.InNestedCV().Connect(collectNestedCV.OutNested())
+					}
+				} // end: for selection group
 
 			} // end: for replicate
-			finalModelsSummary.InTargetDataCount().Connect(countProcs[uniqStrRunSet].Out("count"))
 		} // end: runset
 	} // end: for gene
 
@@ -632,15 +1040,22 @@ func main() {
 	mergeCalibPlots.SetPathStatic("merged", "dat/calibration_plots.png")
 	mergeCalibPlots.In("plots").Connect(sts.OutSubStream())
 
-	sortSummaryOnDataSize := wf.NewProc("sort_summary", "head -n 1 {i:summary} > {o:sorted} && tail -n +2 {i:summary} | sort -k 17n,17 -k 2,2 -k 3r,3 >> {o:sorted}")
+	sortSummaryOnDataSize := wf.NewProc("sort_summary", "head -n 1 {i:summary} > {o:sorted} && tail -n +2 {i:summary} | sort -k 18n,18 -k 2,2 -k 3r,3 >> {o:sorted}")
 	sortSummaryOnDataSize.SetPathReplace("summary", "sorted", ".tsv", ".sorted.tsv")
 	sortSummaryOnDataSize.In("summary").Connect(finalModelsSummary.OutSummary())
 
+	// Aggregate the metrics over replicates, into mean, standard deviation,
+	// min and max per gene and runset
+	aggregateSummary := NewSummaryAggregator(wf, "aggregate_summary")
+	aggregateSummary.SetPathReplace("summary", "aggregated", ".tsv", ".aggregated.tsv")
+	aggregateSummary.InSummary().Connect(finalModelsSummary.OutSummary())
+
 	for _, runSet := range runSets {
-		plotSummary := wf.NewProc("plot_summary_"+runSet, "Rscript bin/plot_summary.r -i {i:summary} -o {o:plot} -f pdf # gene:{i:gene_smiles_activity} runset:{p:runset}")
+		plotSummary := wf.NewProc("plot_summary_"+runSet, "Rscript bin/plot_summary.r -i {i:summary} -a {i:aggregated} -o {o:plot} -f pdf # gene:{i:gene_smiles_activity} runset:{p:runset}")
 		plotSummary.SetPathExtend("summary", "plot", "."+runSet+".pdf")
 		plotSummary.In("summary").Connect(sortSummaryOnDataSize.Out("sorted"))
-		plotSummary.In("gene_smiles_activity").Connect(remDrugBankComps.Out("gisa_wo_drugbank"))
+		plotSummary.In("aggregated").Connect(aggregateSummary.OutAggregated())
+		plotSummary.In("gene_smiles_activity").Connect(remDrugBankComps.OutTSV())
 		plotSummary.ParamInPort("runset").ConnectStr(runSet)
 	}
 
@@ -686,6 +1101,51 @@ type cpSignObservedFuzziness struct {
 	Overall   float64 `json:"overall"`
 }
 
+// writeResolvedGeneSets writes the members of the resolved gene sets to a JSON
+// file, together with the rules and the version of ExCAPE-DB they were
+// resolved against, and the members that were substituted or missing
+func writeResolvedGeneSets(path string, resolvedGeneSets map[string][]string, rulesFile string, resolver *genesets.Resolver, registry *datasrc.Registry) {
+	excapeVersion := ""
+	if src, err := registry.Source("excapedb"); err == nil {
+		excapeVersion = src.Version
+	}
+	substitutions := map[string]string{}
+	for _, genes := range resolvedGeneSets {
+		for _, gene := range genes {
+			if panelEntry, ok := resolver.Substitution(gene); ok {
+				substitutions[panelEntry] = gene
+			}
+		}
+	}
+	data, err := json.MarshalIndent(map[string]interface{}{
+		"rules":            rulesFile,
+		"substitutions":    substitutions,
+		"missing":          resolver.Missing(),
+		"statistics":       targetStatsJSONPath,
+		"excapedb_version": excapeVersion,
+		"gene_sets":        resolvedGeneSets,
+	}, "", "  ")
+	sp.Check(err)
+	sp.Check(os.MkdirAll(filepath.Dir(path), 0755))
+	sp.CheckWithMsg(ioutil.WriteFile(path, append(data, '\n'), 0644), "Could not write resolved gene sets to "+path)
+}
+
+// parseRunSet parses a run set name (orig, balanced, fill or
+// fill_<strategy>) into the strategy for sampling assumed negatives, and
+// whether the run set fills up the data at all
+func parseRunSet(runSet string) (sampling.Strategy, bool, error) {
+	switch {
+	case runSet == "orig" || runSet == "balanced":
+		return "", false, nil
+	case runSet == "fill":
+		return sampling.Uniform, true, nil
+	case str.HasPrefix(runSet, "fill_"):
+		strategy, err := sampling.ParseStrategy(str.TrimPrefix(runSet, "fill_"))
+		return strategy, err == nil, err
+	}
+	return "", false, fmt.Errorf("unknown run set: %s", runSet)
+}
+
 func strInSlice(searchStr string, strings []string) bool {
 	for _, str := range strings {
 		if searchStr == str {
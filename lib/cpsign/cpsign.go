@@ -0,0 +1,376 @@
+// Package cpsign builds command lines for CPSign, the conformal prediction
+// tool that the target profile models are trained with, from option structs
+// per subcommand (see Precompute, CrossValidate, Train and Validate), and
+// SciPipe processes running them (see Tool.NewProc). Option values may be
+// SciPipe placeholders, such as {i:traindata} or {p:seed}, which are filled in
+// when the process runs.
+package cpsign
+
+import (
+	"fmt"
+	str "strings"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+// ClassificationACP is the conformal predictor type (--cptype) of aggregated
+// conformal classification, which all our models are
+const ClassificationACP = 1
+
+// Tool is a CPSign jar file, with the license to run it with
+type Tool struct {
+	JarPath     string
+	LicensePath string
+}
+
+// NewTool returns a Tool for the jar file and license at the given paths
+func NewTool(jarPath string, licensePath string) *Tool {
+	return &Tool{JarPath: jarPath, LicensePath: licensePath}
+}
+
+// Command is the options of a CPSign subcommand
+type Command interface {
+	// Subcommand returns the name of the subcommand, such as train
+	Subcommand() string
+	// Args returns the command line flags of the options, or an error if a
+	// required option is missing
+	Args() ([]string, error)
+	common() *Common
+}
+
+// Common are the options of all subcommands
+type Common struct {
+	// CPType is the conformal predictor type, which is ClassificationACP if
+	// not set
+	CPType int
+	// LogFile is the path of the CPSign log. In processes from Tool.NewProc,
+	// it is written to the out-port logfile if not set (see
+	// Process.SetPathStatic).
+	LogFile string
+}
+
+func (c *Common) common() *Common { return c }
+
+// ================================================================================
+
+// Precompute are the options of CPSign precompute, which computes the
+// signatures descriptors of the training data
+type Precompute struct {
+	Common
+	TrainFile       string
+	ProperTrainFile string
+	ResponseName    string
+	Labels          []string
+	ModelOut        string
+	ModelName       string
+	// ExtraArgs are further flags, such as those of a grid point (see
+	// gridsearch.Point.Args), put in the command line as they are
+	ExtraArgs string
+}
+
+func (c *Precompute) Subcommand() string { return "precompute" }
+
+func (c *Precompute) Args() ([]string, error) {
+	a := newArgList(&c.Common)
+	a.require("--trainfile", c.TrainFile)
+	a.add("--response-name", c.ResponseName)
+	a.addLabels(c.Labels)
+	a.addVerbatim(c.ExtraArgs)
+	a.require("--model-out", c.ModelOut)
+	a.addQuoted("--model-name", c.ModelName)
+	a.addLogFile(c.LogFile)
+	a.add("--proper-trainfile", c.ProperTrainFile)
+	return a.result(c.Subcommand())
+}
+
+// ================================================================================
+
+// CrossValidate are the options of CPSign crossvalidate, which writes the
+// metrics of a crossvalidation to standard output (see JSONTo)
+type CrossValidate struct {
+	Common
+	Seed            string
+	TrainFile       string
+	ProperTrainFile string
+	ResponseName    string
+	Labels          []string
+	Impl            string
+	NrModels        string
+	Cost            string
+	// ExtraArgs are further flags, such as those of a grid point (see
+	// gridsearch.Point.Args), put in the command line as they are
+	ExtraArgs    string
+	CVFolds      string
+	OutputFormat string
+	// Confidence is the single confidence level of older CPSign versions.
+	// Newer ones take a comma-separated list of Confidences.
+	Confidence  string
+	Confidences string
+}
+
+func (c *CrossValidate) Subcommand() string { return "crossvalidate" }
+
+func (c *CrossValidate) Args() ([]string, error) {
+	a := newArgList(&c.Common)
+	a.add("--seed", c.Seed)
+	a.require("--trainfile", c.TrainFile)
+	a.add("--response-name", c.ResponseName)
+	a.add("--impl", c.Impl)
+	a.addLabels(c.Labels)
+	a.add("--nr-models", c.NrModels)
+	a.add("--cost", c.Cost)
+	a.addVerbatim(c.ExtraArgs)
+	a.require("--cv-folds", c.CVFolds)
+	a.add("--output-format", c.OutputFormat)
+	a.addLogFile(c.LogFile)
+	a.add("--proper-trainfile", c.ProperTrainFile)
+	if c.Confidence == "" && c.Confidences == "" {
+		a.missing = append(a.missing, "--confidences")
+	}
+	a.add("--confidence", c.Confidence)
+	a.addQuoted("--confidences", c.Confidences)
+	return a.result(c.Subcommand())
+}
+
+// ================================================================================
+
+// Train are the options of CPSign train, which trains a model from the output
+// of CPSign precompute
+type Train struct {
+	Common
+	Seed      string
+	ModelFile string
+	Labels    []string
+	Impl      string
+	NrModels  string
+	Cost      string
+	// ExtraArgs are further flags, such as those of a grid point (see
+	// gridsearch.Point.Args), put in the command line as they are
+	ExtraArgs       string
+	PercentilesFile string
+	Percentiles     string
+	ModelOut        string
+	ModelName       string
+}
+
+func (c *Train) Subcommand() string { return "train" }
+
+func (c *Train) Args() ([]string, error) {
+	a := newArgList(&c.Common)
+	a.add("--seed", c.Seed)
+	a.require("--modelfile", c.ModelFile)
+	a.addLabels(c.Labels)
+	a.add("--impl", c.Impl)
+	a.add("--nr-models", c.NrModels)
+	a.add("--cost", c.Cost)
+	a.addVerbatim(c.ExtraArgs)
+	a.add("--percentilesfile", c.PercentilesFile)
+	a.add("--percentiles", c.Percentiles)
+	a.require("--model-out", c.ModelOut)
+	a.addLogFile(c.LogFile)
+	a.addQuoted("--model-name", c.ModelName)
+	return a.result(c.Subcommand())
+}
+
+// ================================================================================
+
+// Validate are the options of CPSign validate, which predicts compounds with
+// known labels with a model, and writes the predictions to Output
+type Validate struct {
+	Common
+	ModelFile          string
+	PredictFile        string
+	ValidationProperty string
+	Confidences        string
+	OutputFormat       string
+	Output             string
+}
+
+func (c *Validate) Subcommand() string { return "validate" }
+
+func (c *Validate) Args() ([]string, error) {
+	a := newArgList(&c.Common)
+	a.require("--modelfile", c.ModelFile)
+	a.require("--predictfile", c.PredictFile)
+	a.require("--validation-property", c.ValidationProperty)
+	a.requireQuoted("--confidences", c.Confidences)
+	a.add("--output-format", c.OutputFormat)
+	a.addLogFile(c.LogFile)
+	a.require("--output", c.Output)
+	return a.result(c.Subcommand())
+}
+
+// ================================================================================
+
+// CommandLine returns the full command line of a subcommand, or an error if
+// a required option is missing
+func (t *Tool) CommandLine(c Command) (string, error) {
+	if t.JarPath == "" || t.LicensePath == "" {
+		return "", fmt.Errorf("cpsign: need the paths of both the jar file and the license")
+	}
+	args, err := c.Args()
+	if err != nil {
+		return "", err
+	}
+	return str.Join(append([]string{"java", "-jar", shellQuote(t.JarPath), c.Subcommand(), "--license", shellQuote(t.LicensePath)}, args...), " "), nil
+}
+
+// JSONTo returns a redirection of the JSON output of a CPSign command to a
+// file, which leaves out the log messages among it, for appending to its
+// command line
+func JSONTo(path string) string {
+	return `| grep -P "^[\[{]" > ` + path
+}
+
+// Process is a SciPipe process running a CPSign subcommand
+type Process struct {
+	*sp.Process
+	// ownLog tells whether the process writes the CPSign log to its out-port
+	// logfile, of which the path follows the one of the other out-port
+	ownLog bool
+}
+
+// NewProc returns a SciPipe process running a CPSign subcommand, with tail
+// (such as a redirection of the output, or a comment with params to record
+// in the audit log) appended to the command line. If the command has no
+// LogFile, the log is written to the out-port logfile (see SetPathStatic).
+func (t *Tool) NewProc(wf *sp.Workflow, name string, c Command, tail string) (*Process, error) {
+	common := c.common()
+	ownLog := common.LogFile == ""
+	if ownLog {
+		common.LogFile = "{o:logfile}"
+		defer func() { common.LogFile = "" }()
+	}
+	cmd, err := t.CommandLine(c)
+	if err != nil {
+		return nil, fmt.Errorf("cpsign: could not create process %s: %v", name, err)
+	}
+	if tail != "" {
+		cmd += " " + tail
+	}
+	return &Process{Process: wf.NewProc(name, cmd), ownLog: ownLog}, nil
+}
+
+// SetPathStatic sets the path of an out-port, and, if the process writes the
+// CPSign log to the out-port logfile, its path to the same path with the
+// extension .cpsign.log
+func (p *Process) SetPathStatic(port string, path string) {
+	p.Process.SetPathStatic(port, path)
+	if p.ownLog && port != "logfile" {
+		p.Process.SetPathStatic("logfile", path+".cpsign.log")
+	}
+}
+
+// SetPathCustom is like SetPathStatic, for a path computed per task
+func (p *Process) SetPathCustom(port string, pathFunc func(t *sp.Task) string) {
+	p.Process.SetPathCustom(port, pathFunc)
+	if p.ownLog && port != "logfile" {
+		p.Process.SetPathCustom("logfile", func(t *sp.Task) string {
+			return pathFunc(t) + ".cpsign.log"
+		})
+	}
+}
+
+// SetPathExtend is like SetPathStatic, for a path extending the one of an
+// in-port
+func (p *Process) SetPathExtend(inPort string, outPort string, extension string) {
+	p.Process.SetPathExtend(inPort, outPort, extension)
+	if p.ownLog && outPort != "logfile" {
+		p.Process.SetPathExtend(inPort, "logfile", extension+".cpsign.log")
+	}
+}
+
+// ================================================================================
+
+// argList renders options as command line flags, keeping track of the missing
+// required ones
+type argList struct {
+	args    []string
+	missing []string
+}
+
+func newArgList(common *Common) *argList {
+	cpType := common.CPType
+	if cpType == 0 {
+		cpType = ClassificationACP
+	}
+	return &argList{args: []string{"--cptype", fmt.Sprintf("%d", cpType)}}
+}
+
+func (a *argList) add(flag string, val string) {
+	if val != "" {
+		a.args = append(a.args, flag, shellQuote(val))
+	}
+}
+
+// addQuoted adds a flag with a value that is always quoted, such as a list of
+// confidence levels, or a model name, which may contain spaces when a
+// placeholder in it is filled in
+func (a *argList) addQuoted(flag string, val string) {
+	if val != "" {
+		a.args = append(a.args, flag, `"`+shellEscape(val)+`"`)
+	}
+}
+
+func (a *argList) require(flag string, val string) {
+	if val == "" {
+		a.missing = append(a.missing, flag)
+	}
+	a.add(flag, val)
+}
+
+func (a *argList) requireQuoted(flag string, val string) {
+	if val == "" {
+		a.missing = append(a.missing, flag)
+	}
+	a.addQuoted(flag, val)
+}
+
+// addLabels adds the labels as separate arguments, separated by commas, as
+// CPSign reads them
+func (a *argList) addLabels(labels []string) {
+	if len(labels) == 0 {
+		a.missing = append(a.missing, "--labels")
+		return
+	}
+	a.args = append(a.args, "--labels")
+	for i, label := range labels {
+		if i < len(labels)-1 {
+			label += ","
+		}
+		a.args = append(a.args, shellQuote(label))
+	}
+}
+
+func (a *argList) addLogFile(path string) {
+	a.add("--logfile", path)
+}
+
+func (a *argList) addVerbatim(args string) {
+	if args = str.TrimSpace(args); args != "" {
+		a.args = append(a.args, args)
+	}
+}
+
+func (a *argList) result(subcommand string) ([]string, error) {
+	if len(a.missing) > 0 {
+		return nil, fmt.Errorf("cpsign: missing required options for %s: %s", subcommand, str.Join(a.missing, ", "))
+	}
+	return a.args, nil
+}
+
+// shellQuote returns s as is if it has no characters that the shell treats
+// specially, and otherwise in double quotes
+func shellQuote(s string) string {
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || str.ContainsRune("_-./:,=+@%{}", r)) {
+			return `"` + shellEscape(s) + `"`
+		}
+	}
+	return s
+}
+
+// shellEscape escapes the characters that are special in double quotes
+func shellEscape(s string) string {
+	return str.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`").Replace(s)
+}
@@ -0,0 +1,137 @@
+// Package datasrc implements a registry of the external data sources used by
+// the workflows (such as ExCAPE-DB and DrugBank), with pinned versions and
+// SHA-256 checksums, and either a download URL or a path to a local mirror,
+// so that workflows can also run on nodes without internet access.
+package datasrc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	str "strings"
+)
+
+// Source is an external data source, such as a database dump
+type Source struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	// SHA256 is the expected (hex encoded) SHA-256 checksum of the file. If
+	// empty, the source is not pinned, and can only be used unverified if
+	// the registry allows it (see Registry.AllowUnpinned).
+	SHA256 string `json:"sha256"`
+	URL    string `json:"url"`
+	// AuthFile is an optional file with "user:password" for the download
+	AuthFile string `json:"auth_file"`
+	// MirrorPath is the path to a local copy of the file, used in offline
+	// mode, or when no URL is given. Relative paths are resolved against the
+	// directory of the registry file.
+	MirrorPath string `json:"mirror_path"`
+}
+
+// Pinned tells whether the source has an expected checksum
+func (s *Source) Pinned() bool {
+	return s.SHA256 != ""
+}
+
+// Verify computes the SHA-256 checksum of the file at path, and returns it
+// together with an error if it does not match the expected checksum of the
+// source
+func (s *Source) Verify(path string) (string, error) {
+	sum, err := FileSHA256(path)
+	if err != nil {
+		return "", err
+	}
+	if s.Pinned() && !str.EqualFold(sum, s.SHA256) {
+		return sum, fmt.Errorf("datasrc: checksum mismatch for %s (version %s) in %s: expected sha256 %s, but got %s", s.Name, s.Version, path, s.SHA256, sum)
+	}
+	return sum, nil
+}
+
+// Registry contains the data sources available to a workflow
+type Registry struct {
+	Sources []*Source `json:"sources"`
+	// Offline, if set, makes Fetchable return false for all sources, so that
+	// they are always taken from their local mirrors
+	Offline bool `json:"-"`
+	// AllowUnpinned, if set, allows sources without an expected checksum to
+	// be used unverified, instead of failing in Verify
+	AllowUnpinned bool `json:"-"`
+}
+
+// LoadRegistry reads a registry from a JSON file with a "sources" list
+func LoadRegistry(path string) (*Registry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("datasrc: could not read registry file %s: %v", path, err)
+	}
+	reg := &Registry{}
+	if err := json.Unmarshal(data, reg); err != nil {
+		return nil, fmt.Errorf("datasrc: could not parse registry file %s: %v", path, err)
+	}
+	regDir := filepath.Dir(path)
+	for _, src := range reg.Sources {
+		if src.Name == "" {
+			return nil, fmt.Errorf("datasrc: source without name in registry file %s", path)
+		}
+		if src.URL == "" && src.MirrorPath == "" {
+			return nil, fmt.Errorf("datasrc: source %s has neither url nor mirror_path", src.Name)
+		}
+		if src.MirrorPath != "" && !filepath.IsAbs(src.MirrorPath) {
+			src.MirrorPath = filepath.Join(regDir, src.MirrorPath)
+		}
+	}
+	return reg, nil
+}
+
+// Source returns the source with the given name
+func (reg *Registry) Source(name string) (*Source, error) {
+	names := []string{}
+	for _, src := range reg.Sources {
+		if src.Name == name {
+			return src, nil
+		}
+		names = append(names, src.Name)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("datasrc: no source named %s in registry (available: %s)", name, str.Join(names, ", "))
+}
+
+// Verify verifies the file at path against the checksum of src (see
+// Source.Verify), and returns its checksum. A source that is not pinned is an
+// error, unless AllowUnpinned is set.
+func (reg *Registry) Verify(src *Source, path string) (string, error) {
+	sum, err := src.Verify(path)
+	if err != nil {
+		return sum, err
+	}
+	if !src.Pinned() && !reg.AllowUnpinned {
+		return sum, fmt.Errorf("datasrc: source %s (version %s) is not pinned to a checksum: add \"sha256\": \"%s\" to it in the registry", src.Name, src.Version, sum)
+	}
+	return sum, nil
+}
+
+// Fetchable tells whether src should be downloaded from its URL, rather than
+// taken from its local mirror
+func (reg *Registry) Fetchable(src *Source) bool {
+	return !reg.Offline && src.URL != ""
+}
+
+// FileSHA256 returns the hex encoded SHA-256 checksum of the file at path
+func FileSHA256(path string) (string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, fh); err != nil {
+		return "", fmt.Errorf("datasrc: could not compute checksum of %s: %v", path, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
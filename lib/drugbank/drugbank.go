@@ -0,0 +1,292 @@
+// Package drugbank contains a streaming parser for the full DrugBank XML
+// database, and functions for converting it into, and reading it back from,
+// a TSV table with one row per drug.
+package drugbank
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	str "strings"
+)
+
+// DrugBank groups
+const (
+	GroupApproved        = "approved"
+	GroupWithdrawn       = "withdrawn"
+	GroupExperimental    = "experimental"
+	GroupIllicit         = "illicit"
+	GroupInvestigational = "investigational"
+	GroupNutraceutical   = "nutraceutical"
+	GroupVetApproved     = "vet_approved"
+)
+
+// TypeSmallMolecule is the drug type of small molecule drugs (as opposed to
+// "biotech")
+const TypeSmallMolecule = "small molecule"
+
+// Drugbank is the root element of the DrugBank XML file
+type Drugbank struct {
+	XMLName xml.Name `xml:"drugbank"`
+	Drugs   []Drug   `xml:"drug"`
+}
+
+// Drug is one drug element in the DrugBank XML file
+type Drug struct {
+	XMLName              xml.Name             `xml:"drug"`
+	Type                 string               `xml:"type,attr"`
+	DrugBankIDs          []DrugBankID         `xml:"drugbank-id"`
+	Name                 string               `xml:"name"`
+	Groups               []string             `xml:"groups>group"`
+	CalculatedProperties []Property           `xml:"calculated-properties>property"`
+	ExternalIdentifiers  []ExternalIdentifier `xml:"external-identifiers>external-identifier"`
+	Targets              []Target             `xml:"targets>target"`
+}
+
+// DrugBankID is a DrugBank ID of a drug, of which one is the primary one
+type DrugBankID struct {
+	Primary bool   `xml:"primary,attr"`
+	Value   string `xml:",chardata"`
+}
+
+// Property is a calculated property of a drug, such as the InChIKey
+type Property struct {
+	XMLName xml.Name `xml:"property"`
+	Kind    string   `xml:"kind"`
+	Value   string   `xml:"value"`
+	Source  string   `xml:"source"`
+}
+
+// ExternalIdentifier is an identifier of the drug in an external database,
+// such as ChEMBL or PubChem
+type ExternalIdentifier struct {
+	XMLName    xml.Name `xml:"external-identifier"`
+	Resource   string   `xml:"resource"`
+	Identifier string   `xml:"identifier"`
+}
+
+// Target is an annotated target of a drug
+type Target struct {
+	ID           string        `xml:"id"`
+	Name         string        `xml:"name"`
+	Organism     string        `xml:"organism"`
+	Polypeptides []Polypeptide `xml:"polypeptide"`
+}
+
+// Polypeptide is the polypeptide (protein) of a target
+type Polypeptide struct {
+	ID       string `xml:"id,attr"`
+	Source   string `xml:"source,attr"`
+	Name     string `xml:"name"`
+	GeneName string `xml:"gene-name"`
+}
+
+// PrimaryID returns the primary DrugBank ID of the drug
+func (d *Drug) PrimaryID() string {
+	for _, id := range d.DrugBankIDs {
+		if id.Primary {
+			return id.Value
+		}
+	}
+	if len(d.DrugBankIDs) > 0 {
+		return d.DrugBankIDs[0].Value
+	}
+	return ""
+}
+
+// HasGroup tells whether the drug belongs to the given group, such as
+// GroupApproved
+func (d *Drug) HasGroup(group string) bool {
+	return containsStr(d.Groups, group)
+}
+
+// Property returns the value of the calculated property of the given kind,
+// such as "InChIKey"
+func (d *Drug) Property(kind string) string {
+	for _, p := range d.CalculatedProperties {
+		if p.Kind == kind {
+			return p.Value
+		}
+	}
+	return ""
+}
+
+// ExternalID returns the identifier of the drug in the given external
+// resource, such as "ChEMBL" or "PubChem Compound"
+func (d *Drug) ExternalID(resource string) string {
+	for _, eid := range d.ExternalIdentifiers {
+		if eid.Resource == resource {
+			return eid.Identifier
+		}
+	}
+	return ""
+}
+
+// TargetGenes returns the (unique) gene names of the annotated targets of the
+// drug
+func (d *Drug) TargetGenes() []string {
+	genes := []string{}
+	for _, t := range d.Targets {
+		for _, pp := range t.Polypeptides {
+			if pp.GeneName != "" && !containsStr(genes, pp.GeneName) {
+				genes = append(genes, pp.GeneName)
+			}
+		}
+	}
+	return genes
+}
+
+// XMLReader reads drugs one at a time from a DrugBank XML stream, so that the
+// full (multi-GB) file does not need to be kept in memory
+type XMLReader struct {
+	xmlDec *xml.Decoder
+}
+
+// NewXMLReader returns an XMLReader reading from r
+func NewXMLReader(r io.Reader) *XMLReader {
+	return &XMLReader{xmlDec: xml.NewDecoder(bufio.NewReader(r))}
+}
+
+// Read returns the next drug in the stream, or io.EOF when there are no more
+// drugs
+func (xr *XMLReader) Read() (*Drug, error) {
+	// Implement a streaming XML parser according to guide in
+	// http://blog.davidsingleton.org/parsing-huge-xml-files-with-go
+	for {
+		token, err := xr.xmlDec.Token()
+		if err != nil {
+			return nil, err
+		}
+		startElem, ok := token.(xml.StartElement)
+		if !ok || startElem.Name.Local != "drug" {
+			continue
+		}
+		drug := &Drug{}
+		if err := xr.xmlDec.DecodeElement(drug, &startElem); err != nil {
+			return nil, fmt.Errorf("drugbank: could not decode drug element: %v", err)
+		}
+		return drug, nil
+	}
+}
+
+// TSVHeader lists the columns of the TSV table written by WriteTSV. Groups
+// and target genes are comma-separated lists.
+var TSVHeader = []string{
+	"drugbank_id",
+	"name",
+	"type",
+	"inchikey",
+	"groups",
+	"chembl_id",
+	"pubchem_cid",
+	"pubchem_sid",
+	"target_genes",
+}
+
+// WriteTSV converts the DrugBank XML data in r into a TSV table, with the
+// columns in TSVHeader, written to w
+func WriteTSV(r io.Reader, w io.Writer) error {
+	tsvWrt := csv.NewWriter(w)
+	tsvWrt.Comma = '\t'
+	tsvWrt.Write(TSVHeader)
+	xmlReader := NewXMLReader(r)
+	for {
+		drug, err := xmlReader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		tsvWrt.Write([]string{
+			drug.PrimaryID(),
+			drug.Name,
+			drug.Type,
+			drug.Property("InChIKey"),
+			str.Join(drug.Groups, ","),
+			drug.ExternalID("ChEMBL"),
+			drug.ExternalID("PubChem Compound"),
+			drug.ExternalID("PubChem Substance"),
+			str.Join(drug.TargetGenes(), ","),
+		})
+	}
+	tsvWrt.Flush()
+	return tsvWrt.Error()
+}
+
+// Entry is one row in the TSV table written by WriteTSV
+type Entry struct {
+	DrugBankID  string
+	Name        string
+	Type        string
+	InChIKey    string
+	Groups      []string
+	ChEMBLID    string
+	PubChemCID  string
+	PubChemSID  string
+	TargetGenes []string
+}
+
+// HasGroup tells whether the entry belongs to the given group, such as
+// GroupApproved
+func (e *Entry) HasGroup(group string) bool {
+	return containsStr(e.Groups, group)
+}
+
+// ReadTSV reads all the entries of a TSV table written by WriteTSV. The
+// columns are picked by the names in the header.
+func ReadTSV(r io.Reader) ([]*Entry, error) {
+	tsvReader := csv.NewReader(r)
+	tsvReader.Comma = '\t'
+	tsvReader.LazyQuotes = true
+	header, err := tsvReader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("drugbank: could not read TSV header: %v", err)
+	}
+	colIdx := map[string]int{}
+	for i, col := range header {
+		colIdx[col] = i
+	}
+	for _, col := range TSVHeader {
+		if _, ok := colIdx[col]; !ok {
+			return nil, fmt.Errorf("drugbank: TSV header is missing column %s", col)
+		}
+	}
+	splitList := func(s string) []string {
+		if s == "" {
+			return []string{}
+		}
+		return str.Split(s, ",")
+	}
+	entries := []*Entry{}
+	for {
+		rec, err := tsvReader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("drugbank: could not read TSV row: %v", err)
+		}
+		entries = append(entries, &Entry{
+			DrugBankID:  rec[colIdx["drugbank_id"]],
+			Name:        rec[colIdx["name"]],
+			Type:        rec[colIdx["type"]],
+			InChIKey:    rec[colIdx["inchikey"]],
+			Groups:      splitList(rec[colIdx["groups"]]),
+			ChEMBLID:    rec[colIdx["chembl_id"]],
+			PubChemCID:  rec[colIdx["pubchem_cid"]],
+			PubChemSID:  rec[colIdx["pubchem_sid"]],
+			TargetGenes: splitList(rec[colIdx["target_genes"]]),
+		})
+	}
+	return entries, nil
+}
+
+func containsStr(strs []string, s string) bool {
+	for _, x := range strs {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
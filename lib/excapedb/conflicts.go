@@ -0,0 +1,201 @@
+package excapedb
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	str "strings"
+)
+
+// ConflictPolicy decides what to do with a compound (SMILES) that has
+// disagreeing activity flags for the same target
+type ConflictPolicy string
+
+// Available conflict resolution policies
+const (
+	// ConflictDropAll drops all compound/target pairs with conflicting flags
+	// (the behaviour of the old remove_conflicting awk script)
+	ConflictDropAll ConflictPolicy = "drop"
+	// ConflictMajority keeps the label with the most measurements. Ties are
+	// dropped.
+	ConflictMajority ConflictPolicy = "majority"
+	// ConflictMostAssays keeps the label backed by the most distinct assays.
+	// Ties are dropped.
+	ConflictMostAssays ConflictPolicy = "most_assays"
+	// ConflictPXC50TieBreak keeps the label with the most measurements, and
+	// breaks ties by comparing the median pXC50 of all measurements with the
+	// activity threshold. Ties without any pXC50 values are dropped.
+	ConflictPXC50TieBreak ConflictPolicy = "pxc50_tiebreak"
+)
+
+// ConflictPolicies lists all available conflict resolution policies
+var ConflictPolicies = []ConflictPolicy{
+	ConflictDropAll,
+	ConflictMajority,
+	ConflictMostAssays,
+	ConflictPXC50TieBreak,
+}
+
+// DefaultActivePXC50 is the pXC50 value at or above which ExCAPE-DB flags a
+// compound as active
+const DefaultActivePXC50 = 6.0
+
+// ParseConflictPolicy returns the ConflictPolicy with the given name
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	names := []string{}
+	for _, pol := range ConflictPolicies {
+		if string(pol) == name {
+			return pol, nil
+		}
+		names = append(names, string(pol))
+	}
+	return "", fmt.Errorf("excapedb: unknown conflict policy '%s' (available: %s)", name, str.Join(names, ", "))
+}
+
+// Measurement is one activity measurement of a compound on a target, as
+// extracted from ExCAPE-DB
+type Measurement struct {
+	Gene     string
+	ID       string
+	SMILES   string
+	Label    string
+	PXC50    float64 // NaN if missing
+	AssayID  string
+	InchiKey string
+	TaxID    string
+	DB       string
+}
+
+// Actions reported for resolved conflicts
+const (
+	ActionRemoved    = "removed"
+	ActionRelabelled = "relabelled"
+)
+
+// Resolution is the outcome of resolving the measurements of one compound on
+// one target
+type Resolution struct {
+	Kept              *Measurement // nil if the pair was removed
+	Conflicting       bool
+	Action            string // Empty if nothing was changed
+	Reason            string
+	ActiveCnt         int
+	NonactiveCnt      int
+	ActiveAssayCnt    int
+	NonactiveAssayCnt int
+	MedianPXC50       float64 // NaN if no measurement has a pXC50 value
+}
+
+// ConflictResolver resolves conflicting activity flags according to Policy
+type ConflictResolver struct {
+	Policy      ConflictPolicy
+	ActivePXC50 float64 // Used by ConflictPXC50TieBreak
+}
+
+// NewConflictResolver returns a ConflictResolver for the given policy, using
+// DefaultActivePXC50 for pXC50 based tie breaks
+func NewConflictResolver(policy ConflictPolicy) *ConflictResolver {
+	return &ConflictResolver{
+		Policy:      policy,
+		ActivePXC50: DefaultActivePXC50,
+	}
+}
+
+// Resolve resolves the measurements of one compound (SMILES) on one target.
+// The first measurement with the winning label is kept.
+func (cr *ConflictResolver) Resolve(group []*Measurement) *Resolution {
+	res := &Resolution{}
+	if len(group) == 0 {
+		return res
+	}
+	activeAssays := map[string]bool{}
+	nonactiveAssays := map[string]bool{}
+	pxc50s := []float64{}
+	for _, m := range group {
+		if m.Label == Active {
+			res.ActiveCnt++
+			activeAssays[m.AssayID] = true
+		} else {
+			res.NonactiveCnt++
+			nonactiveAssays[m.AssayID] = true
+		}
+		if !math.IsNaN(m.PXC50) {
+			pxc50s = append(pxc50s, m.PXC50)
+		}
+	}
+	res.ActiveAssayCnt = len(activeAssays)
+	res.NonactiveAssayCnt = len(nonactiveAssays)
+	res.MedianPXC50 = Median(pxc50s)
+
+	if res.ActiveCnt == 0 || res.NonactiveCnt == 0 {
+		res.Kept = group[0]
+		return res
+	}
+
+	res.Conflicting = true
+	label := ""
+	switch cr.Policy {
+	case ConflictDropAll:
+		res.Reason = "conflicting activity flags"
+	case ConflictMajority:
+		label = majorityLabel(res.ActiveCnt, res.NonactiveCnt)
+		res.Reason = fmt.Sprintf("majority of measurements (A:%d, N:%d)", res.ActiveCnt, res.NonactiveCnt)
+	case ConflictMostAssays:
+		label = majorityLabel(res.ActiveAssayCnt, res.NonactiveAssayCnt)
+		res.Reason = fmt.Sprintf("majority of assays (A:%d, N:%d)", res.ActiveAssayCnt, res.NonactiveAssayCnt)
+	case ConflictPXC50TieBreak:
+		label = majorityLabel(res.ActiveCnt, res.NonactiveCnt)
+		res.Reason = fmt.Sprintf("majority of measurements (A:%d, N:%d)", res.ActiveCnt, res.NonactiveCnt)
+		if label == "" && !math.IsNaN(res.MedianPXC50) {
+			label = Nonactive
+			if res.MedianPXC50 >= cr.ActivePXC50 {
+				label = Active
+			}
+			res.Reason = fmt.Sprintf("tie (A:%d, N:%d) broken by median pXC50 %.2f vs threshold %.2f", res.ActiveCnt, res.NonactiveCnt, res.MedianPXC50, cr.ActivePXC50)
+		}
+	default:
+		panic("excapedb: unknown conflict policy: " + string(cr.Policy))
+	}
+
+	if label == "" {
+		res.Action = ActionRemoved
+		if cr.Policy != ConflictDropAll {
+			res.Reason = "tie: " + res.Reason
+		}
+		return res
+	}
+	for _, m := range group {
+		if m.Label == label {
+			res.Kept = m
+			break
+		}
+	}
+	res.Action = ActionRelabelled
+	return res
+}
+
+// majorityLabel returns the label with the larger count, or an empty string
+// on ties
+func majorityLabel(activeCnt int, nonactiveCnt int) string {
+	if activeCnt > nonactiveCnt {
+		return Active
+	} else if nonactiveCnt > activeCnt {
+		return Nonactive
+	}
+	return ""
+}
+
+// Median returns the median of vals, or NaN if vals is empty. vals is not
+// modified.
+func Median(vals []float64) float64 {
+	if len(vals) == 0 {
+		return math.NaN()
+	}
+	sorted := append([]float64{}, vals...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
@@ -0,0 +1,124 @@
+package excapedb
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// DefaultMaxPXC50Spread is the default largest spread (max - min) of pXC50
+// values for one compound and target, above which the compound is flagged as
+// having a high variance
+const DefaultMaxPXC50Spread = 1.0
+
+// Consensus is the aggregate of all the measurements of one compound
+// (InChIKey) on one target
+type Consensus struct {
+	Representative *Measurement // The first measurement in the group
+	Label          string       // Empty if no label could be derived
+	Reason         string       // Why no label could be derived, if so
+	PXC50          float64      // Median pXC50, or NaN if no pXC50 values
+	Spread         float64      // Max - min pXC50, or NaN if no pXC50 values
+	MeasurementCnt int
+	AssayCnt       int
+	HighVariance   bool
+	// Conflicting is set when the activity flags of measurements without a
+	// pXC50 value disagree with the label derived from the pXC50 values
+	Conflicting bool
+}
+
+// ConsensusAggregator aggregates repeated measurements of the same compound
+// on the same target into one Consensus
+type ConsensusAggregator struct {
+	// Labeller, if set, decides labels from the consensus pXC50 for targets
+	// that it has thresholds for. Otherwise DefaultActivePXC50 is used.
+	Labeller  *Labeller
+	MaxSpread float64
+}
+
+// NewConsensusAggregator returns a ConsensusAggregator using the given
+// labeller (which can be nil) and the default max pXC50 spread
+func NewConsensusAggregator(labeller *Labeller) *ConsensusAggregator {
+	return &ConsensusAggregator{
+		Labeller:  labeller,
+		MaxSpread: DefaultMaxPXC50Spread,
+	}
+}
+
+// Aggregate computes the consensus of a group of measurements. The label is
+// decided by a majority vote, in which the measurements with a pXC50 value all
+// vote for the label derived from their median pXC50, and the ones without
+// vote with their activity flags, so that, for example, one active pXC50
+// value does not outvote five nonactive flags. Without pXC50 values, this is a
+// majority vote on the activity flags.
+func (ca *ConsensusAggregator) Aggregate(group []*Measurement) *Consensus {
+	cons := &Consensus{
+		PXC50:          math.NaN(),
+		Spread:         math.NaN(),
+		MeasurementCnt: len(group),
+	}
+	if len(group) == 0 {
+		return cons
+	}
+	cons.Representative = group[0]
+
+	assays := map[string]bool{}
+	pxc50s := []float64{}
+	// Activity flags of the measurements without a pXC50 value
+	activeCnt, nonactiveCnt := 0, 0
+	for _, m := range group {
+		assays[m.AssayID] = true
+		if !math.IsNaN(m.PXC50) {
+			pxc50s = append(pxc50s, m.PXC50)
+		} else if m.Label == Active {
+			activeCnt++
+		} else if m.Label == Nonactive {
+			nonactiveCnt++
+		}
+	}
+	cons.AssayCnt = len(assays)
+
+	if len(pxc50s) == 0 {
+		cons.Label = majorityLabel(activeCnt, nonactiveCnt)
+		if cons.Label == "" {
+			cons.Reason = fmt.Sprintf("tie in activity flags without pXC50 values (A:%d, N:%d)", activeCnt, nonactiveCnt)
+		}
+		return cons
+	}
+
+	sort.Float64s(pxc50s)
+	cons.PXC50 = Median(pxc50s)
+	cons.Spread = pxc50s[len(pxc50s)-1] - pxc50s[0]
+	cons.HighVariance = cons.Spread > ca.MaxSpread
+
+	pxc50Label := ca.pxc50Label(cons.Representative.Gene, cons.PXC50)
+	if pxc50Label == "" && activeCnt+nonactiveCnt == 0 {
+		cons.Reason = fmt.Sprintf("consensus pXC50 %.2f in grey zone", cons.PXC50)
+		return cons
+	}
+	cons.Conflicting = (pxc50Label == Active && nonactiveCnt > 0) || (pxc50Label == Nonactive && activeCnt > 0)
+	if pxc50Label == Active {
+		activeCnt += len(pxc50s)
+	} else if pxc50Label == Nonactive {
+		nonactiveCnt += len(pxc50s)
+	}
+	cons.Label = majorityLabel(activeCnt, nonactiveCnt)
+	if cons.Label == "" {
+		cons.Reason = fmt.Sprintf("tie between consensus pXC50 %.2f and activity flags without pXC50 values (A:%d, N:%d)", cons.PXC50, activeCnt, nonactiveCnt)
+	}
+	return cons
+}
+
+// pxc50Label returns the label of a consensus pXC50 value of a target, which
+// is empty in the grey zone of the labeller
+func (ca *ConsensusAggregator) pxc50Label(gene string, pxc50 float64) string {
+	if ca.Labeller != nil {
+		if _, ok := ca.Labeller.Thresholds(gene); ok {
+			return ca.Labeller.Label(gene, pxc50, "")
+		}
+	}
+	if pxc50 >= DefaultActivePXC50 {
+		return Active
+	}
+	return Nonactive
+}
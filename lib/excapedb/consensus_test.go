@@ -0,0 +1,66 @@
+package excapedb
+
+import (
+	"math"
+	"testing"
+)
+
+// measurements returns measurements of one compound on PDE3A, one per
+// activity flag and pXC50 value pair (NaN for none)
+func measurements(flags []string, pxc50s []float64) []*Measurement {
+	group := []*Measurement{}
+	for i, flag := range flags {
+		group = append(group, &Measurement{Gene: "PDE3A", Label: flag, PXC50: pxc50s[i], AssayID: string(rune('a' + i)), InchiKey: "KEY"})
+	}
+	return group
+}
+
+func TestAggregate(t *testing.T) {
+	nan := math.NaN()
+	labeller, err := ParseLabeller("7.0:5.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name        string
+		labeller    *Labeller
+		flags       []string
+		pxc50s      []float64
+		label       string
+		conflicting bool
+	}{
+		{name: "flags only", flags: []string{Active, Active, Nonactive}, pxc50s: []float64{nan, nan, nan}, label: Active},
+		{name: "tie in flags only", flags: []string{Active, Nonactive}, pxc50s: []float64{nan, nan}, label: ""},
+		{name: "median pXC50", flags: []string{Nonactive, Active, Active}, pxc50s: []float64{5.0, 6.5, 7.0}, label: Active},
+		{name: "one pXC50 outvoted by flags", flags: []string{Active, Nonactive, Nonactive, Nonactive, Nonactive, Nonactive}, pxc50s: []float64{6.1, nan, nan, nan, nan, nan}, label: Nonactive, conflicting: true},
+		{name: "pXC50s outvoting flags", flags: []string{Active, Active, Nonactive}, pxc50s: []float64{6.1, 6.3, nan}, label: Active, conflicting: true},
+		{name: "tie between pXC50 and flags", flags: []string{Active, Nonactive}, pxc50s: []float64{6.1, nan}, label: "", conflicting: true},
+		{name: "flags agreeing with pXC50", flags: []string{Active, Active}, pxc50s: []float64{6.1, nan}, label: Active},
+		{name: "grey zone", labeller: labeller, flags: []string{Active}, pxc50s: []float64{6.0}, label: ""},
+		{name: "grey zone with flags", labeller: labeller, flags: []string{Active, Nonactive}, pxc50s: []float64{6.0, nan}, label: Nonactive},
+	} {
+		cons := NewConsensusAggregator(tc.labeller).Aggregate(measurements(tc.flags, tc.pxc50s))
+		if cons.Label != tc.label {
+			t.Errorf("Case %s: expected label '%s', but got '%s' (reason: %s)", tc.name, tc.label, cons.Label, cons.Reason)
+		}
+		if cons.Label == "" && cons.Reason == "" {
+			t.Errorf("Case %s: expected a reason for the missing label", tc.name)
+		}
+		if cons.Conflicting != tc.conflicting {
+			t.Errorf("Case %s: expected conflicting=%v, but got %v", tc.name, tc.conflicting, cons.Conflicting)
+		}
+		if cons.MeasurementCnt != len(tc.flags) || cons.AssayCnt != len(tc.flags) {
+			t.Errorf("Case %s: expected %d measurements and assays, but got %d and %d", tc.name, len(tc.flags), cons.MeasurementCnt, cons.AssayCnt)
+		}
+	}
+}
+
+func TestAggregateSpread(t *testing.T) {
+	cons := NewConsensusAggregator(nil).Aggregate(measurements([]string{Active, Active, Nonactive}, []float64{7.5, 6.0, 5.0}))
+	if cons.PXC50 != 6.0 || cons.Spread != 2.5 {
+		t.Errorf("Expected median pXC50 6.0 and spread 2.5, but got %f and %f", cons.PXC50, cons.Spread)
+	}
+	if !cons.HighVariance {
+		t.Error("Expected a spread of 2.5 to be flagged as high variance")
+	}
+}
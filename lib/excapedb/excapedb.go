@@ -0,0 +1,274 @@
+// Package excapedb contains a streaming reader for the ExCAPE-DB TSV dump
+// (pubchem.chembl.dataset4publication_inchi_smiles.tsv[.xz]), which picks out
+// columns by their header names instead of by position, so that a schema
+// change in a new ExCAPE-DB release gives a clear error instead of silently
+// producing garbage datasets.
+package excapedb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	str "strings"
+
+	"github.com/ulikunitz/xz"
+)
+
+// Column names in the ExCAPE-DB TSV header
+const (
+	ColAmbitInchiKey   = "Ambit_InchiKey"
+	ColOriginalEntryID = "Original_Entry_ID"
+	ColEntrezID        = "Entrez_ID"
+	ColActivityFlag    = "Activity_Flag"
+	ColPXC50           = "pXC50"
+	ColDB              = "DB"
+	ColOriginalAssayID = "Original_Assay_ID"
+	ColTaxID           = "Tax_ID"
+	ColGeneSymbol      = "Gene_Symbol"
+	ColOrthologGroup   = "Ortholog_Group"
+	ColInChI           = "InChI"
+	ColSMILES          = "SMILES"
+)
+
+// Columns lists all the columns that a valid ExCAPE-DB file must contain, in
+// the order of the ExCAPE-DB v2 release
+var Columns = []string{
+	ColAmbitInchiKey,
+	ColOriginalEntryID,
+	ColEntrezID,
+	ColActivityFlag,
+	ColPXC50,
+	ColDB,
+	ColOriginalAssayID,
+	ColTaxID,
+	ColGeneSymbol,
+	ColOrthologGroup,
+	ColInChI,
+	ColSMILES,
+}
+
+// Activity flag values used in ExCAPE-DB
+const (
+	Active    = "A"
+	Nonactive = "N"
+)
+
+// Record is one row in the ExCAPE-DB file. Numeric fields that are empty in
+// the file are set to 0, except PXC50, which is set to NaN (see HasPXC50).
+type Record struct {
+	AmbitInchiKey   string
+	OriginalEntryID string
+	EntrezID        int64
+	ActivityFlag    string
+	PXC50           float64
+	DB              string
+	OriginalAssayID int64
+	TaxID           int64
+	GeneSymbol      string
+	OrthologGroup   int64
+	InChI           string
+	SMILES          string
+}
+
+// HasPXC50 tells whether the record has a pXC50 value
+func (rec *Record) HasPXC50() bool {
+	return !math.IsNaN(rec.PXC50)
+}
+
+// Value returns the (string formatted) value of the record, for the column
+// with the given header name
+func (rec *Record) Value(column string) string {
+	switch column {
+	case ColAmbitInchiKey:
+		return rec.AmbitInchiKey
+	case ColOriginalEntryID:
+		return rec.OriginalEntryID
+	case ColEntrezID:
+		return strconv.FormatInt(rec.EntrezID, 10)
+	case ColActivityFlag:
+		return rec.ActivityFlag
+	case ColPXC50:
+		if !rec.HasPXC50() {
+			return ""
+		}
+		return strconv.FormatFloat(rec.PXC50, 'f', -1, 64)
+	case ColDB:
+		return rec.DB
+	case ColOriginalAssayID:
+		return strconv.FormatInt(rec.OriginalAssayID, 10)
+	case ColTaxID:
+		return strconv.FormatInt(rec.TaxID, 10)
+	case ColGeneSymbol:
+		return rec.GeneSymbol
+	case ColOrthologGroup:
+		return strconv.FormatInt(rec.OrthologGroup, 10)
+	case ColInChI:
+		return rec.InChI
+	case ColSMILES:
+		return rec.SMILES
+	}
+	return ""
+}
+
+// Measurement returns the fields of the record used as an activity
+// measurement
+func (rec *Record) Measurement() *Measurement {
+	return &Measurement{
+		Gene:     rec.GeneSymbol,
+		ID:       rec.OriginalEntryID,
+		SMILES:   rec.SMILES,
+		Label:    rec.ActivityFlag,
+		PXC50:    rec.PXC50,
+		AssayID:  rec.Value(ColOriginalAssayID),
+		InchiKey: rec.AmbitInchiKey,
+		TaxID:    rec.Value(ColTaxID),
+		DB:       rec.DB,
+	}
+}
+
+// Reader reads Records from an ExCAPE-DB TSV stream, one at a time
+type Reader struct {
+	bufReader *bufio.Reader
+	colIdx    map[string]int
+	nCols     int
+	line      int
+}
+
+// NewReader reads and validates the header of the ExCAPE-DB data in r, and
+// returns a Reader for the records following it. An error is returned if any
+// of the columns in Columns is missing from the header.
+func NewReader(r io.Reader) (*Reader, error) {
+	rdr := &Reader{
+		bufReader: bufio.NewReaderSize(r, 1024*1024),
+		colIdx:    map[string]int{},
+	}
+	header, err := rdr.readFields()
+	if err == io.EOF {
+		return nil, fmt.Errorf("excapedb: no header found (empty file)")
+	} else if err != nil {
+		return nil, err
+	}
+	for i, colName := range header {
+		rdr.colIdx[colName] = i
+	}
+	missing := []string{}
+	for _, colName := range Columns {
+		if _, ok := rdr.colIdx[colName]; !ok {
+			missing = append(missing, colName)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("excapedb: header is missing column(s) %s (header was: %s)", str.Join(missing, ", "), str.Join(header, ", "))
+	}
+	rdr.nCols = len(header)
+	return rdr, nil
+}
+
+// Read returns the next Record, or io.EOF when there are no more records
+func (rdr *Reader) Read() (*Record, error) {
+	fields, err := rdr.readFields()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) != rdr.nCols {
+		return nil, fmt.Errorf("excapedb: line %d has %d fields, but the header has %d", rdr.line, len(fields), rdr.nCols)
+	}
+	rec := &Record{
+		AmbitInchiKey:   fields[rdr.colIdx[ColAmbitInchiKey]],
+		OriginalEntryID: fields[rdr.colIdx[ColOriginalEntryID]],
+		ActivityFlag:    fields[rdr.colIdx[ColActivityFlag]],
+		DB:              fields[rdr.colIdx[ColDB]],
+		GeneSymbol:      fields[rdr.colIdx[ColGeneSymbol]],
+		InChI:           fields[rdr.colIdx[ColInChI]],
+		SMILES:          fields[rdr.colIdx[ColSMILES]],
+	}
+	if rec.ActivityFlag != Active && rec.ActivityFlag != Nonactive {
+		return nil, fmt.Errorf("excapedb: line %d has unknown %s value: '%s'", rdr.line, ColActivityFlag, rec.ActivityFlag)
+	}
+	if rec.EntrezID, err = rdr.parseInt(fields, ColEntrezID); err != nil {
+		return nil, err
+	}
+	if rec.OriginalAssayID, err = rdr.parseInt(fields, ColOriginalAssayID); err != nil {
+		return nil, err
+	}
+	if rec.TaxID, err = rdr.parseInt(fields, ColTaxID); err != nil {
+		return nil, err
+	}
+	if rec.OrthologGroup, err = rdr.parseInt(fields, ColOrthologGroup); err != nil {
+		return nil, err
+	}
+	rec.PXC50 = math.NaN()
+	if val := fields[rdr.colIdx[ColPXC50]]; val != "" {
+		if rec.PXC50, err = strconv.ParseFloat(val, 64); err != nil {
+			return nil, fmt.Errorf("excapedb: line %d: could not parse %s value '%s': %v", rdr.line, ColPXC50, val, err)
+		}
+	}
+	return rec, nil
+}
+
+func (rdr *Reader) parseInt(fields []string, column string) (int64, error) {
+	val := fields[rdr.colIdx[column]]
+	if val == "" {
+		return 0, nil
+	}
+	i, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("excapedb: line %d: could not parse %s value '%s': %v", rdr.line, column, val, err)
+	}
+	return i, nil
+}
+
+// readFields reads the next (non-empty) line, and splits it on tabs
+func (rdr *Reader) readFields() ([]string, error) {
+	for {
+		line, err := rdr.bufReader.ReadString('\n')
+		if err != nil && !(err == io.EOF && line != "") {
+			return nil, err
+		}
+		rdr.line++
+		line = str.TrimRight(line, "\r\n")
+		if line == "" {
+			continue
+		}
+		return str.Split(line, "\t"), nil
+	}
+}
+
+// File is a Reader for an ExCAPE-DB file on disk, which should be closed
+// after use
+type File struct {
+	*Reader
+	fh *os.File
+}
+
+// Open opens the ExCAPE-DB file at path for reading. Files ending with .xz are
+// decompressed on the fly.
+func Open(path string) (*File, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = fh
+	if str.HasSuffix(path, ".xz") {
+		xzReader, err := xz.NewReader(bufio.NewReaderSize(fh, 1024*1024))
+		if err != nil {
+			fh.Close()
+			return nil, fmt.Errorf("excapedb: could not open xz file %s: %v", path, err)
+		}
+		r = xzReader
+	}
+	rdr, err := NewReader(r)
+	if err != nil {
+		fh.Close()
+		return nil, fmt.Errorf("%v (in file %s)", err, path)
+	}
+	return &File{Reader: rdr, fh: fh}, nil
+}
+
+// Close closes the underlying file
+func (f *File) Close() error {
+	return f.fh.Close()
+}
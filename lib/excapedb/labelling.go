@@ -0,0 +1,137 @@
+package excapedb
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	str "strings"
+)
+
+// LabelThresholds defines activity labels from pXC50 values: Compounds with a
+// pXC50 >= Active are labelled active, and compounds with a pXC50 <= Inactive
+// are labelled non-active. Compounds in between (the "grey zone") are dropped.
+type LabelThresholds struct {
+	Active   float64
+	Inactive float64
+}
+
+// String returns the thresholds in the same format as they are specified
+// ("active:inactive")
+func (lt LabelThresholds) String() string {
+	return formatFloat(lt.Active) + ":" + formatFloat(lt.Inactive)
+}
+
+// Tag returns a string representation of the thresholds, that is safe to use
+// in file names
+func (lt LabelThresholds) Tag() string {
+	return "pxc50_a" + formatFloat(lt.Active) + "_n" + formatFloat(lt.Inactive)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// Labeller derives activity labels from pXC50 values, using per-target
+// thresholds when available, and global (default) ones otherwise. Targets
+// without any thresholds keep their ExCAPE-DB activity flags.
+type Labeller struct {
+	Default   *LabelThresholds
+	PerTarget map[string]LabelThresholds
+}
+
+// ParseLabeller parses a comma-separated list of thresholds, each formatted
+// as active:inactive (global thresholds) or GENE=active:inactive (thresholds
+// for a specific target), such as: 6.5:5.0,PDE3A=7.0:5.5
+func ParseLabeller(spec string) (*Labeller, error) {
+	lb := &Labeller{PerTarget: map[string]LabelThresholds{}}
+	for _, part := range str.Split(spec, ",") {
+		part = str.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		gene := ""
+		if eqIdx := str.Index(part, "="); eqIdx > -1 {
+			gene = str.TrimSpace(part[:eqIdx])
+			part = part[eqIdx+1:]
+		}
+		vals := str.Split(part, ":")
+		if len(vals) != 2 {
+			return nil, fmt.Errorf("excapedb: label thresholds must be formatted as active:inactive, got: '%s'", part)
+		}
+		active, err := strconv.ParseFloat(str.TrimSpace(vals[0]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("excapedb: could not parse active threshold '%s': %v", vals[0], err)
+		}
+		inactive, err := strconv.ParseFloat(str.TrimSpace(vals[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("excapedb: could not parse inactive threshold '%s': %v", vals[1], err)
+		}
+		if inactive > active {
+			return nil, fmt.Errorf("excapedb: inactive threshold (%s) is larger than active threshold (%s)", vals[1], vals[0])
+		}
+		lt := LabelThresholds{Active: active, Inactive: inactive}
+		if gene == "" {
+			lb.Default = &lt
+		} else {
+			lb.PerTarget[gene] = lt
+		}
+	}
+	return lb, nil
+}
+
+// String returns the labeller in the same format as parsed by ParseLabeller,
+// with per-target thresholds sorted on gene name
+func (lb *Labeller) String() string {
+	parts := []string{}
+	if lb.Default != nil {
+		parts = append(parts, lb.Default.String())
+	}
+	genes := []string{}
+	for gene := range lb.PerTarget {
+		genes = append(genes, gene)
+	}
+	sort.Strings(genes)
+	for _, gene := range genes {
+		parts = append(parts, gene+"="+lb.PerTarget[gene].String())
+	}
+	return str.Join(parts, ",")
+}
+
+// Thresholds returns the thresholds used for gene, and false if the
+// ExCAPE-DB activity flags are used for it
+func (lb *Labeller) Thresholds(gene string) (LabelThresholds, bool) {
+	if lt, ok := lb.PerTarget[gene]; ok {
+		return lt, true
+	}
+	if lb.Default != nil {
+		return *lb.Default, true
+	}
+	return LabelThresholds{}, false
+}
+
+// Tag returns a file name safe description of the labelling used for gene,
+// or an empty string if the ExCAPE-DB activity flags are used
+func (lb *Labeller) Tag(gene string) string {
+	if lt, ok := lb.Thresholds(gene); ok {
+		return lt.Tag()
+	}
+	return ""
+}
+
+// Label returns the label for a measurement on gene with the given pXC50
+// value (NaN if missing), and original ExCAPE-DB activity flag. Measurements
+// without a pXC50 value keep their original flag. An empty label is returned
+// for measurements in the grey zone between the thresholds.
+func (lb *Labeller) Label(gene string, pxc50 float64, origLabel string) string {
+	lt, ok := lb.Thresholds(gene)
+	if !ok || math.IsNaN(pxc50) {
+		return origLabel
+	}
+	if pxc50 >= lt.Active {
+		return Active
+	} else if pxc50 <= lt.Inactive {
+		return Nonactive
+	}
+	return ""
+}
@@ -0,0 +1,182 @@
+package excapedb
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	str "strings"
+)
+
+// NCBI taxonomy IDs of the species in ExCAPE-DB
+const (
+	TaxHuman int64 = 9606
+	TaxRat   int64 = 10116
+	TaxMouse int64 = 10090
+)
+
+// SpeciesNames maps the taxonomy IDs in ExCAPE-DB to species names
+var SpeciesNames = map[int64]string{
+	TaxHuman: "human",
+	TaxRat:   "rat",
+	TaxMouse: "mouse",
+}
+
+// SpeciesName returns the name of the species with the given taxonomy ID, or
+// "tax<id>" for unknown species
+func SpeciesName(taxID int64) string {
+	if name, ok := SpeciesNames[taxID]; ok {
+		return name
+	}
+	return "tax" + strconv.FormatInt(taxID, 10)
+}
+
+// SpeciesFilter restricts the records used for each target to a set of
+// species, and optionally selects the records of a target by its ortholog
+// group, rather than by its gene symbol only
+type SpeciesFilter struct {
+	// TaxIDs is the set of species to keep. If empty, all species are kept.
+	TaxIDs map[int64]bool
+	// ByOrthologGroup, if set, assigns all members of an ortholog group to the
+	// same target gene (see OrthologMap)
+	ByOrthologGroup bool
+}
+
+// ParseSpeciesFilter parses a comma-separated list of species, given as
+// taxonomy IDs or names in SpeciesNames, such as: human,10116. An empty list
+// keeps all species.
+func ParseSpeciesFilter(spec string, byOrthologGroup bool) (*SpeciesFilter, error) {
+	sf := &SpeciesFilter{TaxIDs: map[int64]bool{}, ByOrthologGroup: byOrthologGroup}
+	nameToTaxID := map[string]int64{}
+	for taxID, name := range SpeciesNames {
+		nameToTaxID[name] = taxID
+	}
+	for _, part := range str.Split(spec, ",") {
+		part = str.ToLower(str.TrimSpace(part))
+		if part == "" {
+			continue
+		}
+		if taxID, ok := nameToTaxID[part]; ok {
+			sf.TaxIDs[taxID] = true
+			continue
+		}
+		taxID, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("excapedb: species must be a taxonomy ID or one of human, rat, mouse, got: '%s'", part)
+		}
+		sf.TaxIDs[taxID] = true
+	}
+	return sf, nil
+}
+
+// Accept tells whether the record is of one of the species in the filter
+func (sf *SpeciesFilter) Accept(rec *Record) bool {
+	return len(sf.TaxIDs) == 0 || sf.TaxIDs[rec.TaxID]
+}
+
+// sortedTaxIDs returns the taxonomy IDs in the filter in ascending order
+func (sf *SpeciesFilter) sortedTaxIDs() []int64 {
+	taxIDs := []int64{}
+	for taxID := range sf.TaxIDs {
+		taxIDs = append(taxIDs, taxID)
+	}
+	sort.Slice(taxIDs, func(i, j int) bool { return taxIDs[i] < taxIDs[j] })
+	return taxIDs
+}
+
+// String returns a description of the filter, such as "9606,10116" or
+// "all,orthologs"
+func (sf *SpeciesFilter) String() string {
+	parts := []string{}
+	for _, taxID := range sf.sortedTaxIDs() {
+		parts = append(parts, strconv.FormatInt(taxID, 10))
+	}
+	if len(parts) == 0 {
+		parts = append(parts, "all")
+	}
+	if sf.ByOrthologGroup {
+		parts = append(parts, "orthologs")
+	}
+	return str.Join(parts, ",")
+}
+
+// Tag returns a file name safe description of the filter, or an empty string
+// if it keeps all records, by gene symbol
+func (sf *SpeciesFilter) Tag() string {
+	if len(sf.TaxIDs) == 0 && !sf.ByOrthologGroup {
+		return ""
+	}
+	parts := []string{}
+	for _, taxID := range sf.sortedTaxIDs() {
+		parts = append(parts, SpeciesName(taxID))
+	}
+	if sf.ByOrthologGroup {
+		parts = append(parts, "og")
+	}
+	return "species_" + str.Join(parts, "_")
+}
+
+// OrthologMap maps the ortholog groups in ExCAPE-DB to one gene symbol each,
+// so that measurements on all members of an ortholog group can be assigned to
+// the same target. The symbol of the human member is used when available, and
+// otherwise the alphabetically first symbol in the group.
+type OrthologMap struct {
+	genes   map[int64]string
+	isHuman map[int64]bool
+}
+
+// NewOrthologMap returns an empty OrthologMap
+func NewOrthologMap() *OrthologMap {
+	return &OrthologMap{
+		genes:   map[int64]string{},
+		isHuman: map[int64]bool{},
+	}
+}
+
+// Add registers the gene symbol and ortholog group of rec
+func (om *OrthologMap) Add(rec *Record) {
+	if rec.OrthologGroup == 0 || rec.GeneSymbol == "" {
+		return
+	}
+	og := rec.OrthologGroup
+	isHuman := rec.TaxID == TaxHuman
+	gene, ok := om.genes[og]
+	switch {
+	case !ok,
+		isHuman && !om.isHuman[og],
+		isHuman == om.isHuman[og] && rec.GeneSymbol < gene:
+		om.genes[og] = rec.GeneSymbol
+		om.isHuman[og] = isHuman
+	}
+}
+
+// Gene returns the gene symbol of the ortholog group of rec, or the gene
+// symbol of rec itself, if the ortholog group is unknown
+func (om *OrthologMap) Gene(rec *Record) string {
+	if gene, ok := om.genes[rec.OrthologGroup]; ok {
+		return gene
+	}
+	return rec.GeneSymbol
+}
+
+// SpeciesComposition counts measurements per species (taxonomy ID)
+type SpeciesComposition map[int64]int
+
+// String returns the composition as a comma-separated list of species:count,
+// with the most common species first, such as: human:120,rat:30
+func (sc SpeciesComposition) String() string {
+	taxIDs := []int64{}
+	for taxID := range sc {
+		taxIDs = append(taxIDs, taxID)
+	}
+	sort.Slice(taxIDs, func(i, j int) bool {
+		if sc[taxIDs[i]] != sc[taxIDs[j]] {
+			return sc[taxIDs[i]] > sc[taxIDs[j]]
+		}
+		return taxIDs[i] < taxIDs[j]
+	})
+	parts := []string{}
+	for _, taxID := range taxIDs {
+		parts = append(parts, SpeciesName(taxID)+":"+strconv.Itoa(sc[taxID]))
+	}
+	return str.Join(parts, ",")
+}
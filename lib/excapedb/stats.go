@@ -0,0 +1,204 @@
+package excapedb
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	str "strings"
+)
+
+// Source databases in the DB column of ExCAPE-DB
+const (
+	DBChEMBL  = "chembl"
+	DBPubChem = "pubchem"
+)
+
+// TargetStats contains statistics about the data for one target
+type TargetStats struct {
+	Gene string `json:"gene"`
+	// MeasurementCnt is the number of (ExCAPE-DB) rows for the target
+	MeasurementCnt int `json:"measurement_cnt"`
+	// UniqueStructureCnt is the number of unique compounds (InChIKeys)
+	UniqueStructureCnt int `json:"unique_structure_cnt"`
+	// UniqueSMILESCnt is the number of unique SMILES strings
+	UniqueSMILESCnt int `json:"unique_smiles_cnt"`
+	// ActiveCnt and NonactiveCnt are the number of active and non-active rows
+	ActiveCnt    int `json:"active_cnt"`
+	NonactiveCnt int `json:"nonactive_cnt"`
+	// ChEMBLCnt and PubChemCnt are the number of rows from each source DB
+	ChEMBLCnt  int `json:"chembl_cnt"`
+	PubChemCnt int `json:"pubchem_cnt"`
+	AssayCnt   int `json:"assay_cnt"`
+	// Species is the number of rows per species (taxonomy ID)
+	Species SpeciesComposition `json:"species"`
+	// ConflictingRemovedCnt is the number of compounds removed when
+	// aggregating the measurements into one label per compound
+	ConflictingRemovedCnt int `json:"conflicting_removed_cnt"`
+	// DrugBankRemovedCnt is the number of compounds removed because they are
+	// in the DrugBank exclusion list
+	DrugBankRemovedCnt int `json:"drugbank_removed_cnt"`
+	// FinalActiveCnt and FinalNonactiveCnt are the number of active and
+	// non-active compounds in the final data for the target
+	FinalActiveCnt    int `json:"final_active_cnt"`
+	FinalNonactiveCnt int `json:"final_nonactive_cnt"`
+}
+
+// FinalCnt returns the total number of compounds in the final data for the
+// target
+func (ts *TargetStats) FinalCnt() int {
+	return ts.FinalActiveCnt + ts.FinalNonactiveCnt
+}
+
+// StatsCollector collects TargetStats from measurements, one at a time. To
+// keep memory usage bounded, the sets of unique structures and assays are
+// only kept for one target at a time, so the measurements must come sorted
+// (or at least grouped) on gene.
+type StatsCollector struct {
+	stats       map[string]*TargetStats
+	genes       []string
+	currentGene string
+	inchiKeys   map[string]bool
+	smiles      map[string]bool
+	assays      map[string]bool
+}
+
+// NewStatsCollector returns an empty StatsCollector
+func NewStatsCollector() *StatsCollector {
+	return &StatsCollector{stats: map[string]*TargetStats{}}
+}
+
+// Add adds a measurement to the statistics of its target. It returns an error
+// if the measurements are not grouped on gene.
+func (sc *StatsCollector) Add(m *Measurement) error {
+	if m.Gene != sc.currentGene {
+		if _, seen := sc.stats[m.Gene]; seen {
+			return fmt.Errorf("excapedb: measurements are not grouped on gene (%s seen again after %s)", m.Gene, sc.currentGene)
+		}
+		sc.finishGene()
+		sc.currentGene = m.Gene
+		sc.genes = append(sc.genes, m.Gene)
+		sc.stats[m.Gene] = &TargetStats{Gene: m.Gene, Species: SpeciesComposition{}}
+		sc.inchiKeys = map[string]bool{}
+		sc.smiles = map[string]bool{}
+		sc.assays = map[string]bool{}
+	}
+	ts := sc.stats[m.Gene]
+	ts.MeasurementCnt++
+	sc.inchiKeys[m.InchiKey] = true
+	sc.smiles[m.SMILES] = true
+	sc.assays[m.AssayID] = true
+	switch m.Label {
+	case Active:
+		ts.ActiveCnt++
+	case Nonactive:
+		ts.NonactiveCnt++
+	}
+	switch db := str.ToLower(m.DB); {
+	case str.HasPrefix(db, DBChEMBL):
+		ts.ChEMBLCnt++
+	case str.HasPrefix(db, DBPubChem):
+		ts.PubChemCnt++
+	}
+	if taxID, err := strconv.ParseInt(m.TaxID, 10, 64); err == nil {
+		ts.Species[taxID]++
+	}
+	return nil
+}
+
+func (sc *StatsCollector) finishGene() {
+	ts, ok := sc.stats[sc.currentGene]
+	if !ok {
+		return
+	}
+	ts.UniqueStructureCnt = len(sc.inchiKeys)
+	ts.UniqueSMILESCnt = len(sc.smiles)
+	ts.AssayCnt = len(sc.assays)
+	sc.inchiKeys, sc.smiles, sc.assays = nil, nil, nil
+}
+
+// Stats returns the statistics for all targets, sorted on gene. The counts
+// of removed and final compounds are zero, and filled in by the caller.
+func (sc *StatsCollector) Stats() []*TargetStats {
+	sc.finishGene()
+	sort.Strings(sc.genes)
+	allStats := []*TargetStats{}
+	for _, gene := range sc.genes {
+		allStats = append(allStats, sc.stats[gene])
+	}
+	return allStats
+}
+
+// StatsTSVHeader lists the columns of the TSV file written by WriteStatsTSV
+var StatsTSVHeader = []string{
+	"Gene",
+	"MeasurementCnt",
+	"UniqueStructureCnt",
+	"UniqueSMILESCnt",
+	"ActiveCnt",
+	"NonactiveCnt",
+	"ChEMBLCnt",
+	"PubChemCnt",
+	"AssayCnt",
+	"Species",
+	"ConflictingRemovedCnt",
+	"DrugBankRemovedCnt",
+	"FinalActiveCnt",
+	"FinalNonactiveCnt",
+	"FinalCnt",
+}
+
+// WriteStatsTSV writes allStats as a TSV file with the columns in
+// StatsTSVHeader
+func WriteStatsTSV(allStats []*TargetStats, w io.Writer) error {
+	tsvWriter := csv.NewWriter(w)
+	tsvWriter.Comma = '\t'
+	tsvWriter.Write(StatsTSVHeader)
+	for _, ts := range allStats {
+		row := []string{ts.Gene}
+		for _, cnt := range []int{
+			ts.MeasurementCnt,
+			ts.UniqueStructureCnt,
+			ts.UniqueSMILESCnt,
+			ts.ActiveCnt,
+			ts.NonactiveCnt,
+			ts.ChEMBLCnt,
+			ts.PubChemCnt,
+			ts.AssayCnt,
+		} {
+			row = append(row, strconv.Itoa(cnt))
+		}
+		row = append(row, ts.Species.String())
+		for _, cnt := range []int{
+			ts.ConflictingRemovedCnt,
+			ts.DrugBankRemovedCnt,
+			ts.FinalActiveCnt,
+			ts.FinalNonactiveCnt,
+			ts.FinalCnt(),
+		} {
+			row = append(row, strconv.Itoa(cnt))
+		}
+		tsvWriter.Write(row)
+	}
+	tsvWriter.Flush()
+	return tsvWriter.Error()
+}
+
+// WriteStatsJSON writes allStats as a JSON list
+func WriteStatsJSON(allStats []*TargetStats, w io.Writer) error {
+	jsonEnc := json.NewEncoder(w)
+	jsonEnc.SetIndent("", "  ")
+	return jsonEnc.Encode(allStats)
+}
+
+// ReadStatsJSON reads a JSON list of statistics, as written by
+// WriteStatsJSON
+func ReadStatsJSON(r io.Reader) ([]*TargetStats, error) {
+	allStats := []*TargetStats{}
+	if err := json.NewDecoder(r).Decode(&allStats); err != nil {
+		return nil, fmt.Errorf("excapedb: could not read target statistics: %v", err)
+	}
+	return allStats, nil
+}
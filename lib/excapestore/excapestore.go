@@ -0,0 +1,392 @@
+// Package excapestore implements an SQLite database with the deduplicated
+// per-target data derived from ExCAPE-DB, indexed on gene symbol, so that
+// per-target data, assumed-negative pools and DrugBank exclusions can be
+// queried without another pass over the full data for every target. It uses
+// the pure-Go SQLite driver in modernc.org/sqlite, so no cgo or sqlite3 binary
+// is needed.
+package excapestore
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	str "strings"
+
+	"github.com/pharmbio/ptp-project/lib/excapedb"
+	_ "modernc.org/sqlite" // Registers the "sqlite" database/sql driver
+)
+
+// DriverName is the name of the database/sql driver used
+const DriverName = "sqlite"
+
+// Schema creates the tables of the store. The gisa table has the deduplicated
+// gene, id, smiles, activity rows (with consensus columns, if available), and
+// the drugbank_removed table has the rows removed from it because the
+// compound is in the DrugBank exclusion list, in drugbank_exclusions. The
+// smiles table has the distinct SMILES of the gisa table, sorted, from which
+// the assumed-negative pools are taken.
+var Schema = []string{
+	`CREATE TABLE gisa (Gene_Symbol TEXT, Original_Entry_ID TEXT, SMILES TEXT, Activity_Flag TEXT, Measurement_Cnt INTEGER, pXC50_Spread REAL, Consensus_pXC50 REAL, Assay_Cnt INTEGER, High_Variance INTEGER);`,
+	`CREATE TABLE drugbank_removed (Gene_Symbol TEXT, Original_Entry_ID TEXT, SMILES TEXT, Activity_Flag TEXT, Measurement_Cnt INTEGER, pXC50_Spread REAL, Consensus_pXC50 REAL, Assay_Cnt INTEGER, High_Variance INTEGER);`,
+	`CREATE TABLE drugbank_exclusions (Compound_ID TEXT PRIMARY KEY);`,
+	`CREATE TABLE smiles (SMILES TEXT PRIMARY KEY) WITHOUT ROWID;`,
+}
+
+// Indices are created after the data is imported, which is much faster than
+// updating them on every insert
+var Indices = []string{
+	`CREATE INDEX gisa_Gene_Symbol ON gisa(Gene_Symbol);`,
+	`CREATE INDEX gisa_SMILES ON gisa(SMILES);`,
+	`CREATE INDEX drugbank_removed_Gene_Symbol ON drugbank_removed(Gene_Symbol);`,
+}
+
+// importBatchSize is the number of rows inserted per transaction
+const importBatchSize = 100000
+
+// Store is an SQLite database with per-target data derived from ExCAPE-DB
+type Store struct {
+	db *sql.DB
+}
+
+// Create creates a new store at path, with the tables in Schema
+func Create(path string) (*Store, error) {
+	store, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range Schema {
+		if _, err := store.db.Exec(stmt); err != nil {
+			store.Close()
+			return nil, fmt.Errorf("excapestore: could not create schema in %s: %v", path, err)
+		}
+	}
+	return store, nil
+}
+
+// Open opens an existing store at path
+func Open(path string) (*Store, error) {
+	db, err := sql.Open(DriverName, path)
+	if err != nil {
+		return nil, fmt.Errorf("excapestore: could not open %s: %v", path, err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the underlying database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// DB returns the underlying database, for custom queries
+func (s *Store) DB() *sql.DB {
+	return s.db
+}
+
+// CreateIndices creates the indices in Indices
+func (s *Store) CreateIndices() error {
+	for _, stmt := range Indices {
+		if _, err := s.db.Exec(stmt); err != nil {
+			return fmt.Errorf("excapestore: could not create index: %v", err)
+		}
+	}
+	return nil
+}
+
+// batchInserter inserts rows with a prepared statement, committing the
+// transaction every importBatchSize rows
+type batchInserter struct {
+	db    *sql.DB
+	query string
+	tx    *sql.Tx
+	stmt  *sql.Stmt
+	cnt   int64
+}
+
+func (bi *batchInserter) insert(vals ...interface{}) error {
+	if bi.tx == nil {
+		var err error
+		if bi.tx, err = bi.db.Begin(); err != nil {
+			return err
+		}
+		if bi.stmt, err = bi.tx.Prepare(bi.query); err != nil {
+			return err
+		}
+	}
+	if _, err := bi.stmt.Exec(vals...); err != nil {
+		return err
+	}
+	bi.cnt++
+	if bi.cnt%importBatchSize == 0 {
+		return bi.commit()
+	}
+	return nil
+}
+
+func (bi *batchInserter) commit() error {
+	if bi.tx == nil {
+		return nil
+	}
+	bi.stmt.Close()
+	err := bi.tx.Commit()
+	bi.tx = nil
+	return err
+}
+
+// ImportGISA imports a tab-separated gene, id, smiles, activity (GISA) file,
+// optionally with the consensus columns measurement count, pXC50 spread,
+// consensus pXC50, assay count and high variance flag, into the gisa table
+func (s *Store) ImportGISA(r io.Reader) (int64, error) {
+	bi := &batchInserter{db: s.db, query: `INSERT INTO gisa VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);`}
+	lineScanner := bufio.NewScanner(r)
+	lineScanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for lineScanner.Scan() {
+		fields := str.Split(lineScanner.Text(), "\t")
+		if len(fields) != 4 && len(fields) != 9 {
+			return bi.cnt, fmt.Errorf("excapestore: expected 4 or 9 fields in GISA file, but got %d in line: %s", len(fields), lineScanner.Text())
+		}
+		vals := []interface{}{fields[0], fields[1], fields[2], fields[3], nil, nil, nil, nil, nil}
+		for i := 4; i < len(fields); i++ {
+			if fields[i] != "" {
+				vals[i] = fields[i]
+			}
+		}
+		if err := bi.insert(vals...); err != nil {
+			return bi.cnt, fmt.Errorf("excapestore: could not insert GISA row: %v", err)
+		}
+	}
+	if err := lineScanner.Err(); err != nil {
+		return bi.cnt, err
+	}
+	return bi.cnt, bi.commit()
+}
+
+// ImportDrugBankExclusions imports a file with one compound id (ChEMBL or
+// PubChem) per line into the drugbank_exclusions table
+func (s *Store) ImportDrugBankExclusions(r io.Reader) (int64, error) {
+	bi := &batchInserter{db: s.db, query: `INSERT OR IGNORE INTO drugbank_exclusions VALUES (?);`}
+	lineScanner := bufio.NewScanner(r)
+	for lineScanner.Scan() {
+		id := str.TrimSpace(lineScanner.Text())
+		if id == "" {
+			continue
+		}
+		if err := bi.insert(id); err != nil {
+			return bi.cnt, fmt.Errorf("excapestore: could not insert DrugBank exclusion: %v", err)
+		}
+	}
+	if err := lineScanner.Err(); err != nil {
+		return bi.cnt, err
+	}
+	return bi.cnt, bi.commit()
+}
+
+// RemoveDrugBankExcluded moves the rows of the compounds in the DrugBank
+// exclusion list (by ChEMBL or PubChem id) from the gisa table to the
+// drugbank_removed table, and returns the number of moved rows
+func (s *Store) RemoveDrugBankExcluded() (int64, error) {
+	const excluded = `Original_Entry_ID IN (SELECT Compound_ID FROM drugbank_exclusions)`
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`INSERT INTO drugbank_removed SELECT * FROM gisa WHERE ` + excluded + ` ORDER BY rowid;`); err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("excapestore: could not copy DrugBank compounds: %v", err)
+	}
+	res, err := tx.Exec(`DELETE FROM gisa WHERE ` + excluded + `;`)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("excapestore: could not remove DrugBank compounds: %v", err)
+	}
+	cnt, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return cnt, tx.Commit()
+}
+
+// FillSMILES fills the smiles table with the distinct SMILES of the gisa
+// table, and returns their number. It should be run after
+// RemoveDrugBankExcluded, so that the DrugBank compounds are left out.
+func (s *Store) FillSMILES() (int64, error) {
+	res, err := s.db.Exec(`INSERT INTO smiles SELECT DISTINCT SMILES FROM gisa;`)
+	if err != nil {
+		return 0, fmt.Errorf("excapestore: could not fill the smiles table: %v", err)
+	}
+	return res.RowsAffected()
+}
+
+// HasConsensus tells whether the gisa table has consensus columns (measurement
+// count, pXC50 spread etc) filled in
+func (s *Store) HasConsensus() (bool, error) {
+	var exists int
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM gisa WHERE Measurement_Cnt IS NOT NULL);`).Scan(&exists)
+	return exists == 1, err
+}
+
+// WriteTargetData writes the training data for gene as a TSV file with header
+// for CPSign, with the columns smiles and activity, and, if available, the
+// measurement count and pXC50 spread
+func (s *Store) WriteTargetData(gene string, w io.Writer) error {
+	hasConsensus, err := s.HasConsensus()
+	if err != nil {
+		return err
+	}
+	bufW := bufio.NewWriter(w)
+	if hasConsensus {
+		bufW.WriteString("smiles\tactivity\tmeasurement_cnt\tpxc50_spread\n")
+	} else {
+		bufW.WriteString("smiles\tactivity\n")
+	}
+	rows, err := s.db.Query(`SELECT SMILES, Activity_Flag, Measurement_Cnt, pXC50_Spread FROM gisa WHERE Gene_Symbol = ? ORDER BY rowid;`, gene)
+	if err != nil {
+		return fmt.Errorf("excapestore: could not query target data for %s: %v", gene, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var smiles, activity string
+		var measurementCnt sql.NullInt64
+		var spread sql.NullFloat64
+		if err := rows.Scan(&smiles, &activity, &measurementCnt, &spread); err != nil {
+			return err
+		}
+		bufW.WriteString(smiles + "\t" + activity)
+		if hasConsensus {
+			bufW.WriteString("\t" + strconv.FormatInt(measurementCnt.Int64, 10) + "\t" + formatNullFloat(spread))
+		}
+		bufW.WriteString("\n")
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return bufW.Flush()
+}
+
+// WriteGISA writes all rows of table, which should be "gisa" or
+// "drugbank_removed", in the order they were imported, in the same format as
+// the file read by ImportGISA
+func (s *Store) WriteGISA(table string, w io.Writer) error {
+	if table != "gisa" && table != "drugbank_removed" {
+		return fmt.Errorf("excapestore: can not write GISA data from table %s", table)
+	}
+	hasConsensus, err := s.HasConsensus()
+	if err != nil {
+		return err
+	}
+	rows, err := s.db.Query(`SELECT Gene_Symbol, Original_Entry_ID, SMILES, Activity_Flag, Measurement_Cnt, pXC50_Spread, Consensus_pXC50, Assay_Cnt, High_Variance FROM ` + table + ` ORDER BY rowid;`)
+	if err != nil {
+		return fmt.Errorf("excapestore: could not query table %s: %v", table, err)
+	}
+	defer rows.Close()
+	bufW := bufio.NewWriter(w)
+	for rows.Next() {
+		var gene, id, smiles, activity string
+		var measurementCnt, assayCnt, highVariance sql.NullInt64
+		var spread, pxc50 sql.NullFloat64
+		if err := rows.Scan(&gene, &id, &smiles, &activity, &measurementCnt, &spread, &pxc50, &assayCnt, &highVariance); err != nil {
+			return err
+		}
+		bufW.WriteString(gene + "\t" + id + "\t" + smiles + "\t" + activity)
+		if hasConsensus {
+			bufW.WriteString("\t" + strconv.FormatInt(measurementCnt.Int64, 10) +
+				"\t" + formatNullFloat(spread) +
+				"\t" + formatNullFloat(pxc50) +
+				"\t" + strconv.FormatInt(assayCnt.Int64, 10) +
+				"\t" + strconv.FormatInt(highVariance.Int64, 10))
+		}
+		bufW.WriteString("\n")
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return bufW.Flush()
+}
+
+// WriteAssumedNegativePool writes the (unique, sorted) SMILES of all
+// compounds measured on any other target than gene, but not on gene itself,
+// as smiles, "N" rows, to be sampled from as assumed negatives. The SMILES
+// are read in order from the smiles table (see FillSMILES), leaving out the
+// ones of gene, which are looked up through the gene symbol index.
+func (s *Store) WriteAssumedNegativePool(gene string, w io.Writer) error {
+	rows, err := s.db.Query(`SELECT SMILES FROM smiles WHERE SMILES NOT IN (SELECT SMILES FROM gisa WHERE Gene_Symbol = ?) ORDER BY SMILES;`, gene)
+	if err != nil {
+		return fmt.Errorf("excapestore: could not query assumed negative pool for %s: %v", gene, err)
+	}
+	defer rows.Close()
+	bufW := bufio.NewWriter(w)
+	for rows.Next() {
+		var smiles string
+		if err := rows.Scan(&smiles); err != nil {
+			return err
+		}
+		bufW.WriteString(smiles + "\t" + excapedb.Nonactive + "\n")
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return bufW.Flush()
+}
+
+// WriteDrugBankRemoved writes the id, smiles and activity of the compounds
+// for gene that were removed from the training data because they are in the
+// DrugBank exclusion list, for use as validation data
+func (s *Store) WriteDrugBankRemoved(gene string, w io.Writer) error {
+	rows, err := s.db.Query(`SELECT Original_Entry_ID, SMILES, Activity_Flag FROM drugbank_removed WHERE Gene_Symbol = ? ORDER BY rowid;`, gene)
+	if err != nil {
+		return fmt.Errorf("excapestore: could not query DrugBank removed data for %s: %v", gene, err)
+	}
+	defer rows.Close()
+	bufW := bufio.NewWriter(w)
+	for rows.Next() {
+		var id, smiles, activity string
+		if err := rows.Scan(&id, &smiles, &activity); err != nil {
+			return err
+		}
+		bufW.WriteString(id + "\t" + smiles + "\t" + activity + "\n")
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return bufW.Flush()
+}
+
+// SMILESForGenes returns the set of SMILES measured on any of the given genes,
+// or, if activesOnly is set, the ones that are active on any of them
+func (s *Store) SMILESForGenes(genes []string, activesOnly bool) (map[string]bool, error) {
+	smilesSet := map[string]bool{}
+	query := `SELECT SMILES FROM gisa WHERE Gene_Symbol = ?;`
+	if activesOnly {
+		query = `SELECT SMILES FROM gisa WHERE Gene_Symbol = ? AND Activity_Flag = '` + excapedb.Active + `';`
+	}
+	for _, gene := range genes {
+		rows, err := s.db.Query(query, gene)
+		if err != nil {
+			return nil, fmt.Errorf("excapestore: could not query SMILES for %s: %v", gene, err)
+		}
+		for rows.Next() {
+			var smiles string
+			if err := rows.Scan(&smiles); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			smilesSet[smiles] = true
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return smilesSet, nil
+}
+
+func formatNullFloat(f sql.NullFloat64) string {
+	if !f.Valid || math.IsNaN(f.Float64) {
+		return ""
+	}
+	return strconv.FormatFloat(f.Float64, 'f', 2, 64)
+}
@@ -0,0 +1,147 @@
+package genesets
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	str "strings"
+)
+
+// AliasEntry is one target in an AliasTable, with its official gene symbol,
+// Entrez gene ID, UniProt accession, and the alternative symbols under which
+// it might be found in the data
+type AliasEntry struct {
+	Symbol   string
+	EntrezID string
+	UniProt  string
+	Aliases  []string
+}
+
+// AliasTable maps gene symbols, Entrez gene IDs, UniProt accessions and
+// aliases to AliasEntries
+type AliasTable struct {
+	Entries []*AliasEntry
+	byID    map[string]*AliasEntry
+}
+
+// LoadAliasTable reads an alias table from a tab-separated file with the
+// columns symbol, entrez_id, uniprot and aliases (comma-separated), with a
+// header line. Empty lines and lines starting with # are skipped.
+func LoadAliasTable(path string) (*AliasTable, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("genesets: could not open alias table %s: %v", path, err)
+	}
+	defer fh.Close()
+
+	at := &AliasTable{byID: map[string]*AliasEntry{}}
+	headerRead := false
+	lineScanner := bufio.NewScanner(fh)
+	for lineScanner.Scan() {
+		line := lineScanner.Text()
+		if str.TrimSpace(line) == "" || str.HasPrefix(line, "#") {
+			continue
+		}
+		fields := str.Split(line, "\t")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("genesets: expected 4 fields (symbol, entrez_id, uniprot, aliases) in alias table %s, but got %d in line: %s", path, len(fields), line)
+		}
+		if !headerRead {
+			headerRead = true
+			continue
+		}
+		entry := &AliasEntry{
+			Symbol:   str.ToUpper(str.TrimSpace(fields[0])),
+			EntrezID: str.TrimSpace(fields[1]),
+			UniProt:  str.ToUpper(str.TrimSpace(fields[2])),
+			Aliases:  []string{},
+		}
+		for _, alias := range str.Split(fields[3], ",") {
+			if alias = str.ToUpper(str.TrimSpace(alias)); alias != "" {
+				entry.Aliases = append(entry.Aliases, alias)
+			}
+		}
+		at.Entries = append(at.Entries, entry)
+		for _, id := range []string{entry.Symbol, entry.EntrezID, entry.UniProt} {
+			if id != "" {
+				at.byID[id] = entry
+			}
+		}
+	}
+	if err := lineScanner.Err(); err != nil {
+		return nil, fmt.Errorf("genesets: could not read alias table %s: %v", path, err)
+	}
+	return at, nil
+}
+
+// Lookup returns the entry with the given gene symbol, Entrez gene ID or
+// UniProt accession, or nil if there is none
+func (at *AliasTable) Lookup(id string) *AliasEntry {
+	return at.byID[str.ToUpper(str.TrimSpace(id))]
+}
+
+// Resolver resolves panel entries (gene symbols, Entrez gene IDs or UniProt
+// accessions) to the gene symbols available in the data, using an alias
+// table, and keeps track of substituted and missing entries
+type Resolver struct {
+	Aliases *AliasTable
+	// Available is the set of gene symbols in the data. If nil, availability
+	// is not checked, and entries are only mapped to their gene symbols.
+	Available     map[string]bool
+	substitutions map[string]string
+	missing       map[string]bool
+}
+
+// NewResolver returns a Resolver using the given alias table (which can be
+// nil) and set of available gene symbols (which can be nil)
+func NewResolver(aliases *AliasTable, available map[string]bool) *Resolver {
+	return &Resolver{
+		Aliases:       aliases,
+		Available:     available,
+		substitutions: map[string]string{},
+		missing:       map[string]bool{},
+	}
+}
+
+// Resolve returns the gene symbol in the data for a panel entry, and false if
+// the target is not available in the data
+func (r *Resolver) Resolve(panelEntry string) (string, bool) {
+	id := str.ToUpper(str.TrimSpace(panelEntry))
+	var entry *AliasEntry
+	if r.Aliases != nil {
+		entry = r.Aliases.Lookup(id)
+	}
+	candidates := []string{id}
+	if entry != nil {
+		candidates = append([]string{entry.Symbol}, entry.Aliases...)
+	}
+	for _, symbol := range candidates {
+		if r.Available == nil || r.Available[symbol] {
+			if symbol != id {
+				r.substitutions[symbol] = id
+			}
+			return symbol, true
+		}
+	}
+	r.missing[id] = true
+	return "", false
+}
+
+// Substitution returns the panel entry that was resolved to symbol, if it
+// was resolved from another identifier or alias
+func (r *Resolver) Substitution(symbol string) (string, bool) {
+	panelEntry, ok := r.substitutions[symbol]
+	return panelEntry, ok
+}
+
+// Missing returns the panel entries (sorted) that were not available in the
+// data
+func (r *Resolver) Missing() []string {
+	missing := []string{}
+	for id := range r.missing {
+		missing = append(missing, id)
+	}
+	sort.Strings(missing)
+	return missing
+}
@@ -0,0 +1,207 @@
+// Package genesets implements gene sets defined by rules, such as "the members
+// of panel X with at least N actives and N non-actives", which are resolved
+// against per-target statistics (see excapedb.TargetStats), so that the sets
+// stay correct when the data changes, instead of being hard-coded.
+package genesets
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	str "strings"
+
+	"github.com/pharmbio/ptp-project/lib/excapedb"
+)
+
+// Rule defines a gene set, either as an explicit list of members, or as the
+// members of another set that fulfil all of the given count criteria. All
+// counts refer to the final per-target data (see excapedb.TargetStats).
+type Rule struct {
+	Name string `json:"name"`
+	// Members is an explicit list of targets, such as a target panel, given
+	// as gene symbols, Entrez gene IDs or UniProt accessions (see Resolver)
+	Members []string `json:"members,omitempty"`
+	// From is the name of the set to select members from
+	From string `json:"from,omitempty"`
+	// MinActives and MinNonactives are the least number of active and
+	// non-active compounds
+	MinActives    int `json:"min_actives,omitempty"`
+	MinNonactives int `json:"min_nonactives,omitempty"`
+	// MinCompounds is the least number of compounds, and MaxCompounds, if
+	// non-zero, the number of compounds that members must have fewer than
+	MinCompounds int `json:"min_compounds,omitempty"`
+	MaxCompounds int `json:"max_compounds,omitempty"`
+	// Smallest, if non-zero, keeps only this many of the (remaining) members
+	// with the fewest compounds
+	Smallest int `json:"smallest,omitempty"`
+	// Description is a free-text description of the set
+	Description string `json:"description,omitempty"`
+}
+
+// countBased tells whether the rule needs statistics to be resolved
+func (r *Rule) countBased() bool {
+	return r.MinActives > 0 || r.MinNonactives > 0 || r.MinCompounds > 0 || r.MaxCompounds > 0 || r.Smallest > 0
+}
+
+// accepts tells whether a target with the given statistics fulfils the count
+// criteria of the rule
+func (r *Rule) accepts(ts *excapedb.TargetStats) bool {
+	if ts == nil {
+		return !r.countBased()
+	}
+	return ts.FinalActiveCnt >= r.MinActives &&
+		ts.FinalNonactiveCnt >= r.MinNonactives &&
+		ts.FinalCnt() >= r.MinCompounds &&
+		(r.MaxCompounds == 0 || ts.FinalCnt() < r.MaxCompounds)
+}
+
+// Rules is a set of gene set rules, as read from a JSON file with a
+// "gene_sets" list
+type Rules struct {
+	Sets []*Rule `json:"gene_sets"`
+	// Resolver, if set, resolves the explicit members of sets to the gene
+	// symbols available in the data. Unavailable members are left out.
+	Resolver *Resolver `json:"-"`
+}
+
+// LoadRules reads rules from a JSON file, and validates them
+func LoadRules(path string) (*Rules, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("genesets: could not read rules file %s: %v", path, err)
+	}
+	rules := &Rules{}
+	if err := json.Unmarshal(data, rules); err != nil {
+		return nil, fmt.Errorf("genesets: could not parse rules file %s: %v", path, err)
+	}
+	seen := map[string]bool{}
+	for _, r := range rules.Sets {
+		if r.Name == "" {
+			return nil, fmt.Errorf("genesets: gene set without name in %s", path)
+		}
+		if seen[r.Name] {
+			return nil, fmt.Errorf("genesets: gene set %s is defined more than once in %s", r.Name, path)
+		}
+		seen[r.Name] = true
+		if (len(r.Members) > 0) == (r.From != "") {
+			return nil, fmt.Errorf("genesets: gene set %s must have either members or from", r.Name)
+		}
+		if len(r.Members) > 0 && r.countBased() {
+			return nil, fmt.Errorf("genesets: gene set %s has count criteria, which requires from instead of members", r.Name)
+		}
+	}
+	for _, r := range rules.Sets {
+		if r.From != "" && !seen[r.From] {
+			return nil, fmt.Errorf("genesets: gene set %s selects from unknown gene set %s", r.Name, r.From)
+		}
+	}
+	return rules, nil
+}
+
+// Names returns the names of all gene sets, sorted
+func (rules *Rules) Names() []string {
+	names := []string{}
+	for _, r := range rules.Sets {
+		names = append(names, r.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Rule returns the rule with the given name
+func (rules *Rules) Rule(name string) (*Rule, error) {
+	for _, r := range rules.Sets {
+		if r.Name == name {
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("genesets: unknown gene set %s (available: %s)", name, str.Join(rules.Names(), ", "))
+}
+
+// chain returns the rule with the given name, followed by the rules it
+// selects from, recursively
+func (rules *Rules) chain(name string) ([]*Rule, error) {
+	chain := []*Rule{}
+	seen := map[string]bool{}
+	for name != "" {
+		if seen[name] {
+			return nil, fmt.Errorf("genesets: gene set %s selects from itself", name)
+		}
+		seen[name] = true
+		r, err := rules.Rule(name)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, r)
+		name = r.From
+	}
+	return chain, nil
+}
+
+// NeedsStats tells whether statistics are needed to resolve the gene set
+func (rules *Rules) NeedsStats(name string) (bool, error) {
+	chain, err := rules.chain(name)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range chain {
+		if r.countBased() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Resolve returns the members of the gene set with the given name, given the
+// statistics per target. Stats can be nil, for sets that do not need them.
+// Targets without statistics are not accepted by any count criteria.
+func (rules *Rules) Resolve(name string, stats map[string]*excapedb.TargetStats) ([]string, error) {
+	chain, err := rules.chain(name)
+	if err != nil {
+		return nil, err
+	}
+	var members []string
+	for i := len(chain) - 1; i >= 0; i-- {
+		r := chain[i]
+		if len(r.Members) > 0 {
+			members = []string{}
+			for _, member := range r.Members {
+				if rules.Resolver == nil {
+					members = append(members, member)
+				} else if symbol, ok := rules.Resolver.Resolve(member); ok {
+					members = append(members, symbol)
+				}
+			}
+			continue
+		}
+		if r.countBased() && stats == nil {
+			return nil, fmt.Errorf("genesets: statistics are needed to resolve gene set %s", r.Name)
+		}
+		selected := []string{}
+		for _, gene := range members {
+			if r.accepts(stats[gene]) {
+				selected = append(selected, gene)
+			}
+		}
+		if r.Smallest > 0 {
+			sort.SliceStable(selected, func(i, j int) bool {
+				return stats[selected[i]].FinalCnt() < stats[selected[j]].FinalCnt()
+			})
+			if len(selected) > r.Smallest {
+				selected = selected[:r.Smallest]
+			}
+		}
+		members = selected
+	}
+	return members, nil
+}
+
+// StatsByGene indexes a list of statistics on gene
+func StatsByGene(allStats []*excapedb.TargetStats) map[string]*excapedb.TargetStats {
+	stats := map[string]*excapedb.TargetStats{}
+	for _, ts := range allStats {
+		stats[ts.Gene] = ts
+	}
+	return stats
+}
@@ -0,0 +1,74 @@
+package gridsearch
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Curve-level metrics, computed over all confidence levels of a grid point
+const (
+	CurveMeanObsFuzzOverall  = "MeanObsFuzzOverall"
+	CurveMeanObsFuzzClassAvg = "MeanObsFuzzClassAvg"
+	CurveMeanEfficiency      = "MeanEfficiency"
+	// CurveCalibration is the area between the calibration curve and the
+	// diagonal (see Calibration)
+	CurveCalibration = "Calibration"
+)
+
+// CurveEfficiencyConfidences are the confidence levels at which the efficiency
+// is included in the curve-level metrics, as Efficiency<percent>, such as
+// Efficiency80
+var CurveEfficiencyConfidences = []float64{0.7, 0.8, 0.9, 0.95}
+
+// CurveMetricNames returns the names of the curve-level metrics, in order
+func CurveMetricNames() []string {
+	names := []string{CurveMeanObsFuzzOverall, CurveMeanObsFuzzClassAvg, CurveMeanEfficiency, CurveCalibration}
+	for _, conf := range CurveEfficiencyConfidences {
+		names = append(names, efficiencyAtName(conf))
+	}
+	return names
+}
+
+func efficiencyAtName(confidence float64) string {
+	return "Efficiency" + strconv.Itoa(int(math.Round(confidence*100)))
+}
+
+// CurveMetrics returns the curve-level metrics of a grid point (see
+// CurveMetricNames). The efficiency at a confidence level that is not in the
+// results is left out.
+func CurveMetrics(results []*Result, point string) (map[string]float64, error) {
+	sums := map[string]float64{}
+	cnts := map[string]int{}
+	curve := map[string]float64{}
+	for _, r := range results {
+		if r.Point != point {
+			continue
+		}
+		sums[r.Metric] += r.Value
+		cnts[r.Metric]++
+		if r.Metric == MetricEfficiency {
+			for _, conf := range CurveEfficiencyConfidences {
+				if sameConfidence(r.Confidence, conf) {
+					curve[efficiencyAtName(conf)] = r.Value
+				}
+			}
+		}
+	}
+	for name, metric := range map[string]string{
+		CurveMeanObsFuzzOverall:  MetricObsFuzzOverall,
+		CurveMeanObsFuzzClassAvg: MetricObsFuzzClassAvg,
+		CurveMeanEfficiency:      MetricEfficiency,
+	} {
+		if cnts[metric] == 0 {
+			return nil, fmt.Errorf("gridsearch: no %s values for grid point %s", metric, point)
+		}
+		curve[name] = sums[metric] / float64(cnts[metric])
+	}
+	calibration, err := Calibration(results, point)
+	if err != nil {
+		return nil, err
+	}
+	curve[CurveCalibration] = calibration
+	return curve, nil
+}
@@ -0,0 +1,173 @@
+package gridsearch
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	str "strings"
+)
+
+// Halving configures an adaptive grid search with successive halving: all grid
+// points are first evaluated in cheap rounds (with fewer folds and models),
+// after each of which only the best ones are kept. Around the best point left,
+// new points are then added (see Space.Refine), and all remaining points are
+// evaluated in a final, full round.
+type Halving struct {
+	// Rounds are the cheap rounds, before the final full round
+	Rounds []*HalvingRound `json:"rounds"`
+	// Keep is the fraction of grid points kept after each cheap round, of
+	// which at least one is kept
+	Keep float64 `json:"keep"`
+	// Refine tells whether to add points around the best one after the
+	// cheap rounds
+	Refine bool `json:"refine"`
+}
+
+// HalvingRound is a cheap round in a Halving search
+type HalvingRound struct {
+	CVFolds int `json:"cv_folds"`
+	// Values overrides the values of parameters in the round, such as
+	// {"nrmdl": "3"} for fewer models. Overridden values do not change the
+	// identity (key) of grid points.
+	Values map[string]string `json:"values,omitempty"`
+}
+
+func (h *Halving) validate(declared map[string]bool) error {
+	if len(h.Rounds) == 0 {
+		return fmt.Errorf("gridsearch: no rounds in halving")
+	}
+	if h.Keep <= 0 || h.Keep > 1 {
+		return fmt.Errorf("gridsearch: keep in halving must be in (0, 1], but was %f", h.Keep)
+	}
+	for i, round := range h.Rounds {
+		if round.CVFolds < 2 {
+			return fmt.Errorf("gridsearch: need two or more cv_folds in halving round %d, but got %d", i+1, round.CVFolds)
+		}
+		for name := range round.Values {
+			if !declared[name] {
+				return fmt.Errorf("gridsearch: unknown parameter %s in values of halving round %d", name, i+1)
+			}
+		}
+	}
+	return nil
+}
+
+// Survivors returns the points to keep after a cheap round: the Keep fraction
+// (rounded up) of the valid points with the smallest value of the objective
+// of the selection, in order of increasing value. If no point is valid, all
+// of them are ranked.
+func (h *Halving) Survivors(results []*Result, points []string, selection *Selection) ([]string, error) {
+	ranked := []string{}
+	scores := map[string]float64{}
+	for _, point := range points {
+		if selection.ValidityTolerance >= 0 && !IsValid(results, point, selection.ValidityTolerance) {
+			continue
+		}
+		score, err := selection.Objective.Score(results, point, selection.Confidence)
+		if err != nil {
+			return nil, err
+		}
+		scores[point] = score
+		ranked = append(ranked, point)
+	}
+	if len(ranked) == 0 {
+		unchecked := *selection
+		unchecked.ValidityTolerance = -1
+		return h.Survivors(results, points, &unchecked)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return scores[ranked[i]] < scores[ranked[j]] })
+	keepCnt := int(math.Ceil(h.Keep * float64(len(points))))
+	if keepCnt < 1 {
+		keepCnt = 1
+	}
+	if keepCnt < len(ranked) {
+		ranked = ranked[:keepCnt]
+	}
+	return ranked, nil
+}
+
+// With returns a copy of the point, with the values of the parameters in
+// values replaced
+func (p Point) With(values map[string]string) Point {
+	np := append(Point{}, p...)
+	for i, s := range np {
+		if val, ok := values[s.Name]; ok {
+			np[i].Value = val
+		}
+	}
+	return np
+}
+
+// ParsePoint returns the point with the given key (see Point.Key), which may
+// have values of the parameters that are not among the declared ones, such as
+// from Space.Refine
+func (s *Space) ParsePoint(key string) (Point, error) {
+	point := Point{}
+	for _, part := range str.Split(key, ",") {
+		nameVal := str.SplitN(part, "=", 2)
+		if len(nameVal) != 2 {
+			return nil, fmt.Errorf("gridsearch: could not parse '%s' in grid point %s", part, key)
+		}
+		p := s.Param(nameVal[0])
+		if p == nil {
+			return nil, fmt.Errorf("gridsearch: unknown parameter %s in grid point %s", nameVal[0], key)
+		}
+		point = append(point, Setting{Name: p.Name, Flag: p.Flag, Value: nameVal[1], Stages: p.stages()})
+	}
+	return point, nil
+}
+
+// Refine returns new points around best: for each numeric parameter with
+// positive values (such as cost and gamma), best with the value replaced by
+// the geometric mean of the value of best and each of its neighbours among
+// the declared values. Points equal to best are not returned.
+func (s *Space) Refine(best Point) []Point {
+	refined := []Point{}
+	seen := map[string]bool{best.Key(): true}
+	for _, setting := range best {
+		p := s.Param(setting.Name)
+		values, ok := positiveFloats(p.Values)
+		if !ok || len(values) < 2 {
+			continue
+		}
+		bestVal, err := strconv.ParseFloat(setting.Value, 64)
+		if err != nil {
+			continue
+		}
+		sort.Float64s(values)
+		idx := sort.SearchFloat64s(values, bestVal)
+		neighbours := []float64{}
+		if idx > 0 {
+			neighbours = append(neighbours, values[idx-1])
+		}
+		if idx < len(values) && values[idx] != bestVal {
+			neighbours = append(neighbours, values[idx])
+		} else if idx+1 < len(values) {
+			neighbours = append(neighbours, values[idx+1])
+		}
+		for _, nb := range neighbours {
+			mid := strconv.FormatFloat(math.Sqrt(bestVal*nb), 'g', 3, 64)
+			np := best.With(map[string]string{setting.Name: mid})
+			if !seen[np.Key()] {
+				seen[np.Key()] = true
+				refined = append(refined, np)
+			}
+		}
+	}
+	return refined
+}
+
+// positiveFloats parses values as numbers, and tells whether all of them are
+// positive numbers
+func positiveFloats(values []string) ([]float64, bool) {
+	floats := []float64{}
+	for _, v := range values {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 {
+			return nil, false
+		}
+		floats = append(floats, f)
+	}
+	return floats, true
+}
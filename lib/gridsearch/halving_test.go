@@ -0,0 +1,93 @@
+package gridsearch
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSurvivors(t *testing.T) {
+	objective, err := ParseObjective(ObjectiveObsFuzzOverall)
+	if err != nil {
+		t.Fatal(err)
+	}
+	selection := &Selection{Objective: objective, Confidence: 0.8}
+	invalid := map[float64]float64{0.8: 0.6}
+	points := []string{"a", "b", "c", "d", "e"}
+	for _, tc := range []struct {
+		name      string
+		keep      float64
+		invalid   map[string]bool
+		survivors []string
+	}{
+		{name: "rounded up", keep: 0.5, survivors: []string{"e", "d", "c"}},
+		{name: "at least one", keep: 0.01, survivors: []string{"e"}},
+		{name: "all", keep: 1, survivors: []string{"e", "d", "c", "b", "a"}},
+		{name: "invalid skipped", keep: 0.5, invalid: map[string]bool{"d": true}, survivors: []string{"e", "c", "b"}},
+		{name: "fewer valid than kept", keep: 0.5, invalid: map[string]bool{"a": true, "b": true, "c": true, "d": true}, survivors: []string{"e"}},
+		{name: "none valid", keep: 0.4, invalid: map[string]bool{"a": true, "b": true, "c": true, "d": true, "e": true}, survivors: []string{"e", "d"}},
+	} {
+		results := []*Result{}
+		for i, point := range points {
+			accuracies := map[float64]float64{}
+			if tc.invalid[point] {
+				accuracies = invalid
+			}
+			// Later points have a smaller observed fuzziness
+			results = append(results, curveResults(point, accuracies, 0.5-0.1*float64(i))...)
+		}
+		halving := &Halving{Rounds: []*HalvingRound{{CVFolds: 3}}, Keep: tc.keep}
+		survivors, err := halving.Survivors(results, points, selection)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(survivors, tc.survivors) {
+			t.Errorf("Case %s: expected survivors %v, but got %v", tc.name, tc.survivors, survivors)
+		}
+	}
+}
+
+func TestParsePoint(t *testing.T) {
+	space := testSpace()
+	point, err := space.ParsePoint("impl=libsvm,cost=3.16,gamma=0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args := point.Args(StageTrain); args != "--impl libsvm --cost 3.16 --gamma 0.1" {
+		t.Errorf("Unexpected args '%s' of parsed grid point", args)
+	}
+	for _, key := range []string{"impl=libsvm,kernel=rbf", "impl"} {
+		if _, err := space.ParsePoint(key); err == nil {
+			t.Errorf("Expected an error when parsing grid point %s", key)
+		}
+	}
+}
+
+func TestRefine(t *testing.T) {
+	space := &Space{Params: []*Param{
+		{Name: "impl", Flag: "--impl", Values: []string{"liblinear", "libsvm"}},
+		{Name: "cost", Flag: "--cost", Values: []string{"1", "10", "100"}},
+		{Name: "nrmdl", Flag: "--nr-models", Values: []string{"10"}},
+	}}
+	for _, tc := range []struct {
+		best    string
+		refined []string
+	}{
+		{"impl=libsvm,cost=10,nrmdl=10", []string{"impl=libsvm,cost=3.16,nrmdl=10", "impl=libsvm,cost=31.6,nrmdl=10"}},
+		{"impl=libsvm,cost=1,nrmdl=10", []string{"impl=libsvm,cost=3.16,nrmdl=10"}},
+		{"impl=libsvm,cost=100,nrmdl=10", []string{"impl=libsvm,cost=31.6,nrmdl=10"}},
+		{"impl=libsvm,cost=3.16,nrmdl=10", []string{"impl=libsvm,cost=1.78,nrmdl=10", "impl=libsvm,cost=5.62,nrmdl=10"}},
+		{"impl=libsvm,cost=200,nrmdl=10", []string{"impl=libsvm,cost=141,nrmdl=10"}},
+	} {
+		best, err := space.ParsePoint(tc.best)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refined := []string{}
+		for _, point := range space.Refine(best) {
+			refined = append(refined, point.Key())
+		}
+		if !reflect.DeepEqual(refined, tc.refined) {
+			t.Errorf("Refining %s: expected %v, but got %v", tc.best, tc.refined, refined)
+		}
+	}
+}
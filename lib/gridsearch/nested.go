@@ -0,0 +1,201 @@
+package gridsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+// Prediction is one line of the JSON output of CPSign validate: the observed
+// label of a compound, its p-value for each label, and the predicted labels at
+// each confidence level, in the order given with --confidences
+type Prediction struct {
+	Molecule struct {
+		Activity string `json:"activity"`
+	} `json:"molecule"`
+	Prediction struct {
+		PValues         map[string]float64 `json:"pValues"`
+		PredictedLabels []struct {
+			Labels []string `json:"labels"`
+		} `json:"predictedLabels"`
+	} `json:"prediction"`
+}
+
+// ReadPredictions reads the JSON output of CPSign validate, with one
+// prediction per line
+func ReadPredictions(r io.Reader) ([]*Prediction, error) {
+	preds := []*Prediction{}
+	dec := json.NewDecoder(r)
+	for {
+		pred := &Prediction{}
+		err := dec.Decode(pred)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("gridsearch: could not parse prediction %d: %v", len(preds)+1, err)
+		}
+		preds = append(preds, pred)
+	}
+	return preds, nil
+}
+
+// PredictionResults computes the metrics of the grid search results (see
+// Metric*) from predictions of compounds with known labels, at the confidence
+// levels they were predicted at, as results of the given grid point. The
+// observed fuzziness of a prediction is the sum of the p-values of the labels
+// other than the observed one, and the class confidence and credibility are 1
+// minus the second largest, and the largest, p-value. All of them are averaged
+// over the predictions, which do not depend on the confidence level.
+func PredictionResults(preds []*Prediction, confidences []float64, active string, nonactive string, gene string, replicate string, runset string, point string) ([]*Result, error) {
+	if len(preds) == 0 {
+		return nil, fmt.Errorf("gridsearch: no predictions for grid point %s", point)
+	}
+	fuzzSums := map[string]float64{}
+	fuzzCnts := map[string]int{}
+	confidenceSum, credibilitySum := 0.0, 0.0
+	for i, pred := range preds {
+		if len(pred.Prediction.PValues) < 2 {
+			return nil, fmt.Errorf("gridsearch: need p-values of two or more labels in prediction %d, but got %d", i+1, len(pred.Prediction.PValues))
+		}
+		if len(pred.Prediction.PredictedLabels) != len(confidences) {
+			return nil, fmt.Errorf("gridsearch: expected predicted labels at %d confidence levels in prediction %d, but got %d", len(confidences), i+1, len(pred.Prediction.PredictedLabels))
+		}
+		observed := pred.Molecule.Activity
+		pValues := []float64{}
+		fuzz := 0.0
+		for label, pValue := range pred.Prediction.PValues {
+			pValues = append(pValues, pValue)
+			if label != observed {
+				fuzz += pValue
+			}
+		}
+		sort.Sort(sort.Reverse(sort.Float64Slice(pValues)))
+		confidenceSum += 1 - pValues[1]
+		credibilitySum += pValues[0]
+		fuzzSums[""] += fuzz
+		fuzzCnts[""]++
+		fuzzSums[observed] += fuzz
+		fuzzCnts[observed]++
+	}
+	meanFuzz := func(label string) float64 {
+		if fuzzCnts[label] == 0 {
+			return 0
+		}
+		return fuzzSums[label] / float64(fuzzCnts[label])
+	}
+
+	results := []*Result{}
+	for c, conf := range confidences {
+		correct, single := 0, 0
+		for _, pred := range preds {
+			labels := pred.Prediction.PredictedLabels[c].Labels
+			for _, label := range labels {
+				if label == pred.Molecule.Activity {
+					correct++
+				}
+			}
+			if len(labels) == 1 {
+				single++
+			}
+		}
+		n := float64(len(preds))
+		metrics := []struct {
+			name  string
+			value float64
+		}{
+			{MetricAccuracy, float64(correct) / n},
+			{MetricEfficiency, float64(single) / n},
+			{MetricObsFuzzOverall, meanFuzz("")},
+			{MetricObsFuzzActive, meanFuzz(active)},
+			{MetricObsFuzzNonactive, meanFuzz(nonactive)},
+			{MetricObsFuzzClassAvg, (meanFuzz(active) + meanFuzz(nonactive)) / 2},
+			{MetricClassConfidence, confidenceSum / n},
+			{MetricClassCredibility, credibilitySum / n},
+		}
+		for _, m := range metrics {
+			results = append(results, &Result{Gene: gene, Replicate: replicate, Runset: runset, Point: point, Confidence: conf, Metric: m.name, Value: m.value})
+		}
+	}
+	return results, nil
+}
+
+// NestedPoint is the grid point of the results of the outer loop of a nested
+// crossvalidation, which pools the predictions of models with (possibly)
+// different grid points
+const NestedPoint = "outer"
+
+// Nested is the outcome of a nested crossvalidation for a target, runset and
+// replicate: in each outer fold, the best grid point is selected with a grid
+// search on the other folds, and a model trained with it on them is validated
+// on the outer fold. The metrics are computed from the pooled predictions of
+// all outer folds.
+type Nested struct {
+	Gene      string `json:"gene"`
+	Replicate string `json:"replicate"`
+	Runset    string `json:"runset"`
+	// Group is the selection group (see Best.Group), if any
+	Group string `json:"group,omitempty"`
+	// Points are the grid points selected in each outer fold, in order
+	Points     []string `json:"grid_points"`
+	Confidence float64  `json:"confidence"`
+	// Metrics are the metrics of the outer loop at Confidence
+	Metrics map[string]float64 `json:"metrics"`
+	// CurveMetrics are the metrics of the outer loop over all confidence
+	// levels (see CurveMetrics)
+	CurveMetrics map[string]float64 `json:"curve_metrics"`
+	// Results are the results of the outer loop, as of grid point
+	// NestedPoint
+	Results []*Result `json:"results"`
+}
+
+// NewNested returns a Nested from the results of the outer loop (see
+// PredictionResults), with the metrics taken at the given confidence level
+func NewNested(gene string, replicate string, runset string, points []string, confidence float64, results []*Result) (*Nested, error) {
+	_, metricsPerPoint := MetricsAt(results, confidence)
+	metrics, ok := metricsPerPoint[NestedPoint]
+	if !ok {
+		return nil, fmt.Errorf("gridsearch: no outer loop results at confidence %.3f", confidence)
+	}
+	curveMetrics, err := CurveMetrics(results, NestedPoint)
+	if err != nil {
+		return nil, err
+	}
+	return &Nested{
+		Gene:         gene,
+		Replicate:    replicate,
+		Runset:       runset,
+		Points:       points,
+		Confidence:   confidence,
+		Metrics:      metrics,
+		CurveMetrics: curveMetrics,
+		Results:      results,
+	}, nil
+}
+
+// WriteNested writes a Nested as indented JSON to a file
+func WriteNested(path string, nested *Nested) error {
+	data, err := json.MarshalIndent(nested, "", "\t")
+	if err != nil {
+		return fmt.Errorf("gridsearch: could not marshal nested crossvalidation: %v", err)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("gridsearch: could not write nested crossvalidation to %s: %v", path, err)
+	}
+	return nil
+}
+
+// ReadNested reads a Nested from a JSON file written by WriteNested
+func ReadNested(path string) (*Nested, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("gridsearch: could not read nested crossvalidation from %s: %v", path, err)
+	}
+	nested := &Nested{}
+	if err := json.Unmarshal(data, nested); err != nil {
+		return nil, fmt.Errorf("gridsearch: could not parse nested crossvalidation in %s: %v", path, err)
+	}
+	return nested, nil
+}
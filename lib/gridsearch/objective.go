@@ -0,0 +1,245 @@
+package gridsearch
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	str "strings"
+)
+
+// Terms of an Objective. All of them are smaller for better models, so the
+// efficiency, which is larger for better models, enters as 1 - efficiency.
+const (
+	// ObjectiveObsFuzzOverall is the overall observed fuzziness
+	ObjectiveObsFuzzOverall = "obsfuzz_overall"
+	// ObjectiveObsFuzzClassAvg is the average of the observed fuzziness of
+	// the two classes, giving them equal influence
+	ObjectiveObsFuzzClassAvg = "obsfuzz_classavg"
+	// ObjectiveEfficiency is one minus the efficiency as output by CPSign
+	// (the fraction of single-label predictions)
+	ObjectiveEfficiency = "efficiency"
+	// ObjectiveAccuracyDeviation is the absolute difference between the
+	// accuracy and the confidence level
+	ObjectiveAccuracyDeviation = "accuracy_deviation"
+	// ObjectiveCalibration is the integrated absolute difference between the
+	// error rate and the expected error rate (the diagonal of the calibration
+	// plot), over all confidence levels
+	ObjectiveCalibration = "calibration"
+	// ObjectiveMeanObsFuzzOverall, ObjectiveMeanObsFuzzClassAvg and
+	// ObjectiveMeanEfficiency are the means over all confidence levels (see
+	// CurveMetrics), the last one again as 1 - mean efficiency
+	ObjectiveMeanObsFuzzOverall  = "mean_obsfuzz_overall"
+	ObjectiveMeanObsFuzzClassAvg = "mean_obsfuzz_classavg"
+	ObjectiveMeanEfficiency      = "mean_efficiency"
+)
+
+// objectiveTerms are all terms of an Objective, in order
+var objectiveTerms = []string{
+	ObjectiveObsFuzzOverall,
+	ObjectiveObsFuzzClassAvg,
+	ObjectiveEfficiency,
+	ObjectiveAccuracyDeviation,
+	ObjectiveCalibration,
+	ObjectiveMeanObsFuzzOverall,
+	ObjectiveMeanObsFuzzClassAvg,
+	ObjectiveMeanEfficiency,
+}
+
+// Objective is a weighted sum of terms (such as the observed fuzziness and the
+// calibration), which is minimized in model selection
+type Objective struct {
+	Terms   []string
+	Weights []float64
+}
+
+// ParseObjective parses an objective given as a single term, such as
+// obsfuzz_overall, or as a comma-separated list of term:weight, such as
+// obsfuzz_classavg:0.7,calibration:0.3
+func ParseObjective(s string) (*Objective, error) {
+	o := &Objective{}
+	for _, part := range str.Split(s, ",") {
+		term, weight := str.TrimSpace(part), 1.0
+		if idx := str.Index(term, ":"); idx >= 0 {
+			var err error
+			weight, err = strconv.ParseFloat(term[idx+1:], 64)
+			if err != nil {
+				return nil, fmt.Errorf("gridsearch: could not parse weight in objective term '%s': %v", part, err)
+			}
+			term = term[:idx]
+		}
+		known := false
+		for _, t := range objectiveTerms {
+			if term == t {
+				known = true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("gridsearch: unknown objective term '%s' (must be one of %s)", term, str.Join(objectiveTerms, ", "))
+		}
+		o.Terms = append(o.Terms, term)
+		o.Weights = append(o.Weights, weight)
+	}
+	return o, nil
+}
+
+// String returns the objective in the format parsed by ParseObjective
+func (o *Objective) String() string {
+	if len(o.Terms) == 1 && o.Weights[0] == 1.0 {
+		return o.Terms[0]
+	}
+	parts := []string{}
+	for i, term := range o.Terms {
+		parts = append(parts, term+":"+strconv.FormatFloat(o.Weights[i], 'f', -1, 64))
+	}
+	return str.Join(parts, ",")
+}
+
+// Score returns the value of the objective for a grid point, with the terms
+// that depend on a confidence level taken at the given confidence
+func (o *Objective) Score(results []*Result, point string, confidence float64) (float64, error) {
+	score := 0.0
+	for i, term := range o.Terms {
+		val, err := termValue(results, point, term, confidence)
+		if err != nil {
+			return 0, err
+		}
+		score += o.Weights[i] * val
+	}
+	return score, nil
+}
+
+func termValue(results []*Result, point string, term string, confidence float64) (float64, error) {
+	curveMetric, isCurve := map[string]string{
+		ObjectiveCalibration:         CurveCalibration,
+		ObjectiveMeanObsFuzzOverall:  CurveMeanObsFuzzOverall,
+		ObjectiveMeanObsFuzzClassAvg: CurveMeanObsFuzzClassAvg,
+		ObjectiveMeanEfficiency:      CurveMeanEfficiency,
+	}[term]
+	if isCurve {
+		curve, err := CurveMetrics(results, point)
+		if err != nil {
+			return 0, err
+		}
+		if term == ObjectiveMeanEfficiency {
+			return 1 - curve[curveMetric], nil
+		}
+		return curve[curveMetric], nil
+	}
+	metric := map[string]string{
+		ObjectiveObsFuzzOverall:    MetricObsFuzzOverall,
+		ObjectiveObsFuzzClassAvg:   MetricObsFuzzClassAvg,
+		ObjectiveEfficiency:        MetricEfficiency,
+		ObjectiveAccuracyDeviation: MetricAccuracy,
+	}[term]
+	for _, r := range results {
+		if r.Point == point && r.Metric == metric && sameConfidence(r.Confidence, confidence) {
+			switch term {
+			case ObjectiveAccuracyDeviation:
+				return math.Abs(r.Value - confidence), nil
+			case ObjectiveEfficiency:
+				return 1 - r.Value, nil
+			}
+			return r.Value, nil
+		}
+	}
+	return 0, fmt.Errorf("gridsearch: no %s value at confidence %.3f for grid point %s", metric, confidence, point)
+}
+
+// accuracyCurve returns the confidence levels of a grid point, in increasing
+// order, with the accuracy at each of them
+func accuracyCurve(results []*Result, point string) (confidences []float64, accuracies []float64) {
+	accuracyAt := map[float64]float64{}
+	for _, r := range results {
+		if r.Point == point && r.Metric == MetricAccuracy {
+			accuracyAt[r.Confidence] = r.Value
+		}
+	}
+	for conf := range accuracyAt {
+		confidences = append(confidences, conf)
+	}
+	sort.Float64s(confidences)
+	for _, conf := range confidences {
+		accuracies = append(accuracies, accuracyAt[conf])
+	}
+	return confidences, accuracies
+}
+
+// Calibration returns the area between the calibration curve of a grid point
+// (error rate against expected error rate, 1 - confidence) and the diagonal,
+// integrated with the trapezoidal rule over the confidence levels
+func Calibration(results []*Result, point string) (float64, error) {
+	confidences, accuracies := accuracyCurve(results, point)
+	if len(confidences) < 2 {
+		return 0, fmt.Errorf("gridsearch: need accuracy at two or more confidence levels for the calibration of grid point %s, but got %d", point, len(confidences))
+	}
+	area := 0.0
+	for i := 1; i < len(confidences); i++ {
+		// The error rate deviates from 1 - confidence as much as the
+		// accuracy deviates from the confidence
+		devPrev := math.Abs(accuracies[i-1] - confidences[i-1])
+		dev := math.Abs(accuracies[i] - confidences[i])
+		area += (confidences[i] - confidences[i-1]) * (devPrev + dev) / 2
+	}
+	return area, nil
+}
+
+// IsValid tells whether the error rate (1 - accuracy) of a grid point is at
+// most 1 - confidence + tolerance at every confidence level
+func IsValid(results []*Result, point string, tolerance float64) bool {
+	confidences, accuracies := accuracyCurve(results, point)
+	for i, conf := range confidences {
+		if 1-accuracies[i] > 1-conf+tolerance+1e-9 {
+			return false
+		}
+	}
+	return true
+}
+
+// Selection is a rule for selecting the best grid point from the results of a
+// grid search
+type Selection struct {
+	Objective *Objective
+	// Confidence is the confidence level at which the terms of the
+	// objective that depend on one are taken
+	Confidence float64
+	// ValidityTolerance is how much the error rate of a grid point may
+	// exceed 1 - confidence, at any confidence level, before the grid point
+	// is rejected (see IsValid). Negative values turn off the check.
+	ValidityTolerance float64
+}
+
+// Select returns the valid grid point with the smallest value of the objective,
+// together with that value and the rejected (invalid) grid points, in order
+// of first appearance in results. Of equally good points, the first one is
+// selected. If all grid points are invalid, an error is returned.
+func (s *Selection) Select(results []*Result) (best string, score float64, rejected []string, err error) {
+	points := []string{}
+	seen := map[string]bool{}
+	for _, r := range results {
+		if !seen[r.Point] {
+			points = append(points, r.Point)
+			seen[r.Point] = true
+		}
+	}
+	if len(points) == 0 {
+		return "", 0, nil, fmt.Errorf("gridsearch: no grid points to select from")
+	}
+	for _, point := range points {
+		if s.ValidityTolerance >= 0 && !IsValid(results, point, s.ValidityTolerance) {
+			rejected = append(rejected, point)
+			continue
+		}
+		pointScore, err := s.Objective.Score(results, point, s.Confidence)
+		if err != nil {
+			return "", 0, nil, err
+		}
+		if best == "" || pointScore < score {
+			best, score = point, pointScore
+		}
+	}
+	if best == "" {
+		return "", 0, rejected, fmt.Errorf("gridsearch: all grid points have an error rate above 1 - confidence + %.3f: %s", s.ValidityTolerance, str.Join(rejected, "; "))
+	}
+	return best, score, rejected, nil
+}
@@ -0,0 +1,197 @@
+package gridsearch
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// curveResults returns results for a grid point with the given accuracy at
+// each confidence level, and the same observed fuzziness (overall and class
+// average) at all of them
+func curveResults(point string, accuracies map[float64]float64, obsFuzz float64) []*Result {
+	results := []*Result{}
+	for _, conf := range []float64{0.1, 0.5, 0.8} {
+		acc, ok := accuracies[conf]
+		if !ok {
+			acc = conf
+		}
+		results = append(results,
+			&Result{Point: point, Confidence: conf, Metric: MetricAccuracy, Value: acc},
+			&Result{Point: point, Confidence: conf, Metric: MetricObsFuzzOverall, Value: obsFuzz},
+			&Result{Point: point, Confidence: conf, Metric: MetricObsFuzzClassAvg, Value: obsFuzz})
+	}
+	return results
+}
+
+func TestCalibration(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		accuracies map[float64]float64
+		expected   float64
+	}{
+		{"on the diagonal", map[float64]float64{}, 0},
+		// Deviations 0, 0.1 and 0.1 at 0.1, 0.5 and 0.8:
+		// 0.4 * (0 + 0.1) / 2 + 0.3 * (0.1 + 0.1) / 2
+		{"trapezoids", map[float64]float64{0.5: 0.6, 0.8: 0.7}, 0.05},
+		{"over- and underconfident alike", map[float64]float64{0.5: 0.4, 0.8: 0.9}, 0.05},
+	} {
+		calibration, err := Calibration(curveResults("p", tc.accuracies, 0), "p")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(calibration-tc.expected) > 1e-9 {
+			t.Errorf("Case %s: expected calibration %f, but got %f", tc.name, tc.expected, calibration)
+		}
+	}
+
+	oneLevel := []*Result{{Point: "p", Confidence: 0.8, Metric: MetricAccuracy, Value: 0.8}}
+	if _, err := Calibration(oneLevel, "p"); err == nil {
+		t.Error("Expected an error for accuracy at a single confidence level")
+	}
+}
+
+func TestIsValid(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		accuracies map[float64]float64
+		tolerance  float64
+		valid      bool
+	}{
+		{"on the diagonal", map[float64]float64{}, 0, true},
+		{"conservative", map[float64]float64{0.8: 0.95}, 0, true},
+		{"error rate above", map[float64]float64{0.8: 0.75}, 0, false},
+		{"error rate within tolerance", map[float64]float64{0.8: 0.75}, 0.05, true},
+		{"error rate above tolerance", map[float64]float64{0.8: 0.7}, 0.05, false},
+	} {
+		if valid := IsValid(curveResults("p", tc.accuracies, 0), "p", tc.tolerance); valid != tc.valid {
+			t.Errorf("Case %s: expected valid=%v, but got %v", tc.name, tc.valid, valid)
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	objective, err := ParseObjective(ObjectiveObsFuzzOverall)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalid := map[float64]float64{0.8: 0.6}
+	for _, tc := range []struct {
+		name      string
+		results   [][]*Result
+		tolerance float64
+		best      string
+		rejected  []string
+		fails     bool
+	}{
+		{
+			name: "smallest valid",
+			results: [][]*Result{
+				curveResults("a", nil, 0.3),
+				curveResults("b", invalid, 0.2),
+				curveResults("c", nil, 0.25),
+			},
+			best:     "c",
+			rejected: []string{"b"},
+		},
+		{
+			name: "first of equals",
+			results: [][]*Result{
+				curveResults("a", nil, 0.2),
+				curveResults("b", nil, 0.2),
+			},
+			best: "a",
+		},
+		{
+			name: "check turned off",
+			results: [][]*Result{
+				curveResults("a", nil, 0.3),
+				curveResults("b", invalid, 0.2),
+			},
+			tolerance: -1,
+			best:      "b",
+		},
+		{
+			name: "all invalid",
+			results: [][]*Result{
+				curveResults("a", invalid, 0.3),
+				curveResults("b", invalid, 0.2),
+			},
+			rejected: []string{"a", "b"},
+			fails:    true,
+		},
+	} {
+		results := []*Result{}
+		for _, r := range tc.results {
+			results = append(results, r...)
+		}
+		selection := &Selection{Objective: objective, Confidence: 0.8, ValidityTolerance: tc.tolerance}
+		best, _, rejected, err := selection.Select(results)
+		if (err != nil) != tc.fails {
+			t.Errorf("Case %s: expected failure=%v, but got error %v", tc.name, tc.fails, err)
+		}
+		if best != tc.best {
+			t.Errorf("Case %s: expected best grid point '%s', but got '%s'", tc.name, tc.best, best)
+		}
+		if !reflect.DeepEqual(rejected, tc.rejected) {
+			t.Errorf("Case %s: expected rejected grid points %v, but got %v", tc.name, tc.rejected, rejected)
+		}
+	}
+}
+
+// withEfficiency returns results with the given efficiency added at each
+// confidence level of the results of point
+func withEfficiency(results []*Result, point string, efficiency float64) []*Result {
+	for _, r := range results {
+		if r.Point == point && r.Metric == MetricAccuracy {
+			results = append(results, &Result{Point: point, Confidence: r.Confidence, Metric: MetricEfficiency, Value: efficiency})
+		}
+	}
+	return results
+}
+
+func TestSelectEfficiency(t *testing.T) {
+	results := withEfficiency(curveResults("a", nil, 0.2), "a", 0.6)
+	results = withEfficiency(append(results, curveResults("b", nil, 0.2)...), "b", 0.9)
+	for _, objStr := range []string{
+		ObjectiveEfficiency,
+		ObjectiveEfficiency + ":0.5," + ObjectiveObsFuzzOverall + ":0.5",
+		ObjectiveMeanEfficiency,
+		ObjectiveMeanEfficiency + ":0.5," + ObjectiveCalibration + ":0.5",
+	} {
+		objective, err := ParseObjective(objStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		selection := &Selection{Objective: objective, Confidence: 0.8}
+		best, _, _, err := selection.Select(results)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if best != "b" {
+			t.Errorf("Objective %s: expected the grid point with the higher efficiency to be best, but got '%s'", objStr, best)
+		}
+	}
+}
+
+func TestParseObjective(t *testing.T) {
+	for _, tc := range []struct {
+		in    string
+		out   string
+		fails bool
+	}{
+		{in: "obsfuzz_overall", out: "obsfuzz_overall"},
+		{in: "obsfuzz_classavg:0.7, calibration:0.3", out: "obsfuzz_classavg:0.7,calibration:0.3"},
+		{in: "validity", fails: true},
+		{in: "efficiency:x", fails: true},
+	} {
+		o, err := ParseObjective(tc.in)
+		if (err != nil) != tc.fails {
+			t.Errorf("Parsing '%s': expected failure=%v, but got error %v", tc.in, tc.fails, err)
+			continue
+		}
+		if err == nil && o.String() != tc.out {
+			t.Errorf("Parsing '%s': expected '%s', but got '%s'", tc.in, tc.out, o.String())
+		}
+	}
+}
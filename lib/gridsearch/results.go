@@ -0,0 +1,205 @@
+package gridsearch
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+)
+
+// Metric names in the results table
+const (
+	MetricAccuracy         = "Accuracy"
+	MetricEfficiency       = "Efficiency"
+	MetricObsFuzzOverall   = "ObsFuzzOverall"
+	MetricObsFuzzActive    = "ObsFuzzActive"
+	MetricObsFuzzNonactive = "ObsFuzzNonactive"
+	MetricObsFuzzClassAvg  = "ObsFuzzClassAvg"
+	MetricClassConfidence  = "ClassConfidence"
+	MetricClassCredibility = "ClassCredibility"
+)
+
+// Result is one row in the long-format results table: the value of one
+// metric, at one confidence level, for one grid point
+type Result struct {
+	Gene       string  `json:"gene"`
+	Replicate  string  `json:"replicate"`
+	Runset     string  `json:"runset"`
+	Point      string  `json:"grid_point"`
+	Confidence float64 `json:"confidence"`
+	Metric     string  `json:"metric"`
+	Value      float64 `json:"value"`
+}
+
+// ResultsHeader is the header of the results table
+var ResultsHeader = []string{"Gene", "Replicate", "Runset", "GridPoint", "Confidence", "Metric", "Value"}
+
+// WriteResults writes results as a tab-separated table, with header
+func WriteResults(w io.Writer, results []*Result) error {
+	tsvWriter := csv.NewWriter(w)
+	tsvWriter.Comma = '\t'
+	tsvWriter.Write(ResultsHeader)
+	for _, r := range results {
+		tsvWriter.Write([]string{
+			r.Gene,
+			r.Replicate,
+			r.Runset,
+			r.Point,
+			strconv.FormatFloat(r.Confidence, 'f', -1, 64),
+			r.Metric,
+			strconv.FormatFloat(r.Value, 'f', -1, 64),
+		})
+	}
+	tsvWriter.Flush()
+	return tsvWriter.Error()
+}
+
+// ReadResults reads a results table written by WriteResults
+func ReadResults(r io.Reader) ([]*Result, error) {
+	tsvReader := csv.NewReader(r)
+	tsvReader.Comma = '\t'
+	tsvReader.FieldsPerRecord = len(ResultsHeader)
+	rows, err := tsvReader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("gridsearch: could not read results: %v", err)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("gridsearch: no header in results")
+	}
+	results := []*Result{}
+	for i, row := range rows[1:] {
+		conf, err := strconv.ParseFloat(row[4], 64)
+		if err != nil {
+			return nil, fmt.Errorf("gridsearch: could not parse confidence on line %d of results: %v", i+2, err)
+		}
+		val, err := strconv.ParseFloat(row[6], 64)
+		if err != nil {
+			return nil, fmt.Errorf("gridsearch: could not parse value on line %d of results: %v", i+2, err)
+		}
+		results = append(results, &Result{Gene: row[0], Replicate: row[1], Runset: row[2], Point: row[3], Confidence: conf, Metric: row[5], Value: val})
+	}
+	return results, nil
+}
+
+// sameConfidence tells whether two confidence levels are the same, allowing
+// for rounding in the output of CPSign
+func sameConfidence(a float64, b float64) bool {
+	return math.Abs(a-b) < 0.001
+}
+
+// MetricsAt returns the metrics of each grid point (in order of first
+// appearance) at the given confidence level
+func MetricsAt(results []*Result, confidence float64) (points []string, metrics map[string]map[string]float64) {
+	metrics = map[string]map[string]float64{}
+	for _, r := range results {
+		if !sameConfidence(r.Confidence, confidence) {
+			continue
+		}
+		if _, ok := metrics[r.Point]; !ok {
+			points = append(points, r.Point)
+			metrics[r.Point] = map[string]float64{}
+		}
+		metrics[r.Point][r.Metric] = r.Value
+	}
+	return points, metrics
+}
+
+// Best is the best grid point for a target, runset and replicate, as selected
+// from the grid search results
+type Best struct {
+	Gene      string `json:"gene"`
+	Replicate string `json:"replicate"`
+	Runset    string `json:"runset"`
+	// Group is the value of the parameter that grid points are selected
+	// per, such as the implementation, if any
+	Group string `json:"group,omitempty"`
+	Point string `json:"grid_point"`
+	// Params are the parameter values of the grid point
+	Params map[string]string `json:"params"`
+	// Args are the command line flags of the grid point, per stage
+	Args map[string]string `json:"args"`
+	// Objective is the objective that was minimized (see ParseObjective),
+	// with Score its value for the grid point
+	Objective         string  `json:"objective"`
+	Score             float64 `json:"score"`
+	Confidence        float64 `json:"confidence"`
+	ValidityTolerance float64 `json:"validity_tolerance"`
+	// Rejected are the grid points that failed the validity check
+	Rejected []string `json:"rejected,omitempty"`
+	// Metrics are all metrics of the grid point, at Confidence
+	Metrics map[string]float64 `json:"metrics"`
+	// CurveMetrics are the metrics of the grid point over all confidence
+	// levels (see CurveMetrics)
+	CurveMetrics map[string]float64 `json:"curve_metrics"`
+	// DatasetHash is the hash of the data the grid point was selected on
+	// (see DatasetHash)
+	DatasetHash string `json:"dataset_hash"`
+	// SearchHash is the hash of the parameter space and selection settings
+	// the grid point was selected with (see SearchHash)
+	SearchHash string `json:"search_hash,omitempty"`
+	// Results are the grid search results of the grid point, for selecting
+	// it again without a new grid search
+	Results []*Result `json:"results"`
+}
+
+// NewBest returns a Best for the given grid point
+func NewBest(gene string, replicate string, runset string, point Point, selection *Selection, score float64, rejected []string, metrics map[string]float64, curveMetrics map[string]float64) *Best {
+	return &Best{
+		Gene:      gene,
+		Replicate: replicate,
+		Runset:    runset,
+		Point:     point.Key(),
+		Params:    point.Params(),
+		Args: map[string]string{
+			StagePrecompute:    point.Args(StagePrecompute),
+			StageCrossValidate: point.Args(StageCrossValidate),
+			StageTrain:         point.Args(StageTrain),
+		},
+		Objective:         selection.Objective.String(),
+		Score:             score,
+		Confidence:        selection.Confidence,
+		ValidityTolerance: selection.ValidityTolerance,
+		Rejected:          rejected,
+		Metrics:           metrics,
+		CurveMetrics:      curveMetrics,
+	}
+}
+
+// PointResults returns the results of one grid point
+func PointResults(results []*Result, point string) []*Result {
+	pointResults := []*Result{}
+	for _, r := range results {
+		if r.Point == point {
+			pointResults = append(pointResults, r)
+		}
+	}
+	return pointResults
+}
+
+// WriteBest writes a Best as indented JSON to a file
+func WriteBest(path string, best *Best) error {
+	data, err := json.MarshalIndent(best, "", "\t")
+	if err != nil {
+		return fmt.Errorf("gridsearch: could not marshal best grid point: %v", err)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("gridsearch: could not write best grid point to %s: %v", path, err)
+	}
+	return nil
+}
+
+// ReadBest reads a Best from a JSON file written by WriteBest
+func ReadBest(path string) (*Best, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("gridsearch: could not read best grid point from %s: %v", path, err)
+	}
+	best := &Best{}
+	if err := json.Unmarshal(data, best); err != nil {
+		return nil, fmt.Errorf("gridsearch: could not parse best grid point in %s: %v", path, err)
+	}
+	return best, nil
+}
@@ -0,0 +1,293 @@
+// Package gridsearch implements hyperparameter grid search over a declared
+// parameter space (such as CPSign's cost, gamma, number of models and
+// implementation), with one evaluation per grid point, a long-format table of
+// the resulting metrics, and selection of the best grid point.
+package gridsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	str "strings"
+)
+
+// Stages of model building that a parameter can be passed to
+const (
+	StagePrecompute    = "precompute"
+	StageCrossValidate = "crossvalidate"
+	StageTrain         = "train"
+)
+
+// Param is a hyperparameter in a Space, with the values to search
+type Param struct {
+	Name string `json:"name"`
+	// Flag is the command line flag with which values are passed, such as
+	// --cost
+	Flag   string   `json:"flag"`
+	Values []string `json:"values"`
+	// When, if set, restricts the parameter to grid points where the given
+	// (earlier declared) parameters have one of the given values, such as
+	// gamma only for the libsvm implementation
+	When map[string][]string `json:"when,omitempty"`
+	// Stages are the stages the parameter is passed to. The default is
+	// crossvalidate and train. Parameters used for computing signatures,
+	// such as heights, should instead be passed to crossvalidate and
+	// precompute.
+	Stages []string `json:"stages,omitempty"`
+}
+
+// stages returns the stages the parameter is passed to
+func (p *Param) stages() []string {
+	if len(p.Stages) == 0 {
+		return []string{StageCrossValidate, StageTrain}
+	}
+	return p.Stages
+}
+
+// Space is a parameter space, as read from a JSON file
+type Space struct {
+	Params []*Param `json:"params"`
+	// Targets overrides the values of parameters for single targets (by
+	// gene symbol), such as {"PDE3A": {"cost": ["1"]}}
+	Targets map[string]map[string][]string `json:"targets,omitempty"`
+	// Halving, if set, configures the adaptive search with successive
+	// halving (see Halving)
+	Halving *Halving `json:"halving,omitempty"`
+}
+
+// LoadSpace reads a parameter space from a JSON file, and validates it
+func LoadSpace(path string) (*Space, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("gridsearch: could not read parameter space %s: %v", path, err)
+	}
+	s := &Space{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("gridsearch: could not parse parameter space %s: %v", path, err)
+	}
+	if err := s.validate(); err != nil {
+		return nil, fmt.Errorf("%v (in %s)", err, path)
+	}
+	return s, nil
+}
+
+func (s *Space) validate() error {
+	if len(s.Params) == 0 {
+		return fmt.Errorf("gridsearch: no parameters in parameter space")
+	}
+	seen := map[string]bool{}
+	for _, p := range s.Params {
+		if p.Name == "" || str.ContainsAny(p.Name, "=,_ ") {
+			return fmt.Errorf("gridsearch: invalid parameter name '%s' (must be non-empty, without any of '=,_ ')", p.Name)
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("gridsearch: parameter %s is declared more than once", p.Name)
+		}
+		if !str.HasPrefix(p.Flag, "-") {
+			return fmt.Errorf("gridsearch: flag of parameter %s must start with -, but was '%s'", p.Name, p.Flag)
+		}
+		if len(p.Values) == 0 {
+			return fmt.Errorf("gridsearch: parameter %s has no values", p.Name)
+		}
+		for cond := range p.When {
+			if !seen[cond] {
+				return fmt.Errorf("gridsearch: parameter %s depends on %s, which is not declared before it", p.Name, cond)
+			}
+		}
+		for _, stage := range p.stages() {
+			if stage != StagePrecompute && stage != StageCrossValidate && stage != StageTrain {
+				return fmt.Errorf("gridsearch: unknown stage %s for parameter %s", stage, p.Name)
+			}
+		}
+		seen[p.Name] = true
+	}
+	for gene, overrides := range s.Targets {
+		for name, values := range overrides {
+			if !seen[name] {
+				return fmt.Errorf("gridsearch: unknown parameter %s in values for target %s", name, gene)
+			}
+			if len(values) == 0 {
+				return fmt.Errorf("gridsearch: no values for parameter %s for target %s", name, gene)
+			}
+		}
+	}
+	if s.Halving != nil {
+		return s.Halving.validate(seen)
+	}
+	return nil
+}
+
+// ForTarget returns the parameter space for gene, with the values of the
+// parameters overridden for it, if any
+func (s *Space) ForTarget(gene string) *Space {
+	ts := &Space{Halving: s.Halving}
+	overrides := s.Targets[str.ToUpper(gene)]
+	for _, p := range s.Params {
+		tp := *p
+		if values, ok := overrides[p.Name]; ok {
+			tp.Values = values
+		}
+		ts.Params = append(ts.Params, &tp)
+	}
+	return ts
+}
+
+// Values returns the values of the parameter with the given name, or nil if
+// there is no such parameter
+func (s *Space) Values(name string) []string {
+	if p := s.Param(name); p != nil {
+		return p.Values
+	}
+	return nil
+}
+
+// Restrict returns the space with the parameter with the given name restricted
+// to one value, such as one implementation
+func (s *Space) Restrict(name string, value string) *Space {
+	rs := &Space{Targets: s.Targets, Halving: s.Halving}
+	for _, p := range s.Params {
+		rp := *p
+		if p.Name == name {
+			rp.Values = []string{value}
+		}
+		rs.Params = append(rs.Params, &rp)
+	}
+	return rs
+}
+
+// Param returns the parameter with the given name, or nil if there is none
+func (s *Space) Param(name string) *Param {
+	for _, p := range s.Params {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// Points returns all the points in the grid spanned by the space, in the
+// order of declaration of the parameters and their values
+func (s *Space) Points() []Point {
+	points := []Point{{}}
+	for _, p := range s.Params {
+		newPoints := []Point{}
+		for _, point := range points {
+			if !point.matches(p.When) {
+				newPoints = append(newPoints, point)
+				continue
+			}
+			for _, val := range p.Values {
+				newPoint := append(append(Point{}, point...), Setting{Name: p.Name, Flag: p.Flag, Value: val, Stages: p.stages()})
+				newPoints = append(newPoints, newPoint)
+			}
+		}
+		points = newPoints
+	}
+	return points
+}
+
+// Point returns the point with the given key (see Point.Key)
+func (s *Space) Point(key string) (Point, error) {
+	for _, point := range s.Points() {
+		if point.Key() == key {
+			return point, nil
+		}
+	}
+	return nil, fmt.Errorf("gridsearch: no grid point %s in parameter space", key)
+}
+
+// Setting is the value of one parameter in a Point
+type Setting struct {
+	Name   string
+	Flag   string
+	Value  string
+	Stages []string
+}
+
+// Point is a point in the grid spanned by a Space
+type Point []Setting
+
+// matches tells whether the point fulfils the conditions (see Param.When)
+func (p Point) matches(conds map[string][]string) bool {
+	for name, allowed := range conds {
+		val, ok := p.Value(name)
+		if !ok {
+			return false
+		}
+		found := false
+		for _, a := range allowed {
+			if a == val {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Value returns the value of the parameter with the given name, and false if
+// the parameter is not set in this point
+func (p Point) Value(name string) (string, bool) {
+	for _, s := range p {
+		if s.Name == name {
+			return s.Value, true
+		}
+	}
+	return "", false
+}
+
+// KeyParams returns the parameter values in a point key (see Point.Key), such
+// as {"cost": "10", "impl": "liblinear"} for cost=10,impl=liblinear
+func KeyParams(key string) map[string]string {
+	params := map[string]string{}
+	for _, part := range str.Split(key, ",") {
+		if nameVal := str.SplitN(part, "=", 2); len(nameVal) == 2 {
+			params[nameVal[0]] = nameVal[1]
+		}
+	}
+	return params
+}
+
+// Key returns a string identifying the point, such as cost=10,impl=liblinear
+func (p Point) Key() string {
+	parts := []string{}
+	for _, s := range p {
+		parts = append(parts, s.Name+"="+s.Value)
+	}
+	return str.Join(parts, ",")
+}
+
+// Tag returns a string identifying the point, for use in file names, such as
+// cost-10_impl-liblinear
+func (p Point) Tag() string {
+	parts := []string{}
+	for _, s := range p {
+		parts = append(parts, s.Name+"-"+s.Value)
+	}
+	return str.Join(parts, "_")
+}
+
+// Args returns the command line flags and values of the parameters that are
+// passed to the given stage, such as "--cost 10 --impl liblinear"
+func (p Point) Args(stage string) string {
+	args := []string{}
+	for _, s := range p {
+		for _, st := range s.Stages {
+			if st == stage {
+				args = append(args, s.Flag+" "+s.Value)
+			}
+		}
+	}
+	return str.Join(args, " ")
+}
+
+// Params returns the parameter values of the point as a map
+func (p Point) Params() map[string]string {
+	params := map[string]string{}
+	for _, s := range p {
+		params[s.Name] = s.Value
+	}
+	return params
+}
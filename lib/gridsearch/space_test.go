@@ -0,0 +1,78 @@
+package gridsearch
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testSpace() *Space {
+	return &Space{Params: []*Param{
+		{Name: "impl", Flag: "--impl", Values: []string{"liblinear", "libsvm"}},
+		{Name: "cost", Flag: "--cost", Values: []string{"1", "10"}},
+		{Name: "gamma", Flag: "--gamma", Values: []string{"0.01", "0.1"}, When: map[string][]string{"impl": {"libsvm"}}},
+		{Name: "height", Flag: "--height", Values: []string{"3"}, Stages: []string{StagePrecompute, StageCrossValidate}},
+	}}
+}
+
+func TestPoints(t *testing.T) {
+	keys := []string{}
+	for _, point := range testSpace().Points() {
+		keys = append(keys, point.Key())
+	}
+	expected := []string{
+		"impl=liblinear,cost=1,height=3",
+		"impl=liblinear,cost=10,height=3",
+		"impl=libsvm,cost=1,gamma=0.01,height=3",
+		"impl=libsvm,cost=1,gamma=0.1,height=3",
+		"impl=libsvm,cost=10,gamma=0.01,height=3",
+		"impl=libsvm,cost=10,gamma=0.1,height=3",
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected points %v, but got %v", expected, keys)
+	}
+}
+
+func TestPointArgs(t *testing.T) {
+	point, err := testSpace().Point("impl=libsvm,cost=10,gamma=0.1,height=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		stage string
+		args  string
+	}{
+		{StagePrecompute, "--height 3"},
+		{StageCrossValidate, "--impl libsvm --cost 10 --gamma 0.1 --height 3"},
+		{StageTrain, "--impl libsvm --cost 10 --gamma 0.1"},
+	} {
+		if args := point.Args(tc.stage); args != tc.args {
+			t.Errorf("Expected args '%s' for stage %s, but got '%s'", tc.args, tc.stage, args)
+		}
+	}
+	if tag := point.Tag(); tag != "impl-libsvm_cost-10_gamma-0.1_height-3" {
+		t.Errorf("Unexpected tag %s", tag)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		space *Space
+		ok    bool
+	}{
+		{"valid", testSpace(), true},
+		{"no params", &Space{}, false},
+		{"name with underscore", &Space{Params: []*Param{{Name: "nr_models", Flag: "--nr-models", Values: []string{"10"}}}}, false},
+		{"flag without dash", &Space{Params: []*Param{{Name: "cost", Flag: "cost", Values: []string{"1"}}}}, false},
+		{"no values", &Space{Params: []*Param{{Name: "cost", Flag: "--cost"}}}, false},
+		{"condition declared after", &Space{Params: []*Param{
+			{Name: "gamma", Flag: "--gamma", Values: []string{"0.1"}, When: map[string][]string{"impl": {"libsvm"}}},
+			{Name: "impl", Flag: "--impl", Values: []string{"libsvm"}},
+		}}, false},
+		{"unknown stage", &Space{Params: []*Param{{Name: "cost", Flag: "--cost", Values: []string{"1"}, Stages: []string{"predict"}}}}, false},
+	} {
+		if err := tc.space.validate(); (err == nil) != tc.ok {
+			t.Errorf("Case %s: expected ok=%v, but got error %v", tc.name, tc.ok, err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package gridsearch
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	str "strings"
+)
+
+// Store is a directory with the best grid point (see Best) of each target,
+// runset and replicate, as JSON files, which is kept between runs of a
+// workflow
+type Store struct {
+	Dir string
+}
+
+// NewStore returns a Store in dir
+func NewStore(dir string) *Store {
+	return &Store{Dir: dir}
+}
+
+// Path returns the path of the file with the best grid point of a target,
+// runset and replicate, in the given selection group (see Best.Group), if
+// any
+func (s *Store) Path(gene string, replicate string, runset string, group string) string {
+	gene = str.ToLower(gene)
+	name := gene + "." + replicate + "." + runset
+	if group != "" {
+		name += "." + group
+	}
+	return filepath.Join(s.Dir, gene, name+".best.json")
+}
+
+// Get returns the stored best grid point of a target, runset, replicate and
+// selection group, or nil if there is none
+func (s *Store) Get(gene string, replicate string, runset string, group string) (*Best, error) {
+	path := s.Path(gene, replicate, runset, group)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	return ReadBest(path)
+}
+
+// Put stores the best grid point of a target, runset, replicate and selection
+// group, replacing any earlier one
+func (s *Store) Put(best *Best) error {
+	path := s.Path(best.Gene, best.Replicate, best.Runset, best.Group)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("gridsearch: could not create directory for %s: %v", path, err)
+	}
+	if err := WriteBest(path+".tmp", best); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("gridsearch: could not move %s.tmp to %s: %v", path, path, err)
+	}
+	return nil
+}
+
+// DatasetHash returns a hash of the contents of the files at paths (in order),
+// such as the training and proper training data, for telling whether a stored
+// best grid point was selected on the same data
+func DatasetHash(paths ...string) (string, error) {
+	h := sha256.New()
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return "", fmt.Errorf("gridsearch: could not open %s for hashing: %v", path, err)
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return "", fmt.Errorf("gridsearch: could not stat %s: %v", path, err)
+		}
+		// The size goes before each file, so that the boundaries between
+		// the files count
+		binary.Write(h, binary.BigEndian, fi.Size())
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", fmt.Errorf("gridsearch: could not hash %s: %v", path, err)
+		}
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// SearchHash returns a hash of a parameter space, as searched, and of the
+// settings of the selection (objective, confidence and validity tolerance),
+// for telling whether a stored best grid point was selected in the same
+// search
+func SearchHash(space *Space, selection *Selection) (string, error) {
+	spaceJSON, err := json.Marshal(space)
+	if err != nil {
+		return "", fmt.Errorf("gridsearch: could not encode parameter space for hashing: %v", err)
+	}
+	h := sha256.New()
+	h.Write(spaceJSON)
+	fmt.Fprintf(h, "\n%s\n%g\n%g\n", selection.Objective, selection.Confidence, selection.ValidityTolerance)
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,37 @@
+package gridsearch
+
+import "testing"
+
+func TestSearchHash(t *testing.T) {
+	searchHash := func(space *Space, selection *Selection) string {
+		hash, err := SearchHash(space, selection)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+	objective, err := ParseObjective(ObjectiveObsFuzzOverall)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherObjective, err := ParseObjective(ObjectiveEfficiency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	space := &Space{Params: []*Param{{Name: "cost", Values: []string{"1", "10"}}}}
+	selection := &Selection{Objective: objective, Confidence: 0.8}
+	hash := searchHash(space, selection)
+	if other := searchHash(&Space{Params: []*Param{{Name: "cost", Values: []string{"1", "10"}}}}, &Selection{Objective: objective, Confidence: 0.8}); other != hash {
+		t.Errorf("Expected the same hash for the same search, but got %s and %s", hash, other)
+	}
+	for name, other := range map[string]string{
+		"values":     searchHash(&Space{Params: []*Param{{Name: "cost", Values: []string{"1", "100"}}}}, selection),
+		"objective":  searchHash(space, &Selection{Objective: otherObjective, Confidence: 0.8}),
+		"confidence": searchHash(space, &Selection{Objective: objective, Confidence: 0.9}),
+		"tolerance":  searchHash(space, &Selection{Objective: objective, Confidence: 0.8, ValidityTolerance: 0.05}),
+	} {
+		if other == hash {
+			t.Errorf("Expected another hash with other %s", name)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package sampling
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	str "strings"
+)
+
+// FillUpRule defines how many assumed negatives to add to a target
+type FillUpRule struct {
+	// Ratio is the number of non-actives per active to fill up to
+	Ratio float64 `json:"ratio"`
+	// MinAdded is the least number of assumed negatives worth adding.
+	// Targets that would get fewer are not filled up at all.
+	MinAdded int `json:"min_added,omitempty"`
+	// MaxAdded, if non-zero, is the largest number of assumed negatives to add
+	MaxAdded int `json:"max_added,omitempty"`
+	// Eligible, if set, overrides whether the target is eligible for fill-up,
+	// which otherwise is decided by membership in the fill-up gene set
+	Eligible *bool `json:"eligible,omitempty"`
+}
+
+// Count returns the number of assumed negatives to add to a target with the
+// given number of actives and non-actives
+func (r *FillUpRule) Count(activeCnt int, nonactiveCnt int) int {
+	cnt := int(r.Ratio*float64(activeCnt)+0.5) - nonactiveCnt
+	if r.MaxAdded > 0 && cnt > r.MaxAdded {
+		cnt = r.MaxAdded
+	}
+	if cnt <= 0 || cnt < r.MinAdded {
+		return 0
+	}
+	return cnt
+}
+
+// FillUpConfig configures which targets to fill up with assumed negatives, and
+// by how much, as read from a JSON file
+type FillUpConfig struct {
+	// GeneSet is the name of the gene set (see genesets.Rules) of the targets
+	// eligible for fill-up
+	GeneSet string `json:"gene_set"`
+	// Default is the rule used for all targets, unless overridden in Targets
+	Default FillUpRule `json:"default"`
+	// Targets overrides fields of the default rule for single targets (by
+	// gene symbol). Fields not given are taken from the default rule.
+	Targets map[string]json.RawMessage `json:"targets,omitempty"`
+	rules   map[string]*FillUpRule
+}
+
+// LoadFillUpConfig reads a fill-up configuration from a JSON file, and
+// validates it
+func LoadFillUpConfig(path string) (*FillUpConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("sampling: could not read fill-up config %s: %v", path, err)
+	}
+	c := &FillUpConfig{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("sampling: could not parse fill-up config %s: %v", path, err)
+	}
+	if c.GeneSet == "" {
+		return nil, fmt.Errorf("sampling: no gene_set given in fill-up config %s", path)
+	}
+	if err := c.Default.validate("default"); err != nil {
+		return nil, fmt.Errorf("%v (in %s)", err, path)
+	}
+	c.rules = map[string]*FillUpRule{}
+	for gene, override := range c.Targets {
+		rule := c.Default
+		rule.Eligible = nil
+		if err := json.Unmarshal(override, &rule); err != nil {
+			return nil, fmt.Errorf("sampling: could not parse fill-up rule for %s in %s: %v", gene, path, err)
+		}
+		if err := rule.validate(gene); err != nil {
+			return nil, fmt.Errorf("%v (in %s)", err, path)
+		}
+		c.rules[str.ToUpper(gene)] = &rule
+	}
+	return c, nil
+}
+
+func (r *FillUpRule) validate(name string) error {
+	if r.Ratio < 0 || r.MinAdded < 0 || r.MaxAdded < 0 {
+		return fmt.Errorf("sampling: negative values in fill-up rule %s", name)
+	}
+	if r.MaxAdded > 0 && r.MinAdded > r.MaxAdded {
+		return fmt.Errorf("sampling: min_added (%d) is larger than max_added (%d) in fill-up rule %s", r.MinAdded, r.MaxAdded, name)
+	}
+	return nil
+}
+
+// Rule returns the fill-up rule for gene
+func (c *FillUpConfig) Rule(gene string) *FillUpRule {
+	if rule, ok := c.rules[str.ToUpper(gene)]; ok {
+		return rule
+	}
+	return &c.Default
+}
+
+// IsEligible tells whether gene should be filled up, given whether it is a
+// member of the fill-up gene set
+func (c *FillUpConfig) IsEligible(gene string, inGeneSet bool) bool {
+	if rule := c.Rule(gene); rule.Eligible != nil {
+		return *rule.Eligible
+	}
+	return inGeneSet
+}
@@ -0,0 +1,27 @@
+package sampling
+
+import "testing"
+
+func TestFillUpRuleCount(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		rule         FillUpRule
+		activeCnt    int
+		nonactiveCnt int
+		expected     int
+	}{
+		{"up to ratio", FillUpRule{Ratio: 2}, 10, 5, 15},
+		{"ratio rounded half up", FillUpRule{Ratio: 1.5}, 3, 0, 5},
+		{"ratio rounded down", FillUpRule{Ratio: 1.2}, 3, 0, 4},
+		{"capped at max", FillUpRule{Ratio: 2, MaxAdded: 10}, 100, 0, 10},
+		{"below max", FillUpRule{Ratio: 2, MaxAdded: 10}, 3, 0, 6},
+		{"at min", FillUpRule{Ratio: 2, MinAdded: 15}, 10, 5, 15},
+		{"below min", FillUpRule{Ratio: 2, MinAdded: 20}, 10, 5, 0},
+		{"enough nonactives", FillUpRule{Ratio: 2}, 10, 30, 0},
+		{"zero ratio", FillUpRule{Ratio: 0}, 10, 0, 0},
+	} {
+		if cnt := tc.rule.Count(tc.activeCnt, tc.nonactiveCnt); cnt != tc.expected {
+			t.Errorf("Case %s: expected %d assumed negatives, but got %d", tc.name, tc.expected, cnt)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package sampling
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// StratifiedFolds assigns each item, with the given labels (such as A and N),
+// to one of k folds at random, with each label spread over the folds as evenly
+// as possible, and returns the fold (0 to k-1) of each item
+func StratifiedFolds(labels []string, k int, rnd *rand.Rand) ([]int, error) {
+	if k < 2 {
+		return nil, fmt.Errorf("sampling: need two or more folds, but got %d", k)
+	}
+	if k > len(labels) {
+		return nil, fmt.Errorf("sampling: can not split %d items into %d folds", len(labels), k)
+	}
+	// Items are grouped per label, in order of first appearance, so that the
+	// folds do not depend on map iteration order
+	order := []string{}
+	perLabel := map[string][]int{}
+	for i, label := range labels {
+		if _, ok := perLabel[label]; !ok {
+			order = append(order, label)
+		}
+		perLabel[label] = append(perLabel[label], i)
+	}
+	folds := make([]int, len(labels))
+	// The folds continue where the previous label left off, so that the
+	// fold sizes differ by at most one
+	fold := 0
+	for _, label := range order {
+		indices := perLabel[label]
+		for _, j := range rnd.Perm(len(indices)) {
+			folds[indices[j]] = fold
+			fold = (fold + 1) % k
+		}
+	}
+	return folds, nil
+}
@@ -0,0 +1,34 @@
+package sampling
+
+import "math/rand"
+
+// NewRand returns a random number generator seeded with seed, for reproducible
+// sampling: the same seed always gives the same sequence, on all platforms and
+// Go versions, so that a seed recorded in the audit log fully reproduces a
+// selection. The generator is SplitMix64 (Steele, Lea and Flood, "Fast
+// splittable pseudorandom number generators", OOPSLA 2014), and integers in a
+// range are drawn from it with the algorithms of math/rand.Rand.
+func NewRand(seed int64) *rand.Rand {
+	return rand.New(&splitMix64{state: uint64(seed)})
+}
+
+// splitMix64 implements rand.Source64 with the SplitMix64 algorithm
+type splitMix64 struct {
+	state uint64
+}
+
+func (s *splitMix64) Seed(seed int64) {
+	s.state = uint64(seed)
+}
+
+func (s *splitMix64) Uint64() uint64 {
+	s.state += 0x9e3779b97f4a7c15
+	z := s.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (s *splitMix64) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
@@ -0,0 +1,34 @@
+package sampling
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewRand(t *testing.T) {
+	// Reference outputs of SplitMix64 for seed 0
+	expected := []uint64{0xe220a8397b1dcdaf, 0x6e789e6aa1b965f4, 0x06c45d188009454f}
+	rnd := NewRand(0)
+	for i, exp := range expected {
+		if val := rnd.Uint64(); val != exp {
+			t.Errorf("Expected value %d to be %#x, but got %#x", i, exp, val)
+		}
+	}
+}
+
+func TestSampleSeed(t *testing.T) {
+	pool := []string{}
+	for _, c := range "ABCDEFGHIJKLMNOPQRSTUVWXYZ" {
+		pool = append(pool, string(c))
+	}
+	sample := Sample(pool, 10, NewRand(42))
+	if again := Sample(pool, 10, NewRand(42)); !reflect.DeepEqual(sample, again) {
+		t.Errorf("Expected the same sample with the same seed, but got %v and %v", sample, again)
+	}
+	if other := Sample(pool, 10, NewRand(43)); reflect.DeepEqual(sample, other) {
+		t.Errorf("Expected different samples with different seeds, but got %v for both", sample)
+	}
+	if len(Sample(pool, 100, NewRand(42))) != len(pool) {
+		t.Errorf("Expected the whole pool when sampling more items than in it")
+	}
+}
@@ -0,0 +1,210 @@
+// Package sampling implements strategies for sampling assumed negatives
+// (assumed non-binders) for a target, from the compounds in ExCAPE-DB that are
+// not measured on it, used to fill up small datasets.
+package sampling
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	str "strings"
+)
+
+// Strategy is a strategy for sampling assumed negatives
+type Strategy string
+
+const (
+	// Uniform samples uniformly from all compounds not measured on the
+	// target
+	Uniform Strategy = "uniform"
+	// ExcludeFamily excludes compounds measured on any target in the same
+	// target family (see FamilyTable), such as another muscarinic receptor
+	ExcludeFamily Strategy = "exclude_family"
+	// ExcludePanelActives excludes compounds that are active on any target
+	// in the panel (gene set) being modelled
+	ExcludePanelActives Strategy = "exclude_panel_actives"
+	// PropertyMatched samples so that the size (heavy atom count)
+	// distribution of the assumed negatives matches the one of the actives
+	PropertyMatched Strategy = "property_matched"
+)
+
+// Strategies lists all available strategies
+var Strategies = []Strategy{
+	Uniform,
+	ExcludeFamily,
+	ExcludePanelActives,
+	PropertyMatched,
+}
+
+// ParseStrategy returns the Strategy with the given name
+func ParseStrategy(name string) (Strategy, error) {
+	names := []string{}
+	for _, s := range Strategies {
+		if string(s) == name {
+			return s, nil
+		}
+		names = append(names, string(s))
+	}
+	return "", fmt.Errorf("sampling: unknown strategy '%s' (available: %s)", name, str.Join(names, ", "))
+}
+
+// FamilyTable maps gene symbols to target families
+type FamilyTable struct {
+	families map[string]string
+	members  map[string][]string
+}
+
+// LoadFamilyTable reads a tab-separated file with the columns gene and family
+// (without header). Empty lines and lines starting with # are skipped.
+func LoadFamilyTable(path string) (*FamilyTable, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("sampling: could not open family table %s: %v", path, err)
+	}
+	defer fh.Close()
+	ft := &FamilyTable{families: map[string]string{}, members: map[string][]string{}}
+	lineScanner := bufio.NewScanner(fh)
+	for lineScanner.Scan() {
+		line := lineScanner.Text()
+		if str.TrimSpace(line) == "" || str.HasPrefix(line, "#") {
+			continue
+		}
+		fields := str.Split(line, "\t")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("sampling: expected 2 fields (gene, family) in family table %s, but got %d in line: %s", path, len(fields), line)
+		}
+		gene, family := str.ToUpper(str.TrimSpace(fields[0])), str.TrimSpace(fields[1])
+		if prev, ok := ft.families[gene]; ok && prev != family {
+			return nil, fmt.Errorf("sampling: gene %s is in both family %s and %s in family table %s", gene, prev, family, path)
+		}
+		ft.families[gene] = family
+		ft.members[family] = append(ft.members[family], gene)
+	}
+	if err := lineScanner.Err(); err != nil {
+		return nil, fmt.Errorf("sampling: could not read family table %s: %v", path, err)
+	}
+	return ft, nil
+}
+
+// Family returns the family of gene, or an empty string if it is not in the
+// table
+func (ft *FamilyTable) Family(gene string) string {
+	return ft.families[gene]
+}
+
+// Relatives returns the other members (sorted) of the family of gene
+func (ft *FamilyTable) Relatives(gene string) []string {
+	relatives := []string{}
+	for _, member := range ft.members[ft.families[gene]] {
+		if member != gene {
+			relatives = append(relatives, member)
+		}
+	}
+	sort.Strings(relatives)
+	return relatives
+}
+
+// Sample returns n items drawn uniformly without replacement from pool, or
+// all of them (shuffled) if there are fewer than n. The pool is not modified.
+// With rnd from NewRand, the result is fully given by the seed.
+func Sample(pool []string, n int, rnd *rand.Rand) []string {
+	shuffled := append([]string{}, pool...)
+	if n > len(shuffled) {
+		n = len(shuffled)
+	} else if n < 0 {
+		n = 0
+	}
+	// Partial Fisher-Yates shuffle of the first n items
+	for i := 0; i < n; i++ {
+		j := i + rnd.Intn(len(shuffled)-i)
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	}
+	return shuffled[:n]
+}
+
+// SamplePropertyMatched returns n SMILES drawn without replacement from pool,
+// such that their heavy atom count distribution follows the one of the
+// reference SMILES (such as the actives of the target). Heavy atom counts are
+// binned in bins of binWidth atoms. If a bin has too few compounds in the
+// pool, the remainder is drawn uniformly from the rest of the pool.
+func SamplePropertyMatched(pool []string, n int, reference []string, binWidth int, rnd *rand.Rand) []string {
+	if len(reference) == 0 || binWidth < 1 {
+		return Sample(pool, n, rnd)
+	}
+	poolBins := map[int][]string{}
+	for _, smiles := range pool {
+		bin := HeavyAtomCount(smiles) / binWidth
+		poolBins[bin] = append(poolBins[bin], smiles)
+	}
+	refCounts := map[int]int{}
+	for _, smiles := range reference {
+		refCounts[HeavyAtomCount(smiles)/binWidth]++
+	}
+	bins := []int{}
+	for bin := range refCounts {
+		bins = append(bins, bin)
+	}
+	sort.Ints(bins)
+
+	sampled := []string{}
+	used := map[string]bool{}
+	for _, bin := range bins {
+		binN := int(float64(n)*float64(refCounts[bin])/float64(len(reference)) + 0.5)
+		for _, smiles := range Sample(poolBins[bin], binN, rnd) {
+			sampled = append(sampled, smiles)
+			used[smiles] = true
+		}
+	}
+	if len(sampled) > n {
+		sampled = Sample(sampled, n, rnd)
+	} else if len(sampled) < n {
+		rest := []string{}
+		for _, smiles := range pool {
+			if !used[smiles] {
+				rest = append(rest, smiles)
+			}
+		}
+		sampled = append(sampled, Sample(rest, n-len(sampled), rnd)...)
+	}
+	return sampled
+}
+
+// HeavyAtomCount returns the number of heavy (non-hydrogen) atoms in a SMILES
+// string, counting each bracket atom, and each organic subset atom (B, C, N,
+// O, P, S, F, Cl, Br, I, and their aromatic lower-case forms) outside
+// brackets, as one atom
+func HeavyAtomCount(smiles string) int {
+	cnt := 0
+	for i := 0; i < len(smiles); i++ {
+		switch c := smiles[i]; c {
+		case '[':
+			end := str.IndexByte(smiles[i:], ']')
+			if end == -1 {
+				return cnt
+			}
+			if !isBracketHydrogen(smiles[i+1 : i+end]) {
+				cnt++
+			}
+			i += end
+		case 'B', 'C':
+			// Br and Cl are one atom
+			if i+1 < len(smiles) && ((c == 'B' && smiles[i+1] == 'r') || (c == 'C' && smiles[i+1] == 'l')) {
+				i++
+			}
+			cnt++
+		case 'N', 'O', 'P', 'S', 'F', 'I', 'b', 'c', 'n', 'o', 'p', 's':
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// isBracketHydrogen tells whether the contents of a bracket atom is a
+// hydrogen atom (such as [H] or [2H]), rather than a heavy atom (such as
+// [NH4+])
+func isBracketHydrogen(atom string) bool {
+	atom = str.TrimLeft(atom, "0123456789")
+	return atom == "H" || (str.HasPrefix(atom, "H") && !str.HasPrefix(atom, "Hg") && !str.HasPrefix(atom, "He") && !str.HasPrefix(atom, "Hf") && !str.HasPrefix(atom, "Ho") && !str.HasPrefix(atom, "Hs"))
+}
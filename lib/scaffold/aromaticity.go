@@ -0,0 +1,206 @@
+package scaffold
+
+import (
+	"sort"
+	"strconv"
+	str "strings"
+)
+
+// perceiveAromaticity makes the aromatic rings of the molecule aromatic (atoms
+// and bonds), also when written in Kekulé form (such as C1=CC=CC=C1), so that
+// a compound has the same canonical SMILES in both forms. A ring, or a pair of
+// fused rings (such as in azulene), is aromatic if all its atoms have a p
+// orbital, and it has 4n+2 pi electrons (Hückel's rule). Bonds between
+// aromatic atoms that are not in a ring, such as the one in biphenyl written
+// as c1ccccc1c1ccccc1, are made single.
+func (m *Molecule) perceiveAromaticity() {
+	nbrs := m.neighbors()
+	bondIdx := map[[2]int]int{}
+	for i, b := range m.Bonds {
+		bondIdx[bondKey(b.A, b.B)] = i
+	}
+	rings := m.rings(nbrs)
+	inRing := map[int]bool{}
+	for _, ring := range rings {
+		for k := range ring {
+			inRing[bondIdx[bondKey(ring[k], ring[(k+1)%len(ring)])]] = true
+		}
+	}
+
+	// Electrons are counted on the molecule as parsed, before any ring is
+	// made aromatic
+	electrons := make([]int, len(m.Atoms))
+	for i := range m.Atoms {
+		electrons[i] = m.piElectrons(i, nbrs[i], bondIdx, inRing)
+	}
+	isAromatic := func(atoms []int) bool {
+		total := 0
+		for _, atom := range atoms {
+			if electrons[atom] < 0 {
+				return false
+			}
+			total += electrons[atom]
+		}
+		return total%4 == 2
+	}
+
+	aromaticRings := [][]int{}
+	candidates := [][]int{}
+	for _, ring := range rings {
+		if isAromatic(ring) {
+			aromaticRings = append(aromaticRings, ring)
+		} else {
+			candidates = append(candidates, ring)
+		}
+	}
+	for i, a := range candidates {
+		for _, b := range candidates[i+1:] {
+			if fused, ok := fusedAtoms(a, b); ok && isAromatic(fused) {
+				aromaticRings = append(aromaticRings, a, b)
+			}
+		}
+	}
+
+	aromaticBond := map[int]bool{}
+	for _, ring := range aromaticRings {
+		for k, atom := range ring {
+			m.Atoms[atom].Aromatic = true
+			aromaticBond[bondIdx[bondKey(atom, ring[(k+1)%len(ring)])]] = true
+		}
+	}
+	for i, b := range m.Bonds {
+		if aromaticBond[i] {
+			m.Bonds[i].Order = Aromatic
+		} else if b.Order == Aromatic && !inRing[i] {
+			m.Bonds[i].Order = Single
+		}
+	}
+}
+
+// piElectrons returns the number of electrons that an atom in a ring adds to
+// the pi system of the ring, or -1 if the atom has no p orbital (such as sp3
+// carbon), so that the ring can not be aromatic. Atoms that are aromatic as
+// parsed add one electron.
+func (m *Molecule) piElectrons(atom int, nbrs []neighbor, bondIdx map[[2]int]int, inRing map[int]bool) int {
+	if m.Atoms[atom].Aromatic {
+		return 1
+	}
+	ringDouble, exoDouble := false, false
+	for _, nbr := range nbrs {
+		switch nbr.order {
+		case Double:
+			if inRing[bondIdx[bondKey(atom, nbr.atom)]] {
+				ringDouble = true
+			} else if el := m.Atoms[nbr.atom].Element; el == "N" || el == "O" || el == "S" {
+				exoDouble = true
+			} else {
+				// An exocyclic double bond to carbon, such as in fulvene
+				return -1
+			}
+		case Triple, Quadruple:
+			return -1
+		}
+	}
+	switch {
+	case ringDouble:
+		return 1
+	case exoDouble:
+		// Such as the carbonyl carbon in 2-pyridone
+		return 0
+	}
+	switch m.Atoms[atom].Element {
+	case "N", "P", "As":
+		if len(nbrs) <= 3 {
+			return 2
+		}
+	case "O", "S", "Se", "Te":
+		if len(nbrs) == 2 {
+			return 2
+		}
+	case "B":
+		return 0
+	}
+	return -1
+}
+
+// rings returns the smallest ring through each ring bond of the molecule, each
+// once, as the atoms in ring order
+func (m *Molecule) rings(nbrs [][]neighbor) [][]int {
+	rings := [][]int{}
+	seen := map[string]bool{}
+	for _, b := range m.Bonds {
+		ring := shortestPath(nbrs, b.A, b.B)
+		if ring == nil {
+			continue
+		}
+		sorted := append([]int{}, ring...)
+		sort.Ints(sorted)
+		key := fmtInts(sorted)
+		if !seen[key] {
+			seen[key] = true
+			rings = append(rings, ring)
+		}
+	}
+	return rings
+}
+
+// shortestPath returns the atoms on the shortest path from atom a to atom b
+// that does not use the bond between them, or nil if there is none (if the
+// bond is not in a ring)
+func shortestPath(nbrs [][]neighbor, a int, b int) []int {
+	prev := map[int]int{a: -1}
+	queue := []int{a}
+	for len(queue) > 0 {
+		atom := queue[0]
+		queue = queue[1:]
+		for _, nbr := range nbrs[atom] {
+			if _, ok := prev[nbr.atom]; ok || (atom == a && nbr.atom == b) {
+				continue
+			}
+			prev[nbr.atom] = atom
+			if nbr.atom == b {
+				path := []int{}
+				for at := b; at != -1; at = prev[at] {
+					path = append(path, at)
+				}
+				return path
+			}
+			queue = append(queue, nbr.atom)
+		}
+	}
+	return nil
+}
+
+// fusedAtoms returns the atoms of two rings that share a bond (two or more
+// atoms), each once, and whether they do
+func fusedAtoms(a []int, b []int) ([]int, bool) {
+	inA := map[int]bool{}
+	for _, atom := range a {
+		inA[atom] = true
+	}
+	fused := append([]int{}, a...)
+	shared := 0
+	for _, atom := range b {
+		if inA[atom] {
+			shared++
+		} else {
+			fused = append(fused, atom)
+		}
+	}
+	return fused, shared >= 2
+}
+
+func bondKey(a int, b int) [2]int {
+	if b < a {
+		return [2]int{b, a}
+	}
+	return [2]int{a, b}
+}
+
+func fmtInts(vals []int) string {
+	strs := []string{}
+	for _, val := range vals {
+		strs = append(strs, strconv.Itoa(val))
+	}
+	return str.Join(strs, ",")
+}
@@ -0,0 +1,120 @@
+package scaffold
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// MurckoScaffold returns the Bemis-Murcko framework of the molecule (Bemis and
+// Murcko, J Med Chem 1996), which is its ring systems and the linkers between
+// them, with all side chains removed. Atoms double-bonded to ring or linker
+// atoms, such as the oxygen of a ring or linker carbonyl, are kept. Acyclic
+// molecules have an empty scaffold.
+func (m *Molecule) MurckoScaffold() *Molecule {
+	nbrs := m.neighbors()
+	degree := make([]int, len(m.Atoms))
+	removed := make([]bool, len(m.Atoms))
+	terminal := []int{}
+	for i := range m.Atoms {
+		degree[i] = len(nbrs[i])
+		if degree[i] <= 1 {
+			terminal = append(terminal, i)
+		}
+	}
+	// Repeatedly remove terminal atoms, which leaves only atoms in rings, or
+	// on paths between rings
+	for len(terminal) > 0 {
+		atom := terminal[len(terminal)-1]
+		terminal = terminal[:len(terminal)-1]
+		if removed[atom] {
+			continue
+		}
+		removed[atom] = true
+		for _, nbr := range nbrs[atom] {
+			if removed[nbr.atom] {
+				continue
+			}
+			degree[nbr.atom]--
+			if degree[nbr.atom] == 1 {
+				terminal = append(terminal, nbr.atom)
+			}
+		}
+	}
+
+	// Keep the atoms double-bonded to the rings and linkers
+	keep := make([]bool, len(m.Atoms))
+	for i := range m.Atoms {
+		keep[i] = !removed[i]
+		for _, nbr := range nbrs[i] {
+			if removed[i] && !removed[nbr.atom] && nbr.order == Double {
+				keep[i] = true
+			}
+		}
+	}
+
+	scaffold := &Molecule{}
+	newIdx := make([]int, len(m.Atoms))
+	for i, atom := range m.Atoms {
+		if keep[i] {
+			newIdx[i] = len(scaffold.Atoms)
+			scaffold.Atoms = append(scaffold.Atoms, atom)
+		}
+	}
+	for _, b := range m.Bonds {
+		if keep[b.A] && keep[b.B] {
+			scaffold.Bonds = append(scaffold.Bonds, Bond{A: newIdx[b.A], B: newIdx[b.B], Order: b.Order})
+		}
+	}
+	return scaffold
+}
+
+// Scaffold returns the Bemis-Murcko scaffold of a molecule given as SMILES, as
+// a canonical SMILES string (see Molecule.CanonicalSMILES)
+func Scaffold(smiles string) (string, error) {
+	m, err := ParseSMILES(smiles)
+	if err != nil {
+		return "", err
+	}
+	return m.MurckoScaffold().CanonicalSMILES(), nil
+}
+
+// Split splits compounds, given as SMILES, into a training and a test set, so
+// that no Bemis-Murcko scaffold is in both. Whole scaffold groups are added
+// to the test set, in random order, as long as they fit in testFraction of
+// the compounds, and the rest go to the training set. Compounds whose SMILES
+// cannot be parsed are grouped on their SMILES. The indices of the compounds
+// in each set are returned in ascending order, together with the scaffold of
+// each compound. With rnd from sampling.NewRand, the split is fully given by
+// the seed.
+func Split(smiles []string, testFraction float64, rnd *rand.Rand) (train []int, test []int, scaffolds []string) {
+	groupKeys := []string{}
+	groups := map[string][]int{}
+	scaffolds = make([]string, len(smiles))
+	for i, s := range smiles {
+		scaffold, err := Scaffold(s)
+		if err != nil {
+			scaffold = s
+		}
+		scaffolds[i] = scaffold
+		if _, ok := groups[scaffold]; !ok {
+			groupKeys = append(groupKeys, scaffold)
+		}
+		groups[scaffold] = append(groups[scaffold], i)
+	}
+	rnd.Shuffle(len(groupKeys), func(i, j int) {
+		groupKeys[i], groupKeys[j] = groupKeys[j], groupKeys[i]
+	})
+
+	maxTestCnt := int(testFraction * float64(len(smiles)))
+	train, test = []int{}, []int{}
+	for _, key := range groupKeys {
+		if len(test)+len(groups[key]) <= maxTestCnt {
+			test = append(test, groups[key]...)
+		} else {
+			train = append(train, groups[key]...)
+		}
+	}
+	sort.Ints(train)
+	sort.Ints(test)
+	return train, test, scaffolds
+}
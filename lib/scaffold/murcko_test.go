@@ -0,0 +1,92 @@
+package scaffold
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestScaffold(t *testing.T) {
+	for _, tc := range []struct {
+		smiles   string
+		scaffold string
+	}{
+		{"c1ccccc1CCO", "c1ccccc1"},
+		{"C1=CC=CC=C1CCO", "c1ccccc1"},
+		{"CC(=O)Nc1ccc(O)cc1", "c1ccccc1"},
+		{"CC(C)Cc1ccc(cc1)C(C)C(=O)O", "c1ccccc1"},
+		{"Cc1ccc(Cc2ccccc2)cc1", "c1ccc(Cc2ccccc2)cc1"},
+		{"O=C1CCCCC1", "O=C1CCCCC1"},
+		{"CC1CCC(=O)CC1", "O=C1CCCCC1"},
+		{"ON=C1CCCCC1", "N=C1CCCCC1"},
+		{"O=C(c1ccccc1)c1ccccc1", "O=C(c1ccccc1)c1ccccc1"},
+		{"O=C(C1=CC=CC=C1)C1=CC=CC=C1", "O=C(c1ccccc1)c1ccccc1"},
+		{"Cc1ccccc1NC(=O)c1ccccc1", "O=C(Nc1ccccc1)c1ccccc1"},
+		{"Cn1ccccc1=O", "O=C1C=CC=CN1"},
+		{"c1ccccc1S(=O)(=O)Nc1ccccn1", "O=S(=O)(Nc1ccccn1)c1ccccc1"},
+		{"CCN(CC)CCOC(=O)c1ccc2[nH]ccc2c1", "c1ccc2[nH]ccc2c1"},
+		{"CCO", ""},
+	} {
+		scaffold, err := Scaffold(tc.smiles)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := ""
+		if tc.scaffold != "" {
+			m, err := ParseSMILES(tc.scaffold)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected = m.CanonicalSMILES()
+		}
+		if scaffold != expected {
+			t.Errorf("Expected scaffold %s for %s, but got %s", expected, tc.smiles, scaffold)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	smiles := []string{
+		"c1ccccc1CCO",
+		"C1=CC=CC=C1CCN",
+		"Cc1ccccc1",
+		"O=C1CCCCC1",
+		"CC1CCC(=O)CC1",
+		"C1CCCCC1",
+		"c1ccncc1C",
+		"C1=CC=NC=C1CC",
+		"CCO",
+		"CCCN",
+	}
+	train, test, scaffolds := Split(smiles, 0.4, rand.New(rand.NewSource(1)))
+	if len(train)+len(test) != len(smiles) {
+		t.Fatalf("Expected all %d compounds to be split, but got %d in training and %d in test", len(smiles), len(train), len(test))
+	}
+	if len(test) > 4 {
+		t.Errorf("Expected at most 4 compounds in test, but got %d", len(test))
+	}
+	trainScaffolds := map[string]bool{}
+	for _, i := range train {
+		trainScaffolds[scaffolds[i]] = true
+	}
+	for _, i := range test {
+		if trainScaffolds[scaffolds[i]] {
+			t.Errorf("Scaffold %s of %s is in both training and test", scaffolds[i], smiles[i])
+		}
+	}
+	if distinct := countDistinct(scaffoldIDs(scaffolds)); distinct != 5 {
+		t.Errorf("Expected 5 distinct scaffolds, but got %d: %v", distinct, scaffolds)
+	}
+}
+
+// scaffoldIDs numbers the distinct scaffolds in order of first appearance
+func scaffoldIDs(scaffolds []string) []int {
+	ids := map[string]int{}
+	result := []int{}
+	for _, s := range scaffolds {
+		if _, ok := ids[s]; !ok {
+			ids[s] = len(ids)
+		}
+		result = append(result, ids[s])
+	}
+	return result
+}
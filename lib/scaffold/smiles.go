@@ -0,0 +1,505 @@
+// Package scaffold computes Bemis-Murcko scaffolds (frameworks) of molecules
+// given as SMILES, and splits sets of compounds into training and test sets
+// that have no scaffold in common, for estimating the performance of models
+// on novel chemistry.
+package scaffold
+
+import (
+	"fmt"
+	"sort"
+	str "strings"
+)
+
+// Atom is an atom in a Molecule. Only the element and aromaticity are kept:
+// charges, isotopes, chirality and hydrogens are ignored.
+type Atom struct {
+	// Element is the element symbol, such as C, Cl or Se, or * for a wildcard
+	Element  string
+	Aromatic bool
+}
+
+// Bond orders
+const (
+	Single    = 1
+	Double    = 2
+	Triple    = 3
+	Quadruple = 4
+	Aromatic  = 5
+)
+
+// Bond is a bond between the atoms with index A and B in a Molecule
+type Bond struct {
+	A     int
+	B     int
+	Order int
+}
+
+// Molecule is a molecular graph
+type Molecule struct {
+	Atoms []Atom
+	Bonds []Bond
+}
+
+// organicSubset lists the elements that can be written without brackets in
+// SMILES
+var organicSubset = map[string]bool{"B": true, "C": true, "N": true, "O": true, "P": true, "S": true, "F": true, "Cl": true, "Br": true, "I": true}
+
+// aromaticSubset lists the aromatic elements that can be written without
+// brackets in SMILES
+var aromaticSubset = map[string]bool{"B": true, "C": true, "N": true, "O": true, "P": true, "S": true}
+
+type ringOpening struct {
+	atom  int
+	order int
+}
+
+// ParseSMILES parses a SMILES string into a Molecule, with aromatic rings
+// written in Kekulé form made aromatic (see perceiveAromaticity)
+func ParseSMILES(smiles string) (*Molecule, error) {
+	m := &Molecule{}
+	prev := -1
+	branches := []int{}
+	bondOrder := 0 // Explicit order of the next bond, or 0 if not given
+	rings := map[int]ringOpening{}
+
+	addAtom := func(atom Atom) {
+		m.Atoms = append(m.Atoms, atom)
+		idx := len(m.Atoms) - 1
+		if prev != -1 {
+			m.addBond(prev, idx, bondOrder)
+		}
+		bondOrder = 0
+		prev = idx
+	}
+
+	for i := 0; i < len(smiles); {
+		c := smiles[i]
+		switch {
+		case c == '(':
+			if prev == -1 {
+				return nil, fmt.Errorf("scaffold: branch without preceding atom at position %d in SMILES %s", i, smiles)
+			}
+			branches = append(branches, prev)
+			i++
+		case c == ')':
+			if len(branches) == 0 {
+				return nil, fmt.Errorf("scaffold: unbalanced parenthesis at position %d in SMILES %s", i, smiles)
+			}
+			prev = branches[len(branches)-1]
+			branches = branches[:len(branches)-1]
+			i++
+		case c == '.':
+			prev = -1
+			i++
+		case str.IndexByte("-=#$:/\\", c) >= 0:
+			bondOrder = map[byte]int{'-': Single, '=': Double, '#': Triple, '$': Quadruple, ':': Aromatic, '/': Single, '\\': Single}[c]
+			i++
+		case (c >= '0' && c <= '9') || c == '%':
+			digit := int(c - '0')
+			i++
+			if c == '%' {
+				if i+2 > len(smiles) || smiles[i] < '0' || smiles[i] > '9' || smiles[i+1] < '0' || smiles[i+1] > '9' {
+					return nil, fmt.Errorf("scaffold: invalid ring closure at position %d in SMILES %s", i-1, smiles)
+				}
+				digit = int(smiles[i]-'0')*10 + int(smiles[i+1]-'0')
+				i += 2
+			}
+			if prev == -1 {
+				return nil, fmt.Errorf("scaffold: ring closure without preceding atom at position %d in SMILES %s", i-1, smiles)
+			}
+			if opening, ok := rings[digit]; ok {
+				order := bondOrder
+				if order == 0 {
+					order = opening.order
+				}
+				m.addBond(opening.atom, prev, order)
+				delete(rings, digit)
+			} else {
+				rings[digit] = ringOpening{atom: prev, order: bondOrder}
+			}
+			bondOrder = 0
+		case c == '[':
+			end := str.IndexByte(smiles[i:], ']')
+			if end == -1 {
+				return nil, fmt.Errorf("scaffold: unclosed bracket atom at position %d in SMILES %s", i, smiles)
+			}
+			atom, err := parseBracketAtom(smiles[i+1 : i+end])
+			if err != nil {
+				return nil, fmt.Errorf("%v, in SMILES %s", err, smiles)
+			}
+			addAtom(atom)
+			i += end + 1
+		case c == 'C' && i+1 < len(smiles) && smiles[i+1] == 'l':
+			addAtom(Atom{Element: "Cl"})
+			i += 2
+		case c == 'B' && i+1 < len(smiles) && smiles[i+1] == 'r':
+			addAtom(Atom{Element: "Br"})
+			i += 2
+		case str.IndexByte("BCNOPSFI*", c) >= 0:
+			addAtom(Atom{Element: string(c)})
+			i++
+		case str.IndexByte("bcnops", c) >= 0:
+			addAtom(Atom{Element: str.ToUpper(string(c)), Aromatic: true})
+			i++
+		default:
+			return nil, fmt.Errorf("scaffold: unexpected character '%c' at position %d in SMILES %s", c, i, smiles)
+		}
+	}
+	if len(branches) > 0 {
+		return nil, fmt.Errorf("scaffold: unclosed branch in SMILES %s", smiles)
+	}
+	if len(rings) > 0 {
+		return nil, fmt.Errorf("scaffold: unclosed ring in SMILES %s", smiles)
+	}
+	m.perceiveAromaticity()
+	return m, nil
+}
+
+// parseBracketAtom parses the contents of a bracket atom, such as 13CH4 or
+// nH, of which only the element and aromaticity are kept
+func parseBracketAtom(contents string) (Atom, error) {
+	s := str.TrimLeft(contents, "0123456789")
+	switch {
+	case s == "":
+		return Atom{}, fmt.Errorf("scaffold: bracket atom without element: [%s]", contents)
+	case s[0] == '*':
+		return Atom{Element: "*"}, nil
+	case s[0] >= 'a' && s[0] <= 'z':
+		// Aromatic: se, as and te, or a single letter
+		for _, sym := range []string{"se", "as", "te"} {
+			if str.HasPrefix(s, sym) {
+				return Atom{Element: str.ToUpper(sym[:1]) + sym[1:], Aromatic: true}, nil
+			}
+		}
+		return Atom{Element: str.ToUpper(s[:1]), Aromatic: true}, nil
+	case s[0] >= 'A' && s[0] <= 'Z':
+		if len(s) > 1 && s[1] >= 'a' && s[1] <= 'z' {
+			return Atom{Element: s[:2]}, nil
+		}
+		return Atom{Element: s[:1]}, nil
+	}
+	return Atom{}, fmt.Errorf("scaffold: invalid bracket atom: [%s]", contents)
+}
+
+// addBond adds a bond between atoms a and b. Bonds without explicit order are
+// aromatic between aromatic atoms, and single otherwise.
+func (m *Molecule) addBond(a int, b int, order int) {
+	if order == 0 {
+		order = Single
+		if m.Atoms[a].Aromatic && m.Atoms[b].Aromatic {
+			order = Aromatic
+		}
+	}
+	m.Bonds = append(m.Bonds, Bond{A: a, B: b, Order: order})
+}
+
+type neighbor struct {
+	atom  int
+	order int
+}
+
+// neighbors returns the neighbors of each atom
+func (m *Molecule) neighbors() [][]neighbor {
+	nbrs := make([][]neighbor, len(m.Atoms))
+	for _, b := range m.Bonds {
+		nbrs[b.A] = append(nbrs[b.A], neighbor{atom: b.B, order: b.Order})
+		nbrs[b.B] = append(nbrs[b.B], neighbor{atom: b.A, order: b.Order})
+	}
+	return nbrs
+}
+
+// CanonicalSMILES returns a SMILES string for the molecule that does not
+// depend on the order of the atoms, so that it can be used as a key for the
+// molecular graph. Fragments are written in sorted order.
+func (m *Molecule) CanonicalSMILES() string {
+	nbrs := m.neighbors()
+	ranks := m.canonicalRanks(nbrs)
+
+	// Atoms in rank order, and neighbors sorted on rank
+	order := make([]int, len(m.Atoms))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return ranks[order[i]] < ranks[order[j]] })
+	for _, atomNbrs := range nbrs {
+		sort.Slice(atomNbrs, func(i, j int) bool { return ranks[atomNbrs[i].atom] < ranks[atomNbrs[j].atom] })
+	}
+
+	w := &smilesWriter{mol: m, nbrs: nbrs, ranks: ranks, visited: make([]bool, len(m.Atoms))}
+	fragments := []string{}
+	for _, start := range order {
+		if w.visited[start] {
+			continue
+		}
+		w.children = map[int][]neighbor{}
+		w.closures = map[int][]neighbor{}
+		w.findTree(start, -1)
+		w.sb = &str.Builder{}
+		w.digits = map[[2]int]int{}
+		w.write(start)
+		fragments = append(fragments, w.sb.String())
+	}
+	sort.Strings(fragments)
+	return str.Join(fragments, ".")
+}
+
+// canonicalRanks ranks the atoms by iteratively refining atom invariants
+// (element, aromaticity and degree) with the ranks of their neighbors, and
+// breaking remaining ties one at a time, as in the CANON algorithm of
+// Weininger et al. (1989)
+func (m *Molecule) canonicalRanks(nbrs [][]neighbor) []int {
+	keys := make([][]int, len(m.Atoms))
+	for i, atom := range m.Atoms {
+		aromatic := 0
+		if atom.Aromatic {
+			aromatic = 1
+		}
+		bondOrderSum := 0
+		for _, nbr := range nbrs[i] {
+			bondOrderSum += nbr.order
+		}
+		keys[i] = []int{elementNumber(atom.Element), aromatic, len(nbrs[i]), bondOrderSum}
+	}
+	ranks := ranksFromKeys(keys)
+	for {
+		ranks = refineRanks(ranks, nbrs)
+		// Break a tie, by giving the first atom with the lowest tied rank
+		// a rank of its own
+		counts := map[int]int{}
+		for _, r := range ranks {
+			counts[r]++
+		}
+		if len(counts) == len(ranks) {
+			return ranks
+		}
+		tied, tiedAtom := -1, -1
+		for i, r := range ranks {
+			if counts[r] > 1 && (tied == -1 || r < tied) {
+				tied, tiedAtom = r, i
+			}
+		}
+		for i := range ranks {
+			ranks[i] *= 2
+		}
+		ranks[tiedAtom]--
+	}
+}
+
+// refineRanks refines ranks with the (sorted) bond orders and ranks of the
+// neighbors of each atom, until the number of distinct ranks stops growing
+func refineRanks(ranks []int, nbrs [][]neighbor) []int {
+	ranks = ranksFromKeys(intKeys(ranks))
+	distinct := countDistinct(ranks)
+	for {
+		keys := make([][]int, len(ranks))
+		for i := range ranks {
+			nbrKeys := []int{}
+			for _, nbr := range nbrs[i] {
+				nbrKeys = append(nbrKeys, ranks[nbr.atom]*10+nbr.order)
+			}
+			sort.Ints(nbrKeys)
+			keys[i] = append([]int{ranks[i]}, nbrKeys...)
+		}
+		newRanks := ranksFromKeys(keys)
+		newDistinct := countDistinct(newRanks)
+		if newDistinct == distinct {
+			return newRanks
+		}
+		ranks, distinct = newRanks, newDistinct
+	}
+}
+
+// ranksFromKeys returns the rank (0, 1, ...) of each key among the distinct
+// keys, in lexicographic order
+func ranksFromKeys(keys [][]int) []int {
+	idx := make([]int, len(keys))
+	for i := range idx {
+		idx[i] = i
+	}
+	less := func(a, b []int) bool {
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	}
+	sort.SliceStable(idx, func(i, j int) bool { return less(keys[idx[i]], keys[idx[j]]) })
+	ranks := make([]int, len(keys))
+	rank := 0
+	for k, i := range idx {
+		if k > 0 && less(keys[idx[k-1]], keys[i]) {
+			rank++
+		}
+		ranks[i] = rank
+	}
+	return ranks
+}
+
+func intKeys(vals []int) [][]int {
+	keys := make([][]int, len(vals))
+	for i, val := range vals {
+		keys[i] = []int{val}
+	}
+	return keys
+}
+
+func countDistinct(vals []int) int {
+	seen := map[int]bool{}
+	for _, val := range vals {
+		seen[val] = true
+	}
+	return len(seen)
+}
+
+// elementNumber returns a number for ordering elements, which is the atomic
+// number for common elements in drug-like compounds
+func elementNumber(element string) int {
+	numbers := map[string]int{"*": 0, "H": 1, "B": 5, "C": 6, "N": 7, "O": 8, "F": 9, "Si": 14, "P": 15, "S": 16, "Cl": 17, "As": 33, "Se": 34, "Br": 35, "Te": 52, "I": 53}
+	if n, ok := numbers[element]; ok {
+		return n
+	}
+	// Other elements are ordered after the common ones, by symbol
+	n := 1000
+	for _, c := range element {
+		n = n*128 + int(c)
+	}
+	return n
+}
+
+// smilesWriter writes a SMILES string for a molecule, by depth-first
+// traversal in rank order
+type smilesWriter struct {
+	mol      *Molecule
+	nbrs     [][]neighbor
+	ranks    []int
+	visited  []bool
+	children map[int][]neighbor
+	closures map[int][]neighbor
+	digits   map[[2]int]int
+	sb       *str.Builder
+}
+
+// findTree finds the spanning tree (children) and the ring closure bonds of
+// the fragment containing atom, before writing it
+func (w *smilesWriter) findTree(atom int, parent int) {
+	w.visited[atom] = true
+	for _, nbr := range w.nbrs[atom] {
+		if nbr.atom == parent {
+			continue
+		}
+		if w.visited[nbr.atom] {
+			// Each ring closure is recorded once from each end, when
+			// found from the atom visited last
+			if !containsNeighbor(w.closures[atom], nbr.atom) {
+				w.closures[atom] = append(w.closures[atom], nbr)
+				w.closures[nbr.atom] = append(w.closures[nbr.atom], neighbor{atom: atom, order: nbr.order})
+			}
+			continue
+		}
+		w.children[atom] = append(w.children[atom], nbr)
+		w.findTree(nbr.atom, atom)
+	}
+}
+
+func containsNeighbor(nbrs []neighbor, atom int) bool {
+	for _, nbr := range nbrs {
+		if nbr.atom == atom {
+			return true
+		}
+	}
+	return false
+}
+
+// write writes atom, its ring closures, and (recursively) its children
+func (w *smilesWriter) write(atom int) {
+	w.sb.WriteString(atomSymbol(w.mol.Atoms[atom]))
+	closures := append([]neighbor{}, w.closures[atom]...)
+	sort.Slice(closures, func(i, j int) bool { return w.ranks[closures[i].atom] < w.ranks[closures[j].atom] })
+	for _, nbr := range closures {
+		key := [2]int{atom, nbr.atom}
+		if nbr.atom < atom {
+			key = [2]int{nbr.atom, atom}
+		}
+		if digit, ok := w.digits[key]; ok {
+			// Close the ring
+			w.sb.WriteString(ringDigit(digit))
+			delete(w.digits, key)
+			continue
+		}
+		// Open the ring, with the lowest free digit
+		used := map[int]bool{}
+		for _, d := range w.digits {
+			used[d] = true
+		}
+		digit := 1
+		for used[digit] {
+			digit++
+		}
+		w.digits[key] = digit
+		w.sb.WriteString(w.bondSymbol(atom, nbr.atom, nbr.order) + ringDigit(digit))
+	}
+	children := w.children[atom]
+	for i, child := range children {
+		if i < len(children)-1 {
+			w.sb.WriteString("(")
+			w.writeChild(atom, child)
+			w.sb.WriteString(")")
+		} else {
+			w.writeChild(atom, child)
+		}
+	}
+}
+
+func (w *smilesWriter) writeChild(atom int, child neighbor) {
+	w.sb.WriteString(w.bondSymbol(atom, child.atom, child.order))
+	w.write(child.atom)
+}
+
+// bondSymbol returns the symbol of a bond between atoms a and b
+func (w *smilesWriter) bondSymbol(a int, b int, order int) string {
+	bothAromatic := w.mol.Atoms[a].Aromatic && w.mol.Atoms[b].Aromatic
+	switch order {
+	case Single:
+		if bothAromatic {
+			return "-"
+		}
+		return ""
+	case Double:
+		return "="
+	case Triple:
+		return "#"
+	case Quadruple:
+		return "$"
+	case Aromatic:
+		if bothAromatic {
+			return ""
+		}
+		return ":"
+	}
+	return ""
+}
+
+func ringDigit(digit int) string {
+	if digit > 9 {
+		return fmt.Sprintf("%%%02d", digit)
+	}
+	return fmt.Sprintf("%d", digit)
+}
+
+func atomSymbol(atom Atom) string {
+	if atom.Element == "*" {
+		return "*"
+	}
+	if atom.Aromatic {
+		sym := str.ToLower(atom.Element[:1]) + atom.Element[1:]
+		if aromaticSubset[atom.Element] {
+			return sym
+		}
+		return "[" + sym + "]"
+	}
+	if organicSubset[atom.Element] {
+		return atom.Element
+	}
+	return "[" + atom.Element + "]"
+}
@@ -0,0 +1,108 @@
+package scaffold
+
+import "testing"
+
+func TestCanonicalSMILES(t *testing.T) {
+	// Each group lists ways of writing the same molecule, which should all
+	// give the same canonical SMILES
+	for _, group := range [][]string{
+		{"c1ccccc1", "C1=CC=CC=C1", "C1C=CC=CC=1", "c1ccc:c:c1"},
+		{"c1ccccc1CCO", "OCCc1ccccc1", "C1=CC=CC=C1CCO", "OCCC1=CC=CC=C1"},
+		{"c1ccncc1", "C1=CC=NC=C1", "n1ccccc1"},
+		{"c1cc[nH]c1", "C1=CNC=C1", "N1C=CC=C1"},
+		{"c1ccoc1", "C1=COC=C1"},
+		{"c1ccsc1", "S1C=CC=C1"},
+		{"c1ccc2ccccc2c1", "C1=CC=C2C=CC=CC2=C1", "C1=CC2=CC=CC=C2C=C1"},
+		{"c1ccc2[nH]ccc2c1", "C1=CC=C2C(=C1)C=CN2"},
+		{"c1ccc2cc3ccccc3cc2c1", "C1=CC=C2C=C3C=CC=CC3=CC2=C1"},
+		{"c1cc2cccccc2c1", "C1=CC2=CC=CC=CC2=C1"},
+		{"O=c1cccc[nH]1", "O=C1C=CC=CN1"},
+		{"c1ccc(-c2ccccc2)cc1", "c1ccc(cc1)c1ccccc1", "C1=CC=C(C=C1)C1=CC=CC=C1"},
+		{"CC(=O)Nc1ccc(O)cc1", "OC1=CC=C(NC(C)=O)C=C1"},
+		{"C1CCCCC1", "C1CCCCC1"},
+		{"OCC.c1ccccc1", "C1=CC=CC=C1.CCO"},
+	} {
+		expected := ""
+		for i, smiles := range group {
+			m, err := ParseSMILES(smiles)
+			if err != nil {
+				t.Fatal(err)
+			}
+			canonical := m.CanonicalSMILES()
+			if i == 0 {
+				expected = canonical
+			} else if canonical != expected {
+				t.Errorf("Expected canonical SMILES %s for %s (as for %s), but got %s", expected, smiles, group[0], canonical)
+			}
+		}
+	}
+}
+
+func TestCanonicalSMILESDistinct(t *testing.T) {
+	// Molecules that are not aromatic should not be made so, and should get
+	// a canonical SMILES of their own
+	for _, pair := range [][2]string{
+		{"C1=CCCC=C1", "c1ccccc1"},
+		{"C1=CC=CC1", "c1cc[cH-]c1"},
+		{"O=C1C=CC(=O)C=C1", "Oc1ccc(O)cc1"},
+		{"C=C1C=CC=C1", "Cc1ccccc1"},
+		{"C1=CC=CC=CC=C1", "c1ccccccc1"},
+		{"C1CCCCC1", "c1ccccc1"},
+	} {
+		a, err := ParseSMILES(pair[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ParseSMILES(pair[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.CanonicalSMILES() == b.CanonicalSMILES() {
+			t.Errorf("Expected different canonical SMILES for %s and %s, but got %s for both", pair[0], pair[1], a.CanonicalSMILES())
+		}
+		for _, atom := range a.Atoms {
+			if atom.Aromatic {
+				t.Errorf("Expected no aromatic atoms in %s", pair[0])
+				break
+			}
+		}
+	}
+}
+
+func TestParseSMILESErrors(t *testing.T) {
+	for _, smiles := range []string{
+		"C1CC",
+		"CC(C",
+		"CC)C",
+		"(C)C",
+		"C[Na",
+		"C%1",
+		"C&C",
+	} {
+		if _, err := ParseSMILES(smiles); err == nil {
+			t.Errorf("Expected an error when parsing %s", smiles)
+		}
+	}
+}
+
+func TestParseBracketAtom(t *testing.T) {
+	for _, tc := range []struct {
+		contents string
+		atom     Atom
+	}{
+		{"13CH4", Atom{Element: "C"}},
+		{"nH", Atom{Element: "N", Aromatic: true}},
+		{"se", Atom{Element: "Se", Aromatic: true}},
+		{"Na+", Atom{Element: "Na"}},
+		{"2H", Atom{Element: "H"}},
+		{"*", Atom{Element: "*"}},
+	} {
+		atom, err := parseBracketAtom(tc.contents)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if atom != tc.atom {
+			t.Errorf("Expected %v for [%s], but got %v", tc.atom, tc.contents, atom)
+		}
+	}
+}